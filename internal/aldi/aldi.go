@@ -0,0 +1,119 @@
+package aldi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+const DEFAULT_LISTING_PAGE_CHECK_INTERVAL = 1 * time.Minute
+
+// DEFAULT_REQUEST_INTERVAL is the time between requests to Aldi while it isn't struggling.
+const DEFAULT_REQUEST_INTERVAL = 1 * time.Second
+
+// Aldi satisfies the ProductInfoGetter interface to provide a stream of product information from Aldi.
+type Aldi struct {
+	baseURL                   string
+	client                    *shared.RLHTTPClient
+	db                        *store.DB
+	productMaxAge             time.Duration
+	listingPageUpdateInterval time.Duration
+	locations                 []string // Service points to read prices from. "" is DEFAULT_SERVICE_POINT.
+}
+
+// SetLocations sets the service points, Aldi's store IDs, to read prices from as well as
+// DEFAULT_SERVICE_POINT. Every department is scraped once per location.
+func (a *Aldi) SetLocations(locations []string) {
+	a.locations = shared.WithDefaultLocation(locations)
+}
+
+// SetRateLimit sets how fast Aldi is scraped, and how the scraper backs off when Aldi
+// struggles.
+func (a *Aldi) SetRateLimit(limit shared.RateLimit) {
+	a.client.SetRateLimit(limit)
+}
+
+// Init sets up the Aldi struct with the given parameters. The baseURL is that of Aldi's API,
+// not the website.
+func (a *Aldi) Init(baseURL string, dbPath string, productMaxAge time.Duration) error {
+	a.baseURL = baseURL
+	a.client = shared.NewRLHTTPClient(&http.Client{
+		Timeout: 30 * time.Second,
+	}, retailer.Name, shared.DefaultRateLimit(DEFAULT_REQUEST_INTERVAL))
+	a.productMaxAge = productMaxAge
+	a.SetLocations(nil)
+	if err := a.initDB(dbPath); err != nil {
+		return fmt.Errorf("failed to initialise Aldi DB: %w", err)
+	}
+	a.listingPageUpdateInterval = DEFAULT_LISTING_PAGE_CHECK_INTERVAL
+	return nil
+}
+
+// Runs up all the workers and mediates data flowing between them. It returns once
+// the context is done and every worker has finished what it was doing.
+func (a *Aldi) Run(ctx context.Context) {
+	departmentPageChannel := make(chan departmentPage)
+
+	var wg sync.WaitGroup
+	defer a.client.Client.CloseIdleConnections()
+	defer wg.Wait()
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		a.productListPageWorker(ctx, departmentPageChannel)
+	}()
+	go func() {
+		defer wg.Done()
+		a.newDepartmentInfoWorker(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		a.departmentPageUpdateQueueWorker(ctx, departmentPageChannel, a.productMaxAge)
+	}()
+
+	<-ctx.Done()
+	slog.Info("Exiting scheduler", "store", "Aldi")
+}
+
+// GetSharedProductsUpdatedAfter provides a list of product IDs that have been updated since the given time
+func (a *Aldi) GetSharedProductsUpdatedAfter(t time.Time, count int) ([]shared.ProductInfo, error) {
+	return a.db.GetSharedProductsUpdatedAfter(t, count)
+}
+
+// GetSharedProductsAfterCursor provides up to count products that sort after the given cursor.
+func (a *Aldi) GetSharedProductsAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ProductInfo, shared.ExportCursor, error) {
+	return a.db.GetSharedProductsAfterCursor(cursor, count)
+}
+
+// GetShrinkflationAfterCursor provides up to count shrinkflation events that sort after the
+// given cursor.
+func (a *Aldi) GetShrinkflationAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ShrinkflationEvent, shared.ExportCursor, error) {
+	return a.db.GetShrinkflationAfterCursor(cursor, count)
+}
+
+// GetTotalProductCount returns the total number of products in the database.
+func (a *Aldi) GetTotalProductCount() (int, error) {
+	return a.db.GetTotalProductCount()
+}
+
+// LoadExportCursor loads the named export cursor from the database.
+func (a *Aldi) LoadExportCursor(name string) (shared.ExportCursor, error) {
+	return a.db.LoadExportCursor(name)
+}
+
+// SaveExportCursor saves the named export cursor to the database.
+func (a *Aldi) SaveExportCursor(name string, cursor shared.ExportCursor) error {
+	return a.db.SaveExportCursor(name, cursor)
+}
+
+// GetPriceHistory returns every recorded price change for the product, oldest first. The
+// ID may be given with or without the Aldi prefix.
+func (a *Aldi) GetPriceHistory(id string) ([]shared.PriceHistoryEntry, error) {
+	return a.db.GetPriceHistory(id)
+}
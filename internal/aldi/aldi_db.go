@@ -0,0 +1,200 @@
+package aldi
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/migrate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+	"github.com/tjhowse/aus_grocery_price_database/internal/unitprice"
+)
+
+// retailer plugs Aldi into the shared store.
+var retailer = store.Retailer{Name: "Aldi", IDPrefix: ALDI_ID_PREFIX, SchemaBaseline: 1}
+
+var DB_SCHEMA_VERSION = retailer.SchemaVersion()
+
+// initDB opens the DB and migrates it to the current schema.
+func (a *Aldi) initDB(dbPath string) error {
+	var err error
+	a.db, err = store.Open(dbPath, retailer)
+	return err
+}
+
+// DryRunMigrations reports the migrations the DB at dbPath needs without applying them.
+func DryRunMigrations(dbPath string) ([]migrate.Migration, error) {
+	return store.DryRunMigrations(dbPath, retailer)
+}
+
+// DB returns the local product DB, for read-only queries.
+func (a *Aldi) DB() *store.DB {
+	return a.db
+}
+
+// This matches selling sizes like "1kg", "500 g", "1.25L" and "6 x 375ml".
+var sellingSizeRegex = regexp.MustCompile(`(?i)^(?:(\d+)\s*x\s*)?(\d+(?:\.\d+)?)\s*(g|kg|ml|l)$`)
+
+// This matches selling sizes for products priced by weight, like "per kg".
+var perUnitSellingSizeRegex = regexp.MustCompile(`(?i)^per\s*(?:1\s*)?(g|kg|ml|l)$`)
+
+// unitGrams is the number of grams, or millilitres, in a unit.
+var unitGrams = map[string]float64{"g": 1, "kg": 1000, "ml": 1, "l": 1000}
+
+// calcWeightInGrams works out the weight of the product from its selling size. Products sold by
+// weight are priced per unit of weight, so they weigh one unit. Millilitres are counted as grams.
+func calcWeightInGrams(productInfo aldiProductInfo) (int, error) {
+	sellingSize := strings.TrimSpace(productInfo.Info.SellingSize)
+	if matches := perUnitSellingSizeRegex.FindStringSubmatch(sellingSize); matches != nil {
+		return int(unitGrams[strings.ToLower(matches[1])]), nil
+	}
+	matches := sellingSizeRegex.FindStringSubmatch(sellingSize)
+	if matches == nil {
+		return 0, fmt.Errorf("cannot convert selling size `%s` to grams", productInfo.Info.SellingSize)
+	}
+	count := 1
+	if matches[1] != "" {
+		count, _ = strconv.Atoi(matches[1])
+	}
+	quantity, err := strconv.ParseFloat(matches[2], 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse quantity in selling size `%s`: %w", productInfo.Info.SellingSize, err)
+	}
+	return int(float64(count) * quantity * unitGrams[strings.ToLower(matches[3])]), nil
+}
+
+// parseDisplayPriceCents converts a displayed price like "$4.49" to cents.
+func parseDisplayPriceCents(display string) (int, error) {
+	price, err := decimal.NewFromString(strings.TrimPrefix(strings.TrimSpace(display), "$"))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse price `%s`: %w", display, err)
+	}
+	return int(price.Mul(decimal.NewFromInt(100)).IntPart()), nil
+}
+
+// unitPrice normalises the product's price by its selling size. Products sold by weight
+// are priced per unit of weight, so "per kg" is a kilogram.
+func (p aldiProductInfo) unitPrice() shared.UnitPrice {
+	quantity, err := unitprice.Parse(p.Info.SellingSize)
+	if err != nil {
+		slog.Debug("Couldn't work out unit price", "productID", p.ID, "error", err)
+		return shared.UnitPrice{}
+	}
+	unitPrice, err := unitprice.Of(float64(p.Info.Price.AmountRelevant), quantity)
+	if err != nil {
+		slog.Debug("Couldn't work out unit price", "productID", p.ID, "error", err)
+		return shared.UnitPrice{}
+	}
+	return unitPrice
+}
+
+// toStoreProduct converts a product to the shared store's representation.
+func (p aldiProductInfo) toStoreProduct() store.Product {
+	product := store.Product{
+		ID:           string(p.ID),
+		Location:     p.location,
+		Name:         p.Info.Name,
+		Description:  p.Info.SellingSize,
+		PriceCents:   p.Info.Price.AmountRelevant,
+		WeightGrams:  p.WeightGrams,
+		UnitPrice:    p.unitPrice(),
+		RawJSON:      p.RawJSON,
+		DepartmentID: p.departmentID,
+		Updated:      p.Updated,
+	}
+	if p.Info.BrandName != nil && *p.Info.BrandName != "" {
+		product.Description = strings.TrimSpace(*p.Info.BrandName + " " + p.Info.SellingSize)
+		product.Brand = *p.Info.BrandName
+	}
+	if p.Info.Price.WasPriceDisplay != nil {
+		wasPriceCents, err := parseDisplayPriceCents(*p.Info.Price.WasPriceDisplay)
+		if err != nil {
+			slog.Debug("Couldn't parse was price", "productID", p.ID, "error", err)
+		} else {
+			if wasPriceCents > product.PriceCents {
+				product.Promotion = shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: wasPriceCents}
+			}
+		}
+	}
+	return product
+}
+
+// saveProductInfo saves a single product to the database transactionfully.
+func (a *Aldi) saveProductInfo(tx *sql.Tx, productInfo aldiProductInfo) error {
+	var err error
+	productInfo.WeightGrams, err = calcWeightInGrams(productInfo)
+	if err != nil {
+		slog.Debug("Couldn't calculate weight in grams", "productID", productInfo.ID, "error", err)
+		productInfo.WeightGrams = 0
+	}
+	return a.db.SaveProduct(tx, productInfo.toStoreProduct())
+}
+
+// saveProductInfoes saves the product info to the database transactionfully.
+func (a *Aldi) saveProductInfoes(products []aldiProductInfo) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, product := range products {
+		if err := a.saveProductInfo(tx, product); err != nil {
+			return fmt.Errorf("failed to save product info: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// loadProductInfo loads cached product info at the default location from the database.
+func (a *Aldi) loadProductInfo(productID productID) (aldiProductInfo, error) {
+	var aProdInfo aldiProductInfo
+	product, err := a.db.LoadProduct(string(productID), "")
+	if err != nil {
+		return aProdInfo, err
+	}
+	aProdInfo.ID = productID
+	aProdInfo.Info.Name = product.Name
+	aProdInfo.Info.Price.AmountRelevant = product.PriceCents
+	aProdInfo.PreviousPriceCents = product.PreviousPriceCents
+	aProdInfo.WeightGrams = product.WeightGrams
+	aProdInfo.RawJSON = product.RawJSON
+	aProdInfo.departmentID = product.DepartmentID
+	aProdInfo.departmentDescription = product.DepartmentName
+	aProdInfo.Updated = product.Updated
+	return aProdInfo, nil
+}
+
+// saveDepartment saves the department to the database.
+func (a *Aldi) saveDepartment(departmentInfo departmentInfo) error {
+	return a.db.SaveDepartment(store.Department{
+		ID:           departmentInfo.ID,
+		Description:  departmentInfo.Name,
+		ProductCount: departmentInfo.ProductCount,
+		Updated:      departmentInfo.Updated,
+	})
+}
+
+func (a *Aldi) loadDepartmentInfoList() ([]departmentInfo, error) {
+	var departmentInfos []departmentInfo
+	departments, err := a.db.LoadDepartments()
+	if err != nil {
+		return departmentInfos, err
+	}
+	for _, department := range departments {
+		departmentInfos = append(departmentInfos, departmentInfo{
+			ID:           department.ID,
+			Name:         department.Description,
+			ProductCount: department.ProductCount,
+			Updated:      department.Updated,
+		})
+	}
+	return departmentInfos, nil
+}
@@ -0,0 +1,124 @@
+package aldi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestCalcWeightInGrams(t *testing.T) {
+	for _, tc := range []struct {
+		sellingSize string
+		want        int
+		err         bool
+	}{
+		{"1kg", 1000, false},
+		{"500 g", 500, false},
+		{"1.25L", 1250, false},
+		{"2L", 2000, false},
+		{"6 x 100g", 600, false},
+		{"per kg", 1000, false},
+		{"Per KG", 1000, false},
+		{"each", 0, true},
+		{"12 pack", 0, true},
+	} {
+		got, err := calcWeightInGrams(aldiProductInfo{Info: productSearchProduct{SellingSize: tc.sellingSize}})
+		if want, got := tc.err, err != nil; want != got {
+			t.Errorf("%s: expected error %v, got %v", tc.sellingSize, want, err)
+		}
+		if want := tc.want; want != got {
+			t.Errorf("%s: expected %d, got %d", tc.sellingSize, want, got)
+		}
+	}
+}
+
+func TestSaveProductInfo(t *testing.T) {
+	a := getInitialisedAldi()
+	products, _, err := a.getProductsAndTotalCountForCategoryPage(t.Context(), departmentPage{ID: "970000000", offset: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.saveProductInfoes(products); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tasty Cheese Block, 6 x 100g for $8.99, was $9.99.
+	cheese, err := a.loadProductInfo("500103")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 899, cheese.Info.Price.AmountRelevant; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 600, cheese.WeightGrams; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	history, err := a.GetPriceHistory(ALDI_ID_PREFIX + "500103")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(history); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 999, history[0].WasPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := true, history[0].OnSpecial; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if _, err := a.loadProductInfo("123"); err != shared.ErrProductMissing {
+		t.Errorf("Expected %v, got %v", shared.ErrProductMissing, err)
+	}
+
+	exported, err := a.GetSharedProductsUpdatedAfter(time.Now().Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, len(exported); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	for _, product := range exported {
+		if want, got := "Aldi", product.Store; want != got {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+	if want, got := ALDI_ID_PREFIX+"500100", exported[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestDepartmentInfo(t *testing.T) {
+	a := getInitialisedAldi()
+	a.saveDepartment(departmentInfo{ID: "950000000", Name: "Fruits & Vegetables", ProductCount: 32, Updated: time.Now()})
+	departments, err := a.loadDepartmentInfoList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(departments); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 32, departments[0].ProductCount; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestUnitPrice(t *testing.T) {
+	for _, tc := range []struct {
+		sellingSize string
+		cents       int
+		want        shared.UnitPrice
+	}{
+		{"2L", 325, shared.UnitPrice{Cents: 16.25, Unit: shared.UNIT_PER_100ML}},
+		{"12 pack", 599, shared.UnitPrice{Cents: 49.92, Unit: shared.UNIT_EACH}},
+		{"per kg", 399, shared.UnitPrice{Cents: 39.9, Unit: shared.UNIT_PER_100G}},
+		{"6 x 100g", 899, shared.UnitPrice{Cents: 149.83, Unit: shared.UNIT_PER_100G}},
+		{"", 100, shared.UnitPrice{}},
+	} {
+		product := aldiProductInfo{Info: productSearchProduct{SellingSize: tc.sellingSize, Price: productSearchPrice{AmountRelevant: tc.cents}}}
+		if want, got := tc.want, product.unitPrice(); want != got {
+			t.Errorf("%s: expected %v, got %v", tc.sellingSize, want, got)
+		}
+	}
+}
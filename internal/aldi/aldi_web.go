@@ -0,0 +1,139 @@
+package aldi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+)
+
+const CATEGORY_TREE_URL_FORMAT = "%s/v2/product-category-tree"
+const PRODUCT_SEARCH_URL_FORMAT = "%s/v3/product-search"
+
+// Aldi prices differ a little between stores. This is the service point the website
+// falls back to when no store has been chosen.
+const DEFAULT_SERVICE_POINT = "G452"
+
+// getJSON fetches the URL with the given query parameters and returns the body.
+func (a *Aldi) getJSON(ctx context.Context, url string, query map[string]string) ([]byte, error) {
+	var req *http.Request
+	var resp *http.Response
+	var err error
+	var body []byte
+
+	if req, err = http.NewRequestWithContext(ctx, "GET", url, nil); err != nil {
+		return body, err
+	}
+	q := req.URL.Query()
+	for key, value := range query {
+		q.Add(key, value)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:129.0) Gecko/20100101 Firefox/129.0")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err = a.client.Do(req)
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return body, fmt.Errorf("failed to get %s: %s", url, resp.Status)
+	}
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return body, err
+	}
+	return body, nil
+}
+
+// getDepartmentInfos returns the top-level categories from the category tree.
+func (a *Aldi) getDepartmentInfos(ctx context.Context) ([]departmentInfo, error) {
+	body, err := a.getJSON(ctx, fmt.Sprintf(CATEGORY_TREE_URL_FORMAT, a.baseURL), map[string]string{
+		"serviceType": "walk-in",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tree categoryTree
+	err = json.Unmarshal(body, &tree)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(retailer.Name).Inc()
+		return nil, fmt.Errorf("failed to unmarshal category tree: %w", err)
+	}
+	return tree.Data, nil
+}
+
+// getProductSearchPage fetches PRODUCTS_PER_PAGE products from the category, starting at offset,
+// priced at the given service point. A blank location uses DEFAULT_SERVICE_POINT.
+func (a *Aldi) getProductSearchPage(ctx context.Context, category string, offset int, location string) (productSearchPage, error) {
+	servicePoint := location
+	if servicePoint == "" {
+		servicePoint = DEFAULT_SERVICE_POINT
+	}
+	body, err := a.getJSON(ctx, fmt.Sprintf(PRODUCT_SEARCH_URL_FORMAT, a.baseURL), map[string]string{
+		"currency":     "AUD",
+		"serviceType":  "walk-in",
+		"categoryKey":  category,
+		"limit":        strconv.Itoa(PRODUCTS_PER_PAGE),
+		"offset":       strconv.Itoa(offset),
+		"sort":         "relevance",
+		"servicePoint": servicePoint,
+	})
+	if err != nil {
+		return productSearchPage{}, err
+	}
+	metrics.PagesFetched.WithLabelValues(retailer.Name).Inc()
+	var page productSearchPage
+	err = json.Unmarshal(body, &page)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(retailer.Name).Inc()
+		return productSearchPage{}, fmt.Errorf("failed to unmarshal product search page: %w", err)
+	}
+	return page, nil
+}
+
+// getCategoryProductCount returns the number of products in the category.
+func (a *Aldi) getCategoryProductCount(ctx context.Context, category string) (int, error) {
+	page, err := a.getProductSearchPage(ctx, category, 0, "")
+	if err != nil {
+		return 0, err
+	}
+	return page.Meta.Pagination.TotalCount, nil
+}
+
+// getProductsAndTotalCountForCategoryPage fetches the specified page of the specified category
+// and returns the products and the total count of products in the category.
+func (a *Aldi) getProductsAndTotalCountForCategoryPage(ctx context.Context, dp departmentPage) ([]aldiProductInfo, int, error) {
+	page, err := a.getProductSearchPage(ctx, dp.ID, dp.offset, dp.location)
+	if err != nil {
+		return nil, 0, err
+	}
+	var products []aldiProductInfo
+	for _, result := range page.Data {
+		if result.NotForSale {
+			continue
+		}
+		var product aldiProductInfo
+		product.Info = result
+		product.RawJSON, err = json.Marshal(result)
+		if err != nil {
+			slog.Warn("Failed to marshal product info for storage", "error", err)
+		}
+		product.departmentID = dp.ID
+		product.location = dp.location
+		// SKUs are zero-padded to 18 digits.
+		product.ID = productID(strings.TrimLeft(result.SKU, "0"))
+		product.Updated = time.Now()
+		products = append(products, product)
+	}
+	return products, page.Meta.Pagination.TotalCount, nil
+}
@@ -0,0 +1,116 @@
+package aldi
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/utils"
+)
+
+var aldiServer = AldiHTTPServer()
+
+func getInitialisedAldi() Aldi {
+	a := Aldi{}
+	err := a.Init(aldiServer.URL, ":memory:", 10*time.Minute)
+	if err != nil {
+		slog.Error("Failed to initialise Aldi", "error", err)
+	}
+	return a
+}
+
+// This mocks enough of the Aldi API to test various stuff
+func AldiHTTPServer() *httptest.Server {
+	var err error
+
+	filesToLoad := []string{
+		"data/product-category-tree.json",
+		"data/950000000_0.json",
+		"data/950000000_30.json",
+		"data/970000000_0.json",
+	}
+	fileContents := make(map[string][]byte)
+	for _, filename := range filesToLoad {
+		fileContents[filename], err = utils.ReadEntireFile(filename)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to read file %s: %v\n", filename, err))
+		}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var responseFilename string
+
+		switch r.URL.Path {
+		case "/v2/product-category-tree":
+			responseFilename = "data/product-category-tree.json"
+		case "/v3/product-search":
+			offset := r.URL.Query().Get("offset")
+			if offset == "" {
+				offset = "0"
+			}
+			responseFilename = fmt.Sprintf("data/%s_%s.json", r.URL.Query().Get("categoryKey"), offset)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			slog.Error("Simulated aldi server can't find requested URL.", "url", r.URL.Path)
+			return
+		}
+
+		if responseData, knownFile := fileContents[responseFilename]; !knownFile {
+			slog.Error("Simulated aldi server can't find requested file.", "filename", responseFilename)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else {
+			w.Write(responseData)
+		}
+	}))
+}
+
+func TestGetDepartmentInfos(t *testing.T) {
+	a := getInitialisedAldi()
+	departments, err := a.getDepartmentInfos(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(departments); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "950000000", departments[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Fruits & Vegetables", departments[0].Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestGetProductsAndTotalCountForCategoryPage(t *testing.T) {
+	a := getInitialisedAldi()
+	products, count, err := a.getProductsAndTotalCountForCategoryPage(t.Context(), departmentPage{ID: "950000000", offset: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 32, count; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := PRODUCTS_PER_PAGE, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := productID("500000"), products[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Australian Bananas", products[0].Info.Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 399, products[0].Info.Price.AmountRelevant; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	products, _, err = a.getProductsAndTotalCountForCategoryPage(t.Context(), departmentPage{ID: "950000000", offset: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(products); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
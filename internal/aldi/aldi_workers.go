@@ -0,0 +1,187 @@
+package aldi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+const PRODUCTS_PER_PAGE = 30
+
+func departmentInSlice(a departmentInfo, list []departmentInfo) *departmentInfo {
+	for _, b := range list {
+		if a.ID == b.ID {
+			return &b
+		}
+	}
+	return nil
+}
+
+// newDepartmentInfoWorker is a worker that monitors for new departments and writes them to the DB.
+// It returns once the context is done.
+func (a *Aldi) newDepartmentInfoWorker(ctx context.Context) {
+	for {
+
+		// Read the department list from the web...
+		departmentsFromWeb, err := a.getDepartmentInfos(ctx)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting department IDs from web: %v", err))
+		}
+
+		// Read the department list from the DB.
+		departmentInfosFromDB, err := a.loadDepartmentInfoList()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error loading department IDs from DB: %v", err))
+		}
+
+		// Compare the two lists and output any new department IDs.
+		for _, webDepartmentInfo := range departmentsFromWeb {
+			// The category tree doesn't include product counts, so ask the search API.
+			webDepartmentInfo.ProductCount, err = a.getCategoryProductCount(ctx, webDepartmentInfo.ID)
+			if err != nil {
+				slog.Error("Error getting department product count", "ID", webDepartmentInfo.ID, "error", err)
+				continue
+			}
+			update := false
+			if dept := departmentInSlice(webDepartmentInfo, departmentInfosFromDB); dept == nil {
+				slog.Info("New department ID", "ID", webDepartmentInfo.ID, "Description", webDepartmentInfo.Name)
+				update = true
+			} else {
+				if dept.ProductCount != webDepartmentInfo.ProductCount {
+					slog.Info("Department flagged for update", "oldProductCount", dept.ProductCount, "newProductCount", webDepartmentInfo.ProductCount)
+					update = true
+				}
+			}
+			if update {
+				// Save the department to the DB.
+				// Set the update time to the past so we force an update on the next poll.
+				webDepartmentInfo.Updated = time.Now().Add(-2 * a.productMaxAge)
+				err := a.saveDepartment(webDepartmentInfo)
+				if err != nil {
+					slog.Error(fmt.Sprintf("Error saving department ID to DB: %v", err))
+				}
+			}
+		}
+
+		// We don't need to check for departments very often.
+		if !shared.Sleep(ctx, 1*time.Hour) {
+			return
+		}
+	}
+}
+
+// departmentPageUpdateQueueWorker generates a stream of departmentPage structs that are due for an update.
+// It returns once the context is done.
+func (a *Aldi) departmentPageUpdateQueueWorker(ctx context.Context, output chan<- departmentPage, maxAge time.Duration) {
+	for {
+		departmentInfos, err := a.loadDepartmentInfoList()
+		if err != nil {
+			slog.Error("error loading department IDs. Trying again soon.", "error", err)
+			if !shared.Sleep(ctx, 1*time.Minute) {
+				return
+			}
+			continue
+		}
+		queueDepth := metrics.QueueDepth.WithLabelValues(retailer.Name)
+		var pages int
+		for _, departmentInfo := range departmentInfos {
+			if time.Since(departmentInfo.Updated) >= maxAge {
+				pages += (departmentInfo.ProductCount + PRODUCTS_PER_PAGE - 1) / PRODUCTS_PER_PAGE * len(a.locations)
+			}
+		}
+		queueDepth.Set(float64(pages))
+		for _, departmentInfo := range departmentInfos {
+			if time.Since(departmentInfo.Updated) < maxAge {
+				slog.Debug("Skipping update of department", "ID", departmentInfo.ID, "UpdatedAgo", time.Since(departmentInfo.Updated))
+				continue
+			}
+			slog.Debug("Checking department", "ID", departmentInfo.ID, "Updated", departmentInfo.Updated)
+
+			for _, location := range a.locations {
+				for offset := 0; offset < departmentInfo.ProductCount; offset += PRODUCTS_PER_PAGE {
+					slog.Debug("Adding department page to queue", "ID", departmentInfo.ID, "offset", offset, "location", location)
+					select {
+					case output <- departmentPage{
+						ID:       departmentInfo.ID,
+						offset:   offset,
+						location: location,
+					}:
+						queueDepth.Dec()
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			// Save this department back to the DB to refresh its updated time.
+			departmentInfo.Updated = time.Now()
+			err := a.saveDepartment(departmentInfo)
+			if err != nil {
+				slog.Error("error saving department info", "error", err)
+			}
+			slog.Info("Updated department", "store", "Aldi", "department", departmentInfo.ID)
+		}
+		queueDepth.Set(0)
+		// We've done an update of all departments, so we don't need to check for new departments very often.
+		if !shared.Sleep(ctx, a.listingPageUpdateInterval) {
+			return
+		}
+	}
+}
+
+// productListPageWorker reads departmentPage structs from the input channel, fetches the product list page from the web,
+// and writes the updated product data to the DB, transactionfully. It returns once the context is done or the
+// input is closed.
+func (a *Aldi) productListPageWorker(ctx context.Context, input <-chan departmentPage) {
+	for {
+		var dp departmentPage
+		var ok bool
+		select {
+		case dp, ok = <-input:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		slog.Debug("Getting product list page", "departmentID", dp.ID, "offset", dp.offset)
+		products, _, err := a.getProductsAndTotalCountForCategoryPage(ctx, dp)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting product list page: %v", err))
+			continue
+		}
+		tx, err := a.db.Begin()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error starting transaction: %v", err))
+			continue
+		}
+		var skippedProductCount int
+		for _, product := range products {
+			// Skip products with zero price. Assume something went wrong.
+			if product.Info.Price.AmountRelevant == 0 {
+				skippedProductCount++
+				continue
+			}
+			err := a.saveProductInfo(tx, product)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Error inserting product info: %v", err))
+				continue
+			}
+			metrics.ProductsUpserted.WithLabelValues(retailer.Name).Inc()
+		}
+		metrics.ProductsSkipped.WithLabelValues(retailer.Name, metrics.SKIPPED_ZERO_PRICE).Add(float64(skippedProductCount))
+		err = tx.Commit()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error committing transaction: %v", err))
+		}
+		if skippedProductCount > 0 {
+			slog.Debug("Skipped products with zero price", "skippedProductCount", skippedProductCount)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package aldi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/leaktest"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestNewDepartmentInfoWorker(t *testing.T) {
+	a := getInitialisedAldi()
+	a.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	go a.newDepartmentInfoWorker(t.Context())
+	// Wait for the worker to run
+	time.Sleep(1 * time.Second)
+
+	departments, err := a.loadDepartmentInfoList()
+	if err != nil {
+		t.Fatalf("Failed to load department list: %v", err)
+	}
+	if want, got := 2, len(departments); want != got {
+		t.Fatalf("Expected %d departments, got %d", want, got)
+	}
+	for _, department := range departments {
+		if department.ID == "950000000" {
+			if want, got := 32, department.ProductCount; want != got {
+				t.Errorf("Expected %d, got %d", want, got)
+			}
+		}
+	}
+}
+
+func TestDepartmentPageUpdateQueueWorker(t *testing.T) {
+	departmentPageChannel := make(chan departmentPage)
+	a := getInitialisedAldi()
+	// We want to get pages from this department, updated an hour ago.
+	a.saveDepartment(departmentInfo{ID: "950000000", Name: "Fruits & Vegetables", ProductCount: 32, Updated: time.Now().Add(-1 * time.Hour)})
+	// We don't want to get pages from this department, updated an hour in the future.
+	a.saveDepartment(departmentInfo{ID: "970000000", Name: "Dairy, Eggs & Fridge", ProductCount: 4, Updated: time.Now().Add(1 * time.Hour)})
+	a.listingPageUpdateInterval = 1 * time.Second
+	go a.departmentPageUpdateQueueWorker(t.Context(), departmentPageChannel, 1*time.Second)
+
+	for _, offset := range []int{0, 30} {
+		dp := <-departmentPageChannel
+		if want, got := "950000000", dp.ID; want != got {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+		if want, got := offset, dp.offset; want != got {
+			t.Errorf("Expected %d, got %d", want, got)
+		}
+	}
+	select {
+	case dp := <-departmentPageChannel:
+		t.Fatal("Expected no more pages, got", dp)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestProductListPageWorker(t *testing.T) {
+	a := getInitialisedAldi()
+	a.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	departmentPageChannel := make(chan departmentPage)
+	go a.productListPageWorker(t.Context(), departmentPageChannel)
+	departmentPageChannel <- departmentPage{ID: "950000000", offset: 0}
+	departmentPageChannel <- departmentPage{ID: "950000000", offset: 30}
+	close(departmentPageChannel)
+	time.Sleep(500 * time.Millisecond)
+
+	// The zero-priced watermelon is skipped.
+	count, err := a.GetTotalProductCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 31, count; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	bananas, err := a.loadProductInfo("500000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1000, bananas.WeightGrams; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := "950000000", bananas.departmentID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	a := getInitialisedAldi()
+	a.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	a.listingPageUpdateInterval = 100 * time.Millisecond
+	checkLeaks := leaktest.Check(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		count, err := a.GetTotalProductCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for products")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Run to stop")
+	case <-stopped:
+	}
+	checkLeaks()
+}
@@ -0,0 +1,101 @@
+package aldi
+
+import (
+	"time"
+)
+
+type productID string
+
+// Prefix for product IDs when exported outside of aldi-world
+const ALDI_ID_PREFIX = "aldi_id_"
+
+type aldiProductInfo struct {
+	ID                    productID
+	location              string
+	departmentID          string
+	departmentDescription string
+	Info                  productSearchProduct
+	WeightGrams           int
+	PreviousPriceCents    int
+	RawJSON               []byte
+	Updated               time.Time
+}
+
+type departmentPage struct {
+	ID       string
+	offset   int
+	location string
+}
+
+// departmentInfo is a top-level category from the product category tree. Aldi doesn't report
+// how many products a category holds in the tree, so ProductCount comes from the first page
+// of a product search.
+type departmentInfo struct {
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	URLSlugText  string         `json:"urlSlugText"`
+	ParentID     *string        `json:"parentId"`
+	Children     []categoryNode `json:"children"`
+	ProductCount int            `json:"-"`
+	Updated      time.Time      `json:"-"`
+}
+
+type categoryNode struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	URLSlugText string         `json:"urlSlugText"`
+	ParentID    *string        `json:"parentId"`
+	Children    []categoryNode `json:"children"`
+}
+
+type categoryTree struct {
+	Data []departmentInfo `json:"data"`
+}
+
+// productSearchPrice is in cents.
+type productSearchPrice struct {
+	Amount                int     `json:"amount"`
+	AmountRelevant        int     `json:"amountRelevant"`
+	AmountRelevantDisplay string  `json:"amountRelevantDisplay"`
+	BottleDeposit         int     `json:"bottleDeposit"`
+	Comparison            int     `json:"comparison"`
+	ComparisonDisplay     *string `json:"comparisonDisplay"`
+	CurrencyCode          string  `json:"currencyCode"`
+	PerUnit               *int    `json:"perUnit"`
+	PerUnitDisplay        *string `json:"perUnitDisplay"`
+	WasPriceDisplay       *string `json:"wasPriceDisplay"`
+	AdditionalInfo        *string `json:"additionalInfo"`
+}
+
+type productSearchCategory struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	URLSlugText string  `json:"urlSlugText"`
+	ParentID    *string `json:"parentId"`
+}
+
+type productSearchProduct struct {
+	SKU               string                  `json:"sku"`
+	Name              string                  `json:"name"`
+	BrandName         *string                 `json:"brandName"`
+	URLSlugText       string                  `json:"urlSlugText"`
+	Discontinued      bool                    `json:"discontinued"`
+	NotForSale        bool                    `json:"notForSale"`
+	QuantityUnit      string                  `json:"quantityUnit"`
+	WeightType        string                  `json:"weightType"`
+	SellingSize       string                  `json:"sellingSize"`
+	Price             productSearchPrice      `json:"price"`
+	Categories        []productSearchCategory `json:"categories"`
+	OnSaleDateDisplay *string                 `json:"onSaleDateDisplay"`
+}
+
+type productSearchPage struct {
+	Meta struct {
+		Pagination struct {
+			Offset     int `json:"offset"`
+			Limit      int `json:"limit"`
+			TotalCount int `json:"totalCount"`
+		} `json:"pagination"`
+	} `json:"meta"`
+	Data []productSearchProduct `json:"data"`
+}
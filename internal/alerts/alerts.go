@@ -0,0 +1,297 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+// CURSOR_NAME is the export cursor the watcher keeps its place in each store with.
+const CURSOR_NAME = "alerts"
+
+// BATCH_SIZE is how many updated products are read from a store at a time.
+const BATCH_SIZE = 1000
+
+// Source is a store whose product updates are watched.
+type Source interface {
+	GetSharedProductsAfterCursor(shared.ExportCursor, int) ([]shared.ProductInfo, shared.ExportCursor, error)
+	LoadExportCursor(string) (shared.ExportCursor, error)
+	SaveExportCursor(string, shared.ExportCursor) error
+}
+
+// sent is the last alert a rule raised about a product at a location.
+type sent struct {
+	priceCents int // Zero once the rule stops matching the product.
+	at         time.Time
+}
+
+// sentKey identifies a rule's alerts about a product at a location.
+func sentKey(rule, productID, location string) string {
+	return rule + "\x00" + productID + "\x00" + location
+}
+
+// Watcher checks product updates against the watchlist's rules and sends alerts.
+//
+// It reads the updates through its own cursor in each store, like the sinks do, rather
+// than being called from the scrapers. That keeps slow channels from holding up scraping,
+// and updates saved while alerts were down are still checked once they're back. The
+// last alert each rule sent about each product is kept in the product's store, so the
+// cooldowns survive restarts too.
+type Watcher struct {
+	watchlist Watchlist
+	channels  map[string]Channel
+	stores    []*store.DB
+	matches   *matching.DB
+	cursors   map[Source]*shared.ExportCursor
+	sent      map[string]sent
+	// groups holds the product IDs confirmed to match each cheapest_elsewhere rule's
+	// product, refreshed on each check.
+	groups map[string]map[string]bool
+}
+
+// NewWatcher sets up the watchlist's channels, and loads the alerts already sent from the
+// stores. Without the stores alerts are only remembered until the watcher is discarded,
+// and cheapest_elsewhere rules need both the stores and the matches.
+func NewWatcher(watchlist Watchlist, stores []*store.DB, matches *matching.DB) (*Watcher, error) {
+	w := &Watcher{
+		watchlist: watchlist,
+		channels:  map[string]Channel{},
+		stores:    stores,
+		matches:   matches,
+		cursors:   map[Source]*shared.ExportCursor{},
+		sent:      map[string]sent{},
+	}
+	for name, config := range watchlist.Channels {
+		channel, err := newChannel(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up channel %q: %w", name, err)
+		}
+		w.channels[name] = channel
+	}
+	for _, db := range stores {
+		alerts, err := db.GetSentAlerts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sent alerts: %w", err)
+		}
+		for _, alert := range alerts {
+			w.sent[sentKey(alert.Rule, alert.ProductID, alert.Location)] = sent{priceCents: alert.PriceCents, at: alert.Sent}
+		}
+	}
+	return w, nil
+}
+
+// remember records the last alert the rule sent about the product, saving it to the
+// product's store if the watcher has it.
+func (w *Watcher) remember(rule Rule, productID, location string, last sent) error {
+	w.sent[sentKey(rule.Name, productID, location)] = last
+	db := w.findStore(productID)
+	if db == nil {
+		return nil
+	}
+	return db.SaveSentAlert(store.SentAlert{Rule: rule.Name, ProductID: productID, Location: location, PriceCents: last.priceCents, Sent: last.at})
+}
+
+// SetChannel replaces a named channel, e.g. with a stand-in.
+func (w *Watcher) SetChannel(name string, channel Channel) {
+	w.channels[name] = channel
+}
+
+// cents formats a price in dollars.
+func cents(c int) string {
+	return fmt.Sprintf("$%d.%02d", c/100, c%100)
+}
+
+// findStore returns the store the prefixed product ID belongs to, or nil.
+func (w *Watcher) findStore(id string) *store.DB {
+	for _, db := range w.stores {
+		if strings.HasPrefix(id, db.Retailer().IDPrefix) {
+			return db
+		}
+	}
+	return nil
+}
+
+// loadProduct returns the product at the location.
+func (w *Watcher) loadProduct(id, location string) (shared.ProductInfo, error) {
+	db := w.findStore(id)
+	if db == nil {
+		return shared.ProductInfo{}, shared.ErrProductMissing
+	}
+	products, err := db.GetProduct(id)
+	if err != nil {
+		return shared.ProductInfo{}, err
+	}
+	for _, product := range products {
+		if product.Location == location {
+			return product, nil
+		}
+	}
+	return shared.ProductInfo{}, shared.ErrProductMissing
+}
+
+// refreshGroups reloads the products matched with each cheapest_elsewhere rule's product.
+func (w *Watcher) refreshGroups() error {
+	w.groups = map[string]map[string]bool{}
+	for _, rule := range w.watchlist.Rules {
+		if rule.Type != RULE_CHEAPEST_ELSEWHERE || w.matches == nil {
+			continue
+		}
+		ids, _, err := w.matches.Group(rule.Product)
+		if err != nil {
+			return fmt.Errorf("failed to load match group: %w", err)
+		}
+		group := map[string]bool{}
+		for _, id := range ids {
+			group[id] = true
+		}
+		w.groups[rule.Name] = group
+	}
+	return nil
+}
+
+// evaluate returns the notification the rule raises for the updated product, if any.
+func (w *Watcher) evaluate(rule Rule, p shared.ProductInfo, now time.Time) (Notification, bool, error) {
+	if p.Location != rule.Location || p.PriceCents <= 0 {
+		return Notification{}, false, nil
+	}
+	n := Notification{
+		Rule:               rule.Name,
+		ProductID:          p.ID,
+		Store:              p.Store,
+		Name:               p.Name,
+		Location:           p.Location,
+		PriceCents:         p.PriceCents,
+		PreviousPriceCents: p.PreviousPriceCents,
+		Time:               now,
+	}
+	switch rule.Type {
+	case RULE_BELOW:
+		if p.ID != rule.Product || p.PriceCents >= rule.Cents {
+			return n, false, nil
+		}
+		n.Title = fmt.Sprintf("%s is %s at %s", p.Name, cents(p.PriceCents), p.Store)
+		n.Message = fmt.Sprintf("%s is %s at %s, below %s.", p.Name, cents(p.PriceCents), p.Store, cents(rule.Cents))
+	case RULE_DROP:
+		if rule.Store != "" && !strings.EqualFold(rule.Store, p.Store) {
+			return n, false, nil
+		}
+		if rule.Department != "" && !strings.EqualFold(rule.Department, p.Department) {
+			return n, false, nil
+		}
+		if p.PreviousPriceCents <= 0 || float64(p.PreviousPriceCents-p.PriceCents) < rule.Percent/100*float64(p.PreviousPriceCents) {
+			return n, false, nil
+		}
+		drop := 100 * float64(p.PreviousPriceCents-p.PriceCents) / float64(p.PreviousPriceCents)
+		n.Title = fmt.Sprintf("%s is %.0f%% off at %s", p.Name, drop, p.Store)
+		n.Message = fmt.Sprintf("%s dropped %.0f%% from %s to %s at %s.", p.Name, drop, cents(p.PreviousPriceCents), cents(p.PriceCents), p.Store)
+	case RULE_CHEAPEST_ELSEWHERE:
+		if !w.groups[rule.Name][p.ID] || w.findStore(p.ID) == w.findStore(rule.Product) {
+			return n, false, nil
+		}
+		watched, err := w.loadProduct(rule.Product, rule.Location)
+		if errors.Is(err, shared.ErrProductMissing) {
+			return n, false, nil
+		} else if err != nil {
+			return n, false, err
+		}
+		if watched.PriceCents <= 0 || p.PriceCents >= watched.PriceCents {
+			return n, false, nil
+		}
+		n.Title = fmt.Sprintf("%s is cheaper at %s", watched.Name, p.Store)
+		n.Message = fmt.Sprintf("%s is %s at %s, cheaper than %s at %s.", p.Name, cents(p.PriceCents), p.Store, cents(watched.PriceCents), watched.Store)
+	default:
+		return n, false, nil
+	}
+	return n, true, nil
+}
+
+// notify sends the notification through the rule's channels, unless the rule has alerted on
+// the product at the same price since it last stopped matching, or within the cooldown.
+func (w *Watcher) notify(rule Rule, n Notification) {
+	if last, ok := w.sent[sentKey(rule.Name, n.ProductID, n.Location)]; ok && (last.priceCents == n.PriceCents || n.Time.Sub(last.at) < w.watchlist.Cooldown()) {
+		return
+	}
+	delivered := false
+	for _, name := range rule.Channels {
+		if err := w.channels[name].Send(n); err != nil {
+			slog.Error("Failed to send alert", "rule", rule.Name, "channel", name, "error", err)
+			continue
+		}
+		delivered = true
+	}
+	if delivered {
+		slog.Info("Alert sent", "rule", rule.Name, "id", n.ProductID, "cents", n.PriceCents)
+		if err := w.remember(rule, n.ProductID, n.Location, sent{priceCents: n.PriceCents, at: n.Time}); err != nil {
+			slog.Error("Failed to remember alert", "rule", rule.Name, "id", n.ProductID, "error", err)
+		}
+	}
+}
+
+// Check reads each source's product updates since the last check and alerts on any that
+// match a rule. On the first check of a source only updates from then on are watched.
+func (w *Watcher) Check(sources []Source) error {
+	if err := w.refreshGroups(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, source := range sources {
+		if err := w.checkSource(source); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Watcher) checkSource(source Source) error {
+	cursor, ok := w.cursors[source]
+	if !ok {
+		loaded, err := source.LoadExportCursor(CURSOR_NAME)
+		if err != nil {
+			return fmt.Errorf("failed to load alert cursor: %w", err)
+		}
+		if loaded.Updated.IsZero() {
+			loaded.Updated = time.Now()
+		}
+		cursor = &loaded
+		w.cursors[source] = cursor
+	}
+	for {
+		products, next, err := source.GetSharedProductsAfterCursor(*cursor, BATCH_SIZE)
+		if err != nil {
+			return fmt.Errorf("failed to get updated products: %w", err)
+		}
+		now := time.Now()
+		for _, product := range products {
+			for _, rule := range w.watchlist.Rules {
+				n, ok, err := w.evaluate(rule, product, now)
+				if err != nil {
+					return fmt.Errorf("failed to evaluate rule %q: %w", rule.Name, err)
+				}
+				if ok {
+					w.notify(rule, n)
+				} else if last, ok := w.sent[sentKey(rule.Name, product.ID, product.Location)]; ok && last.priceCents != 0 {
+					last.priceCents = 0
+					if err := w.remember(rule, product.ID, product.Location, last); err != nil {
+						return fmt.Errorf("failed to remember rule %q stopped matching: %w", rule.Name, err)
+					}
+				}
+			}
+		}
+		if len(products) == 0 {
+			return nil
+		}
+		*cursor = next
+		if err := source.SaveExportCursor(CURSOR_NAME, next); err != nil {
+			return fmt.Errorf("failed to save alert cursor: %w", err)
+		}
+		if len(products) < BATCH_SIZE {
+			return nil
+		}
+	}
+}
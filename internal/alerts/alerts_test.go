@@ -0,0 +1,199 @@
+package alerts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+// recorder is a channel that keeps what it's sent.
+type recorder struct {
+	sent []Notification
+}
+
+func (r *recorder) Send(n Notification) error {
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func openStore(t *testing.T, retailer store.Retailer) *store.DB {
+	db, err := store.Open(":memory:", retailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestWatcher(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	matches, err := matching.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { matches.Close() })
+	if _, err := matches.Override("coles_id_1", "woolworths_sku_1", matching.STATUS_CONFIRMED); err != nil {
+		t.Fatal(err)
+	}
+	if err := woolworths.SaveDepartment(store.Department{ID: "fruit", Description: "Fruit & Veg", Updated: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	watchlist := Watchlist{
+		Channels: map[string]ChannelConfig{"phone": {Type: CHANNEL_NTFY, URL: "http://localhost/topic"}},
+		Rules: []Rule{
+			{Name: "cheap milk", Type: RULE_BELOW, Product: "coles_id_1", Cents: 300, Channels: []string{"phone"}},
+			{Name: "fruit", Type: RULE_DROP, Store: "woolworths", Department: "fruit & veg", Percent: 20, Channels: []string{"phone"}},
+			{Name: "milk elsewhere", Type: RULE_CHEAPEST_ELSEWHERE, Product: "coles_id_1", Channels: []string{"phone"}},
+		},
+	}
+	watcher, err := NewWatcher(watchlist, []*store.DB{woolworths, coles}, matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := &recorder{}
+	watcher.SetChannel("phone", phone)
+	sources := []Source{woolworths, coles}
+
+	// Updates from before the first check are ignored.
+	updated := time.Now().Add(-time.Hour)
+	if err := coles.SaveProducts([]store.Product{{ID: "1", Name: "Milk", PriceCents: 250, Updated: updated}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Check(sources); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+
+	// update saves the products a second after the last update, and checks them.
+	updated = time.Now()
+	update := func(db *store.DB, products ...store.Product) {
+		t.Helper()
+		updated = updated.Add(time.Second)
+		for i := range products {
+			products[i].Updated = updated
+		}
+		if err := db.SaveProducts(products); err != nil {
+			t.Fatal(err)
+		}
+		if err := watcher.Check(sources); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update(coles, store.Product{ID: "1", Name: "Milk", PriceCents: 280})
+	if want, got := 1, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "cheap milk", phone.sent[0].Rule; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Milk is $2.80 at Coles, below $3.00.", phone.sent[0].Message; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// The same price again isn't repeated, and a new price within the cooldown is held back.
+	update(coles, store.Product{ID: "1", Name: "Milk", PriceCents: 280})
+	update(coles, store.Product{ID: "1", Name: "Milk", PriceCents: 270})
+	if want, got := 1, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	// Once the cooldown has passed it is sent.
+	for key, last := range watcher.sent {
+		last.at = last.at.Add(-2 * DEFAULT_COOLDOWN)
+		watcher.sent[key] = last
+	}
+	update(coles, store.Product{ID: "1", Name: "Milk", PriceCents: 260})
+	if want, got := 2, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+
+	// A big enough drop in the department.
+	update(woolworths,
+		store.Product{ID: "2", Name: "Apples", PriceCents: 500, DepartmentID: "fruit"},
+		store.Product{ID: "3", Name: "Pears", PriceCents: 500, DepartmentID: "fruit"})
+	update(woolworths,
+		store.Product{ID: "2", Name: "Apples", PriceCents: 390, DepartmentID: "fruit"},
+		store.Product{ID: "3", Name: "Pears", PriceCents: 450, DepartmentID: "fruit"})
+	if want, got := 3, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "Apples dropped 22% from $5.00 to $3.90 at Woolworths.", phone.sent[2].Message; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// The matched milk is cheaper at Woolworths.
+	update(woolworths, store.Product{ID: "1", Name: "Woolworths Milk", PriceCents: 240})
+	if want, got := 4, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "Woolworths Milk is $2.40 at Woolworths, cheaper than $2.60 at Coles.", phone.sent[3].Message; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// A new watcher picks up where the last left off.
+	watcher, err = NewWatcher(watchlist, []*store.DB{woolworths, coles}, matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.SetChannel("phone", phone)
+	if err := watcher.Check(sources); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, len(phone.sent); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestWatcherRestart(t *testing.T) {
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	watchlist := Watchlist{
+		Channels: map[string]ChannelConfig{"phone": {Type: CHANNEL_NTFY, URL: "http://localhost/topic"}},
+		Rules:    []Rule{{Name: "cheap milk", Type: RULE_BELOW, Product: "coles_id_1", Cents: 300, Channels: []string{"phone"}}},
+	}
+	phone := &recorder{}
+	sources := []Source{coles}
+	updated := time.Now()
+	// check saves the product a second after the last update, and checks it with a new
+	// watcher, as if the service had restarted.
+	check := func(priceCents int) {
+		t.Helper()
+		watcher, err := NewWatcher(watchlist, []*store.DB{coles}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		watcher.SetChannel("phone", phone)
+		updated = updated.Add(time.Second)
+		if err := coles.SaveProducts([]store.Product{{ID: "1", Name: "Milk", PriceCents: priceCents, Updated: updated}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := watcher.Check(sources); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check(280)
+	if want, got := 1, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	// The cooldown carries over the restart.
+	check(270)
+	if want, got := 1, len(phone.sent); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	// So does the rule no longer matching, which lets the same price alert again once
+	// the cooldown is over.
+	check(350)
+	alerts, err := coles.GetSentAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, alerts[0].PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
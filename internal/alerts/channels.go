@@ -0,0 +1,125 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SEND_TIMEOUT bounds how long an HTTP channel waits for a reply.
+const SEND_TIMEOUT = 10 * time.Second
+
+// Notification is an alert raised by a rule.
+type Notification struct {
+	Rule               string    `json:"rule"`
+	Title              string    `json:"title"`
+	Message            string    `json:"message"`
+	ProductID          string    `json:"product_id"`
+	Store              string    `json:"store"`
+	Name               string    `json:"name"`
+	Location           string    `json:"location"`
+	PriceCents         int       `json:"price_cents"`
+	PreviousPriceCents int       `json:"previous_price_cents"`
+	Time               time.Time `json:"time"`
+}
+
+// Channel delivers notifications.
+type Channel interface {
+	Send(Notification) error
+}
+
+// newChannel builds the channel the config describes.
+func newChannel(config ChannelConfig) (Channel, error) {
+	client := &http.Client{Timeout: SEND_TIMEOUT}
+	switch config.Type {
+	case CHANNEL_WEBHOOK:
+		return &webhookChannel{url: config.URL, client: client}, nil
+	case CHANNEL_NTFY:
+		return &ntfyChannel{url: config.URL, token: config.Token, client: client}, nil
+	case CHANNEL_SMTP:
+		return &smtpChannel{config: config}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %q", config.Type)
+}
+
+// post sends the request, failing on anything but a 2xx reply.
+func post(client *http.Client, request *http.Request) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send alert: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("alert rejected with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// webhookChannel POSTs the notification as JSON.
+type webhookChannel struct {
+	url    string
+	client *http.Client
+}
+
+func (c *webhookChannel) Send(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+	request, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build alert request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return post(c.client, request)
+}
+
+// encodeHeader encodes the text for a header as RFC 2047 describes, so product names that
+// aren't ASCII survive. ASCII text is left as it is.
+func encodeHeader(text string) string {
+	return mime.QEncoding.Encode("utf-8", text)
+}
+
+// ntfyChannel POSTs the message to an ntfy topic, with the title in a header.
+type ntfyChannel struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (c *ntfyChannel) Send(n Notification) error {
+	request, err := http.NewRequest(http.MethodPost, c.url, strings.NewReader(n.Message))
+	if err != nil {
+		return fmt.Errorf("failed to build alert request: %w", err)
+	}
+	request.Header.Set("Title", encodeHeader(n.Title))
+	request.Header.Set("Tags", "shopping_cart")
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return post(c.client, request)
+}
+
+// smtpChannel emails the notification.
+type smtpChannel struct {
+	config ChannelConfig
+}
+
+func (c *smtpChannel) Send(n Notification) error {
+	var auth smtp.Auth
+	if c.config.Username != "" {
+		host, _, _ := strings.Cut(c.config.Address, ":")
+		auth = smtp.PlainAuth("", c.config.Username, c.config.Password, host)
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		c.config.From, strings.Join(c.config.To, ", "), encodeHeader(n.Title), n.Message)
+	if err := smtp.SendMail(c.config.Address, auth, c.config.From, c.config.To, []byte(message)); err != nil {
+		return fmt.Errorf("failed to email alert: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package alerts
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var notification = Notification{Rule: "milk", Title: "Milk is $2.80 at Coles", Message: "Milk is $2.80 at Coles, below $3.00.",
+	ProductID: "coles_id_1", Store: "Coles", Name: "Milk", PriceCents: 280}
+
+func TestWebhookChannel(t *testing.T) {
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	channel, err := newChannel(ChannelConfig{Type: CHANNEL_WEBHOOK, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := notification.ProductID, received.ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 280, received.PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestNtfyChannel(t *testing.T) {
+	var title, auth, body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		title, auth = r.Header.Get("Title"), r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	channel, err := newChannel(ChannelConfig{Type: CHANNEL_NTFY, URL: server.URL, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := notification.Title, title; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Bearer secret", auth; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := notification.Message, body; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	status = http.StatusForbidden
+	if err := channel.Send(notification); err == nil {
+		t.Error("Expected an error for a rejected alert")
+	}
+}
+
+// serveSMTP accepts a single message on the listener, speaking just enough SMTP for
+// net/smtp, and sends its data on the channel.
+func serveSMTP(t *testing.T, listener net.Listener, messages chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost")
+	var data strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case command == "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			messages <- data.String()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPChannel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go serveSMTP(t, listener, messages)
+
+	channel, err := newChannel(ChannelConfig{Type: CHANNEL_SMTP, Address: listener.Addr().String(), From: "agpd@localhost", To: []string{"me@localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	message := <-messages
+	if !strings.Contains(message, "Subject: "+notification.Title) {
+		t.Errorf("Expected the title as the subject, got %q", message)
+	}
+	if !strings.Contains(message, notification.Message) {
+		t.Errorf("Expected the message in the body, got %q", message)
+	}
+}
+
+func TestNonASCIITitle(t *testing.T) {
+	n := notification
+	n.Title = "Café Latte is $3.50"
+	var title string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		title = r.Header.Get("Title")
+	}))
+	defer server.Close()
+	channel, err := newChannel(ChannelConfig{Type: CHANNEL_NTFY, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Send(n); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := n.Title, decoded; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go serveSMTP(t, listener, messages)
+	channel, err = newChannel(ChannelConfig{Type: CHANNEL_SMTP, Address: listener.Addr().String(), From: "agpd@localhost", To: []string{"me@localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Send(n); err != nil {
+		t.Fatal(err)
+	}
+	if want, message := "Subject: =?utf-8?q?Caf=C3=A9_Latte_is_$3.50?=\r\n", <-messages; !strings.Contains(message, want) {
+		t.Errorf("Expected %q in %q", want, message)
+	}
+}
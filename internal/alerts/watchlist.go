@@ -0,0 +1,150 @@
+// Package alerts tells people when products on their watchlist get cheaper.
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Rule types.
+const RULE_BELOW = "below"                           // Product is priced below Cents.
+const RULE_DROP = "drop"                             // Any product's price drops by Percent or more.
+const RULE_CHEAPEST_ELSEWHERE = "cheapest_elsewhere" // A product matched with Product is cheaper at another store.
+
+// Channel types.
+const CHANNEL_WEBHOOK = "webhook" // POSTs the alert as JSON.
+const CHANNEL_NTFY = "ntfy"       // POSTs the alert as text to an ntfy topic URL.
+const CHANNEL_SMTP = "smtp"       // Emails the alert.
+
+// DEFAULT_COOLDOWN is how long a rule stays quiet about a product after alerting on it,
+// unless the watchlist says otherwise.
+const DEFAULT_COOLDOWN = 24 * time.Hour
+
+// Rule is something to be told about.
+type Rule struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // One of the RULE_* constants.
+	// Product is the prefixed product ID a below or cheapest_elsewhere rule watches.
+	Product string `json:"product"`
+	// Store and Department narrow a drop rule. Either can be blank to match any.
+	Store      string `json:"store"`
+	Department string `json:"department"`
+	// Location is the location watched. Blank is the store's default.
+	Location string   `json:"location"`
+	Cents    int      `json:"cents"`
+	Percent  float64  `json:"percent"`
+	Channels []string `json:"channels"` // Names of the watchlist's channels to alert through.
+}
+
+// ChannelConfig is somewhere to send alerts.
+type ChannelConfig struct {
+	Type string `json:"type"` // One of the CHANNEL_* constants.
+	// URL is where webhook and ntfy alerts are POSTed.
+	URL string `json:"url"`
+	// Token, if set, is sent to ntfy as a bearer token.
+	Token string `json:"token"`
+	// Address is the SMTP server's host:port.
+	Address  string   `json:"address"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Watchlist is the rules to check and the channels to alert through, e.g.
+//
+//	{
+//		"cooldown_minutes": 1440,
+//		"channels": {
+//			"phone": {"type": "ntfy", "url": "https://ntfy.sh/my-groceries"}
+//		},
+//		"rules": [
+//			{"name": "cheap milk", "type": "below", "product": "coles_id_8150288", "cents": 300, "channels": ["phone"]},
+//			{"name": "fruit", "type": "drop", "store": "woolworths", "department": "Fruit & Veg", "percent": 20, "channels": ["phone"]},
+//			{"name": "milk elsewhere", "type": "cheapest_elsewhere", "product": "coles_id_8150288", "channels": ["phone"]}
+//		]
+//	}
+type Watchlist struct {
+	// CooldownMinutes is how long a rule stays quiet about a product after alerting on it.
+	// Zero means DEFAULT_COOLDOWN.
+	CooldownMinutes int                      `json:"cooldown_minutes"`
+	Channels        map[string]ChannelConfig `json:"channels"`
+	Rules           []Rule                   `json:"rules"`
+}
+
+// Cooldown returns how long a rule stays quiet about a product after alerting on it.
+func (w Watchlist) Cooldown() time.Duration {
+	if w.CooldownMinutes <= 0 {
+		return DEFAULT_COOLDOWN
+	}
+	return time.Duration(w.CooldownMinutes) * time.Minute
+}
+
+// validate checks the rules are complete and only use channels that are defined.
+func (w Watchlist) validate() error {
+	for name, channel := range w.Channels {
+		switch channel.Type {
+		case CHANNEL_WEBHOOK, CHANNEL_NTFY:
+			if channel.URL == "" {
+				return fmt.Errorf("channel %q has no url", name)
+			}
+		case CHANNEL_SMTP:
+			if channel.Address == "" || channel.From == "" || len(channel.To) == 0 {
+				return fmt.Errorf("channel %q needs an address, from and to", name)
+			}
+		default:
+			return fmt.Errorf("channel %q has unknown type %q", name, channel.Type)
+		}
+	}
+	names := map[string]bool{}
+	for i, rule := range w.Rules {
+		if rule.Name == "" || names[rule.Name] {
+			return fmt.Errorf("rule %d needs a unique name", i)
+		}
+		names[rule.Name] = true
+		switch rule.Type {
+		case RULE_BELOW:
+			if rule.Product == "" || rule.Cents <= 0 {
+				return fmt.Errorf("rule %q needs a product and cents", rule.Name)
+			}
+		case RULE_DROP:
+			if rule.Percent <= 0 || rule.Percent >= 100 {
+				return fmt.Errorf("rule %q needs a percent between 0 and 100", rule.Name)
+			}
+		case RULE_CHEAPEST_ELSEWHERE:
+			if rule.Product == "" {
+				return fmt.Errorf("rule %q needs a product", rule.Name)
+			}
+		default:
+			return fmt.Errorf("rule %q has unknown type %q", rule.Name, rule.Type)
+		}
+		if len(rule.Channels) == 0 {
+			return fmt.Errorf("rule %q has no channels", rule.Name)
+		}
+		for _, channel := range rule.Channels {
+			if _, ok := w.Channels[channel]; !ok {
+				return fmt.Errorf("rule %q uses unknown channel %q", rule.Name, channel)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadWatchlist reads a watchlist from a JSON file.
+func LoadWatchlist(path string) (Watchlist, error) {
+	var watchlist Watchlist
+	f, err := os.Open(path)
+	if err != nil {
+		return watchlist, fmt.Errorf("failed to open watchlist: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&watchlist); err != nil {
+		return watchlist, fmt.Errorf("failed to parse watchlist: %w", err)
+	}
+	if err := watchlist.validate(); err != nil {
+		return watchlist, fmt.Errorf("invalid watchlist: %w", err)
+	}
+	return watchlist, nil
+}
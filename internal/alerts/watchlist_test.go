@@ -0,0 +1,54 @@
+package alerts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadWatchlist(t *testing.T) {
+	dir := t.TempDir()
+	channels := `"channels": {"phone": {"type": "ntfy", "url": "http://localhost/topic"}}`
+	for _, test := range []struct {
+		name      string
+		watchlist string
+		wantErr   bool
+	}{
+		{"valid", `{"cooldown_minutes": 60, ` + channels + `, "rules": [
+			{"name": "milk", "type": "below", "product": "coles_id_1", "cents": 300, "channels": ["phone"]},
+			{"name": "fruit", "type": "drop", "department": "Fruit & Veg", "percent": 20, "channels": ["phone"]},
+			{"name": "elsewhere", "type": "cheapest_elsewhere", "product": "coles_id_1", "channels": ["phone"]}]}`, false},
+		{"unknown rule type", `{` + channels + `, "rules": [{"name": "a", "type": "above", "channels": ["phone"]}]}`, true},
+		{"below without cents", `{` + channels + `, "rules": [{"name": "a", "type": "below", "product": "coles_id_1", "channels": ["phone"]}]}`, true},
+		{"drop without percent", `{` + channels + `, "rules": [{"name": "a", "type": "drop", "channels": ["phone"]}]}`, true},
+		{"duplicate names", `{` + channels + `, "rules": [
+			{"name": "a", "type": "drop", "percent": 10, "channels": ["phone"]},
+			{"name": "a", "type": "drop", "percent": 20, "channels": ["phone"]}]}`, true},
+		{"unknown channel", `{` + channels + `, "rules": [{"name": "a", "type": "drop", "percent": 10, "channels": ["pager"]}]}`, true},
+		{"no channels", `{` + channels + `, "rules": [{"name": "a", "type": "drop", "percent": 10}]}`, true},
+		{"incomplete smtp", `{"channels": {"mail": {"type": "smtp", "address": "localhost:25"}}}`, true},
+		{"malformed", `{"rules": `, true},
+	} {
+		path := filepath.Join(dir, test.name+".json")
+		if err := os.WriteFile(path, []byte(test.watchlist), 0644); err != nil {
+			t.Fatal(err)
+		}
+		watchlist, err := LoadWatchlist(path)
+		if test.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if err == nil {
+			if want, got := 3, len(watchlist.Rules); want != got {
+				t.Errorf("Expected %d, got %d", want, got)
+			}
+			if want, got := time.Hour, watchlist.Cooldown(); want != got {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		}
+	}
+	if want, got := DEFAULT_COOLDOWN, (Watchlist{}).Cooldown(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
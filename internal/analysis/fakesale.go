@@ -0,0 +1,179 @@
+// Package analysis draws conclusions from the products' recorded price history.
+package analysis
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// Why a special is flagged as a fake sale.
+const REASON_WAS_PRICE_RARELY_CHARGED = "was_price_rarely_charged"
+const REASON_NOT_BELOW_MEDIAN = "not_below_median"
+
+// FakeSaleOptions tunes what counts as a fake sale.
+type FakeSaleOptions struct {
+	// Lookback is how long before a sale its was price should have been charged.
+	Lookback time.Duration
+	// MinWasPriceShare is the least share of the lookback the was price, or more, should
+	// have been charged for, from 0 to 1.
+	MinWasPriceShare float64
+	// MinHistory is how much history before a sale is needed to judge it.
+	MinHistory time.Duration
+}
+
+// DefaultFakeSaleOptions flags specials whose was price was charged for less than a quarter
+// of the preceding eight weeks, given at least two weeks of history.
+var DefaultFakeSaleOptions = FakeSaleOptions{
+	Lookback:         8 * 7 * 24 * time.Hour,
+	MinWasPriceShare: 0.25,
+	MinHistory:       2 * 7 * 24 * time.Hour,
+}
+
+// FakeSale is a special that isn't the saving it claims to be.
+type FakeSale struct {
+	Location         string
+	SaleStarted      time.Time // When the product went on special.
+	PriceCents       int
+	WasPriceCents    int
+	WasPriceShare    float64 // The share of the lookback the was price, or more, was charged.
+	MedianPriceCents int     // The median price charged before the sale, weighted by time.
+	Reasons          []string
+}
+
+// isSale reports whether the entry is a special that lowers the price anyone pays.
+// Multibuys and member prices don't.
+func isSale(entry shared.PriceHistoryEntry) bool {
+	return entry.PromotionType == shared.PROMOTION_SPECIAL || entry.PromotionType == shared.PROMOTION_HALF_PRICE
+}
+
+// span is a price charged for a duration.
+type span struct {
+	priceCents int
+	duration   time.Duration
+}
+
+// spans returns how long each entry's price was charged between from and to. Each entry
+// holds until the next.
+func spans(history []shared.PriceHistoryEntry, from, to time.Time) []span {
+	var result []span
+	for i, entry := range history {
+		start := entry.Recorded
+		end := to
+		if i+1 < len(history) {
+			end = history[i+1].Recorded
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			result = append(result, span{entry.PriceCents, end.Sub(start)})
+		}
+	}
+	return result
+}
+
+// medianPrice is the price charged for the middle of the spans' total duration.
+func medianPrice(spans []span) int {
+	sorted := append([]span(nil), spans...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].priceCents < sorted[j].priceCents })
+	var total time.Duration
+	for _, s := range sorted {
+		total += s.duration
+	}
+	var elapsed time.Duration
+	for _, s := range sorted {
+		elapsed += s.duration
+		if elapsed*2 >= total {
+			return s.priceCents
+		}
+	}
+	return 0
+}
+
+// CheckSale judges the current special in a product's price history at one location,
+// ordered oldest first. It reports a FakeSale if the product is on special and either its
+// was price was rarely charged during the lookback, or its price isn't below the median
+// price charged before the sale. Returns false if the product isn't on special or there
+// isn't enough history to judge.
+func CheckSale(history []shared.PriceHistoryEntry, options FakeSaleOptions) (FakeSale, bool) {
+	if len(history) == 0 || !isSale(history[len(history)-1]) {
+		return FakeSale{}, false
+	}
+	current := history[len(history)-1]
+	// The sale may have been recorded more than once, e.g. when its price changed.
+	start := len(history) - 1
+	for start > 0 && isSale(history[start-1]) {
+		start--
+	}
+	before := history[:start]
+	saleStarted := history[start].Recorded
+	if len(before) == 0 || saleStarted.Sub(before[0].Recorded) < options.MinHistory {
+		return FakeSale{}, false
+	}
+
+	sale := FakeSale{
+		Location:         current.Location,
+		SaleStarted:      saleStarted,
+		PriceCents:       current.PriceCents,
+		WasPriceCents:    current.WasPriceCents,
+		MedianPriceCents: medianPrice(spans(before, before[0].Recorded, saleStarted)),
+	}
+	if sale.WasPriceCents > 0 {
+		windowStart := saleStarted.Add(-options.Lookback)
+		if windowStart.Before(before[0].Recorded) {
+			windowStart = before[0].Recorded
+		}
+		var charged, total time.Duration
+		for _, s := range spans(before, windowStart, saleStarted) {
+			total += s.duration
+			if s.priceCents >= sale.WasPriceCents {
+				charged += s.duration
+			}
+		}
+		if total > 0 {
+			sale.WasPriceShare = charged.Seconds() / total.Seconds()
+		}
+		if sale.WasPriceShare < options.MinWasPriceShare {
+			sale.Reasons = append(sale.Reasons, REASON_WAS_PRICE_RARELY_CHARGED)
+		}
+	}
+	if sale.PriceCents >= sale.MedianPriceCents {
+		sale.Reasons = append(sale.Reasons, REASON_NOT_BELOW_MEDIAN)
+	}
+	return sale, len(sale.Reasons) > 0
+}
+
+// byLocation splits a product's price history by location, ordered by location.
+func byLocation(history []shared.PriceHistoryEntry) [][]shared.PriceHistoryEntry {
+	entries := map[string][]shared.PriceHistoryEntry{}
+	var locations []string
+	for _, entry := range history {
+		if _, ok := entries[entry.Location]; !ok {
+			locations = append(locations, entry.Location)
+		}
+		entries[entry.Location] = append(entries[entry.Location], entry)
+	}
+	sort.Strings(locations)
+	result := make([][]shared.PriceHistoryEntry, len(locations))
+	for i, location := range locations {
+		result[i] = entries[location]
+	}
+	return result
+}
+
+// CheckSales judges the current special at each location in a product's price history,
+// ordered oldest first, as returned by the store.
+func CheckSales(history []shared.PriceHistoryEntry, options FakeSaleOptions) []FakeSale {
+	var sales []FakeSale
+	for _, location := range byLocation(history) {
+		if sale, ok := CheckSale(location, options); ok {
+			sales = append(sales, sale)
+		}
+	}
+	return sales
+}
@@ -0,0 +1,78 @@
+package analysis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const week = 7 * 24 * time.Hour
+
+// entry is a price recorded the given number of weeks after start.
+func entry(weeks float64, priceCents int, wasPriceCents int) shared.PriceHistoryEntry {
+	e := shared.PriceHistoryEntry{PriceCents: priceCents, Recorded: start.Add(time.Duration(weeks * float64(week)))}
+	if wasPriceCents > 0 {
+		e.WasPriceCents = wasPriceCents
+		e.OnSpecial = true
+		e.PromotionType = shared.PROMOTION_SPECIAL
+	}
+	return e
+}
+
+func TestCheckSale(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		history []shared.PriceHistoryEntry
+		want    string // The reasons, or "ok" if the sale isn't flagged.
+	}{
+		{"genuine", []shared.PriceHistoryEntry{entry(0, 500, 0), entry(8, 400, 500)}, "ok"},
+		{"not on special", []shared.PriceHistoryEntry{entry(0, 500, 0), entry(8, 400, 0)}, "ok"},
+		{"too little history", []shared.PriceHistoryEntry{entry(0, 600, 0), entry(1, 500, 600)}, "ok"},
+		{"was price briefly charged", []shared.PriceHistoryEntry{entry(0, 400, 0), entry(7, 500, 0), entry(7.5, 400, 500)},
+			"[was_price_rarely_charged not_below_median]"},
+		{"was price never charged", []shared.PriceHistoryEntry{entry(0, 400, 0), entry(8, 350, 500)},
+			"[was_price_rarely_charged]"},
+		// Half the last eight weeks at the was price is enough, but the special is the usual price.
+		{"usual price", []shared.PriceHistoryEntry{entry(0, 400, 0), entry(12, 500, 0), entry(16, 400, 500)},
+			"[not_below_median]"},
+		// The price changing during the sale doesn't restart it.
+		{"sale price changed", []shared.PriceHistoryEntry{entry(0, 500, 0), entry(8, 450, 500), entry(9, 400, 500)}, "ok"},
+	} {
+		sale, flagged := CheckSale(test.history, DefaultFakeSaleOptions)
+		got := "ok"
+		if flagged {
+			got = fmt.Sprint(sale.Reasons)
+		}
+		if test.want != got {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, got)
+		}
+	}
+
+	sale, _ := CheckSale([]shared.PriceHistoryEntry{entry(0, 400, 0), entry(7, 500, 0), entry(7.5, 400, 500)}, DefaultFakeSaleOptions)
+	if want, got := 0.5/7.5, sale.WasPriceShare; want-got > 1e-9 || got-want > 1e-9 {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 400, sale.MedianPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := start.Add(7*week+week/2), sale.SaleStarted; !want.Equal(got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestCheckSales(t *testing.T) {
+	history := []shared.PriceHistoryEntry{entry(0, 400, 0), entry(0, 500, 0), entry(8, 350, 500), entry(8, 400, 500)}
+	history[1].Location = "1234"
+	history[3].Location = "1234"
+	sales := CheckSales(history, DefaultFakeSaleOptions)
+	if want, got := 1, len(sales); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "", sales[0].Location; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
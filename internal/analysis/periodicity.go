@@ -0,0 +1,191 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+const day = 24 * time.Hour
+
+// PeriodicityOptions tunes the search for promotion cycles.
+type PeriodicityOptions struct {
+	// History is how far back to look for a cycle.
+	History time.Duration
+	// MinPeriod and MaxPeriod bound the cycle lengths considered.
+	MinPeriod time.Duration
+	MaxPeriod time.Duration
+	// MinCorrelation is the least autocorrelation, from 0 to 1, at the cycle's period for it
+	// to count.
+	MinCorrelation float64
+	// FullConfidenceCycles is how many cycles must be seen to be fully confident of one.
+	FullConfidenceCycles int
+}
+
+// DefaultPeriodicityOptions looks for cycles of one to eight weeks over the last half year.
+var DefaultPeriodicityOptions = PeriodicityOptions{
+	History:              26 * 7 * day,
+	MinPeriod:            7 * day,
+	MaxPeriod:            8 * 7 * day,
+	MinCorrelation:       0.3,
+	FullConfidenceCycles: 4,
+}
+
+// LowPriceForecast predicts when a product that cycles between its regular price and a
+// lower one will next be cheap.
+type LowPriceForecast struct {
+	Location          string
+	Period            time.Duration // The length of the cycle, in whole days.
+	Confidence        float64       // From 0 to 1.
+	RegularPriceCents int           // The median daily price.
+	LowPriceCents     int           // The median price while cheap.
+	NextLowStart      time.Time     // The next low price window. It may have started.
+	NextLowEnd        time.Time
+}
+
+// Wait reports whether it's worth waiting for the next low price window rather than buying
+// at the given price now.
+func (f LowPriceForecast) Wait(priceCents int, now time.Time) bool {
+	return priceCents > f.LowPriceCents && f.NextLowStart.After(now)
+}
+
+// dailyPrices samples the price in effect at the end of each day from the history, oldest
+// first, for the days between from and now.
+func dailyPrices(history []shared.PriceHistoryEntry, from, now time.Time) []int {
+	if len(history) == 0 {
+		return nil
+	}
+	if from.Before(history[0].Recorded) {
+		from = history[0].Recorded
+	}
+	var prices []int
+	i := 0
+	for t := from.Truncate(day).Add(day - time.Nanosecond); !t.After(now.Truncate(day).Add(day - time.Nanosecond)); t = t.Add(day) {
+		for i+1 < len(history) && !history[i+1].Recorded.After(t) {
+			i++
+		}
+		prices = append(prices, history[i].PriceCents)
+	}
+	return prices
+}
+
+// autocorrelation is the correlation of the series with itself shifted by lag.
+func autocorrelation(series []float64, lag int) float64 {
+	var numerator, denominator float64
+	for i, x := range series {
+		denominator += x * x
+		if i+lag < len(series) {
+			numerator += x * series[i+lag]
+		}
+	}
+	if denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
+
+// medianOf returns the median of the values.
+func medianOf(values []int) int {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// PredictLowPrice looks for a regular promotion cycle in a product's price history at one
+// location, ordered oldest first, and predicts the next low price window. The cycle's period
+// is the first peak in the autocorrelation of the daily price. Returns false if no cycle is
+// found.
+func PredictLowPrice(history []shared.PriceHistoryEntry, now time.Time, options PeriodicityOptions) (LowPriceForecast, bool) {
+	from := now.Add(-options.History)
+	prices := dailyPrices(history, from, now)
+	minLag := int(options.MinPeriod / day)
+	maxLag := min(int(options.MaxPeriod/day), len(prices)/2)
+	if minLag < 1 || maxLag < minLag {
+		return LowPriceForecast{}, false
+	}
+
+	regular := medianOf(prices)
+	var mean float64
+	for _, price := range prices {
+		mean += float64(price)
+	}
+	mean /= float64(len(prices))
+	series := make([]float64, len(prices))
+	for i, price := range prices {
+		series[i] = float64(price) - mean
+	}
+
+	// Multiples of the period correlate nearly as well, so take the first lag that's close
+	// to the best.
+	correlations := make([]float64, maxLag+1)
+	best := 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		correlations[lag] = autocorrelation(series, lag)
+		best = math.Max(best, correlations[lag])
+	}
+	if best < options.MinCorrelation {
+		return LowPriceForecast{}, false
+	}
+	period := 0
+	for lag := minLag; lag <= maxLag; lag++ {
+		if correlations[lag] >= 0.9*best {
+			period = lag
+			break
+		}
+	}
+
+	// The runs of days below the regular price.
+	type run struct{ start, length int }
+	var runs []run
+	var lows []int
+	for i, price := range prices {
+		if price >= regular {
+			continue
+		}
+		lows = append(lows, price)
+		if n := len(runs); n > 0 && runs[n-1].start+runs[n-1].length == i {
+			runs[n-1].length++
+		} else {
+			runs = append(runs, run{i, 1})
+		}
+	}
+	if len(runs) < 2 {
+		return LowPriceForecast{}, false
+	}
+	length := 0
+	for _, r := range runs {
+		length += r.length
+	}
+	length = int(math.Round(float64(length) / float64(len(runs))))
+
+	cycles := float64(len(prices)) / float64(period)
+	forecast := LowPriceForecast{
+		Location:          history[0].Location,
+		Period:            time.Duration(period) * day,
+		Confidence:        math.Min(1, correlations[period]) * math.Min(1, cycles/float64(options.FullConfidenceCycles)),
+		RegularPriceCents: regular,
+		LowPriceCents:     medianOf(lows),
+	}
+	firstDay := now.Truncate(day).Add(-time.Duration(len(prices)-1) * day)
+	next := firstDay.Add(time.Duration(runs[len(runs)-1].start) * day)
+	for !next.Add(time.Duration(length) * day).After(now) {
+		next = next.Add(forecast.Period)
+	}
+	forecast.NextLowStart = next
+	forecast.NextLowEnd = next.Add(time.Duration(length) * day)
+	return forecast, true
+}
+
+// PredictLowPrices predicts the next low price window at each location in a product's price
+// history, ordered oldest first, as returned by the store.
+func PredictLowPrices(history []shared.PriceHistoryEntry, now time.Time, options PeriodicityOptions) []LowPriceForecast {
+	var forecasts []LowPriceForecast
+	for _, location := range byLocation(history) {
+		if forecast, ok := PredictLowPrice(location, now, options); ok {
+			forecasts = append(forecasts, forecast)
+		}
+	}
+	return forecasts
+}
@@ -0,0 +1,85 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// cycle is a price history that's 500 for ten days then 350 for four, repeated for the
+// given number of fortnights from start.
+func cycle(fortnights int) []shared.PriceHistoryEntry {
+	var history []shared.PriceHistoryEntry
+	for i := 0; i < fortnights; i++ {
+		cycleStart := start.Add(time.Duration(i) * 2 * week)
+		history = append(history,
+			shared.PriceHistoryEntry{PriceCents: 500, Recorded: cycleStart},
+			shared.PriceHistoryEntry{PriceCents: 350, Recorded: cycleStart.Add(10 * day)})
+	}
+	return history
+}
+
+func TestPredictLowPrice(t *testing.T) {
+	now := start.Add(8*2*week + 2*day)
+	forecast, ok := PredictLowPrice(cycle(8), now, DefaultPeriodicityOptions)
+	if !ok {
+		t.Fatal("Expected a forecast")
+	}
+	if want, got := 14*day, forecast.Period; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 500, forecast.RegularPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 350, forecast.LowPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := start.Add(8*2*week+10*day), forecast.NextLowStart; !want.Equal(got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := start.Add(9*2*week), forecast.NextLowEnd; !want.Equal(got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if forecast.Confidence < 0.5 || forecast.Confidence > 1 {
+		t.Errorf("Expected a confidence between 0.5 and 1, got %v", forecast.Confidence)
+	}
+	if !forecast.Wait(500, now) {
+		t.Error("Expected to wait at the regular price")
+	}
+	if forecast.Wait(350, now) {
+		t.Error("Expected not to wait at the low price")
+	}
+
+	// Fewer cycles are less certain.
+	short, ok := PredictLowPrice(cycle(3), start.Add(3*2*week), DefaultPeriodicityOptions)
+	if !ok {
+		t.Fatal("Expected a forecast")
+	}
+	if short.Confidence >= forecast.Confidence {
+		t.Errorf("Expected less confidence than %v, got %v", forecast.Confidence, short.Confidence)
+	}
+
+	// A single price drop isn't a cycle.
+	history := []shared.PriceHistoryEntry{{PriceCents: 500, Recorded: start}, {PriceCents: 350, Recorded: start.Add(8 * week)}}
+	if _, ok := PredictLowPrice(history, start.Add(16*week), DefaultPeriodicityOptions); ok {
+		t.Error("Expected no forecast for a single price drop")
+	}
+	// Nor is a steady price.
+	history = []shared.PriceHistoryEntry{{PriceCents: 500, Recorded: start}}
+	if _, ok := PredictLowPrice(history, start.Add(16*week), DefaultPeriodicityOptions); ok {
+		t.Error("Expected no forecast for a steady price")
+	}
+}
+
+func TestPredictLowPrices(t *testing.T) {
+	history := cycle(8)
+	history = append(history, shared.PriceHistoryEntry{Location: "4000", PriceCents: 500, Recorded: start})
+	forecasts := PredictLowPrices(history, start.Add(16*week), DefaultPeriodicityOptions)
+	if want, got := 1, len(forecasts); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "", forecasts[0].Location; want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,55 @@
+package analysis
+
+import (
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// MIN_SHRINK is the least a pack must shrink by, as a fraction of its size, to count. It
+// keeps sizes worked out from rounded unit prices from raising false alarms.
+const MIN_SHRINK = 0.02
+
+// The units pack sizes are given in.
+const SIZE_UNIT_GRAMS = "g"
+const SIZE_UNIT_MILLILITRES = "ml"
+const SIZE_UNIT_EACH = "each"
+
+// PackSize is how much of a product is sold for its price.
+type PackSize struct {
+	Amount float64
+	Unit   string // One of the SIZE_UNIT_* constants.
+}
+
+// SizeOf returns a product's pack size from its weight if it's known, or otherwise from its
+// price and unit price. Returns false if neither is known.
+func SizeOf(weightGrams, priceCents int, unitPrice shared.UnitPrice) (PackSize, bool) {
+	if weightGrams > 0 {
+		return PackSize{float64(weightGrams), SIZE_UNIT_GRAMS}, true
+	}
+	if priceCents <= 0 || unitPrice.Cents <= 0 {
+		return PackSize{}, false
+	}
+	switch unitPrice.Unit {
+	case shared.UNIT_PER_100G:
+		return PackSize{float64(priceCents) / unitPrice.Cents * 100, SIZE_UNIT_GRAMS}, true
+	case shared.UNIT_PER_100ML:
+		return PackSize{float64(priceCents) / unitPrice.Cents * 100, SIZE_UNIT_MILLILITRES}, true
+	case shared.UNIT_EACH:
+		return PackSize{float64(priceCents) / unitPrice.Cents, SIZE_UNIT_EACH}, true
+	}
+	return PackSize{}, false
+}
+
+// CheckShrinkflation compares a product's pack size and price before and after an update.
+// It reports the rise in price per unit of size if the pack shrank by at least MIN_SHRINK
+// and the price didn't fall enough to make up for it. Returns false otherwise, including
+// when the sizes aren't comparable.
+func CheckShrinkflation(before, after PackSize, beforePriceCents, afterPriceCents int) (float64, bool) {
+	if before.Unit != after.Unit || before.Amount <= 0 || after.Amount <= 0 || beforePriceCents <= 0 || afterPriceCents <= 0 {
+		return 0, false
+	}
+	if after.Amount > before.Amount*(1-MIN_SHRINK) {
+		return 0, false
+	}
+	increase := (float64(afterPriceCents)/after.Amount)/(float64(beforePriceCents)/before.Amount) - 1
+	return increase, increase > 0
+}
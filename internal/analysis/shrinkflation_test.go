@@ -0,0 +1,58 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestSizeOf(t *testing.T) {
+	for _, test := range []struct {
+		weightGrams int
+		priceCents  int
+		unitPrice   shared.UnitPrice
+		want        PackSize
+		wantOK      bool
+	}{
+		{500, 400, shared.UnitPrice{}, PackSize{500, SIZE_UNIT_GRAMS}, true},
+		{0, 450, shared.UnitPrice{Cents: 90, Unit: shared.UNIT_PER_100G}, PackSize{500, SIZE_UNIT_GRAMS}, true},
+		{0, 300, shared.UnitPrice{Cents: 15, Unit: shared.UNIT_PER_100ML}, PackSize{2000, SIZE_UNIT_MILLILITRES}, true},
+		{0, 600, shared.UnitPrice{Cents: 50, Unit: shared.UNIT_EACH}, PackSize{12, SIZE_UNIT_EACH}, true},
+		{0, 600, shared.UnitPrice{}, PackSize{}, false},
+		{0, 0, shared.UnitPrice{Cents: 50, Unit: shared.UNIT_EACH}, PackSize{}, false},
+	} {
+		got, ok := SizeOf(test.weightGrams, test.priceCents, test.unitPrice)
+		if test.wantOK != ok || math.Abs(test.want.Amount-got.Amount) > 1e-9 || test.want.Unit != got.Unit {
+			t.Errorf("SizeOf(%d, %d, %v): expected %v %v, got %v %v", test.weightGrams, test.priceCents, test.unitPrice, test.want, test.wantOK, got, ok)
+		}
+	}
+}
+
+func TestCheckShrinkflation(t *testing.T) {
+	grams := func(amount float64) PackSize { return PackSize{amount, SIZE_UNIT_GRAMS} }
+	for _, test := range []struct {
+		name         string
+		before       PackSize
+		after        PackSize
+		beforeCents  int
+		afterCents   int
+		wantIncrease float64
+		wantOK       bool
+	}{
+		{"shrank at the same price", grams(500), grams(450), 400, 400, 500.0/450 - 1, true},
+		{"shrank and got dearer", grams(500), grams(400), 400, 450, 450.0/400/(400.0/500) - 1, true},
+		{"shrank and got cheaper to match", grams(500), grams(400), 400, 320, 0, false},
+		{"grew", grams(400), grams(500), 400, 400, 0, false},
+		{"rounding", grams(500), grams(495), 400, 400, 0, false},
+		{"different units", grams(500), PackSize{400, SIZE_UNIT_MILLILITRES}, 400, 400, 0, false},
+	} {
+		increase, ok := CheckShrinkflation(test.before, test.after, test.beforeCents, test.afterCents)
+		if test.wantOK != ok {
+			t.Errorf("%s: expected %v, got %v", test.name, test.wantOK, ok)
+		}
+		if ok && math.Abs(test.wantIncrease-increase) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", test.name, test.wantIncrease, increase)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+// Admin is the API's only write, kept apart from the read-only query API so it can be
+// served on its own listener. Every request needs the token as a bearer token:
+//
+//	PUT /api/matches/{a}/{b}               override a match with {"status": "confirmed"}, etc.
+//
+// Overrides feed the inflation index's substitutes and the cheapest_elsewhere alerts.
+type Admin struct {
+	token string
+	query Server
+	mux   *http.ServeMux
+}
+
+// Init sets up the admin API over the given DBs, accepting the token. A blank token
+// refuses every request.
+func (a *Admin) Init(version, token string, stores []*store.DB, matches *matching.DB) {
+	a.token = token
+	a.query.Init(version, stores, matches)
+	a.mux = http.NewServeMux()
+	a.mux.HandleFunc("PUT /api/matches/{a}/{b}", a.query.handleOverrideMatch)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("a valid admin token is required"))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
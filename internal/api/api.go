@@ -0,0 +1,453 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/gtin"
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+const DEFAULT_SEARCH_LIMIT = 50
+const MAX_SEARCH_LIMIT = 500
+const MAX_SEARCH_OFFSET = 10000
+
+// Server is a JSON API over the retailers' local product DBs and the matches between them:
+//
+//	GET /api/status                        version, uptime and a summary of each store
+//	GET /api/stores                        the stores
+//	GET /api/stores/{store}/departments    a store's departments
+//	GET /api/products?q=&store=&department=&limit=&offset=
+//	                                       products matching every word of q, best first
+//	GET /api/products/{id}                 a product at every location
+//	GET /api/products/{id}/history         a product's price history
+//	GET /api/products/{id}/forecast        when a product is next expected to be cheap
+//	GET /api/barcodes/{code}               products with the barcode, and their price histories
+//	GET /api/products/{id}/matches         the same product in every store
+//	GET /api/groups?limit=&offset=         products confirmed to be the same across stores
+//	GET /api/matches?status=&limit=&offset=
+//	                                       proposed matches between stores, most confident first
+//	GET /api/fake-sales?store=&limit=&offset=
+//	                                       specials that aren't the saving they claim, latest first
+//	GET /api/shrinkflation?store=&limit=&offset=
+//	                                       packs that shrank without getting cheaper, latest first
+//
+// Stores are named in lower case, e.g. "woolworths". Product IDs are the prefixed IDs
+// the sinks see, e.g. "coles_id_123", which identify the store. It's read-only; matches
+// are overridden through Admin.
+type Server struct {
+	version string
+	started time.Time
+	stores  []*store.DB
+	matches *matching.DB
+	mux     *http.ServeMux
+}
+
+// Init sets up the API over the given DBs.
+func (s *Server) Init(version string, stores []*store.DB, matches *matching.DB) {
+	s.version = version
+	s.started = time.Now()
+	s.stores = stores
+	s.matches = matches
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /api/status", s.handleStatus)
+	s.mux.HandleFunc("GET /api/stores", s.handleStores)
+	s.mux.HandleFunc("GET /api/stores/{store}/departments", s.handleDepartments)
+	s.mux.HandleFunc("GET /api/products", s.handleSearch)
+	s.mux.HandleFunc("GET /api/products/{id}", s.handleProduct)
+	s.mux.HandleFunc("GET /api/products/{id}/history", s.handleHistory)
+	s.mux.HandleFunc("GET /api/products/{id}/forecast", s.handleForecast)
+	s.mux.HandleFunc("GET /api/barcodes/{code}", s.handleBarcode)
+	s.mux.HandleFunc("GET /api/products/{id}/matches", s.handleProductMatches)
+	s.mux.HandleFunc("GET /api/groups", s.handleGroups)
+	s.mux.HandleFunc("GET /api/matches", s.handleMatches)
+	s.mux.HandleFunc("GET /api/fake-sales", s.handleFakeSales)
+	s.mux.HandleFunc("GET /api/shrinkflation", s.handleShrinkflation)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type storeResponse struct {
+	Name            string    `json:"name"`
+	ProductCount    int       `json:"product_count"`
+	DepartmentCount int       `json:"department_count"`
+	LastUpdated     time.Time `json:"last_updated"`
+}
+
+type statusResponse struct {
+	Version       string          `json:"version"`
+	UptimeSeconds int             `json:"uptime_seconds"`
+	Stores        []storeResponse `json:"stores"`
+}
+
+type departmentResponse struct {
+	ID           string    `json:"id"`
+	Description  string    `json:"description"`
+	ProductCount int       `json:"product_count"`
+	Updated      time.Time `json:"updated"`
+}
+
+type promotionResponse struct {
+	Type               string `json:"type"`
+	WasPriceCents      int    `json:"was_price_cents,omitempty"`
+	MultibuyQuantity   int    `json:"multibuy_quantity,omitempty"`
+	MultibuyPriceCents int    `json:"multibuy_price_cents,omitempty"`
+	MemberPriceCents   int    `json:"member_price_cents,omitempty"`
+}
+
+type unitPriceResponse struct {
+	Cents float64 `json:"cents"`
+	Unit  string  `json:"unit"`
+}
+
+type productResponse struct {
+	ID                 string             `json:"id"`
+	Store              string             `json:"store"`
+	Location           string             `json:"location"`
+	GTIN               string             `json:"gtin,omitempty"`
+	Name               string             `json:"name"`
+	Description        string             `json:"description"`
+	Brand              string             `json:"brand,omitempty"`
+	Department         string             `json:"department"`
+	PriceCents         int                `json:"price_cents"`
+	PreviousPriceCents int                `json:"previous_price_cents"`
+	WeightGrams        int                `json:"weight_grams"`
+	Promotion          *promotionResponse `json:"promotion,omitempty"`
+	UnitPrice          *unitPriceResponse `json:"unit_price,omitempty"`
+	Updated            time.Time          `json:"updated"`
+}
+
+type priceHistoryResponse struct {
+	Location      string    `json:"location"`
+	PriceCents    int       `json:"price_cents"`
+	WasPriceCents int       `json:"was_price_cents"`
+	OnSpecial     bool      `json:"on_special"`
+	PromotionType string    `json:"promotion_type"`
+	Recorded      time.Time `json:"recorded"`
+}
+
+// barcodeMatchResponse is a product with a scanned barcode, at every location it's stocked.
+type barcodeMatchResponse struct {
+	ID        string                 `json:"id"`
+	Store     string                 `json:"store"`
+	Name      string                 `json:"name"`
+	Locations []productResponse      `json:"locations"`
+	History   []priceHistoryResponse `json:"history"`
+}
+
+type barcodeResponse struct {
+	GTIN     string                 `json:"gtin"`
+	Products []barcodeMatchResponse `json:"products"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func toProductResponse(info shared.ProductInfo) productResponse {
+	product := productResponse{
+		ID:                 info.ID,
+		Store:              info.Store,
+		Location:           info.Location,
+		GTIN:               info.GTIN,
+		Name:               info.Name,
+		Description:        info.Description,
+		Brand:              info.Brand,
+		Department:         info.Department,
+		PriceCents:         info.PriceCents,
+		PreviousPriceCents: info.PreviousPriceCents,
+		WeightGrams:        info.WeightGrams,
+		Updated:            info.Timestamp,
+	}
+	if info.Promotion.OnPromotion() {
+		product.Promotion = &promotionResponse{
+			Type:               info.Promotion.Type,
+			WasPriceCents:      info.Promotion.WasPriceCents,
+			MultibuyQuantity:   info.Promotion.MultibuyQuantity,
+			MultibuyPriceCents: info.Promotion.MultibuyPriceCents,
+			MemberPriceCents:   info.Promotion.MemberPriceCents,
+		}
+	}
+	if info.UnitPrice.Unit != "" {
+		product.UnitPrice = &unitPriceResponse{Cents: info.UnitPrice.Cents, Unit: info.UnitPrice.Unit}
+	}
+	return product
+}
+
+func toProductResponses(infos []shared.ProductInfo) []productResponse {
+	products := make([]productResponse, 0, len(infos))
+	for _, info := range infos {
+		products = append(products, toProductResponse(info))
+	}
+	return products
+}
+
+func toHistoryResponses(history []shared.PriceHistoryEntry) []priceHistoryResponse {
+	response := make([]priceHistoryResponse, 0, len(history))
+	for _, entry := range history {
+		response = append(response, priceHistoryResponse{
+			Location:      entry.Location,
+			PriceCents:    entry.PriceCents,
+			WasPriceCents: entry.WasPriceCents,
+			OnSpecial:     entry.OnSpecial,
+			PromotionType: entry.PromotionType,
+			Recorded:      entry.Recorded,
+		})
+	}
+	return response
+}
+
+// writeJSON writes the value as the response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write API response", "error", err)
+	}
+}
+
+// writeError writes an error response. Internal errors are logged rather than returned to
+// the client.
+func writeError(w http.ResponseWriter, status int, err error) {
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		slog.Error("API request failed", "error", err)
+		message = http.StatusText(status)
+	}
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+// storeName is how a store is named in URLs.
+func storeName(db *store.DB) string {
+	return strings.ToLower(db.Retailer().Name)
+}
+
+// findStore returns the store with the given name, or nil.
+func (s *Server) findStore(name string) *store.DB {
+	for _, db := range s.stores {
+		if storeName(db) == strings.ToLower(name) {
+			return db
+		}
+	}
+	return nil
+}
+
+// findProductStore returns the store the product ID belongs to, or nil.
+func (s *Server) findProductStore(id string) *store.DB {
+	for _, db := range s.stores {
+		if strings.HasPrefix(id, db.Retailer().IDPrefix) {
+			return db
+		}
+	}
+	return nil
+}
+
+func (s *Server) storeSummaries() ([]storeResponse, error) {
+	stores := make([]storeResponse, 0, len(s.stores))
+	for _, db := range s.stores {
+		status, err := db.GetStatus()
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, storeResponse{
+			Name:            storeName(db),
+			ProductCount:    status.ProductCount,
+			DepartmentCount: status.DepartmentCount,
+			LastUpdated:     status.LastUpdated,
+		})
+	}
+	return stores, nil
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	stores, err := s.storeSummaries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{
+		Version:       s.version,
+		UptimeSeconds: int(time.Since(s.started).Seconds()),
+		Stores:        stores,
+	})
+}
+
+func (s *Server) handleStores(w http.ResponseWriter, r *http.Request) {
+	stores, err := s.storeSummaries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stores)
+}
+
+func (s *Server) handleDepartments(w http.ResponseWriter, r *http.Request) {
+	db := s.findStore(r.PathValue("store"))
+	if db == nil {
+		writeError(w, http.StatusNotFound, errors.New("unknown store"))
+		return
+	}
+	departments, err := db.LoadDepartments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := make([]departmentResponse, 0, len(departments))
+	for _, department := range departments {
+		response = append(response, departmentResponse{
+			ID:           department.ID,
+			Description:  department.Description,
+			ProductCount: department.ProductCount,
+			Updated:      department.Updated,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing search query q"))
+		return
+	}
+	limit, ok := intParameter(w, r, "limit", DEFAULT_SEARCH_LIMIT, 1, MAX_SEARCH_LIMIT)
+	if !ok {
+		return
+	}
+	offset, ok := intParameter(w, r, "offset", 0, 0, MAX_SEARCH_OFFSET)
+	if !ok {
+		return
+	}
+	stores := s.stores
+	if name := r.URL.Query().Get("store"); name != "" {
+		db := s.findStore(name)
+		if db == nil {
+			writeError(w, http.StatusNotFound, errors.New("unknown store"))
+			return
+		}
+		stores = []*store.DB{db}
+	}
+
+	// Every store's best matches up to the end of the page are merged, so a page ranks
+	// across stores.
+	options := store.SearchOptions{Department: r.URL.Query().Get("department"), Limit: offset + limit}
+	var results []store.SearchResult
+	for _, db := range stores {
+		matches, err := db.SearchProducts(query, options)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		results = append(results, matches...)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rank < results[j].Rank })
+	results = results[min(offset, len(results)):min(offset+limit, len(results))]
+	products := make([]shared.ProductInfo, len(results))
+	for i, result := range results {
+		products[i] = result.Product
+	}
+	writeJSON(w, http.StatusOK, toProductResponses(products))
+}
+
+// intParameter reads an integer query parameter between lowest and highest, or def if it's
+// absent. If it's invalid it writes a bad request response and returns false.
+func intParameter(w http.ResponseWriter, r *http.Request, name string, def, lowest, highest int) (int, bool) {
+	text := r.URL.Query().Get(name)
+	if text == "" {
+		return def, true
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < lowest || value > highest {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be between %d and %d", name, lowest, highest))
+		return 0, false
+	}
+	return value, true
+}
+
+func (s *Server) handleProduct(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	db := s.findProductStore(id)
+	if db == nil {
+		writeError(w, http.StatusNotFound, shared.ErrProductMissing)
+		return
+	}
+	products, err := db.GetProduct(id)
+	if errors.Is(err, shared.ErrProductMissing) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toProductResponses(products))
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	db := s.findProductStore(id)
+	if db == nil {
+		writeError(w, http.StatusNotFound, shared.ErrProductMissing)
+		return
+	}
+	history, err := db.GetPriceHistory(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(history) == 0 {
+		writeError(w, http.StatusNotFound, shared.ErrProductMissing)
+		return
+	}
+	writeJSON(w, http.StatusOK, toHistoryResponses(history))
+}
+
+func (s *Server) handleBarcode(w http.ResponseWriter, r *http.Request) {
+	code, err := gtin.Normalise(r.PathValue("code"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	response := barcodeResponse{GTIN: code, Products: []barcodeMatchResponse{}}
+	for _, db := range s.stores {
+		products, err := db.FindByGTIN(code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// The products are ordered by ID, so each product's locations are together.
+		for _, product := range products {
+			n := len(response.Products)
+			if n == 0 || response.Products[n-1].ID != product.ID {
+				history, err := db.GetPriceHistory(product.ID)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+				response.Products = append(response.Products, barcodeMatchResponse{
+					ID:      product.ID,
+					Store:   product.Store,
+					Name:    product.Name,
+					History: toHistoryResponses(history),
+				})
+				n++
+			}
+			response.Products[n-1].Locations = append(response.Products[n-1].Locations, toProductResponse(product))
+		}
+	}
+	if len(response.Products) == 0 {
+		writeError(w, http.StatusNotFound, shared.ErrProductMissing)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
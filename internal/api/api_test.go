@@ -0,0 +1,274 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func openStore(t *testing.T, retailer store.Retailer) *store.DB {
+	db, err := store.Open(":memory:", retailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func getTestServer(t *testing.T) *httptest.Server {
+	stores, matches := getTestDBs(t)
+	s := &Server{}
+	s.Init("1.2.3", stores, matches)
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// getTestDBs returns the test stores, and the matches between them.
+func getTestDBs(t *testing.T) ([]*store.DB, *matching.DB) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	updated := time.Now().Add(-time.Hour)
+	if err := woolworths.SaveDepartment(store.Department{ID: "1-E5BEE36E", Description: "Fruit & Veg", ProductCount: 2, Updated: updated}); err != nil {
+		t.Fatal(err)
+	}
+	err := woolworths.SaveProducts([]store.Product{
+		{ID: "1", Name: "Royal Gala Apples", Barcode: "9300633603540", PriceCents: 450, DepartmentID: "1-E5BEE36E", Updated: updated},
+		{ID: "1", Location: "1234", Name: "Royal Gala Apples", Barcode: "9300633603540", PriceCents: 400, DepartmentID: "1-E5BEE36E", Updated: updated},
+		{ID: "2", Name: "Bananas", PriceCents: 350, DepartmentID: "1-E5BEE36E", Updated: updated,
+			Promotion: shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: 400},
+			UnitPrice: shared.UnitPrice{Cents: 35, Unit: shared.UNIT_PER_100G}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = coles.SaveProducts([]store.Product{
+		{ID: "9", Name: "Pink Lady Apples", PriceCents: 490, Updated: updated},
+		{ID: "10", Name: "Royal Gala Apples", Barcode: "09300633603540", PriceCents: 470, Updated: updated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := matching.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { matches.Close() })
+	err = matches.SaveProposals([]matching.Match{
+		{ProductA: "coles_id_10", ProductB: "woolworths_sku_1", Confidence: 1, Method: matching.METHOD_BARCODE, Status: matching.STATUS_CONFIRMED},
+		{ProductA: "coles_id_9", ProductB: "woolworths_sku_1", Confidence: 0.7, Method: matching.METHOD_SIMILARITY, Status: matching.STATUS_PROPOSED},
+	}, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []*store.DB{woolworths, coles}, matches
+}
+
+// get fetches the path and decodes the JSON response into v.
+func get(t *testing.T, server *httptest.Server, path string, v any) int {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if want, got := "application/json", resp.Header.Get("Content-Type"); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestStatus(t *testing.T) {
+	server := getTestServer(t)
+	var status statusResponse
+	if want, got := http.StatusOK, get(t, server, "/api/status", &status); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "1.2.3", status.Version; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 2, len(status.Stores); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "woolworths", status.Stores[0].Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 3, status.Stores[0].ProductCount; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if status.Stores[0].LastUpdated.IsZero() {
+		t.Errorf("Expected a last updated time")
+	}
+
+	var stores []storeResponse
+	if want, got := http.StatusOK, get(t, server, "/api/stores", &stores); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "coles", stores[1].Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestDepartments(t *testing.T) {
+	server := getTestServer(t)
+	var departments []departmentResponse
+	if want, got := http.StatusOK, get(t, server, "/api/stores/Woolworths/departments", &departments); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(departments); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "Fruit & Veg", departments[0].Description; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	var errResp errorResponse
+	if want, got := http.StatusNotFound, get(t, server, "/api/stores/iga/departments", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestProduct(t *testing.T) {
+	server := getTestServer(t)
+	var products []productResponse
+	if want, got := http.StatusOK, get(t, server, "/api/products/woolworths_sku_1", &products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "1234", products[1].Location; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Fruit & Veg", products[0].Department; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if products[0].Promotion != nil {
+		t.Errorf("Expected no promotion, got %v", products[0].Promotion)
+	}
+
+	if want, got := http.StatusOK, get(t, server, "/api/products/woolworths_sku_2", &products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 400, products[0].Promotion.WasPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := shared.UNIT_PER_100G, products[0].UnitPrice.Unit; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	var errResp errorResponse
+	for _, path := range []string{"/api/products/woolworths_sku_3", "/api/products/aldi_id_1"} {
+		if want, got := http.StatusNotFound, get(t, server, path, &errResp); want != got {
+			t.Errorf("%s: expected %d, got %d", path, want, got)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	server := getTestServer(t)
+	var products []productResponse
+	if want, got := http.StatusOK, get(t, server, "/api/products?q=apples", &products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	// Only the default location is searched.
+	if want, got := 3, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "coles_id_9", products[1].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	for path, want := range map[string]int{
+		"/api/products?q=apples&store=coles":              2,
+		"/api/products?q=gala+apples":                     2,
+		"/api/products?q=apples&limit=1":                  1,
+		"/api/products?q=apples&offset=2":                 1,
+		"/api/products?q=apples&offset=3":                 0,
+		"/api/products?q=gala+app":                        2,
+		"/api/products?q=100%25":                          0,
+		"/api/products?q=apples&department=fruit+%26+veg": 1,
+		"/api/products?q=apples&department=1-E5BEE36E":    1,
+	} {
+		if got := get(t, server, path, &products); got != http.StatusOK {
+			t.Fatalf("%s: expected %d, got %d", path, http.StatusOK, got)
+		}
+		if got := len(products); want != got {
+			t.Errorf("%s: expected %d, got %d", path, want, got)
+		}
+	}
+
+	var errResp errorResponse
+	for _, path := range []string{"/api/products", "/api/products?q=apples&limit=0", "/api/products?q=apples&limit=x", "/api/products?q=apples&offset=-1"} {
+		if want, got := http.StatusBadRequest, get(t, server, path, &errResp); want != got {
+			t.Errorf("%s: expected %d, got %d", path, want, got)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	server := getTestServer(t)
+	var history []priceHistoryResponse
+	if want, got := http.StatusOK, get(t, server, "/api/products/woolworths_sku_2/history", &history); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(history); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := shared.PROMOTION_SPECIAL, history[0].PromotionType; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	var errResp errorResponse
+	if want, got := http.StatusNotFound, get(t, server, "/api/products/coles_id_1/history", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestBarcode(t *testing.T) {
+	server := getTestServer(t)
+	var response barcodeResponse
+	// Scanned as a UPC-A would be, with spaces.
+	if want, got := http.StatusOK, get(t, server, "/api/barcodes/930%200633%20603540", &response); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "09300633603540", response.GTIN; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 2, len(response.Products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "woolworths_sku_1", response.Products[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 2, len(response.Products[0].Locations); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(response.Products[0].History); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := "coles_id_10", response.Products[1].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 470, response.Products[1].Locations[0].PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	var errResp errorResponse
+	if want, got := http.StatusBadRequest, get(t, server, "/api/barcodes/9300633603541", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := http.StatusNotFound, get(t, server, "/api/barcodes/96385074", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
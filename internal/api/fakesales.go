@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+type fakeSaleResponse struct {
+	ProductID        string    `json:"product_id"`
+	Store            string    `json:"store"`
+	Name             string    `json:"name"`
+	Location         string    `json:"location"`
+	SaleStarted      time.Time `json:"sale_started"`
+	PriceCents       int       `json:"price_cents"`
+	WasPriceCents    int       `json:"was_price_cents"`
+	WasPriceShare    float64   `json:"was_price_share"`
+	MedianPriceCents int       `json:"median_price_cents"`
+	Reasons          []string  `json:"reasons"`
+	Detected         time.Time `json:"detected"`
+	Updated          time.Time `json:"updated"`
+}
+
+func (s *Server) handleFakeSales(w http.ResponseWriter, r *http.Request) {
+	limit, ok := intParameter(w, r, "limit", DEFAULT_SEARCH_LIMIT, 1, MAX_SEARCH_LIMIT)
+	if !ok {
+		return
+	}
+	offset, ok := intParameter(w, r, "offset", 0, 0, MAX_SEARCH_OFFSET)
+	if !ok {
+		return
+	}
+	stores := s.stores
+	if name := r.URL.Query().Get("store"); name != "" {
+		db := s.findStore(name)
+		if db == nil {
+			writeError(w, http.StatusNotFound, errors.New("unknown store"))
+			return
+		}
+		stores = []*store.DB{db}
+	}
+
+	// Every store's latest up to the end of the page are merged.
+	var sales []store.FakeSaleRecord
+	for _, db := range stores {
+		found, err := db.GetFakeSales(offset+limit, 0)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		sales = append(sales, found...)
+	}
+	sort.SliceStable(sales, func(i, j int) bool { return sales[i].Detected.After(sales[j].Detected) })
+	sales = sales[min(offset, len(sales)):min(offset+limit, len(sales))]
+
+	response := make([]fakeSaleResponse, 0, len(sales))
+	for _, sale := range sales {
+		response = append(response, fakeSaleResponse{
+			ProductID:        sale.ProductID,
+			Store:            sale.Store,
+			Name:             sale.Name,
+			Location:         sale.Location,
+			SaleStarted:      sale.SaleStarted,
+			PriceCents:       sale.PriceCents,
+			WasPriceCents:    sale.WasPriceCents,
+			WasPriceShare:    sale.WasPriceShare,
+			MedianPriceCents: sale.MedianPriceCents,
+			Reasons:          sale.Reasons,
+			Detected:         sale.Detected,
+			Updated:          sale.Updated,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func TestFakeSales(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	start := time.Now().Add(-10 * 7 * 24 * time.Hour)
+	onSale := start.Add(9 * 7 * 24 * time.Hour)
+	special := shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: 500}
+	for _, db := range []*store.DB{woolworths, coles} {
+		for _, product := range []store.Product{
+			{ID: "1", Name: "Apples", PriceCents: 400, Updated: start},
+			{ID: "1", Name: "Apples", PriceCents: 400, Promotion: special, Updated: onSale},
+		} {
+			if err := db.SaveProducts([]store.Product{product}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.DetectFakeSales(analysis.DefaultFakeSaleOptions, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{}
+	s.Init("1.2.3", []*store.DB{woolworths, coles}, nil)
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	var sales []fakeSaleResponse
+	if want, got := http.StatusOK, get(t, server, "/api/fake-sales", &sales); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(sales); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(sales[0].Reasons); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 400, sales[0].MedianPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	if want, got := http.StatusOK, get(t, server, "/api/fake-sales?store=coles&limit=1", &sales); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "coles_id_1", sales[0].ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	var errResp errorResponse
+	if want, got := http.StatusNotFound, get(t, server, "/api/fake-sales?store=iga", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
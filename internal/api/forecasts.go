@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// forecastResponse is when a product is next expected to be cheap at a location, and
+// whether that's worth waiting for at today's price.
+type forecastResponse struct {
+	Location          string    `json:"location"`
+	PeriodDays        int       `json:"period_days"`
+	Confidence        float64   `json:"confidence"`
+	RegularPriceCents int       `json:"regular_price_cents"`
+	LowPriceCents     int       `json:"low_price_cents"`
+	PriceCents        int       `json:"price_cents"` // Today's price.
+	NextLowStart      time.Time `json:"next_low_start"`
+	NextLowEnd        time.Time `json:"next_low_end"`
+	Wait              bool      `json:"wait"`
+	Computed          time.Time `json:"computed"`
+}
+
+func (s *Server) handleForecast(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	db := s.findProductStore(id)
+	if db == nil {
+		writeError(w, http.StatusNotFound, shared.ErrProductMissing)
+		return
+	}
+	products, err := db.GetProduct(id)
+	if errors.Is(err, shared.ErrProductMissing) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	prices := map[string]int{}
+	for _, product := range products {
+		prices[product.Location] = product.PriceCents
+	}
+	forecasts, err := db.GetForecasts(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	response := make([]forecastResponse, 0, len(forecasts))
+	for _, forecast := range forecasts {
+		response = append(response, forecastResponse{
+			Location:          forecast.Location,
+			PeriodDays:        int(forecast.Period / (24 * time.Hour)),
+			Confidence:        forecast.Confidence,
+			RegularPriceCents: forecast.RegularPriceCents,
+			LowPriceCents:     forecast.LowPriceCents,
+			PriceCents:        prices[forecast.Location],
+			NextLowStart:      forecast.NextLowStart,
+			NextLowEnd:        forecast.NextLowEnd,
+			Wait:              forecast.Wait(prices[forecast.Location], now),
+			Computed:          forecast.Computed,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func TestForecast(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	fortnight := 14 * 24 * time.Hour
+	start := time.Now().Truncate(24 * time.Hour).Add(-8 * fortnight)
+	// Apples are cheap for four days a fortnight, the last time ending today.
+	for i := 0; i < 8; i++ {
+		cycleStart := start.Add(time.Duration(i) * fortnight)
+		for _, product := range []store.Product{
+			{ID: "1", Name: "Apples", PriceCents: 500, Updated: cycleStart},
+			{ID: "1", Name: "Apples", PriceCents: 350, Updated: cycleStart.Add(10 * 24 * time.Hour)},
+		} {
+			if err := woolworths.SaveProducts([]store.Product{product}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := woolworths.SaveProducts([]store.Product{{ID: "1", Name: "Apples", PriceCents: 500, Updated: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := woolworths.UpdateForecasts(analysis.DefaultPeriodicityOptions, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.Init("1.2.3", []*store.DB{woolworths}, nil)
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	var forecasts []forecastResponse
+	if want, got := http.StatusOK, get(t, server, "/api/products/woolworths_sku_1/forecast", &forecasts); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(forecasts); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 14, forecasts[0].PeriodDays; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 500, forecasts[0].PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if !forecasts[0].Wait {
+		t.Error("Expected to be told to wait at the regular price")
+	}
+
+	var errResp errorResponse
+	if want, got := http.StatusNotFound, get(t, server, "/api/products/woolworths_sku_2/forecast", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
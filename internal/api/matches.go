@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+type matchResponse struct {
+	ProductA   string    `json:"product_a"`
+	ProductB   string    `json:"product_b"`
+	Confidence float64   `json:"confidence"`
+	Method     string    `json:"method"`
+	Status     string    `json:"status"`
+	Manual     bool      `json:"manual"`
+	Updated    time.Time `json:"updated"`
+}
+
+// groupResponse is a product in every store it's confirmed to be sold in, at each store's
+// default location.
+type groupResponse struct {
+	Products []productResponse `json:"products"`
+	Cheapest string            `json:"cheapest,omitempty"` // The ID of the cheapest product.
+	Matches  []matchResponse   `json:"matches,omitempty"`
+}
+
+type overrideRequest struct {
+	Status string `json:"status"`
+}
+
+func toMatchResponses(matches []matching.Match) []matchResponse {
+	response := make([]matchResponse, 0, len(matches))
+	for _, match := range matches {
+		response = append(response, matchResponse{
+			ProductA:   match.ProductA,
+			ProductB:   match.ProductB,
+			Confidence: match.Confidence,
+			Method:     match.Method,
+			Status:     match.Status,
+			Manual:     match.Manual,
+			Updated:    match.Updated,
+		})
+	}
+	return response
+}
+
+// loadProduct returns the product at its store's default location, or the first location
+// it's stocked at if it isn't at the default.
+func (s *Server) loadProduct(id string) (shared.ProductInfo, error) {
+	db := s.findProductStore(id)
+	if db == nil {
+		return shared.ProductInfo{}, shared.ErrProductMissing
+	}
+	products, err := db.GetProduct(id)
+	if err != nil {
+		return shared.ProductInfo{}, err
+	}
+	return products[0], nil
+}
+
+// toGroupResponse loads the products in the group. Products that have since gone missing
+// are left out.
+func (s *Server) toGroupResponse(ids []string, matches []matching.Match) (groupResponse, error) {
+	response := groupResponse{Products: []productResponse{}, Matches: toMatchResponses(matches)}
+	cheapest := 0
+	for _, id := range ids {
+		product, err := s.loadProduct(id)
+		if errors.Is(err, shared.ErrProductMissing) {
+			continue
+		} else if err != nil {
+			return response, err
+		}
+		response.Products = append(response.Products, toProductResponse(product))
+		if product.PriceCents > 0 && (response.Cheapest == "" || product.PriceCents < cheapest) {
+			response.Cheapest = product.ID
+			cheapest = product.PriceCents
+		}
+	}
+	return response, nil
+}
+
+func (s *Server) handleProductMatches(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.loadProduct(id); errors.Is(err, shared.ErrProductMissing) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ids, matches, err := s.matches.Group(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response, err := s.toGroupResponse(ids, matches)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	limit, ok := intParameter(w, r, "limit", DEFAULT_SEARCH_LIMIT, 1, MAX_SEARCH_LIMIT)
+	if !ok {
+		return
+	}
+	offset, ok := intParameter(w, r, "offset", 0, 0, MAX_SEARCH_OFFSET)
+	if !ok {
+		return
+	}
+	groups, err := s.matches.Groups()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	groups = groups[min(offset, len(groups)):min(offset+limit, len(groups))]
+	response := make([]groupResponse, 0, len(groups))
+	for _, ids := range groups {
+		group, err := s.toGroupResponse(ids, nil)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		response = append(response, group)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleMatches(w http.ResponseWriter, r *http.Request) {
+	limit, ok := intParameter(w, r, "limit", DEFAULT_SEARCH_LIMIT, 1, MAX_SEARCH_LIMIT)
+	if !ok {
+		return
+	}
+	offset, ok := intParameter(w, r, "offset", 0, 0, MAX_SEARCH_OFFSET)
+	if !ok {
+		return
+	}
+	matches, err := s.matches.Matches(r.URL.Query().Get("status"), limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toMatchResponses(matches))
+}
+
+// handleOverrideMatch is served by Admin, not the query API.
+func (s *Server) handleOverrideMatch(w http.ResponseWriter, r *http.Request) {
+	a, b := r.PathValue("a"), r.PathValue("b")
+	for _, id := range []string{a, b} {
+		if _, err := s.loadProduct(id); errors.Is(err, shared.ErrProductMissing) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if s.findProductStore(a) == s.findProductStore(b) {
+		writeError(w, http.StatusBadRequest, errors.New("matched products must be from different stores"))
+		return
+	}
+	var request overrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	match, err := s.matches.Override(a, b, request.Status)
+	if errors.Is(err, matching.ErrInvalidStatus) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toMatchResponses([]matching.Match{match})[0])
+}
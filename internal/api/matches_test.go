@@ -0,0 +1,158 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+)
+
+// put sends the body to the path with the admin token.
+func put(t *testing.T, server string, path string, token string, body string) *http.Response {
+	request, err := http.NewRequest(http.MethodPut, server+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestProductMatches(t *testing.T) {
+	server := getTestServer(t)
+	var group groupResponse
+	if want, got := http.StatusOK, get(t, server, "/api/products/coles_id_10/matches", &group); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(group.Products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "woolworths_sku_1", group.Products[1].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "woolworths_sku_1", group.Cheapest; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 1, len(group.Matches); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// Unmatched products are a group of one.
+	if want, got := http.StatusOK, get(t, server, "/api/products/woolworths_sku_2/matches", &group); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(group.Products); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	var errResp errorResponse
+	if want, got := http.StatusNotFound, get(t, server, "/api/products/coles_id_1/matches", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	server := getTestServer(t)
+	var groups []groupResponse
+	if want, got := http.StatusOK, get(t, server, "/api/groups", &groups); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(groups); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(groups[0].Products); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := http.StatusOK, get(t, server, "/api/groups?offset=1", &groups); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 0, len(groups); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	stores, matchDB := getTestDBs(t)
+	s := &Server{}
+	s.Init("1.2.3", stores, matchDB)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	a := &Admin{}
+	a.Init("1.2.3", "secret", stores, matchDB)
+	admin := httptest.NewServer(a)
+	defer admin.Close()
+
+	var matches []matchResponse
+	if want, got := http.StatusOK, get(t, server, "/api/matches?status=proposed", &matches); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(matches); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "coles_id_9", matches[0].ProductA; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	for path, want := range map[string]int{
+		"/api/matches/woolworths_sku_1/coles_id_9":       http.StatusOK,
+		"/api/matches/woolworths_sku_1/coles_id_11":      http.StatusNotFound,
+		"/api/matches/woolworths_sku_1/woolworths_sku_2": http.StatusBadRequest,
+	} {
+		if got := put(t, admin.URL, path, "secret", `{"status": "confirmed"}`).StatusCode; want != got {
+			t.Errorf("%s: expected %d, got %d", path, want, got)
+		}
+	}
+	if want, got := http.StatusBadRequest, put(t, admin.URL, "/api/matches/woolworths_sku_1/coles_id_9", "secret", `{"status": "maybe"}`).StatusCode; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	if want, got := http.StatusOK, get(t, server, "/api/matches?status="+matching.STATUS_CONFIRMED, &matches); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(matches); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if !matches[1].Manual {
+		t.Errorf("Expected a manual match")
+	}
+	var group groupResponse
+	get(t, server, "/api/products/coles_id_9/matches", &group)
+	if want, got := 3, len(group.Products); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	stores, matchDB := getTestDBs(t)
+	path := "/api/matches/woolworths_sku_1/coles_id_9"
+	body := `{"status": "rejected"}`
+
+	// The query API doesn't serve overrides at all.
+	if want, got := http.StatusNotFound, put(t, getTestServer(t).URL, path, "secret", body).StatusCode; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	a := &Admin{}
+	a.Init("1.2.3", "secret", stores, matchDB)
+	admin := httptest.NewServer(a)
+	defer admin.Close()
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		if got := put(t, admin.URL, path, token, body).StatusCode; want != got {
+			t.Errorf("%q: expected %d, got %d", token, want, got)
+		}
+	}
+
+	// Without a token, nothing gets through.
+	a.Init("1.2.3", "", stores, matchDB)
+	if want, got := http.StatusUnauthorized, put(t, admin.URL, path, "", body).StatusCode; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
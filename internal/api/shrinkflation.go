@@ -0,0 +1,76 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+type shrinkflationResponse struct {
+	ProductID         string    `json:"product_id"`
+	Store             string    `json:"store"`
+	Name              string    `json:"name"`
+	Location          string    `json:"location"`
+	SizeUnit          string    `json:"size_unit"`
+	BeforeSize        float64   `json:"before_size"`
+	AfterSize         float64   `json:"after_size"`
+	BeforePriceCents  int       `json:"before_price_cents"`
+	AfterPriceCents   int       `json:"after_price_cents"`
+	UnitPriceIncrease float64   `json:"unit_price_increase"`
+	Detected          time.Time `json:"detected"`
+}
+
+func (s *Server) handleShrinkflation(w http.ResponseWriter, r *http.Request) {
+	limit, ok := intParameter(w, r, "limit", DEFAULT_SEARCH_LIMIT, 1, MAX_SEARCH_LIMIT)
+	if !ok {
+		return
+	}
+	offset, ok := intParameter(w, r, "offset", 0, 0, MAX_SEARCH_OFFSET)
+	if !ok {
+		return
+	}
+	stores := s.stores
+	if name := r.URL.Query().Get("store"); name != "" {
+		db := s.findStore(name)
+		if db == nil {
+			writeError(w, http.StatusNotFound, errors.New("unknown store"))
+			return
+		}
+		stores = []*store.DB{db}
+	}
+
+	// Every store's latest up to the end of the page are merged.
+	var events []shared.ShrinkflationEvent
+	for _, db := range stores {
+		found, err := db.GetShrinkflation(offset+limit, 0)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		events = append(events, found...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Detected.After(events[j].Detected) })
+	events = events[min(offset, len(events)):min(offset+limit, len(events))]
+
+	response := make([]shrinkflationResponse, 0, len(events))
+	for _, event := range events {
+		response = append(response, shrinkflationResponse{
+			ProductID:         event.ID,
+			Store:             event.Store,
+			Name:              event.Name,
+			Location:          event.Location,
+			SizeUnit:          event.SizeUnit,
+			BeforeSize:        event.BeforeSize,
+			AfterSize:         event.AfterSize,
+			BeforePriceCents:  event.BeforePriceCents,
+			AfterPriceCents:   event.AfterPriceCents,
+			UnitPriceIncrease: event.UnitPriceIncrease,
+			Detected:          event.Detected,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
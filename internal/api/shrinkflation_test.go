@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func TestShrinkflation(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	start := time.Now().Add(-time.Hour)
+	for i, db := range []*store.DB{woolworths, coles} {
+		for _, product := range []store.Product{
+			{ID: "1", Name: "Chips", PriceCents: 400, WeightGrams: 200, Updated: start},
+			{ID: "1", Name: "Chips", PriceCents: 400, WeightGrams: 170, Updated: start.Add(time.Duration(i+1) * time.Minute)},
+		} {
+			if err := db.SaveProducts([]store.Product{product}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s := &Server{}
+	s.Init("1.2.3", []*store.DB{woolworths, coles}, nil)
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	var events []shrinkflationResponse
+	if want, got := http.StatusOK, get(t, server, "/api/shrinkflation", &events); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 2, len(events); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	// The most recent first.
+	if want, got := "coles_id_1", events[0].ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 170.0, events[0].AfterSize; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if want, got := http.StatusOK, get(t, server, "/api/shrinkflation?store=woolworths", &events); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 1, len(events); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	var errResp errorResponse
+	if want, got := http.StatusNotFound, get(t, server, "/api/shrinkflation?store=iga", &errResp); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
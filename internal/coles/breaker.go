@@ -0,0 +1,102 @@
+package coles
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// DEFAULT_SCRAPE_TRAP_COOL_OFF is how long scraping pauses after the first scrape trap.
+const DEFAULT_SCRAPE_TRAP_COOL_OFF = 5 * time.Minute
+
+// DEFAULT_SCRAPE_TRAP_MAX_COOL_OFF is the longest scraping pauses for.
+const DEFAULT_SCRAPE_TRAP_MAX_COOL_OFF = 4 * time.Hour
+
+// circuitBreaker pauses every request to Coles after a scrape trap, so we aren't hammering
+// a site that has already noticed us. When the cool-off is over requests go out again, and
+// the first page that isn't a trap closes the breaker. Each trap in a row before then
+// doubles the cool-off, up to the maximum.
+type circuitBreaker struct {
+	mu         sync.Mutex
+	coolOff    time.Duration // The cool-off after the first trap.
+	maxCoolOff time.Duration
+	trips      int       // Traps in a row.
+	openUntil  time.Time // When requests can go out again.
+}
+
+func newCircuitBreaker(coolOff, maxCoolOff time.Duration) *circuitBreaker {
+	metrics.ScrapeTrapCoolOff.WithLabelValues(retailer.Name).Set(0)
+	return &circuitBreaker{coolOff: coolOff, maxCoolOff: maxCoolOff}
+}
+
+// setCoolOff changes the cool-offs for the next trap.
+func (b *circuitBreaker) setCoolOff(coolOff, maxCoolOff time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.coolOff = coolOff
+	b.maxCoolOff = maxCoolOff
+}
+
+// trip opens the breaker after a trap, and returns how long it's open for. Traps served to
+// requests that went out together only count once.
+func (b *circuitBreaker) trip(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now)
+	}
+	b.trips++
+	coolOff := b.coolOff
+	for i := 1; i < b.trips && coolOff < b.maxCoolOff; i++ {
+		coolOff *= 2
+	}
+	coolOff = min(coolOff, b.maxCoolOff)
+	b.openUntil = now.Add(coolOff)
+	metrics.ScrapeTrapCoolOff.WithLabelValues(retailer.Name).Set(coolOff.Seconds())
+	slog.Warn("Caught in a scrape trap, pausing", "store", retailer.Name, "coolOff", coolOff, "trapsInARow", b.trips)
+	return coolOff
+}
+
+// reset closes the breaker after a page that wasn't a trap.
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.trips == 0 {
+		return
+	}
+	slog.Info("Out of the scrape trap, resuming", "store", retailer.Name, "trapsInARow", b.trips)
+	b.trips = 0
+	b.openUntil = time.Time{}
+	metrics.ScrapeTrapCoolOff.WithLabelValues(retailer.Name).Set(0)
+}
+
+// tripped returns whether the last page was a trap, even if the cool-off is over.
+func (b *circuitBreaker) tripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trips > 0
+}
+
+// until returns when requests can go out again. It's in the past while the breaker is closed.
+func (b *circuitBreaker) until() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openUntil
+}
+
+// wait blocks until requests can go out. It returns false if the context finished first.
+func (b *circuitBreaker) wait(ctx context.Context) bool {
+	for {
+		d := time.Until(b.until())
+		if d <= 0 {
+			return ctx.Err() == nil
+		}
+		if !shared.Sleep(ctx, d) {
+			return false
+		}
+	}
+}
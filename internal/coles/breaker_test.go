@@ -0,0 +1,70 @@
+package coles
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(time.Minute, 3*time.Minute)
+	now := time.Now()
+	if b.tripped() {
+		t.Errorf("Expected a new breaker to be closed")
+	}
+
+	// Each trap in a row doubles the cool-off, up to the maximum.
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if got := b.trip(now); want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+		if want, got := now.Add(want), b.until(); !want.Equal(got) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+		// Traps served while it's open don't count again.
+		if want, got := want-time.Second, b.trip(now.Add(time.Second)); want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+		now = b.until()
+	}
+	if !b.tripped() {
+		t.Errorf("Expected the breaker to be tripped")
+	}
+
+	// A page that comes through starts it over.
+	b.reset()
+	if b.tripped() {
+		t.Errorf("Expected the breaker to be reset")
+	}
+	if want, got := time.Minute, b.trip(now); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestCircuitBreakerWait(t *testing.T) {
+	b := newCircuitBreaker(50*time.Millisecond, time.Hour)
+	if !b.wait(t.Context()) {
+		t.Errorf("Expected a closed breaker not to wait")
+	}
+
+	b.trip(time.Now())
+	start := time.Now()
+	if !b.wait(t.Context()) {
+		t.Errorf("Expected to wait out the cool-off")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected to wait for the cool-off, waited %v", elapsed)
+	}
+
+	// The cool-off is over, but it's still tripped until a page comes through.
+	if !b.tripped() {
+		t.Errorf("Expected the breaker to be tripped")
+	}
+
+	b.trip(time.Now())
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if b.wait(ctx) {
+		t.Errorf("Expected a cancelled wait to return false")
+	}
+}
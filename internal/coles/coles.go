@@ -1,30 +1,61 @@
 package coles
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
+	"sync"
 	"time"
 
 	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
-	"golang.org/x/time/rate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
 )
 
 const DEFAULT_LISTING_PAGE_CHECK_INTERVAL = 1 * time.Minute
 
+// DEFAULT_REQUEST_INTERVAL is the time between requests to Coles while it isn't struggling.
+const DEFAULT_REQUEST_INTERVAL = 1 * time.Second
+
 // Coles satisfies the ProductInfoGetter interface.
 type Coles struct {
 	baseURL                   string
 	client                    *shared.RLHTTPClient
 	cookieJar                 *cookiejar.Jar // TODO This might not be threadsafe.
-	db                        *sql.DB
+	db                        *store.DB
 	colesAPIVersion           string
 	productMaxAge             time.Duration
 	listingPageUpdateInterval time.Duration
 	filteredDepartmentIDsSet  map[string]bool
 	filterDepartments         bool
+	locations                 []string        // Fulfilment store IDs to read prices from. "" is Coles' default.
+	breaker                   *circuitBreaker // Pauses scraping after a scrape trap.
+	quarantine                *quarantine     // Keeps responses that couldn't be used.
+}
+
+// SetLocations sets the fulfilment store IDs to read prices from as well as Coles' default
+// store. Every department is scraped once per location.
+func (c *Coles) SetLocations(locations []string) {
+	c.locations = shared.WithDefaultLocation(locations)
+}
+
+// SetRateLimit sets how fast Coles is scraped, and how the scraper backs off when Coles
+// struggles.
+func (c *Coles) SetRateLimit(limit shared.RateLimit) {
+	c.client.SetRateLimit(limit)
+}
+
+// SetScrapeTrapCoolOff sets how long scraping pauses after a scrape trap. The cool-off
+// doubles for each trap in a row, up to maxCoolOff.
+func (c *Coles) SetScrapeTrapCoolOff(coolOff, maxCoolOff time.Duration) {
+	c.breaker.setCoolOff(coolOff, maxCoolOff)
+}
+
+// SetQuarantine keeps the last maxFiles responses that couldn't be used, like scrape traps,
+// in the directory. A blank directory, the default, doesn't keep any.
+func (c *Coles) SetQuarantine(dir string, maxFiles int) {
+	c.quarantine.set(dir, maxFiles)
 }
 
 // Init initialises the Coles struct.
@@ -34,20 +65,24 @@ func (c *Coles) Init(baseURL string, dbPath string, productMaxAge time.Duration)
 	//'https://www.coles.com.au/_next/data/20240809.03_v4.7.3/en/browse.json'
 	c.colesAPIVersion = DEFAULT_API_VERSION
 	c.baseURL = baseURL
+	c.breaker = newCircuitBreaker(DEFAULT_SCRAPE_TRAP_COOL_OFF, DEFAULT_SCRAPE_TRAP_MAX_COOL_OFF)
+	c.quarantine = &quarantine{}
 
 	c.cookieJar, err = cookiejar.New(nil)
 	if err != nil {
 		return fmt.Errorf("error creating cookie jar: %v", err)
 	}
-	c.baseURL = baseURL
-	c.client = &shared.RLHTTPClient{
-		Client: &http.Client{
-			Jar:     c.cookieJar,
-			Timeout: 30 * time.Second,
-		},
-		Ratelimiter: rate.NewLimiter(rate.Every(1000*time.Millisecond), 1),
-	}
+	// Each request sets its own location, so the jar mustn't add the store Coles last set.
+	c.client = shared.NewRLHTTPClient(&http.Client{
+		Jar:     shared.JarWithout(c.cookieJar, COLES_STORE_COOKIE),
+		Timeout: 30 * time.Second,
+	}, retailer.Name, shared.DefaultRateLimit(DEFAULT_REQUEST_INTERVAL))
+	// Coles serves some traps as 429s and 5xxs, which mustn't be retried before they're caught.
+	c.client.SetRetryCheck(func(resp *http.Response, body []byte) bool {
+		return !isScrapeTrap(body)
+	})
 	c.productMaxAge = productMaxAge
+	c.SetLocations(nil)
 	err = c.initDB(dbPath)
 	if err != nil {
 		return err
@@ -71,79 +106,83 @@ func (c *Coles) Init(baseURL string, dbPath string, productMaxAge time.Duration)
 	}
 	c.filterDepartments = true
 
-	if err := c.updateAPIVersion(); err != nil {
-		slog.Error("error updating API version", "error", err)
-	}
-
 	return nil
 }
 
 // Runs up all the workers and mediates data flowing between them.
 // Currently all sqlite writes happen via this function. This may move
-// off to a separate goroutine in the future.
-func (c *Coles) Run(cancel chan struct{}) {
+// off to a separate goroutine in the future. It returns once the context
+// is done and every worker has finished what it was doing.
+//
+// Nothing is requested from Coles before Run, so the setters all apply
+// from the first request.
+func (c *Coles) Run(ctx context.Context) {
+	if err := c.updateAPIVersion(ctx); err != nil {
+		slog.Error("error updating API version", "error", err)
+	}
+
 	departmentPageChannel := make(chan departmentPage)
 
-	go c.productListPageWorker(departmentPageChannel)
-	go c.newDepartmentInfoWorker()
-	go c.departmentPageUpdateQueueWorker(departmentPageChannel, c.productMaxAge)
+	var wg sync.WaitGroup
+	defer c.client.Client.CloseIdleConnections()
+	defer wg.Wait()
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		c.productListPageWorker(ctx, departmentPageChannel)
+	}()
+	go func() {
+		defer wg.Done()
+		c.newDepartmentInfoWorker(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		c.departmentPageUpdateQueueWorker(ctx, departmentPageChannel, c.productMaxAge)
+	}()
 
-	for range cancel {
-		return
-	}
+	<-ctx.Done()
+	slog.Info("Exiting scheduler", "store", "Coles")
+}
+
+// ScrapeTrapped returns whether Coles served a scrape trap in place of the last page fetched.
+// Scraping is paused while it cools off, then resumes until a page comes through.
+func (c *Coles) ScrapeTrapped() bool {
+	return c.breaker.tripped()
 }
 
 // GetSharedProductsUpdatedAfter provides a list of product IDs that have been updated since the given time
 func (c *Coles) GetSharedProductsUpdatedAfter(t time.Time, count int) ([]shared.ProductInfo, error) {
-	var productIDs []shared.ProductInfo
-	var deptDescription sql.NullString
-	rows, err := c.db.Query(`
-		SELECT
-			productID,
-			products.name,
-			products.description,
-			departments.description,
-			priceCents,
-			previousPriceCents,
-			weightGrams,
-			products.updated
-		FROM
-			products
-			LEFT JOIN departments ON products.departmentID = departments.departmentID
-		WHERE products.updated > ? AND name != '' LIMIT ?`, t, count)
-	if err != nil {
-		return productIDs, fmt.Errorf("failed to query productIDs: %w", err)
-	}
-	for rows.Next() {
-		var product shared.ProductInfo
-		err = rows.Scan(
-			&product.ID,
-			&product.Name,
-			&product.Description,
-			&deptDescription,
-			&product.PriceCents,
-			&product.PreviousPriceCents,
-			&product.WeightGrams,
-			&product.Timestamp)
-		if err != nil {
-			return productIDs, fmt.Errorf("failed to scan productID: %w", err)
-		}
-		if deptDescription.Valid {
-			product.Department = deptDescription.String
-		}
-		product.ID = COLES_ID_PREFIX + product.ID
-		product.Store = "Coles"
-		productIDs = append(productIDs, product)
-	}
-	return productIDs, nil
+	return c.db.GetSharedProductsUpdatedAfter(t, count)
+}
+
+// GetSharedProductsAfterCursor provides up to count products that sort after the given cursor.
+func (c *Coles) GetSharedProductsAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ProductInfo, shared.ExportCursor, error) {
+	return c.db.GetSharedProductsAfterCursor(cursor, count)
+}
+
+// GetShrinkflationAfterCursor provides up to count shrinkflation events that sort after the
+// given cursor.
+func (c *Coles) GetShrinkflationAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ShrinkflationEvent, shared.ExportCursor, error) {
+	return c.db.GetShrinkflationAfterCursor(cursor, count)
 }
 
 // GetTotalProductCount returns the total number of products in the database.
 func (c *Coles) GetTotalProductCount() (int, error) {
-	var count int
-	err := c.db.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
-	if err != nil {
-		return 0, fmt.Errorf("failed to query product count: %w", err)
-	}
-	return count, nil
+	return c.db.GetTotalProductCount()
+}
+
+// LoadExportCursor loads the named export cursor from the database.
+func (c *Coles) LoadExportCursor(name string) (shared.ExportCursor, error) {
+	return c.db.LoadExportCursor(name)
+}
+
+// SaveExportCursor saves the named export cursor to the database.
+func (c *Coles) SaveExportCursor(name string, cursor shared.ExportCursor) error {
+	return c.db.SaveExportCursor(name, cursor)
+}
+
+// GetPriceHistory returns every recorded price change for the product, oldest first. The
+// ID may be given with or without the Coles prefix.
+func (c *Coles) GetPriceHistory(id string) ([]shared.PriceHistoryEntry, error) {
+	return c.db.GetPriceHistory(id)
 }
@@ -4,122 +4,36 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
-	"os"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/migrate"
 	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+	"github.com/tjhowse/aus_grocery_price_database/internal/unitprice"
 )
 
-const DB_SCHEMA_VERSION = 1
+// retailer plugs Coles into the shared store. Coles DBs were at schema version 1 when
+// migrations were introduced.
+var retailer = store.Retailer{Name: "Coles", IDPrefix: COLES_ID_PREFIX, SchemaBaseline: 1}
 
-// Initialises the DB with the schema. Note you must bump the DB_SCHEMA_VERSION
-// constant if you change the schema.
-func (w *Coles) initBlankDB() error {
+var DB_SCHEMA_VERSION = retailer.SchemaVersion()
 
-	// Drop all tables
-	for _, table := range []string{"schema", "departments", "products"} {
-		// Mildly confused by why this doesn't work? TODO investigate
-		// _, err := w.db.Exec("DROP TABLE IF EXISTS ?", table)
-		_, err := w.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
-		if err != nil {
-			return err
-		}
-	}
-
-	_, err := w.db.Exec("CREATE TABLE IF NOT EXISTS schema (version INTEGER PRIMARY KEY)")
-	if err != nil {
-		return err
-	}
-	_, err = w.db.Exec("INSERT INTO schema (version) VALUES (?)", DB_SCHEMA_VERSION)
-	if err != nil {
-		return err
-	}
-	_, err = w.db.Exec("CREATE TABLE IF NOT EXISTS departments (departmentID TEXT UNIQUE, description TEXT, productCount INTEGER, updated DATETIME)")
-	if err != nil {
-		return err
-	}
-	_, err =
-		w.db.Exec(`	CREATE TABLE IF NOT EXISTS products
-						(	productID TEXT UNIQUE,
-							name TEXT,
-							description TEXT,
-							barcode TEXT,
-							priceCents INTEGER,
-							previousPriceCents INTEGER,
-							weightGrams INTEGER,
-							productJSON TEXT,
-							departmentID TEXT DEFAULT "",
-							updated DATETIME
-						)`)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// backupDB moves the specified DB to the same directory with an ISO8601 timestamp and the schema
-// number prepended to the filename.
-func (w *Coles) backupDB(dbPath string, oldSchema int) error {
-	backupName := fmt.Sprintf("%s.%d.%s", dbPath, oldSchema, time.Now().Format("2006-01-02T15:04:05"))
-	err := os.Rename(dbPath, backupName)
-	if err != nil {
-		return fmt.Errorf("failed to backup existing DB: %w", err)
-	}
-	slog.Info("Backed up old DB", "old", dbPath, "new", backupName)
-	return nil
-}
-
-func openDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?cache=shared")
-	if err != nil {
-		return nil, err
-	}
-	db.SetMaxOpenConns(1)
-	return db, nil
-}
-
-// initDB initialises the database.
+// initDB opens the DB and migrates it to the current schema.
 func (c *Coles) initDB(dbPath string) error {
 	var err error
-	c.db, err = openDB(dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to open DB: %w", err)
-	}
-	var version int
-	err = c.db.QueryRow("SELECT version FROM schema").Scan(&version)
-
-	if err != nil || version != DB_SCHEMA_VERSION {
-		slog.Warn("DB schema mismatch", "path", dbPath, "currentVersion", DB_SCHEMA_VERSION, "detectedVersion", version)
-
-		if version != 0 {
-			// If we detected an old schema, backup the DB and create a new one.
-			err = c.db.Close()
-			if err != nil {
-				return fmt.Errorf("failed to close existing DB before backing it up: %w", err)
-			}
-			err = c.backupDB(dbPath, version)
-			if err != nil {
-				return fmt.Errorf("failed to backup existing DB: %w", err)
-			}
+	c.db, err = store.Open(dbPath, retailer)
+	return err
+}
 
-			// Open a new DB
-			c.db, err = openDB(dbPath)
-			if err != nil {
-				return fmt.Errorf("failed to open DB: %w", err)
-			}
-		}
+// DryRunMigrations reports the migrations the DB at dbPath needs without applying them.
+func DryRunMigrations(dbPath string) ([]migrate.Migration, error) {
+	return store.DryRunMigrations(dbPath, retailer)
+}
 
-		// Create the schema
-		err := c.initBlankDB()
-		if err != nil {
-			return fmt.Errorf("failed to create blank DB: %w", err)
-		} else {
-			slog.Info("New blank DB created")
-		}
-	}
-	return nil
+// DB returns the local product DB, for read-only queries.
+func (c *Coles) DB() *store.DB {
+	return c.db
 }
 
 // saveProductInfo saves the product info to the database transactionfully.
@@ -140,147 +54,147 @@ func (c *Coles) saveProductInfoes(products []colesProductInfo) error {
 	return nil
 }
 
+// calcWeightInGrams works out the weight of the product from its unit quantity. Products
+// measured by volume or by count have no weight.
 func calcWeightInGrams(productInfo colesProductInfo) (int, error) {
-	scalar := 0.0
-	switch productInfo.Info.Pricing.Unit.OfMeasureUnits {
-	case "g":
-		scalar = 1.0
-	case "kg":
-		scalar = 1000.0
-	case "ml":
-		scalar = 1.0
-	case "l":
-		scalar = 1000.0
-	default:
-		return 0, fmt.Errorf("cannot convert unit `%s` to grams", productInfo.Info.Pricing.Unit.OfMeasureUnits)
+	quantity, err := unitprice.FromParts(productInfo.Info.Pricing.Unit.Quantity, productInfo.Info.Pricing.Unit.OfMeasureUnits)
+	if err != nil {
+		return 0, fmt.Errorf("cannot convert unit `%s` to grams: %w", productInfo.Info.Pricing.Unit.OfMeasureUnits, err)
+	}
+	return quantity.Grams()
+}
+
+// toStoreProduct converts a product to the shared store's representation.
+func (p colesProductInfo) toStoreProduct() store.Product {
+	return store.Product{
+		ID:           string(p.ID),
+		Location:     p.location,
+		Name:         p.Info.Name,
+		Description:  p.Info.Description,
+		Brand:        p.Info.Brand,
+		PriceCents:   int(p.Info.Pricing.Now.Mul(decimal.NewFromInt(100)).IntPart()),
+		Promotion:    p.promotion(),
+		UnitPrice:    p.unitPrice(),
+		WeightGrams:  p.WeightGrams,
+		RawJSON:      p.RawJSON,
+		DepartmentID: p.departmentID,
+		Updated:      p.Updated,
+	}
+}
+
+// unitPrice normalises the product's comparable price, like "$4.50 per 1kg". For products
+// sold by weight the unit's OfMeasureUnits is the unit of the product's weight rather than of
+// its unit price, so the unit is only used if there's no comparable price.
+func (p colesProductInfo) unitPrice() shared.UnitPrice {
+	priceCents, quantity, err := unitprice.ParseRate(p.Info.Pricing.Comparable)
+	if err != nil && !p.Info.Pricing.Unit.IsWeighted {
+		unit := p.Info.Pricing.Unit
+		priceCents, _ = unit.Price.Mul(decimal.NewFromInt(100)).Float64()
+		quantity, err = unitprice.FromParts(unit.OfMeasureQuantity, unit.OfMeasureUnits)
 	}
-	return int(float64(productInfo.Info.Pricing.Unit.Quantity) * scalar), nil
+	if err != nil {
+		slog.Debug("Couldn't work out unit price", "productID", p.ID, "error", err)
+		return shared.UnitPrice{}
+	}
+	unitPrice, err := unitprice.Of(priceCents, quantity)
+	if err != nil {
+		slog.Debug("Couldn't work out unit price", "productID", p.ID, "error", err)
+		return shared.UnitPrice{}
+	}
+	return unitPrice
+}
+
+// promotion collects the product's offers into the shared promotion model. Coles has no
+// member-only prices.
+func (p colesProductInfo) promotion() shared.Promotion {
+	var promotion shared.Promotion
+	pricing := p.Info.Pricing
+	if multibuy := pricing.MultiBuyPromotion; multibuy != nil && multibuy.MinQuantity > 0 {
+		promotion.Type = shared.PROMOTION_MULTIBUY
+		promotion.MultibuyQuantity = multibuy.MinQuantity
+		promotion.MultibuyPriceCents = int(multibuy.Reward.Mul(decimal.NewFromInt(int64(100 * multibuy.MinQuantity))).IntPart())
+	}
+	if pricing.Was.GreaterThan(pricing.Now) {
+		promotion.Type = shared.PROMOTION_SPECIAL
+		promotion.WasPriceCents = int(pricing.Was.Mul(decimal.NewFromInt(100)).IntPart())
+	} else if promotion.Type == shared.PROMOTION_NONE && (pricing.PromotionType != "" || pricing.OnlineSpecial) {
+		// Some specials don't advertise a was-price.
+		promotion.Type = shared.PROMOTION_SPECIAL
+	}
+	return promotion
 }
 
 // saveProductInfo saves a single product to the database transactionfully.
 func (c *Coles) saveProductInfo(tx *sql.Tx, productInfo colesProductInfo) error {
 	var err error
-	var result sql.Result
-
 	productInfo.WeightGrams, err = calcWeightInGrams(productInfo)
 	if err != nil {
 		slog.Debug("Couldn't calculate weight in grams", "productID", productInfo.ID, "error", err)
 		productInfo.WeightGrams = 0
 	}
-
-	result, err = tx.Exec(`
-			INSERT INTO products (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
-			VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?)
-			ON CONFLICT(productID) DO UPDATE SET
-				productID = excluded.productID,
-				name = excluded.name,
-				description = excluded.description,
-				barcode = excluded.barcode,
-				priceCents = excluded.priceCents,
-				previousPriceCents = priceCents,
-				weightGrams = excluded.weightGrams,
-				productJSON = excluded.productJSON,
-				departmentID = excluded.departmentID,
-				updated = excluded.updated`,
-		productInfo.ID, productInfo.Info.Name, productInfo.Info.Description, 0,
-		productInfo.Info.Pricing.Now.Mul(decimal.NewFromInt(100)).IntPart(),
-		productInfo.WeightGrams, productInfo.RawJSON, productInfo.departmentID, productInfo.Updated)
-
-	if err != nil {
-		return fmt.Errorf("failed to update product info: %w", err)
-	}
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	} else if rowsAffected == 0 {
-		slog.Warn("Product info not updated.")
-	}
-
-	return nil
+	return c.db.SaveProduct(tx, productInfo.toStoreProduct())
 }
 
-// loadProductInfo loads cached extended product info from the database
-func (w *Coles) loadProductInfo(productID productID) (colesProductInfo, error) {
+// loadProductInfo loads cached extended product info at the default location from the
+// database. Prices are loaded in cents.
+func (c *Coles) loadProductInfo(productID productID) (colesProductInfo, error) {
 	var cProdInfo colesProductInfo
-	var deptDescription sql.NullString
-	row := w.db.QueryRow(`
-	SELECT
-		productID,
-		name,
-		products.description,
-		priceCents,
-		previousPriceCents,
-		weightGrams,
-		productJSON,
-		products.departmentID,
-		departments.description,
-		products.updated
-	FROM
-		products
-		LEFT JOIN departments ON products.departmentID = departments.departmentID
-	WHERE productID = ? LIMIT 1`, productID)
-	err := row.Scan(
-		&cProdInfo.ID,
-		&cProdInfo.Info.Name,
-		&cProdInfo.Info.Description,
-		&cProdInfo.Info.Pricing.Now,
-		&cProdInfo.PreviousPrice,
-		&cProdInfo.WeightGrams,
-		&cProdInfo.RawJSON,
-		&cProdInfo.departmentID,
-		&deptDescription, // This value comes from a join, so it might be NULL.
-		&cProdInfo.Updated)
+	product, err := c.db.LoadProduct(string(productID), "")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return cProdInfo, shared.ErrProductMissing
-		}
-		return cProdInfo, fmt.Errorf("failed to query existing product info: %w", err)
-	}
-	if deptDescription.Valid {
-		cProdInfo.departmentDescription = deptDescription.String
-	}
+		return cProdInfo, err
+	}
+	cProdInfo.ID = productID
+	cProdInfo.Info.Name = product.Name
+	cProdInfo.Info.Description = product.Description
+	cProdInfo.Info.Pricing.Now = decimal.NewFromInt(int64(product.PriceCents))
+	cProdInfo.PreviousPrice = decimal.NewFromInt(int64(product.PreviousPriceCents))
+	cProdInfo.WeightGrams = product.WeightGrams
+	cProdInfo.RawJSON = product.RawJSON
+	cProdInfo.departmentID = product.DepartmentID
+	cProdInfo.departmentDescription = product.DepartmentName
+	cProdInfo.Updated = product.Updated
 	return cProdInfo, nil
 }
 
 // Saves product info to the database
 func (c *Coles) saveDepartment(departmentInfo departmentInfo) error {
-	var err error
-	var result sql.Result
-
-	result, err = c.db.Exec(`
-		INSERT INTO departments (departmentID, description, productCount, updated)
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT(departmentID) DO UPDATE SET
-			departmentID = excluded.departmentID,
-			description = excluded.description,
-			productCount = excluded.productCount,
-			updated = excluded.updated`,
-		departmentInfo.SeoToken, departmentInfo.Name, departmentInfo.ProductCount, departmentInfo.Updated)
+	return c.db.SaveDepartment(store.Department{
+		ID:           departmentInfo.SeoToken,
+		Description:  departmentInfo.Name,
+		ProductCount: departmentInfo.ProductCount,
+		Updated:      departmentInfo.Updated,
+	})
+}
 
+// markDepartmentStale sets the department's updated time to the past, so the next pass
+// fetches all of its pages again.
+func (c *Coles) markDepartmentStale(id string) error {
+	departmentInfos, err := c.loadDepartmentInfoList()
 	if err != nil {
-		return fmt.Errorf("failed to update department ID info: %w", err)
+		return err
 	}
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	} else if rowsAffected == 0 {
-		slog.Warn("Department not upserted")
+	for _, departmentInfo := range departmentInfos {
+		if departmentInfo.SeoToken == id {
+			departmentInfo.Updated = time.Now().Add(-2 * c.productMaxAge)
+			return c.saveDepartment(departmentInfo)
+		}
 	}
-
-	return nil
+	return fmt.Errorf("department %s not found", id)
 }
 
 func (c *Coles) loadDepartmentInfoList() ([]departmentInfo, error) {
 	var departmentInfos []departmentInfo
-	rows, err := c.db.Query("SELECT departmentID, description, productCount, updated FROM departments")
+	departments, err := c.db.LoadDepartments()
 	if err != nil {
-		return departmentInfos, fmt.Errorf("failed to query departmentIDs: %w", err)
-	}
-	for rows.Next() {
-		var deptInfo departmentInfo
-		err = rows.Scan(&deptInfo.SeoToken, &deptInfo.Name, &deptInfo.ProductCount, &deptInfo.Updated)
-		if err != nil {
-			return departmentInfos, fmt.Errorf("failed to scan departmentID: %w", err)
-		}
-		departmentInfos = append(departmentInfos, deptInfo)
+		return departmentInfos, err
+	}
+	for _, department := range departments {
+		departmentInfos = append(departmentInfos, departmentInfo{
+			SeoToken:     department.ID,
+			Name:         department.Description,
+			ProductCount: department.ProductCount,
+			Updated:      department.Updated,
+		})
 	}
 	return departmentInfos, nil
 }
@@ -1,16 +1,21 @@
 package coles
 
 import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
 )
 
 func TestCalcWeightInGrams(t *testing.T) {
 	c := getInitialisedColes()
-	dp := departmentPage{"fruit-vegetables", 1}
-	products, _, err := c.getProductsAndTotalCountForCategoryPage(dp)
+	dp := departmentPage{ID: "fruit-vegetables", page: 1}
+	products, _, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), dp)
 	if err != nil {
 		t.Fatalf("Failed to get products: %v", err)
 	}
@@ -38,8 +43,8 @@ func TestCalcWeightInGrams(t *testing.T) {
 
 func TestSaveProductInfo(t *testing.T) {
 	c := getInitialisedColes()
-	dp := departmentPage{"fruit-vegetables", 1}
-	products, _, err := c.getProductsAndTotalCountForCategoryPage(dp)
+	dp := departmentPage{ID: "fruit-vegetables", page: 1}
+	products, _, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), dp)
 	if err != nil {
 		t.Fatalf("Failed to get products: %v", err)
 	}
@@ -166,3 +171,228 @@ func TestGetSharedProductsUpdatedAfter(t *testing.T) {
 		}
 	}
 }
+
+// loadFixtureDB builds a DB at dbPath from a SQL dump of an old schema version.
+func loadFixtureDB(t *testing.T, dbPath, fixturePath string) {
+	fixture, err := os.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(fixture)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateFromFixture(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "coles.db3")
+	loadFixtureDB(t, dbPath, "data/schema_v1.sql")
+
+	pending, err := DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := DB_SCHEMA_VERSION-1, len(pending); want != got {
+		t.Fatalf("Expected %d pending migrations, got %d", want, got)
+	}
+
+	c := Coles{}
+	if err := c.Init(colesServer.URL, dbPath, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer c.db.Close()
+
+	matches, err := filepath.Glob(dbPath + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(matches); want != got {
+		t.Errorf("Expected no backup, found %v", matches)
+	}
+	var version int
+	if err := c.db.QueryRow("SELECT version FROM schema").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := DB_SCHEMA_VERSION, version; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// The cached products and departments survive the upgrade.
+	count, err := c.GetTotalProductCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, count; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	departments, err := c.loadDepartmentInfoList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(departments); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	products, err := c.GetSharedProductsUpdatedAfter(time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 350, products[1].PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// The new tables are usable.
+	cursor := shared.ExportCursor{Updated: time.Now().UTC().Truncate(time.Second), ProductID: "409499"}
+	if err := c.SaveExportCursor("influxdb", cursor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetPriceHistory(COLES_ID_PREFIX + "409499"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err = DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(pending); want != got {
+		t.Errorf("Expected %d pending migrations, got %d", want, got)
+	}
+}
+
+func TestGetSharedProductsAfterCursor(t *testing.T) {
+	c := getInitialisedColes()
+	updated := time.Now().Add(-1 * time.Minute)
+	// Two products share an updated time, so the cursor must break the tie on productID.
+	infoList := []colesProductInfo{
+		{ID: "123457", Info: productListPageProduct{Name: "3", Pricing: productListPageProductPricing{Now: decimal.NewFromFloat(3.3)}}, Updated: updated},
+		{ID: "123456", Info: productListPageProduct{Name: "2", Pricing: productListPageProductPricing{Now: decimal.NewFromFloat(2.4)}}, Updated: updated},
+		{ID: "123455", Info: productListPageProduct{Name: "1", Pricing: productListPageProductPricing{Now: decimal.NewFromFloat(1.5)}}, Updated: updated.Add(-1 * time.Minute)},
+	}
+	if err := c.saveProductInfoes(infoList); err != nil {
+		t.Fatal(err)
+	}
+
+	var cursor shared.ExportCursor
+	var ids []string
+	for {
+		products, next, err := c.GetSharedProductsAfterCursor(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(products) == 0 {
+			break
+		}
+		for _, product := range products {
+			ids = append(ids, product.ID)
+		}
+		cursor = next
+	}
+	if want, got := []string{COLES_ID_PREFIX + "123455", COLES_ID_PREFIX + "123456", COLES_ID_PREFIX + "123457"}, ids; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if err := c.SaveExportCursor("test", cursor); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := c.LoadExportCursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "123457", loaded.ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if !loaded.Updated.Equal(cursor.Updated) {
+		t.Errorf("Expected %v, got %v", cursor.Updated, loaded.Updated)
+	}
+}
+
+func TestPriceHistory(t *testing.T) {
+	c := getInitialisedColes()
+	start := time.Now().Add(-1 * time.Hour)
+	var infoList []colesProductInfo
+	for i, pricing := range []productListPageProductPricing{
+		{Now: decimal.NewFromFloat(4.5)},
+		// Nothing changed, so no new entry.
+		{Now: decimal.NewFromFloat(4.5)},
+		{Now: decimal.NewFromFloat(4.5), PromotionType: "SPECIAL"},
+		{Now: decimal.NewFromFloat(3.9), Was: decimal.NewFromFloat(4.5), PromotionType: "SPECIAL"},
+	} {
+		infoList = append(infoList, colesProductInfo{ID: "4438477", Info: productListPageProduct{Name: "Apples", Pricing: pricing}, Updated: start.Add(time.Duration(i) * time.Minute)})
+	}
+	if err := c.saveProductInfoes(infoList); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := c.GetPriceHistory(COLES_ID_PREFIX + "4438477")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(history); want != got {
+		t.Fatalf("Expected %d entries, got %d", want, got)
+	}
+	if want, got := []int{450, 450, 390}, []int{history[0].PriceCents, history[1].PriceCents, history[2].PriceCents}; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := []bool{false, true, true}, []bool{history[0].OnSpecial, history[1].OnSpecial, history[2].OnSpecial}; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 450, history[2].WasPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	c := getInitialisedColes()
+	products, _, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), departmentPage{ID: "fruit-vegetables", page: 1})
+	if err != nil {
+		t.Fatalf("Failed to get products: %v", err)
+	}
+	var spinach colesProductInfo
+	for _, product := range products {
+		if product.ID == "1499340" {
+			spinach = product
+		}
+	}
+	// "Pick any 2 for $5"
+	if want, got := (shared.Promotion{Type: shared.PROMOTION_MULTIBUY, MultibuyQuantity: 2, MultibuyPriceCents: 500}), spinach.promotion(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	for _, test := range []struct {
+		pricing productListPageProductPricing
+		want    shared.Promotion
+	}{
+		{productListPageProductPricing{Now: decimal.NewFromFloat(4.5)}, shared.Promotion{}},
+		{productListPageProductPricing{Now: decimal.NewFromFloat(3.9), Was: decimal.NewFromFloat(4.5), PromotionType: "SPECIAL"}, shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: 450}},
+		{productListPageProductPricing{Now: decimal.NewFromFloat(3.9), OnlineSpecial: true}, shared.Promotion{Type: shared.PROMOTION_SPECIAL}},
+	} {
+		product := colesProductInfo{Info: productListPageProduct{Pricing: test.pricing}}
+		if want, got := test.want, product.promotion(); want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestUnitPrice(t *testing.T) {
+	c := getInitialisedColes()
+	products, _, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), departmentPage{ID: "fruit-vegetables", page: 1})
+	if err != nil {
+		t.Fatalf("Failed to get products: %v", err)
+	}
+	for _, tc := range []struct {
+		index int
+		want  shared.UnitPrice
+	}{
+		{0, shared.UnitPrice{Cents: 60, Unit: shared.UNIT_PER_100G}},
+		// Sold by weight, so the unit is in grams but the comparable price is per kilogram.
+		{7, shared.UnitPrice{Cents: 45, Unit: shared.UNIT_PER_100G}},
+		{8, shared.UnitPrice{Cents: 250, Unit: shared.UNIT_EACH}},
+	} {
+		if want, got := tc.want, products[tc.index].unitPrice(); want != got {
+			t.Errorf("Expected %v, got %v for test item %s", want, got, products[tc.index].Info.Name)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package coles
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,7 +13,7 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/tjhowse/aus_grocery_price_database/internal/utils"
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
 )
 
 const DEFAULT_API_VERSION = "20240827.02_v4.7.7"
@@ -22,21 +23,55 @@ const BROWSE_HOMEPAGE_URL_FORMAT = "%s/browse"
 const CATEGORY_URL_FORMAT = "%s/_next/data/%s/en/browse/%s.json"
 const SCRAPE_TRAP_STRING = "Pardon Our Interruption"
 
+// COLES_STORE_COOKIE selects the fulfilment store Coles prices products at.
+const COLES_STORE_COOKIE = "fulfillmentStoreId"
+
 var ErrHitScrapeTrap = errors.New("caught in a scrape trap")
 
+// The reasons responses are quarantined.
+const QUARANTINE_SCRAPE_TRAP = "scrape_trap"
+const QUARANTINE_NO_API_VERSION = "no_api_version"
+
+// fetch sends the request once the circuit breaker allows it, and returns the body of the
+// response. Every response is checked for a scrape trap, whatever its status, and a page
+// that comes through closes the breaker. The client hands back traps served as failures
+// rather than retrying them, so they're caught here too.
+func (c *Coles) fetch(req *http.Request) ([]byte, error) {
+	if !c.breaker.wait(req.Context()) {
+		return nil, req.Context().Err()
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if isScrapeTrap(body) {
+		c.checkForScrapeTrap(body)
+		return body, ErrHitScrapeTrap
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: %s", req.URL.Path, resp.Status)
+	}
+	c.checkForScrapeTrap(body)
+	return body, nil
+}
+
 // updateAPIVersion grabs the coles home page and extracts the API version from it.
-func (c *Coles) updateAPIVersion() error {
+func (c *Coles) updateAPIVersion(ctx context.Context) error {
 	// Get the browse homepage
-	body, err := c.getBrowseHomepage()
+	body, err := c.getBrowseHomepage(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get homepage: %w", err)
 	}
 
 	// Extract and update the API version
 	if newAPI, err := extractAPIVersion(body); err != nil {
-
-		if err := utils.WriteEntireFile("failed_coles_homepage.html", body); err != nil {
-			slog.Error("Failed to write failed homepage to file", "error", err)
+		if err := c.quarantine.save(QUARANTINE_NO_API_VERSION, body, time.Now()); err != nil {
+			slog.Error("Failed to quarantine homepage", "error", err)
 		}
 		return fmt.Errorf("failed to extract API version: %w", err)
 	} else if newAPI != c.colesAPIVersion {
@@ -47,36 +82,17 @@ func (c *Coles) updateAPIVersion() error {
 }
 
 // getBrowseHomepage returns the bytes of the Coles browse homepage.
-func (c *Coles) getBrowseHomepage() ([]byte, error) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
+func (c *Coles) getBrowseHomepage(ctx context.Context) ([]byte, error) {
 	url := fmt.Sprintf(BROWSE_HOMEPAGE_URL_FORMAT, c.baseURL)
-	var body []byte
-
-	if req, err = http.NewRequest("GET", url, nil); err != nil {
-		return body, err
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:129.0) Gecko/20100101 Firefox/129.0")
 	req.Header.Set("Accept", "text/html")
 
-	resp, err = c.client.Do(req)
-	if err != nil {
-		return body, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("failed to get category data: %s", resp.Status)
-	}
-	body, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return body, err
-	}
-	if checkForScrapeTrap(body) {
-		return body, ErrHitScrapeTrap
-	}
-	return body, nil
+	return c.fetch(req)
 }
 
 // extractAPIVersion extracts the API version from the given HTML.
@@ -93,45 +109,26 @@ func extractAPIVersion(body []byte) (string, error) {
 }
 
 // getBrowseJSON returns the bytes of the Coles browse JSON.
-func (c *Coles) getBrowseJSON() ([]byte, error) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
+func (c *Coles) getBrowseJSON(ctx context.Context) ([]byte, error) {
 	url := fmt.Sprintf(BROWSE_JSON_URL_FORMAT, c.baseURL, c.colesAPIVersion)
-	var body []byte
-
-	if req, err = http.NewRequest("GET", url, nil); err != nil {
-		return body, err
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:129.0) Gecko/20100101 Firefox/129.0")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err = c.client.Do(req)
-	if err != nil {
-		return body, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("failed to get category data: %s", resp.Status)
-	}
-	body, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return body, err
-	}
-	return body, nil
+	return c.fetch(req)
 }
 
-// getCategoryJSON returns the bytes of the Coles category JSON.
-func (c *Coles) getCategoryJSON(category string, page int) ([]byte, error) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
+// getCategoryJSON returns the bytes of the Coles category JSON, priced at the given fulfilment
+// store. A blank location uses Coles' default store.
+func (c *Coles) getCategoryJSON(ctx context.Context, category string, page int, location string) ([]byte, error) {
 	url := fmt.Sprintf(CATEGORY_URL_FORMAT, c.baseURL, c.colesAPIVersion, category)
-	var body []byte
-
-	if req, err = http.NewRequest("GET", url, nil); err != nil {
-		return body, err
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 	q := req.URL.Query()
 	q.Add("slug", category)
@@ -140,37 +137,47 @@ func (c *Coles) getCategoryJSON(category string, page int) ([]byte, error) {
 
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:129.0) Gecko/20100101 Firefox/129.0")
 	req.Header.Set("Accept", "application/json")
-
-	resp, err = c.client.Do(req)
-	if err != nil {
-		return body, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("failed to get category data: %s", resp.Status)
-	}
-	body, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return body, err
+	if location != "" {
+		req.AddCookie(&http.Cookie{Name: COLES_STORE_COOKIE, Value: location})
 	}
-	return body, nil
+
+	return c.fetch(req)
 }
 
-// checkForScrapeTrap checks the given body for a scrape trap.
-func checkForScrapeTrap(body []byte) bool {
+func isScrapeTrap(body []byte) bool {
 	return bytes.Contains(body, []byte(SCRAPE_TRAP_STRING))
 }
 
+// checkForScrapeTrap checks the given body for a scrape trap, and records whether it was one.
+// A trap trips the circuit breaker, slows down the requests that follow and is quarantined.
+// Anything else resets the breaker.
+func (c *Coles) checkForScrapeTrap(body []byte) bool {
+	if !isScrapeTrap(body) {
+		c.breaker.reset()
+		return false
+	}
+	metrics.ScrapeTrapHits.WithLabelValues(retailer.Name).Inc()
+	c.client.SlowDown()
+	now := time.Now()
+	c.breaker.trip(now)
+	if err := c.quarantine.save(QUARANTINE_SCRAPE_TRAP, body, now); err != nil {
+		slog.Error("Failed to quarantine scrape trap", "error", err)
+	}
+	return true
+}
+
 // getCategoryContents fetches a category page from the Coles API and unmarshals it.
-func (c *Coles) getCategoryContents(category string, page int) (categoryPage, error) {
-	body, err := c.getCategoryJSON(category, page)
+func (c *Coles) getCategoryContents(ctx context.Context, category string, page int, location string) (categoryPage, error) {
+	body, err := c.getCategoryJSON(ctx, category, page, location)
 	if err != nil {
 		return categoryPage{}, err
 	}
 	// Unmarshal into a categoryPage
+	metrics.PagesFetched.WithLabelValues(retailer.Name).Inc()
 	var catPage categoryPage
 	err = json.Unmarshal(body, &catPage)
 	if err != nil {
+		metrics.ParseFailures.WithLabelValues(retailer.Name).Inc()
 		return categoryPage{}, fmt.Errorf("failed to unmarshal category page: %w", err)
 	}
 	return catPage, nil
@@ -178,8 +185,8 @@ func (c *Coles) getCategoryContents(category string, page int) (categoryPage, er
 
 // getProductsAndTotalCountForCategoryPage fetches the specified page of the specified category
 // and returns the products and the total count of products in the category.
-func (c *Coles) getProductsAndTotalCountForCategoryPage(dp departmentPage) ([]colesProductInfo, int, error) {
-	catPage, err := c.getCategoryContents(dp.ID, dp.page)
+func (c *Coles) getProductsAndTotalCountForCategoryPage(ctx context.Context, dp departmentPage) ([]colesProductInfo, int, error) {
+	catPage, err := c.getCategoryContents(ctx, dp.ID, dp.page, dp.location)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -194,6 +201,7 @@ func (c *Coles) getProductsAndTotalCountForCategoryPage(dp departmentPage) ([]co
 				slog.Warn("Failed to marshal product info for storage", "error", err)
 			}
 			product.departmentID = dp.ID
+			product.location = dp.location
 			product.ID = productID(strconv.Itoa(result.ID))
 			product.Updated = time.Now()
 			products = append(products, product)
@@ -202,14 +210,15 @@ func (c *Coles) getProductsAndTotalCountForCategoryPage(dp departmentPage) ([]co
 	return products, catPage.PageProps.SearchResults.NoOfResults, nil
 }
 
-func (c *Coles) getDepartmentInfos() ([]departmentInfo, error) {
-	body, err := c.getBrowseJSON()
+func (c *Coles) getDepartmentInfos(ctx context.Context) ([]departmentInfo, error) {
+	body, err := c.getBrowseJSON(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var browseJSON browsePage
 	err = json.Unmarshal(body, &browseJSON)
 	if err != nil {
+		metrics.ParseFailures.WithLabelValues(retailer.Name).Inc()
 		return nil, fmt.Errorf("failed to unmarshal browse JSON: %w", err)
 	}
 	return browseJSON.PageProps.AllProductCategories.CatalogGroupView, nil
@@ -1,15 +1,19 @@
 package coles
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
 	"github.com/tjhowse/aus_grocery_price_database/internal/utils"
 )
 
@@ -26,6 +30,11 @@ func getInitialisedColes() Coles {
 
 // This mocks enough of the Woolworths API to test various stuff
 func ColesHTTPServer() *httptest.Server {
+	return httptest.NewServer(colesHandler())
+}
+
+// colesHandler serves the test data as Coles would.
+func colesHandler() http.HandlerFunc {
 	var err error
 
 	filesToLoad := []string{
@@ -41,7 +50,7 @@ func ColesHTTPServer() *httptest.Server {
 			slog.Error(fmt.Sprintf("Failed to read file %s: %v\n", filename, err))
 		}
 	}
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		var responseFilename string
 
 		categoryPrefix := fmt.Sprintf("/_next/data/%s/en/browse/", DEFAULT_API_VERSION)
@@ -82,12 +91,12 @@ func ColesHTTPServer() *httptest.Server {
 			w.WriteHeader(http.StatusOK)
 			w.Write(responseData)
 		}
-	}))
+	}
 }
 
 func TestGetHomepage(t *testing.T) {
 	c := getInitialisedColes()
-	body, err := c.getBrowseHomepage()
+	body, err := c.getBrowseHomepage(t.Context())
 	if err != nil {
 		t.Errorf("Failed to get homepage: %v", err)
 	}
@@ -129,16 +138,121 @@ func TestCheckForScrapeTrap(t *testing.T) {
 	if body == nil || err != nil {
 		t.Errorf("Failed to read file")
 	}
-	if !checkForScrapeTrap(body) {
+	c := getInitialisedColes()
+	if !c.checkForScrapeTrap(body) {
 		t.Errorf("Failed to detect scrape trap")
 	}
+	if !c.ScrapeTrapped() {
+		t.Errorf("Expected the scrape trap to be recorded")
+	}
+	// A real page clears it.
+	if c.checkForScrapeTrap([]byte("{}")) {
+		t.Errorf("Detected a scrape trap that isn't there")
+	}
+	if c.ScrapeTrapped() {
+		t.Errorf("Expected the scrape trap to be cleared")
+	}
+}
+
+func TestScrapeTrapCircuitBreaker(t *testing.T) {
+	trap, err := utils.ReadEntireFile("data/scrape_trap.html.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trapping atomic.Bool
+	trapping.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trapping.Load() {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(trap)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	c := getInitialisedColes()
+	c.baseURL = server.URL
+	c.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	c.SetScrapeTrapCoolOff(10*time.Millisecond, time.Second)
+	dir := t.TempDir()
+	c.SetQuarantine(dir, 10)
+
+	// Traps are caught whatever the status they're served with.
+	if _, err := c.getBrowseJSON(t.Context()); !errors.Is(err, ErrHitScrapeTrap) {
+		t.Errorf("Expected %v, got %v", ErrHitScrapeTrap, err)
+	}
+	if !c.ScrapeTrapped() {
+		t.Errorf("Expected the scrape trap to be recorded")
+	}
+	if time.Until(c.breaker.until()) <= 0 {
+		t.Errorf("Expected scraping to be paused")
+	}
+
+	// Requests wait for the cool-off, then a page that comes through resumes scraping.
+	trapping.Store(false)
+	if _, err := c.getBrowseJSON(t.Context()); err != nil {
+		t.Errorf("Failed to get browse JSON: %v", err)
+	}
+	if c.ScrapeTrapped() {
+		t.Errorf("Expected the scrape trap to be cleared")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(entries); want != got {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	if name := entries[0].Name(); !strings.HasPrefix(name, QUARANTINE_PREFIX) || !strings.HasSuffix(name, "_"+QUARANTINE_SCRAPE_TRAP+QUARANTINE_SUFFIX) {
+		t.Errorf("Expected a quarantined scrape trap, got %v", entries[0].Name())
+	}
+}
+
+func TestScrapeTrapNotRetried(t *testing.T) {
+	trap, err := utils.ReadEntireFile("data/scrape_trap.html.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(trap)
+	}))
+	defer server.Close()
+
+	c := getInitialisedColes()
+	c.baseURL = server.URL
+	c.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1, MaxRetries: 3})
+	dir := t.TempDir()
+	c.SetQuarantine(dir, 10)
+
+	// A trap served as a 503 is caught rather than retried.
+	if _, err := c.getBrowseJSON(t.Context()); !errors.Is(err, ErrHitScrapeTrap) {
+		t.Errorf("Expected %v, got %v", ErrHitScrapeTrap, err)
+	}
+	if want, got := int32(1), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if !c.ScrapeTrapped() {
+		t.Errorf("Expected the scrape trap to be recorded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(entries); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
 }
 
 func TestUpdateAPIVersion(t *testing.T) {
 	c := getInitialisedColes()
 	// Set a deliberately old version
 	c.colesAPIVersion = "20240809.03_v4.7.3"
-	err := c.updateAPIVersion()
+	err := c.updateAPIVersion(t.Context())
 	if err != nil {
 		t.Errorf("Failed to update API version: %v", err)
 	}
@@ -154,7 +268,7 @@ func TestGetCategoryJSON(t *testing.T) {
 	// if err := c.updateAPIVersion(); err != nil {
 	// 	t.Fatalf("Failed to update API version: %v", err)
 	// }
-	body, err := c.getCategoryJSON("fruit-vegetables", 1)
+	body, err := c.getCategoryJSON(t.Context(), "fruit-vegetables", 1, "")
 	if err != nil {
 		t.Fatalf("Failed to get category JSON: %v", err)
 	}
@@ -168,8 +282,8 @@ func TestGetProductsAndTotalCountForCategoryPage(t *testing.T) {
 	c := getInitialisedColes()
 
 	{
-		dp := departmentPage{"fruit-vegetables", 1}
-		products, totalRecordCount, err := c.getProductsAndTotalCountForCategoryPage(dp)
+		dp := departmentPage{ID: "fruit-vegetables", page: 1}
+		products, totalRecordCount, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), dp)
 		if err != nil {
 			t.Fatalf("Failed to get products: %v", err)
 		}
@@ -188,8 +302,8 @@ func TestGetProductsAndTotalCountForCategoryPage(t *testing.T) {
 
 	}
 	{
-		dp := departmentPage{"fruit-vegetables", 2}
-		products, totalRecordCount, err := c.getProductsAndTotalCountForCategoryPage(dp)
+		dp := departmentPage{ID: "fruit-vegetables", page: 2}
+		products, totalRecordCount, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), dp)
 		if err != nil {
 			t.Fatalf("Failed to get products: %v", err)
 		}
@@ -214,7 +328,7 @@ func TestGetDepartmentInfos(t *testing.T) {
 	c := getInitialisedColes()
 	// c.updateAPIVersion()
 
-	departments, err := c.getDepartmentInfos()
+	departments, err := c.getDepartmentInfos(t.Context())
 	if err != nil {
 		t.Fatalf("Failed to get department list: %v", err)
 	}
@@ -238,3 +352,35 @@ func TestGetDepartmentInfos(t *testing.T) {
 		}
 	}
 }
+
+func TestGetCategoryJSONAtLocation(t *testing.T) {
+	var gotStore string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(COLES_STORE_COOKIE); err == nil {
+			gotStore = cookie.Value
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	c := getInitialisedColes()
+	c.baseURL = server.URL
+
+	products, _, err := c.getProductsAndTotalCountForCategoryPage(t.Context(), departmentPage{ID: "fruit-vegetables", page: 1, location: "0584"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "0584", gotStore; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 0, len(products); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	gotStore = ""
+	if _, err := c.getCategoryJSON(t.Context(), "fruit-vegetables", 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "", gotStore; want != got {
+		t.Errorf("Expected no store cookie, got %s", got)
+	}
+}
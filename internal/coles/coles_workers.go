@@ -1,15 +1,23 @@
 package coles
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
 )
 
 const PRODUCTS_PER_PAGE = 48
 
+// MAX_TRAPPED_PAGE_RETRIES is how many times a product list page that came back as a scrape
+// trap is fetched again before it's dropped.
+const MAX_TRAPPED_PAGE_RETRIES = 5
+
 func departmentInSlice(a departmentInfo, list []departmentInfo) *departmentInfo {
 	for _, b := range list {
 		if a.SeoToken == b.SeoToken {
@@ -20,11 +28,12 @@ func departmentInSlice(a departmentInfo, list []departmentInfo) *departmentInfo
 }
 
 // newDepartmentInfoWorker is a worker that monitors for new departments and writes them to the DB.
-func (c *Coles) newDepartmentInfoWorker() {
+// It returns once the context is done.
+func (c *Coles) newDepartmentInfoWorker(ctx context.Context) {
 	for {
 
 		// Read the department list from the web...
-		departmentsFromWeb, err := c.getDepartmentInfos()
+		departmentsFromWeb, err := c.getDepartmentInfos(ctx)
 		if err != nil {
 			slog.Error(fmt.Sprintf("Error getting department IDs from web: %v", err))
 		}
@@ -59,25 +68,41 @@ func (c *Coles) newDepartmentInfoWorker() {
 		}
 
 		// We don't need to check for departments very often.
-		time.Sleep(1 * time.Hour)
+		if !shared.Sleep(ctx, 1*time.Hour) {
+			return
+		}
 
 		// Update this every so often.
-		if err := c.updateAPIVersion(); err != nil {
+		if err := c.updateAPIVersion(ctx); err != nil {
 			slog.Error("error updating API version", "error", err)
 		}
 
 	}
 }
 
-// departmentPageUpdateQueueWorker generates a stream of departmentPage structs that are due for an update
-func (c *Coles) departmentPageUpdateQueueWorker(output chan<- departmentPage, maxAge time.Duration) {
+// departmentPageUpdateQueueWorker generates a stream of departmentPage structs that are due for an update.
+// It returns once the context is done.
+func (c *Coles) departmentPageUpdateQueueWorker(ctx context.Context, output chan<- departmentPage, maxAge time.Duration) {
 	for {
 		departmentInfos, err := c.loadDepartmentInfoList()
 		if err != nil {
 			slog.Error("error loading department IDs. Trying again soon.", "error", err)
-			time.Sleep(1 * time.Minute)
+			if !shared.Sleep(ctx, 1*time.Minute) {
+				return
+			}
 			continue
 		}
+		queueDepth := metrics.QueueDepth.WithLabelValues(retailer.Name)
+		var pages int
+		for _, departmentInfo := range departmentInfos {
+			if c.filterDepartments && !c.filteredDepartmentIDsSet[departmentInfo.SeoToken] {
+				continue
+			}
+			if time.Since(departmentInfo.Updated) >= maxAge {
+				pages += (departmentInfo.ProductCount + PRODUCTS_PER_PAGE - 1) / PRODUCTS_PER_PAGE * len(c.locations)
+			}
+		}
+		queueDepth.Set(float64(pages))
 		for _, departmentInfo := range departmentInfos {
 			if c.filterDepartments {
 				_, ok := c.filteredDepartmentIDsSet[departmentInfo.SeoToken]
@@ -93,13 +118,21 @@ func (c *Coles) departmentPageUpdateQueueWorker(output chan<- departmentPage, ma
 			}
 			slog.Debug("Checking department", "ID", departmentInfo.SeoToken, "Updated", departmentInfo.Updated)
 
-			productCount := 0
-			for productCount < departmentInfo.ProductCount {
-				productCount += PRODUCTS_PER_PAGE
-				slog.Debug("Adding department page to queue", "SeoToken", departmentInfo.SeoToken, "page", productCount/PRODUCTS_PER_PAGE)
-				output <- departmentPage{
-					ID:   departmentInfo.SeoToken,
-					page: productCount / PRODUCTS_PER_PAGE,
+			for _, location := range c.locations {
+				productCount := 0
+				for productCount < departmentInfo.ProductCount {
+					productCount += PRODUCTS_PER_PAGE
+					slog.Debug("Adding department page to queue", "SeoToken", departmentInfo.SeoToken, "page", productCount/PRODUCTS_PER_PAGE, "location", location)
+					select {
+					case output <- departmentPage{
+						ID:       departmentInfo.SeoToken,
+						page:     productCount / PRODUCTS_PER_PAGE,
+						location: location,
+					}:
+						queueDepth.Dec()
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 			// Save this department back to the DB to refresh its updated time.
@@ -110,17 +143,48 @@ func (c *Coles) departmentPageUpdateQueueWorker(output chan<- departmentPage, ma
 			}
 			slog.Info("Updated department", "store", "Coles", "department", departmentInfo.SeoToken)
 		}
+		queueDepth.Set(0)
 		// We've done an update of all departments, so we don't need to check for new departments very often.
-		time.Sleep(c.listingPageUpdateInterval)
+		if !shared.Sleep(ctx, c.listingPageUpdateInterval) {
+			return
+		}
 	}
 }
 
 // productListPageWorker reads departmentPage structs from the input channel, fetches the product list page from the web,
-// and writes the updated product data to the DB, transactionfully.
-func (w *Coles) productListPageWorker(input <-chan departmentPage) {
-	for dp := range input {
+// and writes the updated product data to the DB, transactionfully. A page that comes back as a scrape trap is fetched
+// again once the circuit breaker's cool-off is over, up to MAX_TRAPPED_PAGE_RETRIES times. After that the page is
+// dropped and its department marked stale, so the next pass fetches it again. It returns once the context is done
+// or the input is closed.
+func (w *Coles) productListPageWorker(ctx context.Context, input <-chan departmentPage) {
+	for {
+		var dp departmentPage
+		var ok bool
+		select {
+		case dp, ok = <-input:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
 		slog.Debug("Getting product list page", "departmentID", dp.ID, "page", dp.page)
-		products, _, err := w.getProductsAndTotalCountForCategoryPage(dp)
+		products, _, err := w.getProductsAndTotalCountForCategoryPage(ctx, dp)
+		for retry := 0; errors.Is(err, ErrHitScrapeTrap) && retry < MAX_TRAPPED_PAGE_RETRIES; retry++ {
+			slog.Warn("Scrape trap instead of product list page, trying again", "departmentID", dp.ID, "page", dp.page, "location", dp.location)
+			products, _, err = w.getProductsAndTotalCountForCategoryPage(ctx, dp)
+		}
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrHitScrapeTrap) {
+			slog.Error("Dropping product list page after too many scrape traps", "departmentID", dp.ID, "page", dp.page, "location", dp.location)
+			metrics.PagesDropped.WithLabelValues(retailer.Name).Inc()
+			if err := w.markDepartmentStale(dp.ID); err != nil {
+				slog.Error("error marking department stale", "error", err)
+			}
+			continue
+		}
 		if err != nil {
 			slog.Error(fmt.Sprintf("Error getting product info extended: %v", err))
 			continue
@@ -143,7 +207,9 @@ func (w *Coles) productListPageWorker(input <-chan departmentPage) {
 				slog.Error(fmt.Sprintf("Error inserting product info: %v", err))
 				continue
 			}
+			metrics.ProductsUpserted.WithLabelValues(retailer.Name).Inc()
 		}
+		metrics.ProductsSkipped.WithLabelValues(retailer.Name, metrics.SKIPPED_ZERO_PRICE).Add(float64(skippedProductCount))
 		err = tx.Commit()
 		if err != nil {
 			slog.Error(fmt.Sprintf("Error committing transaction: %v", err))
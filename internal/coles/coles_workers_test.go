@@ -1,16 +1,22 @@
 package coles
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/leaktest"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/utils"
 )
 
 func TestNewDepartmentInfoWorker(t *testing.T) {
 	c := getInitialisedColes()
-	go c.newDepartmentInfoWorker()
+	go c.newDepartmentInfoWorker(t.Context())
 	// Wait for the worker to run
 	time.Sleep(3 * time.Second)
 
@@ -34,7 +40,7 @@ func TestDepartmentPageUpdateQueueWorker(t *testing.T) {
 	// We don't want to get pages from this department, updated an hour in the future.
 	c.saveDepartment(departmentInfo{SeoToken: "1-E5BEE36F", Name: "Vruit & Fegetables", ProductCount: PRODUCTS_PER_PAGE * 3, Updated: time.Now().Add(1 * time.Hour)})
 	c.listingPageUpdateInterval = 1 * time.Second
-	go c.departmentPageUpdateQueueWorker(departmentPageChannel, 1*time.Second)
+	go c.departmentPageUpdateQueueWorker(t.Context(), departmentPageChannel, 1*time.Second)
 
 	pageIndex := 1
 	for dp := range departmentPageChannel {
@@ -70,7 +76,7 @@ func TestProductListPageWorker(t *testing.T) {
 	c.saveDepartment(dept)
 
 	departmentPageChannel := make(chan departmentPage)
-	go c.productListPageWorker(departmentPageChannel)
+	go c.productListPageWorker(t.Context(), departmentPageChannel)
 
 	departmentPageChannel <- departmentPage{
 		ID:   "fruit-vegetables",
@@ -88,6 +94,104 @@ func TestProductListPageWorker(t *testing.T) {
 	}
 }
 
+func TestProductListPageWorkerRetriesTrap(t *testing.T) {
+	trap, err := utils.ReadEntireFile("data/scrape_trap.html.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trapped atomic.Bool
+	handler := colesHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first page is a trap.
+		if !trapped.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(trap)
+			return
+		}
+		handler(w, r)
+	}))
+	defer server.Close()
+
+	c := getInitialisedColes()
+	c.baseURL = server.URL
+	c.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	c.SetScrapeTrapCoolOff(10*time.Millisecond, time.Second)
+	c.saveDepartment(departmentInfo{SeoToken: "fruit-vegetables", Name: "Fruit & Vegetables", Updated: time.Now()})
+
+	departmentPageChannel := make(chan departmentPage)
+	go c.productListPageWorker(t.Context(), departmentPageChannel)
+	departmentPageChannel <- departmentPage{ID: "fruit-vegetables", page: 1}
+
+	// The trapped page is fetched again after the cool-off, rather than dropped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		readInfo, err := c.loadProductInfo(productID("2511791"))
+		if err == nil {
+			if want, got := "Bananas Mini Pack", readInfo.Info.Name; want != got {
+				t.Errorf("Expected %s, got %s", want, got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the trapped page: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.ScrapeTrapped() {
+		t.Errorf("Expected the scrape trap to be cleared")
+	}
+}
+
+func TestProductListPageWorkerDropsTrappedPage(t *testing.T) {
+	trap, err := utils.ReadEntireFile("data/scrape_trap.html.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every page is a trap.
+		requests.Add(1)
+		w.Write(trap)
+	}))
+	defer server.Close()
+
+	c := getInitialisedColes()
+	c.baseURL = server.URL
+	c.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	c.SetScrapeTrapCoolOff(time.Millisecond, 10*time.Millisecond)
+	updated := time.Now()
+	c.saveDepartment(departmentInfo{SeoToken: "fruit-vegetables", Name: "Fruit & Vegetables", Updated: updated})
+
+	departmentPageChannel := make(chan departmentPage)
+	go c.productListPageWorker(t.Context(), departmentPageChannel)
+	departmentPageChannel <- departmentPage{ID: "fruit-vegetables", page: 1}
+
+	// The page is given up on, and its department is left for the next pass.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		departmentInfos, err := c.loadDepartmentInfoList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(departmentInfos) == 1 && departmentInfos[0].Updated.Before(updated) {
+			if got := time.Since(departmentInfos[0].Updated); got < c.productMaxAge {
+				t.Errorf("Expected the department to be due for an update, updated %v ago", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the trapped page to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, got := int32(MAX_TRAPPED_PAGE_RETRIES+1), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if !c.ScrapeTrapped() {
+		t.Errorf("Expected Coles to still be trapped")
+	}
+}
+
 func ValidateProduct(t *testing.T, w *Coles, id productID, expectedName string) error {
 	prod, err := w.loadProductInfo(id)
 	if err != nil {
@@ -111,9 +215,14 @@ func TestScheduler(t *testing.T) {
 	c := Coles{}
 	c.Init(colesServer.URL, ":memory:", 100*time.Second)
 	c.listingPageUpdateInterval = 1 * time.Second
-	c.client.Ratelimiter = rate.NewLimiter(rate.Every(1*time.Millisecond), 1)
-	cancel := make(chan struct{})
-	go c.Run(cancel)
+	c.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	checkLeaks := leaktest.Check(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(stopped)
+	}()
 
 	done := make(chan struct{})
 	go func() {
@@ -135,5 +244,11 @@ func TestScheduler(t *testing.T) {
 
 	}
 
-	close(cancel)
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for scheduler to stop")
+	case <-stopped:
+	}
+	checkLeaks()
 }
@@ -0,0 +1,20 @@
+CREATE TABLE schema (version INTEGER PRIMARY KEY);
+INSERT INTO schema (version) VALUES (1);
+CREATE TABLE departments (departmentID TEXT UNIQUE, description TEXT, productCount INTEGER, updated DATETIME);
+CREATE TABLE products
+(	productID TEXT UNIQUE,
+	name TEXT,
+	description TEXT,
+	barcode TEXT,
+	priceCents INTEGER,
+	previousPriceCents INTEGER,
+	weightGrams INTEGER,
+	productJSON TEXT,
+	departmentID TEXT DEFAULT "",
+	updated DATETIME
+);
+INSERT INTO departments (departmentID, description, productCount, updated) VALUES ('fruit-vegetables', 'Fruit & Vegetables', 2, '2024-09-01 10:00:00+00:00');
+INSERT INTO products (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
+VALUES ('409499', 'Bananas', 'Bananas Approx. 180g Each', '', 80, 80, 180, '{}', 'fruit-vegetables', '2024-09-01 10:00:00+00:00');
+INSERT INTO products (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
+VALUES ('2511791', 'Brown Onions', 'Brown Onions 1kg', '', 350, 400, 1000, '{}', 'fruit-vegetables', '2024-09-01 10:00:01+00:00');
@@ -0,0 +1,83 @@
+package coles
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+)
+
+// DEFAULT_QUARANTINE_MAX_FILES is how many responses are kept in quarantine by default.
+const DEFAULT_QUARANTINE_MAX_FILES = 20
+
+// QUARANTINE_PREFIX and QUARANTINE_SUFFIX start and end the name of every quarantined
+// response. Only files matching both are pruned, so nothing else in the directory is touched.
+const (
+	QUARANTINE_PREFIX = "coles_quarantine_"
+	QUARANTINE_SUFFIX = ".html"
+)
+
+// quarantine keeps the most recent responses that couldn't be used, such as scrape traps,
+// for working out what Coles is doing. The oldest are deleted to keep at most maxFiles. A
+// blank directory disables it.
+type quarantine struct {
+	mu       sync.Mutex
+	dir      string
+	maxFiles int
+}
+
+// set changes where responses are kept, and how many.
+func (q *quarantine) set(dir string, maxFiles int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dir = dir
+	q.maxFiles = maxFiles
+}
+
+// save writes the response's body to a file named for the time and the reason it was
+// quarantined, then prunes the oldest.
+func (q *quarantine) save(reason string, body []byte, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dir == "" || q.maxFiles <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(q.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	// The fixed width timestamp sorts the files oldest first.
+	name := QUARANTINE_PREFIX + now.UTC().Format("20060102T150405.000000000Z") + "_" + reason + QUARANTINE_SUFFIX
+	if err := os.WriteFile(filepath.Join(q.dir, name), body, 0o644); err != nil {
+		return fmt.Errorf("failed to quarantine response: %w", err)
+	}
+	metrics.QuarantinedResponses.WithLabelValues(retailer.Name, reason).Inc()
+	return q.prune()
+}
+
+// prune deletes the oldest quarantined responses beyond maxFiles.
+func (q *quarantine) prune() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list quarantine directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, QUARANTINE_PREFIX) && strings.HasSuffix(name, QUARANTINE_SUFFIX) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for len(names) > q.maxFiles {
+		if err := os.Remove(filepath.Join(q.dir, names[0])); err != nil {
+			return fmt.Errorf("failed to prune quarantine directory: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
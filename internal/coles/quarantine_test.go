@@ -0,0 +1,64 @@
+package coles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine")
+	q := quarantine{}
+	// Disabled by default.
+	if err := q.save(QUARANTINE_SCRAPE_TRAP, []byte("trap"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	q.set(dir, 2)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"notes.txt", "index.html"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("keep me"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := q.save(QUARANTINE_SCRAPE_TRAP, []byte{byte('0' + i)}, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	// Only the newest two are kept, and anything else is left alone.
+	want := []string{
+		"coles_quarantine_20240101T000002.000000000Z_scrape_trap.html",
+		"coles_quarantine_20240101T000003.000000000Z_scrape_trap.html",
+		"index.html",
+		"notes.txt",
+	}
+	if len(names) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, names)
+	}
+	for i := range want {
+		if want[i] != names[i] {
+			t.Errorf("Expected %v, got %v", want[i], names[i])
+		}
+	}
+	body, err := os.ReadFile(filepath.Join(dir, names[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "3", string(body); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -13,6 +13,7 @@ const COLES_ID_PREFIX = "coles_id_"
 
 type colesProductInfo struct {
 	ID                    productID
+	location              string
 	departmentID          string
 	departmentDescription string
 	Info                  productListPageProduct
@@ -33,9 +34,21 @@ type productListPageProductPricing struct {
 		OfMeasureType     string          `json:"ofMeasureType"`
 		IsWeighted        bool            `json:"isWeighted"`
 	} `json:"unit"`
-	Comparable    string `json:"comparable"`
-	PromotionType string `json:"promotionType"`
-	OnlineSpecial bool   `json:"onlineSpecial"`
+	Comparable        string             `json:"comparable"`
+	PromotionType     string             `json:"promotionType"`
+	SpecialType       string             `json:"specialType,omitempty"`
+	OnlineSpecial     bool               `json:"onlineSpecial"`
+	OfferDescription  string             `json:"offerDescription,omitempty"`
+	MultiBuyPromotion *multiBuyPromotion `json:"multiBuyPromotion,omitempty"`
+}
+
+// multiBuyPromotion is an offer like "Pick any 2 for $5". Reward is the price of each
+// unit when at least MinQuantity are bought.
+type multiBuyPromotion struct {
+	Type        string          `json:"type"`
+	ID          string          `json:"id"`
+	MinQuantity int             `json:"minQuantity"`
+	Reward      decimal.Decimal `json:"reward"`
 }
 
 type productListPageProduct struct {
@@ -845,8 +858,9 @@ type categoryPage struct {
 }
 
 type departmentPage struct {
-	ID   string
-	page int
+	ID       string
+	page     int
+	location string
 }
 
 type departmentInfo struct {
@@ -32,19 +32,42 @@ func (i *InfluxDB) Init(url, token, database, productTable, systemTable string)
 	return nil
 }
 
-func (i *InfluxDB) WriteProductDatapoint(info shared.ProductInfo) {
+func (i *InfluxDB) WriteProductDatapoint(ctx context.Context, info shared.ProductInfo) {
+	points := make([]*influxdb3.Point, 1)
+	points[0] = i.productPoint(info)
+	i.db.WritePoints(ctx, points)
+}
+
+// WriteProductDatapoints writes a batch of products in a single request, returning
+// an error if the write was not acknowledged.
+func (i *InfluxDB) WriteProductDatapoints(ctx context.Context, infos []shared.ProductInfo) error {
+	points := make([]*influxdb3.Point, 0, len(infos))
+	for _, info := range infos {
+		points = append(points, i.productPoint(info))
+	}
+	return i.db.WritePoints(ctx, points)
+}
+
+func (i *InfluxDB) productPoint(info shared.ProductInfo) *influxdb3.Point {
 	/*
 		(shared.ProductInfo) -> in influxdb we will have:
 			fields:
 				"cents"
 				"grams"
 				"cents_change"
+				"was_cents"
+				"multibuy_quantity"
+				"multibuy_cents"
+				"member_cents"
+				"unit_cents"
 			tags:
 				"id"
 				"name"
 				"store"
 				"location"
 				"department"
+				"promotion"
+				"unit"
 			timestamp
 	*/
 	table := i.productTable
@@ -55,6 +78,8 @@ func (i *InfluxDB) WriteProductDatapoint(info shared.ProductInfo) {
 		"store":      info.Store,
 		"location":   info.Location,
 		"department": info.Department,
+		"promotion":  info.Promotion.Type,
+		"unit":       info.UnitPrice.Unit,
 	}
 	fields := map[string]any{
 		"cents": info.PriceCents,
@@ -64,14 +89,67 @@ func (i *InfluxDB) WriteProductDatapoint(info shared.ProductInfo) {
 	if info.PriceCents != info.PreviousPriceCents {
 		fields["cents_change"] = info.PriceCents - info.PreviousPriceCents
 	}
+	// The promotion fields are only written while they apply, so a gap means no offer.
+	if info.Promotion.WasPriceCents != 0 {
+		fields["was_cents"] = info.Promotion.WasPriceCents
+	}
+	if info.Promotion.MultibuyQuantity != 0 {
+		fields["multibuy_quantity"] = info.Promotion.MultibuyQuantity
+		fields["multibuy_cents"] = info.Promotion.MultibuyPriceCents
+	}
+	if info.Promotion.MemberPriceCents != 0 {
+		fields["member_cents"] = info.Promotion.MemberPriceCents
+	}
+	if info.UnitPrice.Unit != "" {
+		fields["unit_cents"] = info.UnitPrice.Cents
+	}
 
-	point := influxdb3.NewPoint(table, tags, fields, info.Timestamp)
-	points := make([]*influxdb3.Point, 1)
-	points[0] = point
-	i.db.WritePoints(context.Background(), points)
+	return influxdb3.NewPoint(table, tags, fields, info.Timestamp)
+}
+
+// WriteShrinkflationEvents writes the events to the product table's shrinkflation
+// measurement in a single request, returning an error if the write was not acknowledged.
+func (i *InfluxDB) WriteShrinkflationEvents(ctx context.Context, events []shared.ShrinkflationEvent) error {
+	/*
+		(shared.ShrinkflationEvent) -> in influxdb we will have:
+			fields:
+				"before_size"
+				"after_size"
+				"before_cents"
+				"after_cents"
+				"unit_price_increase"
+			tags:
+				"id"
+				"name"
+				"store"
+				"location"
+				"unit"
+			timestamp
+	*/
+	table := i.productTable + shared.SHRINKFLATION_TABLE_SUFFIX
+
+	points := make([]*influxdb3.Point, 0, len(events))
+	for _, event := range events {
+		tags := map[string]string{
+			"id":       event.ID,
+			"name":     event.Name,
+			"store":    event.Store,
+			"location": event.Location,
+			"unit":     event.SizeUnit,
+		}
+		fields := map[string]any{
+			"before_size":         event.BeforeSize,
+			"after_size":          event.AfterSize,
+			"before_cents":        event.BeforePriceCents,
+			"after_cents":         event.AfterPriceCents,
+			"unit_price_increase": event.UnitPriceIncrease,
+		}
+		points = append(points, influxdb3.NewPoint(table, tags, fields, event.Detected))
+	}
+	return i.db.WritePoints(ctx, points)
 }
 
-func (i *InfluxDB) WriteArbitrarySystemDatapoint(field string, value interface{}) {
+func (i *InfluxDB) WriteArbitrarySystemDatapoint(ctx context.Context, field string, value interface{}) error {
 	/*
 		(field, value) -> in influxdb we will have:
 			fields:
@@ -88,10 +166,10 @@ func (i *InfluxDB) WriteArbitrarySystemDatapoint(field string, value interface{}
 	point := influxdb3.NewPoint(table, nil, fields, time.Now())
 	points := make([]*influxdb3.Point, 1)
 	points[0] = point
-	i.db.WritePoints(context.Background(), points)
+	return i.db.WritePoints(ctx, points)
 }
 
-func (i *InfluxDB) WriteSystemDatapoint(data shared.SystemStatusDatapoint) {
+func (i *InfluxDB) WriteSystemDatapoint(ctx context.Context, data shared.SystemStatusDatapoint) error {
 	/*
 		(shared.SystemStatusDatapoint) -> in influxdb we will have:
 			fields:
@@ -115,16 +193,7 @@ func (i *InfluxDB) WriteSystemDatapoint(data shared.SystemStatusDatapoint) {
 	point := influxdb3.NewPoint(table, nil, fields, time.Now())
 	points := make([]*influxdb3.Point, 1)
 	points[0] = point
-	i.db.WritePoints(context.Background(), points)
-}
-
-// WriteWorker writes ProductInfo to InfluxDB
-// Note that the underlying library automatically batches writes
-// so we don't need to worry about that here.
-func (i *InfluxDB) WriteWorker(input <-chan shared.ProductInfo) {
-	for info := range input {
-		i.WriteProductDatapoint(info)
-	}
+	return i.db.WritePoints(ctx, points)
 }
 
 func (i *InfluxDB) Close() {
@@ -142,7 +142,7 @@ func TestWriteProductDatapoint(t *testing.T) {
 	}
 	// write the input product points
 	for _, v := range inputPoints {
-		i.WriteProductDatapoint(v)
+		i.WriteProductDatapoint(t.Context(), v)
 	}
 
 	// sanity testing: check that only the measurements we wrote exist after preWriteTime (cardinality)
@@ -223,7 +223,7 @@ func TestWriteSystemDatapoint(t *testing.T) {
 	}
 	// write the input product points
 	for _, v := range inputPoints {
-		i.WriteSystemDatapoint(v)
+		i.WriteSystemDatapoint(t.Context(), v)
 	}
 
 	// sanity testing: check that only the measurements we wrote exist after preWriteTime (cardinality)
@@ -282,9 +282,9 @@ func TestWriteArbitrarySystemDatapoint(t *testing.T) {
 	preWriteTime := time.Now().Format(time.RFC3339Nano)
 
 	// write the arbitrary system points
-	i.WriteArbitrarySystemDatapoint("colour", "grey")
-	i.WriteArbitrarySystemDatapoint("number", 42)
-	i.WriteArbitrarySystemDatapoint("metres", 1.5)
+	i.WriteArbitrarySystemDatapoint(t.Context(), "colour", "grey")
+	i.WriteArbitrarySystemDatapoint(t.Context(), "number", 42)
+	i.WriteArbitrarySystemDatapoint(t.Context(), "metres", 1.5)
 
 	// sanity testing: check that only the measurements we wrote exist after preWriteTime (cardinality)
 	ctx := context.Background()
@@ -0,0 +1,349 @@
+package parquet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	arrowparquet "github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+const PARQUET_ROW_GROUP_LENGTH = 10000
+const PARTITION_DATE_FORMAT = "2006-01-02"
+
+// Files are written under a temporary name and renamed once their footer is written, so
+// anything matching *.parquet is always a complete file.
+const TEMP_FILE_SUFFIX = ".tmp"
+
+var productSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "time", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}},
+	{Name: "id", Type: arrow.BinaryTypes.String},
+	{Name: "name", Type: arrow.BinaryTypes.String},
+	{Name: "description", Type: arrow.BinaryTypes.String},
+	{Name: "location", Type: arrow.BinaryTypes.String},
+	{Name: "department", Type: arrow.BinaryTypes.String},
+	{Name: "cents", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "previous_cents", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "grams", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "unit_cents", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "unit", Type: arrow.BinaryTypes.String, Nullable: true},
+}, nil)
+
+var systemSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "time", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}},
+	{Name: "field", Type: arrow.BinaryTypes.String},
+	{Name: "value", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "text_value", Type: arrow.BinaryTypes.String, Nullable: true},
+}, nil)
+
+var shrinkflationSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "time", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}},
+	{Name: "id", Type: arrow.BinaryTypes.String},
+	{Name: "name", Type: arrow.BinaryTypes.String},
+	{Name: "location", Type: arrow.BinaryTypes.String},
+	{Name: "unit", Type: arrow.BinaryTypes.String},
+	{Name: "before_size", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "after_size", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "before_cents", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "after_cents", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "unit_price_increase", Type: arrow.PrimitiveTypes.Float64},
+}, nil)
+
+// partitionWriter is an open parquet file in one partition directory.
+type partitionWriter struct {
+	path   string
+	file   *os.File
+	writer *pqarrow.FileWriter
+	rows   int
+}
+
+// close writes the parquet footer and moves the file to its final name.
+func (p *partitionWriter) close() error {
+	if err := p.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close parquet writer: %w", err)
+	}
+	if err := os.Rename(p.path+TEMP_FILE_SUFFIX, p.path); err != nil {
+		return fmt.Errorf("failed to finalise parquet file: %w", err)
+	}
+	slog.Debug("Finalised parquet file", "path", p.path, "rows", p.rows)
+	return nil
+}
+
+// Parquet archives the product and system timeseries, and shrinkflation events, to
+// Hive-partitioned parquet files on local disk, laid out as:
+//
+//	<dir>/<productTable>/store=<store>/date=<YYYY-MM-DD>/part-<nanos>.parquet
+//	<dir>/<productTable>_shrinkflation/store=<store>/date=<YYYY-MM-DD>/part-<nanos>.parquet
+//	<dir>/<systemTable>/date=<YYYY-MM-DD>/part-<nanos>.parquet
+//
+// Writes go to open files, which are only finalised by Flush or Close. Each file gets a
+// new name, so restarts never overwrite earlier files. Rows in a file that wasn't
+// finalised, because the process died, are removed by the next Init, so exporters must
+// only count writes as done once Flush has succeeded.
+type Parquet struct {
+	dir          string
+	productTable string
+	systemTable  string
+	mutex        sync.Mutex
+	writers      map[string]*partitionWriter
+	lost         error // Why rows written since the last Flush were lost, if they were.
+}
+
+// Init sets up the archive in the directory given by url. The token and database are unused.
+func (p *Parquet) Init(url, token, database, productTable, systemTable string) error {
+	slog.Info("Initialising parquet archive", "dir", url)
+	p.dir = url
+	p.productTable = productTable
+	p.systemTable = systemTable
+	p.writers = map[string]*partitionWriter{}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	return p.removeUnfinishedFiles()
+}
+
+// removeUnfinishedFiles deletes files left behind by a previous run that didn't shut down
+// cleanly. They have no footer, so nothing can read them.
+func (p *Parquet) removeUnfinishedFiles() error {
+	return filepath.WalkDir(p.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".parquet"+TEMP_FILE_SUFFIX) {
+			slog.Warn("Removing unfinished parquet file", "path", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// partitionDir builds a Hive-style partition directory from key/value pairs.
+func (p *Parquet) partitionDir(table string, keyValues ...string) string {
+	parts := []string{p.dir, table}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		parts = append(parts, keyValues[i]+"="+url.PathEscape(keyValues[i+1]))
+	}
+	return filepath.Join(parts...)
+}
+
+// getWriter returns the open writer for the partition, creating a new file if required.
+func (p *Parquet) getWriter(dir string, schema *arrow.Schema) (*partitionWriter, error) {
+	if w, ok := p.writers[dir]; ok {
+		return w, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create partition directory: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("part-%d.parquet", time.Now().UnixNano()))
+	file, err := os.Create(path + TEMP_FILE_SUFFIX)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parquet file: %w", err)
+	}
+	props := arrowparquet.NewWriterProperties(
+		arrowparquet.WithCompression(compress.Codecs.Snappy),
+		arrowparquet.WithMaxRowGroupLength(PARQUET_ROW_GROUP_LENGTH),
+	)
+	writer, err := pqarrow.NewFileWriter(schema, file, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+	w := &partitionWriter{path: path, file: file, writer: writer}
+	p.writers[dir] = w
+	return w, nil
+}
+
+// write appends the record to the partition's open file.
+func (p *Parquet) write(dir string, rec arrow.RecordBatch) error {
+	w, err := p.getWriter(dir, rec.Schema())
+	if err != nil {
+		return err
+	}
+	if err := w.writer.WriteBuffered(rec); err != nil {
+		// The file's earlier rows go with it, so the next Flush reports them lost.
+		delete(p.writers, dir)
+		w.file.Close()
+		p.lost = fmt.Errorf("failed to write parquet rows: %w", err)
+		return p.lost
+	}
+	w.rows += int(rec.NumRows())
+	return nil
+}
+
+// WriteProductDatapoints appends the products to their store and day partitions. They
+// aren't durable until the next Flush. The files are local, so the context is unused.
+func (p *Parquet) WriteProductDatapoints(ctx context.Context, infos []shared.ProductInfo) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Group the products into partitions, keeping their order within each.
+	partitions := map[string]*array.RecordBuilder{}
+	var order []string
+	for _, info := range infos {
+		date := info.Timestamp.UTC().Format(PARTITION_DATE_FORMAT)
+		dir := p.partitionDir(p.productTable, "store", info.Store, "date", date)
+		b, ok := partitions[dir]
+		if !ok {
+			b = array.NewRecordBuilder(memory.DefaultAllocator, productSchema)
+			defer b.Release()
+			partitions[dir] = b
+			order = append(order, dir)
+		}
+		b.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(info.Timestamp.UnixMicro()))
+		b.Field(1).(*array.StringBuilder).Append(info.ID)
+		b.Field(2).(*array.StringBuilder).Append(info.Name)
+		b.Field(3).(*array.StringBuilder).Append(info.Description)
+		b.Field(4).(*array.StringBuilder).Append(info.Location)
+		b.Field(5).(*array.StringBuilder).Append(info.Department)
+		b.Field(6).(*array.Int64Builder).Append(int64(info.PriceCents))
+		b.Field(7).(*array.Int64Builder).Append(int64(info.PreviousPriceCents))
+		b.Field(8).(*array.Int64Builder).Append(int64(info.WeightGrams))
+		if info.UnitPrice.Unit != "" {
+			b.Field(9).(*array.Float64Builder).Append(info.UnitPrice.Cents)
+			b.Field(10).(*array.StringBuilder).Append(info.UnitPrice.Unit)
+		} else {
+			b.Field(9).AppendNull()
+			b.Field(10).AppendNull()
+		}
+	}
+
+	for _, dir := range order {
+		rec := partitions[dir].NewRecordBatch()
+		err := p.write(dir, rec)
+		rec.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteShrinkflationEvents appends the events to their store and day partitions.
+func (p *Parquet) WriteShrinkflationEvents(ctx context.Context, events []shared.ShrinkflationEvent) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	partitions := map[string]*array.RecordBuilder{}
+	var order []string
+	for _, event := range events {
+		date := event.Detected.UTC().Format(PARTITION_DATE_FORMAT)
+		dir := p.partitionDir(p.productTable+shared.SHRINKFLATION_TABLE_SUFFIX, "store", event.Store, "date", date)
+		b, ok := partitions[dir]
+		if !ok {
+			b = array.NewRecordBuilder(memory.DefaultAllocator, shrinkflationSchema)
+			defer b.Release()
+			partitions[dir] = b
+			order = append(order, dir)
+		}
+		b.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(event.Detected.UnixMicro()))
+		b.Field(1).(*array.StringBuilder).Append(event.ID)
+		b.Field(2).(*array.StringBuilder).Append(event.Name)
+		b.Field(3).(*array.StringBuilder).Append(event.Location)
+		b.Field(4).(*array.StringBuilder).Append(event.SizeUnit)
+		b.Field(5).(*array.Float64Builder).Append(event.BeforeSize)
+		b.Field(6).(*array.Float64Builder).Append(event.AfterSize)
+		b.Field(7).(*array.Int64Builder).Append(int64(event.BeforePriceCents))
+		b.Field(8).(*array.Int64Builder).Append(int64(event.AfterPriceCents))
+		b.Field(9).(*array.Float64Builder).Append(event.UnitPriceIncrease)
+	}
+
+	for _, dir := range order {
+		rec := partitions[dir].NewRecordBatch()
+		err := p.write(dir, rec)
+		rec.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSystemFields appends one row per field to the system table's day partition. Numbers
+// and booleans go in the value column, as they do in Postgres, and anything else in
+// text_value.
+func (p *Parquet) writeSystemFields(t time.Time, fields map[string]any) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	b := array.NewRecordBuilder(memory.DefaultAllocator, systemSchema)
+	defer b.Release()
+	for field, value := range fields {
+		b.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(t.UnixMicro()))
+		b.Field(1).(*array.StringBuilder).Append(field)
+		switch v := value.(type) {
+		case int:
+			b.Field(2).(*array.Float64Builder).Append(float64(v))
+			b.Field(3).AppendNull()
+		case int64:
+			b.Field(2).(*array.Float64Builder).Append(float64(v))
+			b.Field(3).AppendNull()
+		case bool:
+			var f float64
+			if v {
+				f = 1
+			}
+			b.Field(2).(*array.Float64Builder).Append(f)
+			b.Field(3).AppendNull()
+		case float64:
+			b.Field(2).(*array.Float64Builder).Append(v)
+			b.Field(3).AppendNull()
+		default:
+			b.Field(2).AppendNull()
+			b.Field(3).(*array.StringBuilder).Append(fmt.Sprint(v))
+		}
+	}
+	rec := b.NewRecordBatch()
+	defer rec.Release()
+
+	date := t.UTC().Format(PARTITION_DATE_FORMAT)
+	return p.write(p.partitionDir(p.systemTable, "date", date), rec)
+}
+
+func (p *Parquet) WriteArbitrarySystemDatapoint(ctx context.Context, field string, value interface{}) error {
+	return p.writeSystemFields(time.Now(), map[string]any{field: value})
+}
+
+func (p *Parquet) WriteSystemDatapoint(ctx context.Context, data shared.SystemStatusDatapoint) error {
+	fields := map[string]any{
+		shared.SYSTEM_RAM_UTILISATION_PERCENT_FIELD: data.RAMUtilisationPercent,
+		shared.SYSTEM_PRODUCTS_PER_SECOND_FIELD:     data.ProductsPerSecond,
+		shared.SYSTEM_HDD_BYTES_FREE_FIELD:          data.HDDBytesFree,
+		shared.SYSTEM_TOTAL_PRODUCT_COUNT_FIELD:     data.TotalProductCount,
+	}
+	return p.writeSystemFields(time.Now(), fields)
+}
+
+// Flush finalises every open file, so everything written so far survives a restart. The
+// next write to a partition starts a new file. It returns an error if any rows written
+// since the last Flush didn't make it into a finalised file.
+func (p *Parquet) Flush() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	errs := []error{p.lost}
+	p.lost = nil
+	for dir, w := range p.writers {
+		delete(p.writers, dir)
+		errs = append(errs, w.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Close finalises every open file.
+func (p *Parquet) Close() {
+	if err := p.Flush(); err != nil {
+		slog.Error("Failed to finalise parquet files", "error", err)
+	}
+}
@@ -0,0 +1,253 @@
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// readCents reads the cents column out of every file in the partition directory.
+func readCents(t *testing.T, dir string) []int64 {
+	return readInt64s(t, dir, "cents")
+}
+
+// readInt64s reads an integer column out of every file in the partition directory.
+func readInt64s(t *testing.T, dir string, name string) []int64 {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cents []int64
+	for _, match := range matches {
+		reader, err := file.OpenParquetFile(match, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := fileReader.ReadTable(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		column := table.Column(int(table.Schema().FieldIndices(name)[0]))
+		for _, chunk := range column.Data().Chunks() {
+			cents = append(cents, chunk.(*array.Int64).Int64Values()...)
+		}
+		table.Release()
+		reader.Close()
+	}
+	return cents
+}
+
+func TestWriteProductDatapoints(t *testing.T) {
+	dir := t.TempDir()
+	day1 := time.Date(2024, 9, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+
+	p := Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	err := p.WriteProductDatapoints(t.Context(), []shared.ProductInfo{
+		{ID: "woolworths_sku_1", Name: "Apple", Store: "Woolworths", PriceCents: 100, Timestamp: day1},
+		{ID: "coles_id_1", Name: "Apple", Store: "Coles", PriceCents: 110, Timestamp: day1},
+		{ID: "woolworths_sku_2", Name: "Pear", Store: "Woolworths", PriceCents: 200, Timestamp: day1.Add(time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	woolworthsDay1 := filepath.Join(dir, "product", "store=Woolworths", "date=2024-09-01")
+	// Nothing is readable until it's flushed.
+	if want, got := 0, len(readCents(t, woolworthsDay1)); want != got {
+		t.Fatalf("Expected %d rows, got %d", want, got)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []int64{100, 200}, readCents(t, woolworthsDay1); len(want) != len(got) || want[0] != got[0] || want[1] != got[1] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := []int64{110}, readCents(t, filepath.Join(dir, "product", "store=Coles", "date=2024-09-01")); len(want) != len(got) || want[0] != got[0] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Close flushes too.
+	err = p.WriteProductDatapoints(t.Context(), []shared.ProductInfo{
+		{ID: "woolworths_sku_1", Name: "Apple", Store: "Woolworths", PriceCents: 120, Timestamp: day2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.WriteSystemDatapoint(t.Context(), shared.SystemStatusDatapoint{TotalProductCount: 3})
+	p.Close()
+	woolworthsDay2 := filepath.Join(dir, "product", "store=Woolworths", "date=2024-09-02")
+	if want, got := []int64{120}, readCents(t, woolworthsDay2); len(want) != len(got) || want[0] != got[0] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	systemFiles, err := filepath.Glob(filepath.Join(dir, "system", "date=*", "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(systemFiles); want != got {
+		t.Errorf("Expected %d system files, got %d", want, got)
+	}
+
+	// A restart adds a new file to the partition rather than replacing the old one.
+	p = Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	err = p.WriteProductDatapoints(t.Context(), []shared.ProductInfo{
+		{ID: "woolworths_sku_1", Name: "Apple", Store: "Woolworths", PriceCents: 130, Timestamp: day2.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if want, got := 2, len(readCents(t, woolworthsDay2)); want != got {
+		t.Errorf("Expected %d rows, got %d", want, got)
+	}
+}
+
+func TestWriteShrinkflationEvents(t *testing.T) {
+	dir := t.TempDir()
+	detected := time.Date(2024, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	p := Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	err := p.WriteShrinkflationEvents(t.Context(), []shared.ShrinkflationEvent{
+		{ID: "coles_id_1", Name: "Chips", Store: "Coles", SizeUnit: "g", BeforeSize: 200, AfterSize: 180,
+			BeforePriceCents: 400, AfterPriceCents: 420, UnitPriceIncrease: 420.0/180/(400.0/200) - 1, Detected: detected},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	got := readInt64s(t, filepath.Join(dir, "product_shrinkflation", "store=Coles", "date=2024-09-01"), "after_cents")
+	if want := []int64{420}; len(want) != len(got) || want[0] != got[0] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRemoveUnfinishedFiles(t *testing.T) {
+	dir := t.TempDir()
+	partition := filepath.Join(dir, "product", "store=Coles", "date=2024-09-01")
+	if err := os.MkdirAll(partition, 0755); err != nil {
+		t.Fatal(err)
+	}
+	unfinished := filepath.Join(partition, "part-1.parquet"+TEMP_FILE_SUFFIX)
+	if err := os.WriteFile(unfinished, []byte("PAR1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := os.Stat(unfinished); !os.IsNotExist(err) {
+		t.Errorf("Expected the unfinished file to be removed, got %v", err)
+	}
+}
+
+func TestUnflushedRowsLostOnCrash(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 9, 1, 10, 0, 0, 0, time.UTC)
+	partition := filepath.Join(dir, "product", "store=Coles", "date=2024-09-01")
+
+	p := Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	for i, cents := range []int{100, 110} {
+		if err := p.WriteProductDatapoints(t.Context(), []shared.ProductInfo{{ID: "coles_id_1", Store: "Coles", PriceCents: cents, Timestamp: day}}); err != nil {
+			t.Fatal(err)
+		}
+		// Only the first write is flushed before the crash.
+		if i == 0 {
+			if err := p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The process dies without closing, and the restart throws the unflushed file away.
+	p = Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if want, got := []int64{100}, readCents(t, partition); len(want) != len(got) || want[0] != got[0] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if unfinished, _ := filepath.Glob(filepath.Join(partition, "*"+TEMP_FILE_SUFFIX)); len(unfinished) != 0 {
+		t.Errorf("Expected no unfinished files, got %v", unfinished)
+	}
+}
+
+func TestWriteArbitrarySystemDatapoint(t *testing.T) {
+	dir := t.TempDir()
+	p := Parquet{}
+	if err := p.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	for field, value := range map[string]any{"int": 1, "int64": int64(2), "float": 3.5, "true": true, "false": false, "version": "1.2.3"} {
+		if err := p.WriteArbitrarySystemDatapoint(t.Context(), field, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "system", "date=*", "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, match := range matches {
+		reader, err := file.OpenParquetFile(match, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := fileReader.ReadTable(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for c := range table.Column(1).Data().Chunks() {
+			fields := table.Column(1).Data().Chunk(c).(*array.String)
+			values := table.Column(2).Data().Chunk(c).(*array.Float64)
+			texts := table.Column(3).Data().Chunk(c).(*array.String)
+			for i := 0; i < fields.Len(); i++ {
+				if values.IsValid(i) {
+					got[fields.Value(i)] = fmt.Sprint(values.Value(i))
+				} else {
+					got[fields.Value(i)] = texts.Value(i)
+				}
+			}
+		}
+		table.Release()
+		reader.Close()
+	}
+	// Numbers and booleans are values, as they are in Postgres.
+	want := map[string]string{"int": "1", "int64": "2", "float": "3.5", "true": "1", "false": "0", "version": "1.2.3"}
+	if !maps.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,275 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// Postgres writes the product timeseries, system timeseries and shrinkflation events to
+// PostgreSQL. If the TimescaleDB extension is installed the tables are created as
+// hypertables, otherwise they are plain tables indexed on time.
+type Postgres struct {
+	db           *sql.DB
+	productTable string
+	systemTable  string
+}
+
+var productColumns = []string{"time", "id", "name", "store", "location", "department", "cents", "grams", "cents_change", "unit_cents", "unit"}
+var systemColumns = []string{"time", "field", "value", "text_value"}
+var shrinkflationColumns = []string{"time", "id", "name", "store", "location", "unit", "before_size", "after_size", "before_cents", "after_cents", "unit_price_increase"}
+
+// Init connects to the database and creates the tables if required. The url is a libpq
+// connection string or URL. The token and database override the password and database
+// name in the url if they're not blank. If it fails, the connection is closed again.
+func (p *Postgres) Init(url, token, database, productTable, systemTable string) error {
+	slog.Info("Initialising Postgres", "database", database, "productTable", productTable)
+	cfg, err := pq.NewConfig(url)
+	if err != nil {
+		return fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	if token != "" {
+		cfg.Password = token
+	}
+	if database != "" {
+		cfg.Database = database
+	}
+	connector, err := pq.NewConnectorConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create connector: %w", err)
+	}
+	p.productTable = productTable
+	p.systemTable = systemTable
+	return p.open(connector)
+}
+
+// open connects to the database with the connector and creates the tables, closing the
+// connection again if either fails.
+func (p *Postgres) open(connector driver.Connector) error {
+	p.db = sql.OpenDB(connector)
+	err := p.db.Ping()
+	if err != nil {
+		err = fmt.Errorf("failed to connect: %w", err)
+	} else {
+		err = p.createTables()
+	}
+	if err != nil {
+		p.db.Close()
+	}
+	return err
+}
+
+// shrinkflationTable is the name of the table shrinkflation events are written to.
+func (p *Postgres) shrinkflationTable() string {
+	return p.productTable + shared.SHRINKFLATION_TABLE_SUFFIX
+}
+
+// createTables creates the product, system and shrinkflation tables, converting them to hypertables if
+// TimescaleDB is available.
+func (p *Postgres) createTables() error {
+	product := pq.QuoteIdentifier(p.productTable)
+	system := pq.QuoteIdentifier(p.systemTable)
+	shrinkflation := pq.QuoteIdentifier(p.shrinkflationTable())
+
+	_, err := p.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s
+		(	time TIMESTAMPTZ NOT NULL,
+			id TEXT NOT NULL,
+			name TEXT,
+			store TEXT,
+			location TEXT,
+			department TEXT,
+			cents INTEGER,
+			grams INTEGER,
+			cents_change INTEGER,
+			unit_cents DOUBLE PRECISION,
+			unit TEXT
+		)`, product))
+	if err != nil {
+		return fmt.Errorf("failed to create product table: %w", err)
+	}
+	// Tables created before unit pricing need the columns adding.
+	_, err = p.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS unit_cents DOUBLE PRECISION, ADD COLUMN IF NOT EXISTS unit TEXT", product))
+	if err != nil {
+		return fmt.Errorf("failed to add unit price columns: %w", err)
+	}
+	_, err = p.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s
+		(	time TIMESTAMPTZ NOT NULL,
+			field TEXT NOT NULL,
+			value DOUBLE PRECISION,
+			text_value TEXT
+		)`, system))
+	if err != nil {
+		return fmt.Errorf("failed to create system table: %w", err)
+	}
+	_, err = p.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s
+		(	time TIMESTAMPTZ NOT NULL,
+			id TEXT NOT NULL,
+			name TEXT,
+			store TEXT,
+			location TEXT,
+			unit TEXT,
+			before_size DOUBLE PRECISION,
+			after_size DOUBLE PRECISION,
+			before_cents INTEGER,
+			after_cents INTEGER,
+			unit_price_increase DOUBLE PRECISION
+		)`, shrinkflation))
+	if err != nil {
+		return fmt.Errorf("failed to create shrinkflation table: %w", err)
+	}
+
+	var timescale bool
+	err = p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&timescale)
+	if err != nil {
+		return fmt.Errorf("failed to check for timescaledb: %w", err)
+	}
+	if timescale {
+		for _, table := range []string{p.productTable, p.systemTable, p.shrinkflationTable()} {
+			if _, err := p.db.Exec("SELECT create_hypertable($1::regclass, 'time', if_not_exists => TRUE)", pq.QuoteIdentifier(table)); err != nil {
+				return fmt.Errorf("failed to create hypertable %s: %w", table, err)
+			}
+		}
+	} else {
+		slog.Info("TimescaleDB not installed, using plain tables")
+		_, err = p.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (time)", pq.QuoteIdentifier(p.productTable+"_time_idx"), product))
+		if err != nil {
+			return fmt.Errorf("failed to create product time index: %w", err)
+		}
+		_, err = p.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (time)", pq.QuoteIdentifier(p.systemTable+"_time_idx"), system))
+		if err != nil {
+			return fmt.Errorf("failed to create system time index: %w", err)
+		}
+		_, err = p.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (time)", pq.QuoteIdentifier(p.shrinkflationTable()+"_time_idx"), shrinkflation))
+		if err != nil {
+			return fmt.Errorf("failed to create shrinkflation time index: %w", err)
+		}
+	}
+	_, err = p.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (id, time DESC)", pq.QuoteIdentifier(p.productTable+"_id_time_idx"), product))
+	if err != nil {
+		return fmt.Errorf("failed to create product id index: %w", err)
+	}
+	return nil
+}
+
+// copyRows writes the rows to the table in a single transaction using COPY. Cancelling the
+// context abandons the transaction.
+func (p *Postgres) copyRows(ctx context.Context, table string, columns []string, rows [][]any) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %w", err)
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy row: %w", err)
+		}
+	}
+	// The final Exec with no arguments flushes the buffered rows.
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to flush copy: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to close copy: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// productRow lays a product out in productColumns order. cents_change is only set when
+// the price has changed, and the unit price when it's known, matching the InfluxDB sink.
+func productRow(info shared.ProductInfo) []any {
+	var centsChange sql.NullInt64
+	if info.PriceCents != info.PreviousPriceCents {
+		centsChange = sql.NullInt64{Int64: int64(info.PriceCents - info.PreviousPriceCents), Valid: true}
+	}
+	var unitCents sql.NullFloat64
+	var unit sql.NullString
+	if info.UnitPrice.Unit != "" {
+		unitCents = sql.NullFloat64{Float64: info.UnitPrice.Cents, Valid: true}
+		unit = sql.NullString{String: info.UnitPrice.Unit, Valid: true}
+	}
+	return []any{info.Timestamp, info.ID, info.Name, info.Store, info.Location, info.Department, info.PriceCents, info.WeightGrams, centsChange, unitCents, unit}
+}
+
+// systemRow lays a system field out in systemColumns order. Numeric values go in the value
+// column and anything else is stored as text.
+func systemRow(t time.Time, field string, value interface{}) []any {
+	var number sql.NullFloat64
+	var text sql.NullString
+	switch v := value.(type) {
+	case int:
+		number = sql.NullFloat64{Float64: float64(v), Valid: true}
+	case int64:
+		number = sql.NullFloat64{Float64: float64(v), Valid: true}
+	case float64:
+		number = sql.NullFloat64{Float64: v, Valid: true}
+	case bool:
+		number = sql.NullFloat64{Valid: true}
+		if v {
+			number.Float64 = 1
+		}
+	default:
+		text = sql.NullString{String: fmt.Sprint(v), Valid: true}
+	}
+	return []any{t, field, number, text}
+}
+
+// WriteProductDatapoints writes a batch of products with a single COPY, returning an error
+// if the batch was not committed.
+func (p *Postgres) WriteProductDatapoints(ctx context.Context, infos []shared.ProductInfo) error {
+	rows := make([][]any, 0, len(infos))
+	for _, info := range infos {
+		rows = append(rows, productRow(info))
+	}
+	return p.copyRows(ctx, p.productTable, productColumns, rows)
+}
+
+// WriteShrinkflationEvents writes the events with a single COPY, returning an error if they
+// were not committed.
+func (p *Postgres) WriteShrinkflationEvents(ctx context.Context, events []shared.ShrinkflationEvent) error {
+	rows := make([][]any, 0, len(events))
+	for _, e := range events {
+		rows = append(rows, []any{e.Detected, e.ID, e.Name, e.Store, e.Location, e.SizeUnit, e.BeforeSize, e.AfterSize,
+			e.BeforePriceCents, e.AfterPriceCents, e.UnitPriceIncrease})
+	}
+	return p.copyRows(ctx, p.shrinkflationTable(), shrinkflationColumns, rows)
+}
+
+func (p *Postgres) WriteArbitrarySystemDatapoint(ctx context.Context, field string, value interface{}) error {
+	rows := [][]any{systemRow(time.Now(), field, value)}
+	return p.copyRows(ctx, p.systemTable, systemColumns, rows)
+}
+
+func (p *Postgres) WriteSystemDatapoint(ctx context.Context, data shared.SystemStatusDatapoint) error {
+	now := time.Now()
+	rows := [][]any{
+		systemRow(now, shared.SYSTEM_RAM_UTILISATION_PERCENT_FIELD, data.RAMUtilisationPercent),
+		systemRow(now, shared.SYSTEM_PRODUCTS_PER_SECOND_FIELD, data.ProductsPerSecond),
+		systemRow(now, shared.SYSTEM_HDD_BYTES_FREE_FIELD, data.HDDBytesFree),
+		systemRow(now, shared.SYSTEM_TOTAL_PRODUCT_COUNT_FIELD, data.TotalProductCount),
+	}
+	return p.copyRows(ctx, p.systemTable, systemColumns, rows)
+}
+
+func (p *Postgres) Close() {
+	if err := p.db.Close(); err != nil {
+		slog.Error("Failed to close Postgres", "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+//go:build integration
+// +build integration
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joho/godotenv"
+	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func dir(envFile string) string {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	for {
+		goModPath := filepath.Join(currentDir, "go.mod")
+		if _, err := os.Stat(goModPath); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(currentDir)
+		if parent == currentDir {
+			panic(fmt.Errorf("go.mod not found"))
+		}
+		currentDir = parent
+	}
+
+	return filepath.Join(currentDir, envFile)
+}
+
+// getTestPostgres connects to the database named by POSTGRES_URL in .env.test, e.g. a local
+// container started with:
+//
+//	docker run --rm -e POSTGRES_PASSWORD=test -p 5432:5432 timescale/timescaledb:latest-pg16
+//
+// Each test gets its own tables so runs don't see each other's data.
+func getTestPostgres(t *testing.T) *Postgres {
+	godotenv.Load(dir(".env.test"))
+	suffix := time.Now().Format("20060102150405")
+	p := &Postgres{}
+	err := p.Init(os.Getenv("POSTGRES_URL"), "", "", "product_"+suffix, "system_"+suffix)
+	if err != nil {
+		t.Fatalf("Could not init database client: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		p.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s, %s", p.productTable, p.systemTable, p.shrinkflationTable()))
+		p.Close()
+	})
+	return p
+}
+
+func TestWriteProductDatapoints(t *testing.T) {
+	p := getTestPostgres(t)
+
+	inputPoints := []shared.ProductInfo{
+		{ID: "1", Name: "Test Product", Store: "Test Store", PriceCents: 100, PreviousPriceCents: 0, WeightGrams: 1000, Timestamp: time.Now()},
+		{ID: "1", Name: "Test Product", Store: "Test Store", PriceCents: 101, PreviousPriceCents: 101, WeightGrams: 1000, Timestamp: time.Now().Add(1 * time.Second)},
+		{ID: "1", Name: "Test Product", Store: "Test Store", PriceCents: 99, PreviousPriceCents: 101, WeightGrams: 1000, Timestamp: time.Now().Add(2 * time.Second)},
+	}
+	if err := p.WriteProductDatapoints(t.Context(), inputPoints); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := p.db.Query(fmt.Sprintf("SELECT cents, grams, cents_change FROM %s ORDER BY time", p.productTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var it int
+	for rows.Next() {
+		var cents, grams int
+		var centsChange sql.NullInt64
+		if err := rows.Scan(&cents, &grams, &centsChange); err != nil {
+			t.Fatal(err)
+		}
+		if want, got := inputPoints[it].PriceCents, cents; want != got {
+			t.Errorf("Expected %d, got %d", want, got)
+		}
+		if want, got := inputPoints[it].PriceCents != inputPoints[it].PreviousPriceCents, centsChange.Valid; want != got {
+			t.Errorf("Expected cents_change valid to be %v, got %v", want, got)
+		}
+		it++
+	}
+	if want, got := 3, it; want != got {
+		t.Errorf("cardinality didn't match what was expected: %d", got)
+	}
+}
+
+func TestWriteSystemDatapoint(t *testing.T) {
+	p := getTestPostgres(t)
+
+	p.WriteSystemDatapoint(t.Context(), shared.SystemStatusDatapoint{RAMUtilisationPercent: 35.3, ProductsPerSecond: 0.05, HDDBytesFree: 12, TotalProductCount: 8})
+	p.WriteArbitrarySystemDatapoint(t.Context(), shared.SYSTEM_VERSION_FIELD, "1.2.3")
+
+	var total float64
+	err := p.db.QueryRow(fmt.Sprintf("SELECT value FROM %s WHERE field = $1", p.systemTable), shared.SYSTEM_TOTAL_PRODUCT_COUNT_FIELD).Scan(&total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 8.0, total; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	var version string
+	err = p.db.QueryRow(fmt.Sprintf("SELECT text_value FROM %s WHERE field = $1", p.systemTable), shared.SYSTEM_VERSION_FIELD).Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "1.2.3", version; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,254 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// recorder stands in for a Postgres server. It records the statements run against it, and
+// the rows copied into each table, so the SQL can be checked without a server.
+type recorder struct {
+	mu          sync.Mutex
+	statements  []string
+	args        [][]driver.Value
+	copied      map[string][][]driver.Value // Committed rows, by COPY statement.
+	timescale   bool                        // Whether the timescaledb extension is installed.
+	failCopy    bool                        // Whether copying a row fails.
+	failConnect bool                        // Whether connecting fails.
+}
+
+func (r *recorder) Connect(context.Context) (driver.Conn, error) {
+	if r.failConnect {
+		return nil, errors.New("connection refused")
+	}
+	return &recorderConn{r: r}, nil
+}
+
+func (r *recorder) Driver() driver.Driver { return nil }
+
+type recorderConn struct {
+	r       *recorder
+	pending map[string][][]driver.Value // Rows copied in the open transaction.
+}
+
+func (c *recorderConn) Prepare(query string) (driver.Stmt, error) {
+	return &recorderStmt{c: c, query: query}, nil
+}
+func (c *recorderConn) Close() error { return nil }
+func (c *recorderConn) Begin() (driver.Tx, error) {
+	c.pending = map[string][][]driver.Value{}
+	return c, nil
+}
+
+func (c *recorderConn) Commit() error {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	for query, rows := range c.pending {
+		c.r.copied[query] = append(c.r.copied[query], rows...)
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *recorderConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type recorderStmt struct {
+	c     *recorderConn
+	query string
+}
+
+func (s *recorderStmt) Close() error  { return nil }
+func (s *recorderStmt) NumInput() int { return -1 }
+
+func (s *recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	r := s.c.r
+	if strings.HasPrefix(s.query, "COPY ") {
+		// A COPY with no arguments flushes it.
+		if len(args) == 0 {
+			return driver.RowsAffected(0), nil
+		}
+		if r.failCopy {
+			return nil, errors.New("copy failed")
+		}
+		s.c.pending[s.query] = append(s.c.pending[s.query], args)
+		return driver.RowsAffected(1), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statements = append(r.statements, strings.Join(strings.Fields(s.query), " "))
+	r.args = append(r.args, args)
+	return driver.RowsAffected(0), nil
+}
+
+// Query only answers the check for TimescaleDB.
+func (s *recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &recorderRows{values: []driver.Value{s.c.r.timescale}}, nil
+}
+
+type recorderRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *recorderRows) Columns() []string { return []string{"exists"} }
+func (r *recorderRows) Close() error      { return nil }
+func (r *recorderRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+// getRecordedPostgres returns a Postgres that writes to a recorder rather than a server.
+func getRecordedPostgres(t *testing.T, timescale bool) (*Postgres, *recorder) {
+	r := &recorder{copied: map[string][][]driver.Value{}, timescale: timescale}
+	p := &Postgres{db: sql.OpenDB(r), productTable: "product", systemTable: "system"}
+	t.Cleanup(p.Close)
+	return p, r
+}
+
+func TestCreateTablesPlain(t *testing.T) {
+	p, r := getRecordedPostgres(t, false)
+	if err := p.createTables(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`CREATE TABLE IF NOT EXISTS "product" ( time TIMESTAMPTZ NOT NULL, id TEXT NOT NULL, name TEXT, store TEXT, location TEXT, department TEXT, cents INTEGER, grams INTEGER, cents_change INTEGER, unit_cents DOUBLE PRECISION, unit TEXT )`,
+		`ALTER TABLE "product" ADD COLUMN IF NOT EXISTS unit_cents DOUBLE PRECISION, ADD COLUMN IF NOT EXISTS unit TEXT`,
+		`CREATE TABLE IF NOT EXISTS "system" ( time TIMESTAMPTZ NOT NULL, field TEXT NOT NULL, value DOUBLE PRECISION, text_value TEXT )`,
+		`CREATE TABLE IF NOT EXISTS "product_shrinkflation" ( time TIMESTAMPTZ NOT NULL, id TEXT NOT NULL, name TEXT, store TEXT, location TEXT, unit TEXT, before_size DOUBLE PRECISION, after_size DOUBLE PRECISION, before_cents INTEGER, after_cents INTEGER, unit_price_increase DOUBLE PRECISION )`,
+		`CREATE INDEX IF NOT EXISTS "product_time_idx" ON "product" (time)`,
+		`CREATE INDEX IF NOT EXISTS "system_time_idx" ON "system" (time)`,
+		`CREATE INDEX IF NOT EXISTS "product_shrinkflation_time_idx" ON "product_shrinkflation" (time)`,
+		`CREATE INDEX IF NOT EXISTS "product_id_time_idx" ON "product" (id, time DESC)`,
+	}
+	if got := r.statements; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestCreateTablesTimescale(t *testing.T) {
+	p, r := getRecordedPostgres(t, true)
+	if err := p.createTables(); err != nil {
+		t.Fatal(err)
+	}
+	var hypertables []driver.Value
+	for i, statement := range r.statements {
+		if strings.HasPrefix(statement, "CREATE INDEX") && strings.HasSuffix(statement, "(time)") {
+			t.Errorf("Expected no time index on a hypertable, got %q", statement)
+		}
+		if strings.Contains(statement, "create_hypertable") {
+			hypertables = append(hypertables, r.args[i]...)
+		}
+	}
+	if want, got := []driver.Value{`"product"`, `"system"`, `"product_shrinkflation"`}, hypertables; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	p := &Postgres{productTable: "product", systemTable: "system"}
+	if err := p.open(&recorder{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.db.Ping(); err != nil {
+		t.Errorf("Expected an open connection, got %v", err)
+	}
+	p.Close()
+
+	// A failed connection doesn't leave the pool open.
+	if err := p.open(&recorder{failConnect: true}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if err := p.db.Ping(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("Expected a closed connection, got %v", err)
+	}
+}
+
+func TestCopyProductDatapoints(t *testing.T) {
+	p, r := getRecordedPostgres(t, false)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := p.WriteProductDatapoints(t.Context(), []shared.ProductInfo{
+		{ID: "1", Name: "Milk", Store: "Coles", Location: "2000", Department: "Dairy", PriceCents: 310, PreviousPriceCents: 300, WeightGrams: 1000,
+			UnitPrice: shared.UnitPrice{Cents: 31, Unit: shared.UNIT_PER_100ML}, Timestamp: now},
+		{ID: "2", Name: "Bread", Store: "Aldi", PriceCents: 250, PreviousPriceCents: 250, Timestamp: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]driver.Value{
+		{now, "1", "Milk", "Coles", "2000", "Dairy", int64(310), int64(1000), int64(10), 31.0, shared.UNIT_PER_100ML},
+		{now, "2", "Bread", "Aldi", "", "", int64(250), int64(0), nil, nil, nil},
+	}
+	if got := r.copied[pq.CopyIn("product", productColumns...)]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestCopyShrinkflationEvents(t *testing.T) {
+	p, r := getRecordedPostgres(t, false)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := p.WriteShrinkflationEvents(t.Context(), []shared.ShrinkflationEvent{
+		{ID: "1", Name: "Chips", Store: "Coles", Location: "2000", SizeUnit: "g", BeforeSize: 200, AfterSize: 175,
+			BeforePriceCents: 400, AfterPriceCents: 400, UnitPriceIncrease: 0.14, Detected: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]driver.Value{{now, "1", "Chips", "Coles", "2000", "g", 200.0, 175.0, int64(400), int64(400), 0.14}}
+	if got := r.copied[pq.CopyIn("product_shrinkflation", shrinkflationColumns...)]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestCopySystemDatapoints(t *testing.T) {
+	p, r := getRecordedPostgres(t, false)
+	p.WriteSystemDatapoint(t.Context(), shared.SystemStatusDatapoint{RAMUtilisationPercent: 35.3, ProductsPerSecond: 0.05, HDDBytesFree: 12, TotalProductCount: 8})
+	p.WriteArbitrarySystemDatapoint(t.Context(), shared.SYSTEM_VERSION_FIELD, "1.2.3")
+	p.WriteArbitrarySystemDatapoint(t.Context(), "scrape_trapped", true)
+
+	rows := r.copied[pq.CopyIn("system", systemColumns...)]
+	var got [][]driver.Value
+	for _, row := range rows {
+		// Drop the timestamps, which are the time of writing.
+		got = append(got, row[1:])
+	}
+	want := [][]driver.Value{
+		{shared.SYSTEM_RAM_UTILISATION_PERCENT_FIELD, 35.3, nil},
+		{shared.SYSTEM_PRODUCTS_PER_SECOND_FIELD, 0.05, nil},
+		{shared.SYSTEM_HDD_BYTES_FREE_FIELD, 12.0, nil},
+		{shared.SYSTEM_TOTAL_PRODUCT_COUNT_FIELD, 8.0, nil},
+		{shared.SYSTEM_VERSION_FIELD, nil, "1.2.3"},
+		{"scrape_trapped", 1.0, nil},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestCopyFailureRollsBack(t *testing.T) {
+	p, r := getRecordedPostgres(t, false)
+	r.failCopy = true
+	if err := p.WriteProductDatapoints(t.Context(), []shared.ProductInfo{{ID: "1", PriceCents: 100}}); err == nil {
+		t.Error("Expected an error")
+	}
+	if want, got := 0, len(r.copied); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,52 @@
+package gtin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GTIN_LENGTH is the length of a normalised GTIN. Shorter codes are padded with zeros.
+const GTIN_LENGTH = 14
+
+var ErrInvalidLength = errors.New("barcode must be 8, 12, 13 or 14 digits")
+var ErrInvalidCheckDigit = errors.New("barcode check digit is wrong")
+
+// Normalise validates an EAN-8, UPC-A, EAN-13 or GTIN-14 barcode and returns it as a
+// GTIN-14, so the same product has the same code however it was written. Spaces and
+// hyphens are ignored.
+func Normalise(code string) (string, error) {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code))
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("barcode `%s` contains a non-digit", code)
+		}
+	}
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return "", fmt.Errorf("%w: `%s`", ErrInvalidLength, code)
+	}
+	code = strings.Repeat("0", GTIN_LENGTH-len(code)) + code
+	if strings.Trim(code, "0") == "" {
+		return "", fmt.Errorf("%w: `%s`", ErrInvalidLength, code)
+	}
+	if want := CheckDigit(code[:GTIN_LENGTH-1]); code[GTIN_LENGTH-1] != want {
+		return "", fmt.Errorf("%w: `%s` should end in %c", ErrInvalidCheckDigit, code, want)
+	}
+	return code, nil
+}
+
+// CheckDigit calculates the GS1 check digit for the digits of a barcode before the check
+// digit. Working from the right, digits are weighted 3, 1, 3, 1...
+func CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return byte('0' + (10-sum%10)%10)
+}
@@ -0,0 +1,44 @@
+package gtin
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalise(t *testing.T) {
+	for _, test := range []struct {
+		code string
+		want string
+		err  error
+	}{
+		// EAN-13
+		{"9300633603540", "09300633603540", nil},
+		{"930 0633 603540", "09300633603540", nil},
+		// UPC-A
+		{"036000291452", "00036000291452", nil},
+		// EAN-8
+		{"96385074", "00000096385074", nil},
+		// GTIN-14
+		{"19300633603547", "19300633603547", nil},
+		// The same product as an EAN-13 and a UPC-A.
+		{"0036000291452", "00036000291452", nil},
+		{"9300633603547", "", ErrInvalidCheckDigit},
+		// A Woolworths in-store barcode.
+		{"0260139000009", "00260139000009", nil},
+		{"0", "", ErrInvalidLength},
+		{"00000000", "", ErrInvalidLength},
+		{"930063360354", "", ErrInvalidCheckDigit},
+		{"123456789", "", ErrInvalidLength},
+	} {
+		got, err := Normalise(test.code)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, got %v", test.code, test.err, err)
+		}
+		if want := test.want; want != got {
+			t.Errorf("%s: expected %s, got %s", test.code, want, got)
+		}
+	}
+	if _, err := Normalise("93006336O3540"); err == nil {
+		t.Errorf("Expected an error for a non-digit")
+	}
+}
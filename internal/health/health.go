@@ -0,0 +1,189 @@
+// Package health reports whether the service is alive and ready, for container
+// orchestration.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+// CHECK_TIMEOUT bounds how long a check waits on the DBs.
+const CHECK_TIMEOUT = 5 * time.Second
+
+// Thresholds say how stale things can get before they count as unhealthy.
+type Thresholds struct {
+	MaxScrapeAge time.Duration // How long a store can go without a department being scraped.
+	MaxSinkAge   time.Duration // How long a sink can go without a successful write.
+}
+
+// Store is a retailer whose scraping is checked.
+type Store struct {
+	DB *store.DB
+	// ScrapeTrapped returns whether the retailer is serving scrape traps instead of pages.
+	// Nil for retailers without them.
+	ScrapeTrapped func() bool
+}
+
+// Sink is a sink whose exports are checked.
+type Sink struct {
+	Name string
+	// LastWrite returns when the sink last exported everything successfully, or the zero
+	// time if it hasn't yet.
+	LastWrite func() time.Time
+}
+
+// StoreReport is the health of a single store.
+type StoreReport struct {
+	Name                 string    `json:"name"`
+	Reachable            bool      `json:"reachable"`
+	LastDepartmentUpdate time.Time `json:"last_department_update"`
+	Fresh                bool      `json:"fresh"`
+	ScrapeTrapped        bool      `json:"scrape_trapped"`
+	Error                string    `json:"error,omitempty"`
+}
+
+// SinkReport is the health of a single sink.
+type SinkReport struct {
+	Name      string    `json:"name"`
+	LastWrite time.Time `json:"last_write"`
+	Fresh     bool      `json:"fresh"`
+}
+
+// Report is the health of the whole service.
+//
+// The service is live while every store's DB is reachable and its scraper is making
+// progress, i.e. a department has been scraped within MaxScrapeAge. A service that isn't
+// live won't recover by itself, so should be restarted.
+//
+// The service is ready while it is live, every sink has written successfully within
+// MaxSinkAge and no store is serving scrape traps. A service that isn't ready is still
+// running but its data is falling behind, so shouldn't be relied on.
+type Report struct {
+	Live   bool          `json:"live"`
+	Ready  bool          `json:"ready"`
+	Stores []StoreReport `json:"stores"`
+	Sinks  []SinkReport  `json:"sinks"`
+}
+
+// Server checks the service's health and serves it over HTTP:
+//
+//	GET /health          the full report, with 503 if the service isn't ready
+//	GET /health/live     200 if the service is live, 503 if not
+//	GET /health/ready    200 if the service is ready, 503 if not
+type Server struct {
+	stores     []Store
+	sinks      []Sink
+	thresholds Thresholds
+	started    time.Time
+	mux        *http.ServeMux
+}
+
+// Init sets up the checks over the given stores and sinks.
+func (s *Server) Init(stores []Store, sinks []Sink, thresholds Thresholds) {
+	s.stores = stores
+	s.sinks = sinks
+	s.thresholds = thresholds
+	s.started = time.Now()
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /health", s.handleReport)
+	s.mux.HandleFunc("GET /health/live", s.handleLive)
+	s.mux.HandleFunc("GET /health/ready", s.handleReady)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Check reports the service's health at the given time. A store's scraper is given
+// MaxScrapeAge from startup to scrape its first department.
+func (s *Server) Check(ctx context.Context, now time.Time) Report {
+	report := Report{Live: true, Ready: true, Stores: []StoreReport{}, Sinks: []SinkReport{}}
+	for _, st := range s.stores {
+		r := StoreReport{Name: st.DB.Retailer().Name}
+		if err := st.DB.PingContext(ctx); err != nil {
+			r.Error = fmt.Sprintf("failed to reach DB: %v", err)
+		} else if r.LastDepartmentUpdate, err = st.DB.LastDepartmentUpdate(); err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Reachable = true
+		}
+		progress := r.LastDepartmentUpdate
+		if progress.Before(s.started) {
+			progress = s.started
+		}
+		r.Fresh = now.Sub(progress) <= s.thresholds.MaxScrapeAge
+		if st.ScrapeTrapped != nil {
+			r.ScrapeTrapped = st.ScrapeTrapped()
+		}
+		report.Live = report.Live && r.Reachable && r.Fresh
+		report.Ready = report.Ready && !r.ScrapeTrapped
+		report.Stores = append(report.Stores, r)
+	}
+	for _, sink := range s.sinks {
+		r := SinkReport{Name: sink.Name, LastWrite: sink.LastWrite()}
+		r.Fresh = !r.LastWrite.IsZero() && now.Sub(r.LastWrite) <= s.thresholds.MaxSinkAge
+		report.Ready = report.Ready && r.Fresh
+		report.Sinks = append(report.Sinks, r)
+	}
+	report.Ready = report.Ready && report.Live
+	return report
+}
+
+func (s *Server) check(r *http.Request) Report {
+	ctx, cancel := context.WithTimeout(r.Context(), CHECK_TIMEOUT)
+	defer cancel()
+	return s.Check(ctx, time.Now())
+}
+
+// writeStatus writes just the status code and its text, for probes that only look at the code.
+func writeStatus(w http.ResponseWriter, ok bool) {
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	fmt.Fprintln(w, http.StatusText(status))
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	report := s.check(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Error writing health report", "error", err)
+	}
+}
+
+func (s *Server) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, s.check(r).Live)
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, s.check(r).Ready)
+}
+
+// Probe asks the health server at the base URL, e.g. "http://localhost:8081", whether
+// the service is "live" or "ready". It returns an error if it isn't, or can't be asked.
+func Probe(baseURL string, mode string) error {
+	if mode != "live" && mode != "ready" {
+		return fmt.Errorf("unknown health check %q, expected live or ready", mode)
+	}
+	client := http.Client{Timeout: CHECK_TIMEOUT + time.Second}
+	resp, err := client.Get(baseURL + "/health/" + mode)
+	if err != nil {
+		return fmt.Errorf("failed to reach health server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not %s: %s", mode, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func openStore(t *testing.T, retailer store.Retailer) *store.DB {
+	db, err := store.Open(":memory:", retailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCheck(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	trapped := false
+	var lastWrite time.Time
+
+	s := Server{}
+	s.Init([]Store{
+		{DB: woolworths},
+		{DB: coles, ScrapeTrapped: func() bool { return trapped }},
+	}, []Sink{
+		{Name: "influxdb", LastWrite: func() time.Time { return lastWrite }},
+	}, Thresholds{MaxScrapeAge: time.Hour, MaxSinkAge: 10 * time.Minute})
+	now := s.started.Add(time.Minute)
+
+	// Just started, so the scrapers have time to get going, but the sink hasn't written.
+	report := s.Check(t.Context(), now)
+	if want, got := true, report.Live; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := false, report.Ready; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 2, len(report.Stores); want != got {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	if want, got := "Coles", report.Stores[1].Name; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := true, report.Stores[1].Reachable; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	lastWrite = now
+	if want, got := true, s.Check(t.Context(), now).Ready; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// A scrape trap stops the service being ready, but restarting won't help.
+	trapped = true
+	report = s.Check(t.Context(), now)
+	if want, got := true, report.Stores[1].ScrapeTrapped; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := true, report.Live; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := false, report.Ready; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	trapped = false
+
+	// Woolworths has scraped a department recently, but Coles hasn't scraped any.
+	now = s.started.Add(2 * time.Hour)
+	lastWrite = now
+	if err := woolworths.SaveDepartment(store.Department{ID: "fruit", Description: "Fruit", Updated: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	report = s.Check(t.Context(), now)
+	if want, got := true, report.Stores[0].Fresh; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := false, report.Stores[1].Fresh; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := false, report.Live; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := false, report.Ready; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// A DB that can't be reached isn't live.
+	if err := coles.SaveDepartment(store.Department{ID: "fruit", Description: "Fruit", Updated: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := true, s.Check(t.Context(), now).Live; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	coles.Close()
+	report = s.Check(t.Context(), now)
+	if want, got := false, report.Stores[1].Reachable; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if report.Stores[1].Error == "" {
+		t.Errorf("Expected an error")
+	}
+	if want, got := false, report.Live; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestServer(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	s := &Server{}
+	s.Init([]Store{{DB: woolworths}}, []Sink{{Name: "influxdb", LastWrite: func() time.Time { return time.Time{} }}},
+		Thresholds{MaxScrapeAge: time.Hour, MaxSinkAge: 10 * time.Minute})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	for path, status := range map[string]int{
+		"/health/live":  http.StatusOK,
+		"/health/ready": http.StatusServiceUnavailable,
+		"/health":       http.StatusServiceUnavailable,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, got := status, resp.StatusCode; want != got {
+			t.Errorf("%s: Expected %v, got %v", path, want, got)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := true, report.Live; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := "influxdb", report.Sinks[0].Name; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if err := Probe(server.URL, "live"); err != nil {
+		t.Errorf("Expected live, got %v", err)
+	}
+	if err := Probe(server.URL, "ready"); err == nil {
+		t.Errorf("Expected not to be ready")
+	}
+	if err := Probe(server.URL, "dead"); err == nil {
+		t.Errorf("Expected an error for an unknown check")
+	}
+}
@@ -0,0 +1,64 @@
+// Package inflation computes a CPI-style price index over a basket of products from the
+// stores' price histories.
+package inflation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Item is a product in the basket. It's priced in each store by the first of its products
+// from that store that's on sale, so later products substitute for earlier ones that are
+// missing or delisted.
+type Item struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"` // Relative to the other items.
+	// Products are prefixed product IDs, e.g. "coles_id_123", in order of preference.
+	Products []string `json:"products"`
+	// Group adds the products confirmed to be the same as the listed ones as further
+	// substitutes.
+	Group bool `json:"group"`
+}
+
+// Basket is the products the index is computed over, e.g.
+//
+//	{
+//		"base": "2025-01-06T00:00:00Z",
+//		"items": [
+//			{"name": "Milk 2L", "weight": 2, "products": ["woolworths_sku_888140"], "group": true},
+//			{"name": "Bananas", "weight": 1, "products": ["woolworths_sku_133211", "coles_id_409499"]}
+//		]
+//	}
+type Basket struct {
+	// Base is when the index is 100. If it's zero the index starts from the earliest
+	// price recorded for any item.
+	Base  time.Time `json:"base"`
+	Items []Item    `json:"items"`
+}
+
+// LoadBasket reads a basket from a JSON file.
+func LoadBasket(path string) (Basket, error) {
+	var basket Basket
+	f, err := os.Open(path)
+	if err != nil {
+		return basket, fmt.Errorf("failed to open basket: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&basket); err != nil {
+		return basket, fmt.Errorf("failed to parse basket: %w", err)
+	}
+	if len(basket.Items) == 0 {
+		return basket, fmt.Errorf("basket has no items")
+	}
+	for i, item := range basket.Items {
+		if item.Weight <= 0 {
+			return basket, fmt.Errorf("basket item %d %q has no weight", i, item.Name)
+		}
+		if len(item.Products) == 0 {
+			return basket, fmt.Errorf("basket item %d %q has no products", i, item.Name)
+		}
+	}
+	return basket, nil
+}
@@ -0,0 +1,38 @@
+package inflation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBasket(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name    string
+		basket  string
+		wantErr bool
+	}{
+		{"valid", `{"base": "2025-01-06T00:00:00Z", "items": [{"name": "Milk", "weight": 2, "products": ["coles_id_1"], "group": true}]}`, false},
+		{"no items", `{"items": []}`, true},
+		{"no weight", `{"items": [{"name": "Milk", "products": ["coles_id_1"]}]}`, true},
+		{"no products", `{"items": [{"name": "Milk", "weight": 1}]}`, true},
+		{"malformed", `{"items": `, true},
+	} {
+		path := filepath.Join(dir, test.name+".json")
+		if err := os.WriteFile(path, []byte(test.basket), 0644); err != nil {
+			t.Fatal(err)
+		}
+		basket, err := LoadBasket(path)
+		if test.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if err == nil && (len(basket.Items) != 1 || !basket.Items[0].Group || basket.Base.IsZero()) {
+			t.Errorf("%s: unexpected basket %+v", test.name, basket)
+		}
+	}
+	if _, err := LoadBasket(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected an error for a missing basket")
+	}
+}
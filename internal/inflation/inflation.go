@@ -0,0 +1,249 @@
+package inflation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+// WEEK is the interval between index values. Weeks start on Monday, UTC.
+const WEEK = 7 * 24 * time.Hour
+
+// BASE_VALUE is the index's value at the base week.
+const BASE_VALUE = 100
+
+// candidate is a product that can price a basket item.
+type candidate struct {
+	history  []shared.PriceHistoryEntry // At the store's default location, oldest first.
+	lastSeen time.Time                  // When the store last listed the product.
+}
+
+// priceAt returns the candidate's price at t. Returns false if it hadn't been priced yet,
+// or if the store hadn't listed it in the week before, i.e. it was delisted.
+func (c candidate) priceAt(t time.Time) (int, bool) {
+	if c.lastSeen.Before(t.Add(-WEEK)) {
+		return 0, false
+	}
+	price := 0
+	for _, entry := range c.history {
+		if entry.Recorded.After(t) {
+			break
+		}
+		price = entry.PriceCents
+	}
+	return price, price > 0
+}
+
+// item is a basket item's candidates in one store, in order of preference.
+type item struct {
+	weight     float64
+	candidates []candidate
+}
+
+// relative returns the item's price at t relative to its price at base. It's priced by the
+// first candidate priced at both.
+func (i item) relative(base, t time.Time) (float64, bool) {
+	for _, c := range i.candidates {
+		basePrice, ok := c.priceAt(base)
+		if !ok {
+			continue
+		}
+		price, ok := c.priceAt(t)
+		if !ok {
+			continue
+		}
+		return float64(price) / float64(basePrice), true
+	}
+	return 0, false
+}
+
+// Point is the index's value at the start of a week.
+type Point struct {
+	Week   time.Time
+	Value  float64 // BASE_VALUE at the base week.
+	Weight float64 // The share of the basket's weight priced, from 0 to 1.
+}
+
+// Series is a store's weekly index values, oldest first.
+type Series struct {
+	Store  string // Blank for the combined index.
+	Points []Point
+}
+
+// index is the weighted mean of the items' price relatives each week, scaled to
+// BASE_VALUE. Items that can't be priced in a week are left out of it, and the rest
+// reweighted. Weeks where nothing can be priced are skipped.
+func index(items []item, base time.Time, weeks []time.Time) []Point {
+	total := 0.0
+	for _, i := range items {
+		total += i.weight
+	}
+	var points []Point
+	for _, week := range weeks {
+		var sum, weight float64
+		for _, i := range items {
+			if relative, ok := i.relative(base, week); ok {
+				sum += i.weight * relative
+				weight += i.weight
+			}
+		}
+		if weight > 0 {
+			points = append(points, Point{Week: week, Value: BASE_VALUE * sum / weight, Weight: weight / total})
+		}
+	}
+	return points
+}
+
+// combine averages the stores' indices each week, weighted by how much of the basket each
+// priced.
+func combine(stores []Series) []Point {
+	sums := map[time.Time]*Point{}
+	var weeks []time.Time
+	for _, series := range stores {
+		for _, point := range series.Points {
+			sum, ok := sums[point.Week]
+			if !ok {
+				sum = &Point{Week: point.Week}
+				sums[point.Week] = sum
+				weeks = append(weeks, point.Week)
+			}
+			sum.Value += point.Value * point.Weight
+			sum.Weight += point.Weight
+		}
+	}
+	sort.Slice(weeks, func(i, j int) bool { return weeks[i].Before(weeks[j]) })
+	points := make([]Point, 0, len(weeks))
+	for _, week := range weeks {
+		sum := sums[week]
+		if sum.Weight == 0 {
+			continue
+		}
+		points = append(points, Point{Week: week, Value: sum.Value / sum.Weight, Weight: sum.Weight / float64(len(stores))})
+	}
+	return points
+}
+
+// loadCandidate reads a product's price history and when it was last listed. Returns false
+// if the store has never listed it at its default location.
+func loadCandidate(db *store.DB, id string) (candidate, bool, error) {
+	products, err := db.GetProduct(id)
+	if errors.Is(err, shared.ErrProductMissing) {
+		return candidate{}, false, nil
+	} else if err != nil {
+		return candidate{}, false, err
+	}
+	var c candidate
+	found := false
+	for _, product := range products {
+		if product.Location == "" {
+			c.lastSeen = product.Timestamp
+			found = true
+		}
+	}
+	if !found {
+		return candidate{}, false, nil
+	}
+	history, err := db.GetPriceHistory(id)
+	if err != nil {
+		return candidate{}, false, err
+	}
+	for _, entry := range history {
+		if entry.Location == "" {
+			c.history = append(c.history, entry)
+		}
+	}
+	return c, true, nil
+}
+
+// substitutes returns the item's product IDs in order of preference: those listed, then
+// those in their match groups.
+func substitutes(i Item, matches *matching.DB) ([]string, error) {
+	ids := append([]string(nil), i.Products...)
+	if !i.Group || matches == nil {
+		return ids, nil
+	}
+	listed := map[string]bool{}
+	for _, id := range ids {
+		listed[id] = true
+	}
+	var grouped []string
+	for _, id := range i.Products {
+		group, _, err := matches.Group(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load match group: %w", err)
+		}
+		for _, other := range group {
+			if !listed[other] {
+				listed[other] = true
+				grouped = append(grouped, other)
+			}
+		}
+	}
+	sort.Strings(grouped)
+	return append(ids, grouped...), nil
+}
+
+// Compute returns the basket's weekly index in each store that stocks any of it, then
+// combined across the stores, from the basket's base week up to the start of this week.
+// The matches are only needed if an item uses its match group, and may be nil otherwise.
+func Compute(basket Basket, stores []*store.DB, matches *matching.DB, now time.Time) ([]Series, error) {
+	items := make([][]item, len(stores))
+	earliest := time.Time{}
+	for _, basketItem := range basket.Items {
+		ids, err := substitutes(basketItem, matches)
+		if err != nil {
+			return nil, err
+		}
+		for s, db := range stores {
+			i := item{weight: basketItem.Weight}
+			for _, id := range ids {
+				if !strings.HasPrefix(id, db.Retailer().IDPrefix) {
+					continue
+				}
+				c, ok, err := loadCandidate(db, id)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load %s: %w", id, err)
+				}
+				if !ok {
+					continue
+				}
+				i.candidates = append(i.candidates, c)
+				if len(c.history) > 0 && (earliest.IsZero() || c.history[0].Recorded.Before(earliest)) {
+					earliest = c.history[0].Recorded
+				}
+			}
+			items[s] = append(items[s], i)
+		}
+	}
+
+	base := basket.Base.Truncate(WEEK)
+	if basket.Base.IsZero() {
+		if earliest.IsZero() {
+			return nil, nil
+		}
+		// Prices are taken at the start of the week, so the first is the week after.
+		base = earliest.Truncate(WEEK).Add(WEEK)
+	}
+	var weeks []time.Time
+	for week := base; !week.After(now); week = week.Add(WEEK) {
+		weeks = append(weeks, week)
+	}
+
+	var result []Series
+	for s, db := range stores {
+		points := index(items[s], base, weeks)
+		if len(points) > 0 {
+			result = append(result, Series{Store: db.Retailer().Name, Points: points})
+		}
+	}
+	if len(result) > 0 {
+		result = append(result, Series{Points: combine(result)})
+	}
+	return result, nil
+}
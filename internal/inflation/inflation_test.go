@@ -0,0 +1,129 @@
+package inflation
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func openStore(t *testing.T, retailer store.Retailer) *store.DB {
+	db, err := store.Open(":memory:", retailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func save(t *testing.T, db *store.DB, products ...store.Product) {
+	for _, product := range products {
+		if err := db.SaveProducts([]store.Product{product}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	base := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)
+	entries := func(prices ...int) []shared.PriceHistoryEntry {
+		var history []shared.PriceHistoryEntry
+		for i, price := range prices {
+			history = append(history, shared.PriceHistoryEntry{PriceCents: price, Recorded: base.Add(time.Duration(i) * WEEK)})
+		}
+		return history
+	}
+	lastSeen := base.Add(10 * WEEK)
+	items := []item{
+		{weight: 3, candidates: []candidate{{history: entries(100, 110, 120), lastSeen: lastSeen}}},
+		// Not priced at the base week, so there's nothing to compare it with.
+		{weight: 1, candidates: []candidate{{history: entries(0, 200, 200), lastSeen: lastSeen}}},
+	}
+	weeks := []time.Time{base, base.Add(WEEK), base.Add(2 * WEEK)}
+	points := index(items, base, weeks)
+	if want, got := 3, len(points); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 100.0, points[0].Value; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 120.0, points[2].Value; math.Abs(want-got) > 1e-9 {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 0.75, points[2].Weight; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestCompute(t *testing.T) {
+	woolworths := openStore(t, store.Retailer{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1})
+	coles := openStore(t, store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	matches, err := matching.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { matches.Close() })
+
+	now := time.Now()
+	start := now.Truncate(WEEK).Add(-4 * WEEK)
+	save(t, woolworths,
+		store.Product{ID: "1", Name: "Milk", PriceCents: 200, Updated: start},
+		store.Product{ID: "1", Name: "Milk", PriceCents: 220, Updated: start.Add(2 * WEEK)},
+		store.Product{ID: "1", Name: "Milk", PriceCents: 220, Updated: now},
+		// Delisted after the first week, so the other bread substitutes for it.
+		store.Product{ID: "2", Name: "Bread", PriceCents: 300, Updated: start},
+		store.Product{ID: "3", Name: "Other Bread", PriceCents: 400, Updated: start},
+		store.Product{ID: "3", Name: "Other Bread", PriceCents: 440, Updated: start.Add(3 * WEEK)},
+		store.Product{ID: "3", Name: "Other Bread", PriceCents: 440, Updated: now},
+	)
+	save(t, coles,
+		store.Product{ID: "1", Name: "Milk", PriceCents: 100, Updated: start},
+		store.Product{ID: "1", Name: "Milk", PriceCents: 150, Updated: start.Add(3 * WEEK)},
+		store.Product{ID: "1", Name: "Milk", PriceCents: 150, Updated: now},
+	)
+	if _, err := matches.Override("woolworths_sku_1", "coles_id_1", matching.STATUS_CONFIRMED); err != nil {
+		t.Fatal(err)
+	}
+
+	basket := Basket{Items: []Item{
+		{Name: "Milk", Weight: 2, Products: []string{"woolworths_sku_1"}, Group: true},
+		{Name: "Bread", Weight: 1, Products: []string{"woolworths_sku_2", "woolworths_sku_3", "coles_id_99"}},
+	}}
+	series, err := Compute(basket, []*store.DB{woolworths, coles}, matches, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(series); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	for i, test := range []struct {
+		store  string
+		values []float64
+	}{
+		{"Woolworths", []float64{100, 320.0 / 3, 110, 110}},
+		{"Coles", []float64{100, 100, 150, 150}},
+		{"", []float64{100, (320.0/3 + 100*2.0/3) / (5.0 / 3), 126, 126}},
+	} {
+		if want, got := test.store, series[i].Store; want != got {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+		if want, got := len(test.values), len(series[i].Points); want != got {
+			t.Errorf("%s: expected %d, got %d", test.store, want, got)
+			continue
+		}
+		for j, want := range test.values {
+			if got := series[i].Points[j].Value; math.Abs(want-got) > 1e-9 {
+				t.Errorf("%s week %d: expected %v, got %v", test.store, j, want, got)
+			}
+		}
+	}
+	if want, got := start.Add(WEEK), series[0].Points[0].Week; !want.Equal(got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 2.0/3, series[1].Points[0].Weight; math.Abs(want-got) > 1e-9 {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,63 @@
+// Package leaktest checks that tests don't leave goroutines running.
+package leaktest
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TIMEOUT is how long goroutines get to finish before they're reported as leaked.
+const TIMEOUT = 5 * time.Second
+
+// goroutines returns the stack of every running goroutine, keyed by its header line's ID.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := map[string]string{}
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		// Each stack starts "goroutine 123 [state]:".
+		fields := strings.Fields(stack)
+		if len(fields) < 2 {
+			continue
+		}
+		stacks[fields[1]] = stack
+	}
+	return stacks
+}
+
+// Check records the goroutines running now. The function it returns fails the test if
+// any others are still running once TIMEOUT has passed. Use it like:
+//
+//	defer leaktest.Check(t)()
+func Check(t testing.TB) func() {
+	before := goroutines()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(TIMEOUT)
+		for {
+			var leaked []string
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package leaktest
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recorder is a testing.TB that keeps its errors rather than failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCheck(t *testing.T) {
+	finished := &recorder{TB: t}
+	check := Check(finished)
+	done := make(chan struct{})
+	go func() { <-done }()
+	close(done)
+	check()
+	if want, got := 0, len(finished.errors); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	leaking := &recorder{TB: t}
+	check = Check(leaking)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() { <-stop }()
+	check()
+	if want, got := 1, len(leaking.errors); want != got {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,265 @@
+package matching
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tjhowse/aus_grocery_price_database/internal/migrate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+// ErrInvalidStatus is returned when overriding a match with a status that isn't one of
+// the STATUS_* constants.
+var ErrInvalidStatus = errors.New("invalid match status")
+
+// LOAD_BATCH_SIZE is how many products are read from a store at a time.
+const LOAD_BATCH_SIZE = 1000
+
+// migrations build the match DB. To change the schema, append a migration. Never edit
+// one that has shipped.
+var migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "baseline",
+		Statements: []string{
+			`CREATE TABLE matches
+			(	productA TEXT,
+				productB TEXT,
+				confidence REAL,
+				method TEXT,
+				status TEXT,
+				manual BOOLEAN,
+				updated DATETIME,
+				PRIMARY KEY (productA, productB)
+			)`,
+			"CREATE INDEX matches_productB ON matches (productB)",
+		},
+	},
+}
+
+// DB holds the matches between products in different stores. Products are identified by
+// their prefixed IDs, which say which store they're from.
+type DB struct {
+	*sql.DB
+}
+
+// Open opens the match DB and migrates it to the current schema.
+func Open(dbPath string) (*DB, error) {
+	db, err := sql.Open("sqlite3", dbPath+"?cache=shared")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DB: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := migrate.Migrate(db, migrations, false); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate DB: %w", err)
+	}
+	return &DB{DB: db}, nil
+}
+
+// loadProducts reads the store's products at its default location.
+func loadProducts(db *store.DB) ([]shared.ProductInfo, error) {
+	var products []shared.ProductInfo
+	cursor := shared.ExportCursor{}
+	for {
+		batch, next, err := db.GetSharedProductsAfterCursor(cursor, LOAD_BATCH_SIZE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load products: %w", err)
+		}
+		for _, product := range batch {
+			if product.Location == "" {
+				products = append(products, product)
+			}
+		}
+		if len(batch) < LOAD_BATCH_SIZE {
+			return products, nil
+		}
+		cursor = next
+	}
+}
+
+// Update proposes matches between the stores' products and saves them, replacing the
+// previous proposals. Manual overrides are kept. Returns the number of matches proposed.
+func (m *DB) Update(stores []*store.DB) (int, error) {
+	var catalogues [][]shared.ProductInfo
+	for _, db := range stores {
+		products, err := loadProducts(db)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load %s products: %w", db.Retailer().Name, err)
+		}
+		catalogues = append(catalogues, products)
+	}
+	matches := Propose(catalogues)
+	if err := m.SaveProposals(matches, time.Now()); err != nil {
+		return 0, err
+	}
+	slog.Info("Updated product matches", "proposed", len(matches))
+	return len(matches), nil
+}
+
+// SaveProposals replaces the matcher's proposals with the given matches. Matches that
+// have been overridden manually aren't changed.
+func (m *DB) SaveProposals(matches []Match, updated time.Time) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM matches WHERE NOT manual"); err != nil {
+		return fmt.Errorf("failed to clear proposed matches: %w", err)
+	}
+	for _, match := range matches {
+		_, err := tx.Exec(`
+			INSERT INTO matches (productA, productB, confidence, method, status, manual, updated)
+			VALUES (?, ?, ?, ?, ?, FALSE, ?)
+			ON CONFLICT (productA, productB) DO NOTHING`,
+			match.ProductA, match.ProductB, match.Confidence, match.Method, match.Status, updated)
+		if err != nil {
+			return fmt.Errorf("failed to save match: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Override sets the status of the match between two products by hand. The matcher won't
+// change it again.
+func (m *DB) Override(productA, productB, status string) (Match, error) {
+	if status != STATUS_PROPOSED && status != STATUS_CONFIRMED && status != STATUS_REJECTED {
+		return Match{}, ErrInvalidStatus
+	}
+	match := newMatch(productA, productB, 0, METHOD_MANUAL)
+	_, err := m.Exec(`
+		INSERT INTO matches (productA, productB, confidence, method, status, manual, updated)
+		VALUES (?, ?, 0, ?, ?, TRUE, ?)
+		ON CONFLICT (productA, productB) DO UPDATE SET
+			status = excluded.status,
+			manual = TRUE,
+			updated = excluded.updated`,
+		match.ProductA, match.ProductB, METHOD_MANUAL, status, time.Now())
+	if err != nil {
+		return Match{}, fmt.Errorf("failed to override match: %w", err)
+	}
+	matches, err := m.query("WHERE productA = ? AND productB = ?", match.ProductA, match.ProductB)
+	if err != nil {
+		return Match{}, err
+	}
+	return matches[0], nil
+}
+
+// query returns the matches selected by the clause.
+func (m *DB) query(clause string, args ...any) ([]Match, error) {
+	rows, err := m.Query("SELECT productA, productB, confidence, method, status, manual, updated FROM matches "+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matches: %w", err)
+	}
+	defer rows.Close()
+	var matches []Match
+	for rows.Next() {
+		var match Match
+		err := rows.Scan(&match.ProductA, &match.ProductB, &match.Confidence, &match.Method, &match.Status, &match.Manual, &match.Updated)
+		if err != nil {
+			return matches, fmt.Errorf("failed to scan match: %w", err)
+		}
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+// Matches returns matches with the status, or every match if it's blank, most confident
+// first.
+func (m *DB) Matches(status string, limit, offset int) ([]Match, error) {
+	where := ""
+	var args []any
+	if status != "" {
+		where = "WHERE status = ?"
+		args = append(args, status)
+	}
+	args = append(args, limit, offset)
+	return m.query(where+" ORDER BY confidence DESC, productA, productB LIMIT ? OFFSET ?", args...)
+}
+
+// Group returns the product IDs confirmed to be the same product as the given one, including
+// it, in order, along with the confirmed matches between them.
+func (m *DB) Group(productID string) ([]string, []Match, error) {
+	group := map[string]bool{productID: true}
+	var matches []Match
+	// Each match is found from both of its products.
+	seen := map[[2]string]bool{}
+	queue := []string{productID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		found, err := m.query("WHERE status = ? AND (productA = ? OR productB = ?)", STATUS_CONFIRMED, id, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, match := range found {
+			for _, other := range []string{match.ProductA, match.ProductB} {
+				if !group[other] {
+					group[other] = true
+					queue = append(queue, other)
+				}
+			}
+			if key := [2]string{match.ProductA, match.ProductB}; !seen[key] {
+				seen[key] = true
+				matches = append(matches, match)
+			}
+		}
+	}
+	ids := make([]string, 0, len(group))
+	for id := range group {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, matches, nil
+}
+
+// Groups returns every group of two or more products confirmed to be the same, each in
+// order, ordered by their first product.
+func (m *DB) Groups() ([][]string, error) {
+	matches, err := m.query("WHERE status = ?", STATUS_CONFIRMED)
+	if err != nil {
+		return nil, err
+	}
+	// Union-find over the matched pairs.
+	parent := map[string]string{}
+	var find func(string) string
+	find = func(id string) string {
+		if parent[id] == "" || parent[id] == id {
+			parent[id] = id
+			return id
+		}
+		root := find(parent[id])
+		parent[id] = root
+		return root
+	}
+	for _, match := range matches {
+		a, b := find(match.ProductA), find(match.ProductB)
+		if a < b {
+			parent[b] = a
+		} else if b < a {
+			parent[a] = b
+		}
+	}
+	members := map[string][]string{}
+	for id := range parent {
+		root := find(id)
+		members[root] = append(members[root], id)
+	}
+	groups := make([][]string, 0, len(members))
+	for _, group := range members {
+		sort.Strings(group)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups, nil
+}
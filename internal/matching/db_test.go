@@ -0,0 +1,162 @@
+package matching
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+)
+
+func getTestDB(t *testing.T) *DB {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSaveProposals(t *testing.T) {
+	db := getTestDB(t)
+	err := db.SaveProposals([]Match{
+		newMatch("woolworths_sku_1", "coles_id_1", 0.95, METHOD_SIMILARITY),
+		newMatch("woolworths_sku_2", "coles_id_2", 0.7, METHOD_SIMILARITY),
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Override("woolworths_sku_2", "coles_id_2", STATUS_CONFIRMED); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Override("woolworths_sku_1", "coles_id_1", "maybe"); err != ErrInvalidStatus {
+		t.Errorf("Expected %v, got %v", ErrInvalidStatus, err)
+	}
+
+	// The next run doesn't propose either match. Only the overridden one is kept.
+	if err := db.SaveProposals([]Match{newMatch("woolworths_sku_3", "coles_id_3", 0.6, METHOD_SIMILARITY)}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := db.Matches("", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(matches); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "coles_id_2", matches[0].ProductA; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 0.7, matches[0].Confidence; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if !matches[0].Manual {
+		t.Errorf("Expected a manual match")
+	}
+	matches, err = db.Matches(STATUS_PROPOSED, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(matches); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// A rejected proposal stays rejected.
+	if _, err := db.Override("coles_id_3", "woolworths_sku_3", STATUS_REJECTED); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveProposals([]Match{newMatch("woolworths_sku_3", "coles_id_3", 0.95, METHOD_SIMILARITY)}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	matches, err = db.Matches(STATUS_REJECTED, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(matches); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	db := getTestDB(t)
+	err := db.SaveProposals([]Match{
+		newMatch("woolworths_sku_1", "coles_id_1", 1, METHOD_BARCODE),
+		newMatch("coles_id_1", "aldi_id_1", 0.9, METHOD_SIMILARITY),
+		newMatch("woolworths_sku_1", "aldi_id_2", 0.6, METHOD_SIMILARITY),
+		newMatch("woolworths_sku_5", "coles_id_5", 0.95, METHOD_SIMILARITY),
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, matches, err := db.Group("aldi_id_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "[aldi_id_1 coles_id_1 woolworths_sku_1]", fmt.Sprint(ids); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 2, len(matches); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	ids, matches, err = db.Group("aldi_id_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "[aldi_id_2]", fmt.Sprint(ids); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 0, len(matches); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	groups, err := db.Groups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "[[aldi_id_1 coles_id_1 woolworths_sku_1] [coles_id_5 woolworths_sku_5]]", fmt.Sprint(groups); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var stores []*store.DB
+	for _, retailer := range []store.Retailer{
+		{Name: "Woolworths", IDPrefix: "woolworths_sku_", SchemaBaseline: 1},
+		{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1},
+	} {
+		db, err := store.Open(":memory:", retailer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		stores = append(stores, db)
+	}
+	updated := time.Now()
+	err := stores[0].SaveProducts([]store.Product{
+		{ID: "1", Name: "Royal Gala Apples", Barcode: "9300633603540", Updated: updated},
+		{ID: "1", Location: "1234", Name: "Royal Gala Apples", Barcode: "9300633603540", Updated: updated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[1].SaveProducts([]store.Product{{ID: "10", Name: "Gala Apples", Barcode: "09300633603540", Updated: updated}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db := getTestDB(t)
+	count, err := db.Update(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, count; want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	ids, _, err := db.Group("woolworths_sku_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "[coles_id_10 woolworths_sku_1]", fmt.Sprint(ids); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
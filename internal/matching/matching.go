@@ -0,0 +1,302 @@
+// Package matching proposes which products in different stores are the same product, so
+// their prices can be compared.
+package matching
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/unitprice"
+)
+
+// Proposals below MIN_CONFIDENCE are discarded. Those at or above AUTO_CONFIRM_CONFIDENCE
+// are confirmed without review.
+const MIN_CONFIDENCE = 0.6
+const AUTO_CONFIRM_CONFIDENCE = 0.9
+
+// Two sizes differing by no more than SIZE_TOLERANCE, as a fraction of the larger, are the same.
+const SIZE_TOLERANCE = 0.02
+
+// Candidates for a product are the other store's products sharing one of its
+// CANDIDATE_WORDS rarest name words.
+const CANDIDATE_WORDS = 2
+
+// How a match was made.
+const METHOD_BARCODE = "barcode"
+const METHOD_SIMILARITY = "similarity"
+const METHOD_MANUAL = "manual"
+
+// Match statuses. Only confirmed matches group products.
+const STATUS_PROPOSED = "proposed"
+const STATUS_CONFIRMED = "confirmed"
+const STATUS_REJECTED = "rejected"
+
+// Match is a proposed equivalence between two products in different stores.
+type Match struct {
+	ProductA   string // The prefixed product ID that sorts first.
+	ProductB   string
+	Confidence float64 // From 0 to 1.
+	Method     string  // One of the METHOD_* constants.
+	Status     string  // One of the STATUS_* constants.
+	Manual     bool    // Set by a person, so the matcher leaves it alone.
+	Updated    time.Time
+}
+
+// newMatch orders the pair and sets the status the confidence earns.
+func newMatch(a, b string, confidence float64, method string) Match {
+	if b < a {
+		a, b = b, a
+	}
+	status := STATUS_PROPOSED
+	if confidence >= AUTO_CONFIRM_CONFIDENCE {
+		status = STATUS_CONFIRMED
+	}
+	return Match{ProductA: a, ProductB: b, Confidence: confidence, Method: method, Status: status}
+}
+
+// candidate is a product prepared for comparison.
+type candidate struct {
+	product    shared.ProductInfo
+	brand      string             // Normalised, or blank if unknown.
+	brandWords map[string]bool    // The words of the brand, which are left out of words.
+	size       unitprice.Quantity // Zero if unknown.
+	words      map[string]bool    // The name's words, without the brand or size.
+}
+
+// words splits text into lower case words of letters and numbers. Decimal points are kept
+// so sizes like "1.25l" survive.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '.'
+	})
+}
+
+// normaliseBrand reduces a brand to its letters and numbers, so "Driscoll's" and
+// "DRISCOLLS" compare equal.
+func normaliseBrand(brand string) string {
+	return strings.Join(words(strings.ReplaceAll(brand, "'", "")), "")
+}
+
+// isSize reports whether the word is a size, e.g. "500g".
+func isSize(word string) bool {
+	if !strings.ContainsAny(word, "0123456789") {
+		return false
+	}
+	_, err := unitprice.Parse(word)
+	return err == nil
+}
+
+// parseSize finds the last size written in the text, e.g. "Full Cream Milk 2L" or
+// "Tomatoes 1.25 kg".
+func parseSize(text string) (unitprice.Quantity, bool) {
+	ws := words(text)
+	for i := len(ws) - 1; i >= 0; i-- {
+		if isSize(ws[i]) {
+			size, _ := unitprice.Parse(ws[i])
+			return size, true
+		}
+		if i > 0 && isSize(ws[i-1]+ws[i]) {
+			size, _ := unitprice.Parse(ws[i-1] + ws[i])
+			return size, true
+		}
+	}
+	return unitprice.Quantity{}, false
+}
+
+func newCandidate(product shared.ProductInfo) candidate {
+	c := candidate{product: product, brand: normaliseBrand(product.Brand), brandWords: map[string]bool{}, words: map[string]bool{}}
+	if product.WeightGrams > 0 {
+		c.size = unitprice.Quantity{Amount: float64(product.WeightGrams), Dimension: unitprice.MASS}
+	} else if size, ok := parseSize(product.Name); ok {
+		c.size = size
+	} else if size, ok := parseSize(product.Description); ok {
+		c.size = size
+	}
+	for _, word := range words(strings.ReplaceAll(product.Brand, "'", "")) {
+		c.brandWords[word] = true
+	}
+	nameWords := words(strings.ReplaceAll(product.Name, "'", ""))
+	for i, word := range nameWords {
+		word = strings.Trim(word, ".")
+		if word == "" || c.brandWords[word] || isSize(word) {
+			continue
+		}
+		// The parts of a size written with a space, e.g. "1.25 kg".
+		if i+1 < len(nameWords) && isSize(word+nameWords[i+1]) || i > 0 && isSize(nameWords[i-1]+word) {
+			continue
+		}
+		c.words[word] = true
+	}
+	return c
+}
+
+// sameSize reports whether the sizes are the same, within SIZE_TOLERANCE.
+func sameSize(a, b unitprice.Quantity) bool {
+	if a.Dimension != b.Dimension {
+		return false
+	}
+	return math.Abs(a.Amount-b.Amount) <= SIZE_TOLERANCE*math.Max(a.Amount, b.Amount)
+}
+
+// similarity is the Jaccard index of the candidates' words. Either's brand is left out,
+// as a product without a known brand usually has it in its name.
+func similarity(a, b candidate) float64 {
+	union, shared := 0, 0
+	for word := range a.words {
+		if b.brandWords[word] {
+			continue
+		}
+		union++
+		if b.words[word] {
+			shared++
+		}
+	}
+	for word := range b.words {
+		if !a.brandWords[word] && !a.words[word] {
+			union++
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+// score returns the confidence that the products are the same, and how that was decided.
+// Equal barcodes are certain. Otherwise the name similarity is weighted with whether the
+// brand and size are known to agree. Known brands or sizes that disagree rule a match out.
+func score(a, b candidate) (float64, string) {
+	if a.product.GTIN != "" && b.product.GTIN != "" {
+		if a.product.GTIN == b.product.GTIN {
+			return 1, METHOD_BARCODE
+		}
+		return 0, METHOD_BARCODE
+	}
+	confidence := 0.7 * similarity(a, b)
+	if a.brand != "" && b.brand != "" {
+		if a.brand != b.brand {
+			return 0, METHOD_SIMILARITY
+		}
+		confidence += 0.15
+	}
+	if a.size.Amount > 0 && b.size.Amount > 0 {
+		if !sameSize(a.size, b.size) {
+			return 0, METHOD_SIMILARITY
+		}
+		confidence += 0.15
+	}
+	return confidence, METHOD_SIMILARITY
+}
+
+// Score returns the confidence, from 0 to 1, that the products are the same, and the
+// METHOD_* that decided it.
+func Score(a, b shared.ProductInfo) (float64, string) {
+	return score(newCandidate(a), newCandidate(b))
+}
+
+// catalogue is a store's candidates, indexed for finding matches.
+type catalogue struct {
+	candidates []candidate
+	byGTIN     map[string][]int
+	byWord     map[string][]int
+}
+
+func newCatalogue(products []shared.ProductInfo) catalogue {
+	c := catalogue{byGTIN: map[string][]int{}, byWord: map[string][]int{}}
+	for i, product := range products {
+		candidate := newCandidate(product)
+		c.candidates = append(c.candidates, candidate)
+		if product.GTIN != "" {
+			c.byGTIN[product.GTIN] = append(c.byGTIN[product.GTIN], i)
+		}
+		for word := range candidate.words {
+			c.byWord[word] = append(c.byWord[word], i)
+		}
+	}
+	return c
+}
+
+// bestMatch returns the catalogue's most likely match for the candidate, if any reaches
+// MIN_CONFIDENCE.
+func (c catalogue) bestMatch(product candidate) (Match, bool) {
+	indices := c.byGTIN[product.product.GTIN]
+	if product.product.GTIN == "" || len(indices) == 0 {
+		// Comparing with everything sharing a word is slow for common words, so only
+		// the rarest few are used.
+		var ws []string
+		for word := range product.words {
+			if len(c.byWord[word]) > 0 {
+				ws = append(ws, word)
+			}
+		}
+		sort.Slice(ws, func(i, j int) bool {
+			if len(c.byWord[ws[i]]) != len(c.byWord[ws[j]]) {
+				return len(c.byWord[ws[i]]) < len(c.byWord[ws[j]])
+			}
+			return ws[i] < ws[j]
+		})
+		seen := map[int]bool{}
+		indices = nil
+		for _, word := range ws[:min(CANDIDATE_WORDS, len(ws))] {
+			for _, i := range c.byWord[word] {
+				if !seen[i] {
+					seen[i] = true
+					indices = append(indices, i)
+				}
+			}
+		}
+	}
+
+	// Ties go to the lowest ID, so proposals don't change from run to run.
+	var best Match
+	bestID := ""
+	for _, i := range indices {
+		other := c.candidates[i]
+		confidence, method := score(product, other)
+		if confidence < MIN_CONFIDENCE {
+			continue
+		}
+		if bestID == "" || confidence > best.Confidence || (confidence == best.Confidence && other.product.ID < bestID) {
+			best = newMatch(product.product.ID, other.product.ID, confidence, method)
+			bestID = other.product.ID
+		}
+	}
+	return best, bestID != ""
+}
+
+// Propose returns the likely matches between the stores' products, given one slice of
+// products per store. Each product is proposed with its best match in each other store.
+func Propose(stores [][]shared.ProductInfo) []Match {
+	catalogues := make([]catalogue, len(stores))
+	for i, products := range stores {
+		catalogues[i] = newCatalogue(products)
+	}
+	proposed := map[[2]string]Match{}
+	for i := range catalogues {
+		for j := range catalogues {
+			if i == j {
+				continue
+			}
+			for _, product := range catalogues[i].candidates {
+				if match, ok := catalogues[j].bestMatch(product); ok {
+					proposed[[2]string{match.ProductA, match.ProductB}] = match
+				}
+			}
+		}
+	}
+	matches := make([]Match, 0, len(proposed))
+	for _, match := range proposed {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].ProductA != matches[j].ProductA {
+			return matches[i].ProductA < matches[j].ProductA
+		}
+		return matches[i].ProductB < matches[j].ProductB
+	})
+	return matches
+}
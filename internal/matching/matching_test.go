@@ -0,0 +1,78 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/unitprice"
+)
+
+func TestParseSize(t *testing.T) {
+	for text, want := range map[string]unitprice.Quantity{
+		"Full Cream Milk 2L":         {Amount: 2000, Dimension: unitprice.VOLUME},
+		"Tomatoes 1.25 kg":           {Amount: 1250, Dimension: unitprice.MASS},
+		"Coca-Cola Classic 10x375ml": {Amount: 3750, Dimension: unitprice.VOLUME},
+		"Free Range Eggs 12 pack":    {Amount: 12, Dimension: unitprice.COUNT},
+	} {
+		got, ok := parseSize(text)
+		if !ok || want != got {
+			t.Errorf("%s: expected %v, got %v", text, want, got)
+		}
+	}
+	if _, ok := parseSize("Bananas"); ok {
+		t.Errorf("Expected no size")
+	}
+}
+
+func TestScore(t *testing.T) {
+	milk := shared.ProductInfo{ID: "woolworths_sku_1", Name: "Pauls Full Cream Milk 2L", Brand: "Pauls"}
+	for _, test := range []struct {
+		other      shared.ProductInfo
+		confidence float64
+		method     string
+	}{
+		{shared.ProductInfo{Name: "Full Cream Milk", Brand: "PAULS", Description: "Pauls 2L"}, 1, METHOD_SIMILARITY},
+		{shared.ProductInfo{Name: "Pauls Milk Full Cream 2L"}, 0.85, METHOD_SIMILARITY},
+		{shared.ProductInfo{Name: "Full Cream Milk 2L", Brand: "Coles"}, 0, METHOD_SIMILARITY},
+		{shared.ProductInfo{Name: "Full Cream Milk 3L", Brand: "Pauls"}, 0, METHOD_SIMILARITY},
+		{shared.ProductInfo{Name: "Pauls Smarter White Milk 2L", Brand: "Pauls"}, 0.3 + 0.2*0.7, METHOD_SIMILARITY},
+	} {
+		confidence, method := Score(milk, test.other)
+		if diff := confidence - test.confidence; diff > 1e-9 || diff < -1e-9 || method != test.method {
+			t.Errorf("%s: expected %v by %s, got %v by %s", test.other.Name, test.confidence, test.method, confidence, method)
+		}
+	}
+
+	// Barcodes decide, whatever the names.
+	a := shared.ProductInfo{Name: "Milk", GTIN: "09300633603540"}
+	if confidence, method := Score(a, shared.ProductInfo{Name: "Cheese", GTIN: "09300633603540"}); confidence != 1 || method != METHOD_BARCODE {
+		t.Errorf("Expected 1 by %s, got %v by %s", METHOD_BARCODE, confidence, method)
+	}
+	if confidence, _ := Score(a, shared.ProductInfo{Name: "Milk", GTIN: "19300633603547"}); confidence != 0 {
+		t.Errorf("Expected 0, got %v", confidence)
+	}
+}
+
+func TestPropose(t *testing.T) {
+	woolworths := []shared.ProductInfo{
+		{ID: "woolworths_sku_1", Name: "Pauls Full Cream Milk 2L", Brand: "Pauls"},
+		{ID: "woolworths_sku_2", Name: "Royal Gala Apples", GTIN: "09300633603540"},
+		{ID: "woolworths_sku_3", Name: "Woolworths Full Cream Milk 2L", Brand: "Woolworths"},
+	}
+	coles := []shared.ProductInfo{
+		{ID: "coles_id_7", Name: "Full Cream Milk 2L", Brand: "Pauls"},
+		{ID: "coles_id_8", Name: "Apples Royal Gala Loose", GTIN: "09300633603540"},
+		{ID: "coles_id_9", Name: "Full Cream Milk 2L", Brand: "Coles"},
+		{ID: "coles_id_10", Name: "Pauls Full Cream Milk 1L", Brand: "Pauls"},
+	}
+	matches := Propose([][]shared.ProductInfo{woolworths, coles})
+	if want, got := 2, len(matches); want != got {
+		t.Fatalf("Expected %d, got %d: %v", want, got, matches)
+	}
+	if want, got := (Match{ProductA: "coles_id_7", ProductB: "woolworths_sku_1", Confidence: 1, Method: METHOD_SIMILARITY, Status: STATUS_CONFIRMED}), matches[0]; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := (Match{ProductA: "coles_id_8", ProductB: "woolworths_sku_2", Confidence: 1, Method: METHOD_BARCODE, Status: STATUS_CONFIRMED}), matches[1]; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
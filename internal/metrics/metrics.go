@@ -0,0 +1,147 @@
+// Package metrics instruments the scrapers and sinks for Prometheus.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NAMESPACE prefixes every metric's name.
+const NAMESPACE = "agpd"
+
+// Registry holds every metric, along with the Go runtime's and the process's.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_requests_total",
+		Help:      "Requests to the retailers' websites, by response status. Requests that got no response have the status \"error\".",
+	}, []string{"store", "status"})
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long the retailers' websites took to respond.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"store"})
+	RateLimiterWait = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "rate_limiter_wait_seconds",
+		Help:      "How long requests waited for the rate limiter.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"store"})
+	HTTPRetries = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_retries_total",
+		Help:      "Requests to the retailers' websites retried after failing.",
+	}, []string{"store"})
+	RequestInterval = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "request_interval_seconds",
+		Help:      "The current time between requests to the retailers' websites, which grows while they're failing.",
+	}, []string{"store"})
+	PagesFetched = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "pages_fetched_total",
+		Help:      "Product list pages fetched.",
+	}, []string{"store"})
+	PagesDropped = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "pages_dropped_total",
+		Help:      "Product list pages given up on after being trapped too many times in a row, left for the next pass.",
+	}, []string{"store"})
+	ParseFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "parse_failures_total",
+		Help:      "Pages fetched that couldn't be parsed.",
+	}, []string{"store"})
+	ScrapeTrapHits = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "scrape_trap_hits_total",
+		Help:      "Scrape traps served in place of pages.",
+	}, []string{"store"})
+	ScrapeTrapCoolOff = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "scrape_trap_cool_off_seconds",
+		Help:      "How long scraping was paused for after the last scrape trap, or 0 once a page comes through.",
+	}, []string{"store"})
+	QuarantinedResponses = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "quarantined_responses_total",
+		Help:      "Responses that couldn't be used, saved for inspection, by reason.",
+	}, []string{"store", "reason"})
+	ProductsUpserted = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "products_upserted_total",
+		Help:      "Products saved to the local DB.",
+	}, []string{"store"})
+	ProductsSkipped = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "products_skipped_total",
+		Help:      "Products not saved to the local DB, by reason.",
+	}, []string{"store", "reason"})
+	QueueDepth = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "queue_depth",
+		Help:      "Product list pages due for an update that haven't been handed to a worker yet.",
+	}, []string{"store"})
+	DBSize = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "db_size_bytes",
+		Help:      "Size of the local DB.",
+	}, []string{"store"})
+	SinkWriteDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "sink_write_duration_seconds",
+		Help:      "How long writes to the sinks took.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"sink"})
+	SinkWriteErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "sink_write_errors_total",
+		Help:      "Writes to the sinks that failed.",
+	}, []string{"sink"})
+)
+
+// SKIPPED_ZERO_PRICE is the reason for skipping products with no price.
+const SKIPPED_ZERO_PRICE = "zero_price"
+
+// Value returns the value of an unlabelled gauge or counter in the registry, such as the Go
+// and process collectors' ones. It returns false if there isn't one by that name.
+func Value(name string) (float64, bool) {
+	families, err := Registry.Gather()
+	if err != nil {
+		return 0, false
+	}
+	for _, family := range families {
+		if family.GetName() != name || len(family.GetMetric()) != 1 || len(family.GetMetric()[0].GetLabel()) != 0 {
+			continue
+		}
+		m := family.GetMetric()[0]
+		switch {
+		case m.GetGauge() != nil:
+			return m.GetGauge().GetValue(), true
+		case m.GetCounter() != nil:
+			return m.GetCounter().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+// Handler serves the metrics in Prometheus' format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	PagesFetched.WithLabelValues("Woolworths").Add(3)
+	ProductsSkipped.WithLabelValues("Coles", SKIPPED_ZERO_PRICE).Inc()
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`agpd_pages_fetched_total{store="Woolworths"} 3`,
+		`agpd_products_skipped_total{reason="zero_price",store="Coles"} 1`,
+		"go_goroutines",
+		"process_start_time_seconds",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	SinkWriteErrors.WithLabelValues("value").Inc()
+	if got, ok := Value("go_goroutines"); !ok || got < 1 {
+		t.Errorf("Expected some goroutines, got %v, %v", got, ok)
+	}
+	// Labelled metrics have no single value.
+	if _, ok := Value("agpd_sink_write_errors_total"); ok {
+		t.Error("Expected no value")
+	}
+	if _, ok := Value("nope"); ok {
+		t.Error("Expected no value")
+	}
+}
@@ -0,0 +1,127 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrNoMigrationPath is returned when the database's schema version can't be reached
+// from, or is newer than, the available migrations.
+var ErrNoMigrationPath = errors.New("no migration path for schema version")
+
+// Migration upgrades a database to Version from the version before it. The first
+// migration in a list is the baseline: it builds the whole schema from an empty database,
+// so databases older than the baseline can't be migrated.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// Validate checks the migrations are in order with no gaps.
+func Validate(migrations []Migration) error {
+	if len(migrations) == 0 {
+		return fmt.Errorf("no migrations")
+	}
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version != migrations[i-1].Version+1 {
+			return fmt.Errorf("migration %d follows %d", migrations[i].Version, migrations[i-1].Version)
+		}
+	}
+	return nil
+}
+
+// Latest returns the version the migrations bring a database up to.
+func Latest(migrations []Migration) int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Version reads the schema version of the database. A database without a schema
+// table is version 0.
+func Version(db *sql.DB) (int, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema')").Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check for schema table: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err = db.QueryRow("SELECT version FROM schema").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Pending returns the migrations required to bring a database at the given version up
+// to date. It returns ErrNoMigrationPath if there's no way to get there.
+func Pending(version int, migrations []Migration) ([]Migration, error) {
+	if err := Validate(migrations); err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return migrations, nil
+	}
+	baseline := migrations[0].Version
+	if version < baseline || version > Latest(migrations) {
+		return nil, fmt.Errorf("%w %d: migrations cover %d to %d", ErrNoMigrationPath, version, baseline, Latest(migrations))
+	}
+	return migrations[version-baseline+1:], nil
+}
+
+// Migrate applies any pending migrations to the database in a single transaction, so a
+// failed step leaves the database as it was. With dryRun set the migrations are still
+// run, to prove they work, but the transaction is rolled back. Returns the migrations
+// that were, or would have been, applied.
+func Migrate(db *sql.DB, migrations []Migration, dryRun bool) ([]Migration, error) {
+	version, err := Version(db)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := Pending(version, migrations)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, migration := range pending {
+		slog.Info("Applying migration", "version", migration.Version, "description", migration.Description, "dryRun", dryRun)
+		for _, statement := range migration.Statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return nil, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+			}
+		}
+	}
+
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema (version INTEGER PRIMARY KEY)"); err != nil {
+		return nil, fmt.Errorf("failed to create schema table: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM schema"); err != nil {
+		return nil, fmt.Errorf("failed to clear schema version: %w", err)
+	}
+	if _, err := tx.Exec("INSERT INTO schema (version) VALUES (?)", Latest(migrations)); err != nil {
+		return nil, fmt.Errorf("failed to set schema version: %w", err)
+	}
+
+	if dryRun {
+		return pending, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit migrations: %w", err)
+	}
+	return pending, nil
+}
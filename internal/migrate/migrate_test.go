@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testMigrations = []Migration{
+	{Version: 3, Description: "baseline", Statements: []string{"CREATE TABLE products (productID TEXT UNIQUE, name TEXT)"}},
+	{Version: 4, Description: "add price", Statements: []string{"ALTER TABLE products ADD COLUMN priceCents INTEGER DEFAULT 0"}},
+	{Version: 5, Description: "add history", Statements: []string{"CREATE TABLE price_history (productID TEXT, priceCents INTEGER)"}},
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestPending(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		want    int
+		err     error
+	}{
+		{0, 3, nil},
+		{3, 2, nil},
+		{5, 0, nil},
+		{2, 0, ErrNoMigrationPath},
+		{6, 0, ErrNoMigrationPath},
+	} {
+		pending, err := Pending(tc.version, testMigrations)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Version %d: expected error %v, got %v", tc.version, tc.err, err)
+		}
+		if want, got := tc.want, len(pending); want != got {
+			t.Errorf("Version %d: expected %d pending, got %d", tc.version, want, got)
+		}
+	}
+
+	if _, err := Pending(3, []Migration{{Version: 3}, {Version: 5}}); err == nil {
+		t.Error("Expected an error for a gap in the migrations")
+	}
+}
+
+func TestMigrateBlank(t *testing.T) {
+	db := openTestDB(t)
+	applied, err := Migrate(db, testMigrations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(applied); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	version, err := Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 5, version; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// Running again is a no-op.
+	applied, err = Migrate(db, testMigrations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(applied); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestMigrateKeepsData(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := Migrate(db, testMigrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO products (productID, name) VALUES ('1', 'Apple')"); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := Migrate(db, testMigrations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(applied); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	var name string
+	var price int
+	if err := db.QueryRow("SELECT name, priceCents FROM products WHERE productID = '1'").Scan(&name, &price); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Apple", name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := Migrate(db, testMigrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := Migrate(db, testMigrations, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(applied); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	version, err := Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, version; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if tableExists(t, db, "price_history") {
+		t.Error("Dry run left a table behind")
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := Migrate(db, testMigrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	broken := append(testMigrations[:2:2], Migration{Version: 5, Description: "broken", Statements: []string{"NOT SQL"}})
+	if _, err := Migrate(db, broken, false); err == nil {
+		t.Fatal("Expected an error")
+	}
+	version, err := Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, version; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if _, err := db.Exec("SELECT priceCents FROM products"); err == nil {
+		t.Error("Expected the earlier step in the failed run to be rolled back")
+	}
+}
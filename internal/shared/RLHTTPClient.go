@@ -1,32 +1,283 @@
 package shared
 
 import (
-	"context"
+	"bytes"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
 	"golang.org/x/time/rate"
 )
 
 // Credit to Melchi Salins for the original code
 //https://medium.com/mflow/rate-limiting-in-golang-http-client-a22fba15861a
 
-// RLHTTPClient Rate Limited HTTP Client
+// DEFAULT_MAX_REQUEST_INTERVAL is the slowest a client backs off to by default.
+const DEFAULT_MAX_REQUEST_INTERVAL = 1 * time.Minute
+
+// DEFAULT_REQUEST_INTERVAL_SLOWDOWN_FACTOR multiplies the time between requests on each failure by default.
+const DEFAULT_REQUEST_INTERVAL_SLOWDOWN_FACTOR = 2
+
+// DEFAULT_MAX_RETRIES is how many times a failed request is retried by default.
+const DEFAULT_MAX_RETRIES = 3
+
+// DEFAULT_RETRY_BASE and DEFAULT_RETRY_MAX bound the backoff between retries by default.
+const DEFAULT_RETRY_BASE = 1 * time.Second
+const DEFAULT_RETRY_MAX = 30 * time.Second
+
+// RateLimit configures how fast a client makes requests, and how it backs off.
+//
+// The client starts making a request every Interval. Each failure, whether a 429, a 5xx,
+// a network error or a scrape trap, multiplies the time between requests by the
+// SlowdownFactor, up to MaxInterval. Each success takes Recovery off it again, back down
+// to Interval. Failed requests are retried up to MaxRetries times, after a jittered
+// exponential backoff starting at RetryBase and capped at RetryMax, or however long the
+// server's Retry-After asks for, up to RetryMax.
+type RateLimit struct {
+	IntervalMilliseconds    int     `env:"REQUEST_INTERVAL_MILLISECONDS"`
+	MaxIntervalMilliseconds int     `env:"MAX_REQUEST_INTERVAL_MILLISECONDS"`
+	SlowdownFactor          float64 `env:"REQUEST_INTERVAL_SLOWDOWN_FACTOR"`
+	RecoveryMilliseconds    int     `env:"REQUEST_INTERVAL_RECOVERY_MILLISECONDS"`
+	MaxRetries              int     `env:"MAX_RETRIES"`
+	RetryBaseMilliseconds   int     `env:"RETRY_BASE_MILLISECONDS"`
+	RetryMaxMilliseconds    int     `env:"RETRY_MAX_MILLISECONDS"`
+}
+
+// DefaultRateLimit makes a request every interval, recovering from each slowdown over
+// about ten successes.
+func DefaultRateLimit(interval time.Duration) RateLimit {
+	return RateLimit{
+		IntervalMilliseconds:    int(interval.Milliseconds()),
+		MaxIntervalMilliseconds: int(DEFAULT_MAX_REQUEST_INTERVAL.Milliseconds()),
+		SlowdownFactor:          DEFAULT_REQUEST_INTERVAL_SLOWDOWN_FACTOR,
+		RecoveryMilliseconds:    int(max(interval/10, time.Millisecond).Milliseconds()),
+		MaxRetries:              DEFAULT_MAX_RETRIES,
+		RetryBaseMilliseconds:   int(DEFAULT_RETRY_BASE.Milliseconds()),
+		RetryMaxMilliseconds:    int(DEFAULT_RETRY_MAX.Milliseconds()),
+	}
+}
+
+func milliseconds(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// RLHTTPClient Rate Limited HTTP Client. It slows down when the server struggles, and
+// retries requests that fail transiently.
 type RLHTTPClient struct {
-	Client      *http.Client
-	Ratelimiter *rate.Limiter
+	Client *http.Client
+	Store  string // Labels the client's metrics.
+
+	mu       sync.Mutex
+	limit    RateLimit
+	limiter  *rate.Limiter
+	interval time.Duration // The current time between requests.
+	check    RetryCheck
 }
 
-// Do dispatches the HTTP request to the network
+// RetryCheck inspects a failed response before it's retried, with its body. It returns
+// false if the response shouldn't be retried, but handed back to the caller as it is.
+type RetryCheck func(resp *http.Response, body []byte) bool
+
+// NewRLHTTPClient wraps the HTTP client with the rate limit.
+func NewRLHTTPClient(client *http.Client, store string, limit RateLimit) *RLHTTPClient {
+	c := &RLHTTPClient{Client: client, Store: store}
+	c.SetRateLimit(limit)
+	return c
+}
+
+// SetRateLimit replaces the client's rate limit, forgetting any slowdown.
+func (c *RLHTTPClient) SetRateLimit(limit RateLimit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+	c.interval = milliseconds(limit.IntervalMilliseconds)
+	c.limiter = rate.NewLimiter(rate.Every(c.interval), 1)
+	metrics.RequestInterval.WithLabelValues(c.Store).Set(c.interval.Seconds())
+}
+
+// SetRetryCheck sets the check Do runs on each failed response before retrying it.
+func (c *RLHTTPClient) SetRetryCheck(check RetryCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.check = check
+}
+
+// Interval returns the current time between requests.
+func (c *RLHTTPClient) Interval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interval
+}
+
+// adjustInterval changes the time between requests, within the rate limit's bounds.
+func (c *RLHTTPClient) adjustInterval(adjust func(interval time.Duration, limit RateLimit) time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	floor := milliseconds(c.limit.IntervalMilliseconds)
+	ceiling := max(milliseconds(c.limit.MaxIntervalMilliseconds), floor)
+	interval := max(min(adjust(c.interval, c.limit), ceiling), floor)
+	if interval == c.interval {
+		return
+	}
+	c.interval = interval
+	c.limiter.SetLimit(rate.Every(interval))
+	metrics.RequestInterval.WithLabelValues(c.Store).Set(interval.Seconds())
+}
+
+// SlowDown multiplies the time between requests by the slowdown factor. Do calls it on
+// failures, and stores call it when they're served a page they weren't meant to be.
+func (c *RLHTTPClient) SlowDown() {
+	c.adjustInterval(func(interval time.Duration, limit RateLimit) time.Duration {
+		return time.Duration(float64(interval) * max(limit.SlowdownFactor, 1))
+	})
+}
+
+// speedUp takes the recovery off the time between requests.
+func (c *RLHTTPClient) speedUp() {
+	c.adjustInterval(func(interval time.Duration, limit RateLimit) time.Duration {
+		return interval - milliseconds(limit.RecoveryMilliseconds)
+	})
+}
+
+// retryable returns whether a response with the status might succeed if tried again.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(status >= http.StatusInternalServerError && status != http.StatusNotImplemented)
+}
+
+// retryAfter parses a Retry-After header, in seconds or as a date. It returns zero if
+// there isn't one.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// backoff returns a jittered wait before the given retry, counting from zero. It grows
+// exponentially from RetryBase up to RetryMax, and is between half and all of that.
+func (c *RLHTTPClient) backoff(retry int) time.Duration {
+	c.mu.Lock()
+	base, ceiling := milliseconds(c.limit.RetryBaseMilliseconds), milliseconds(c.limit.RetryMaxMilliseconds)
+	c.mu.Unlock()
+	d := base
+	for i := 0; i < retry && d < ceiling; i++ {
+		d *= 2
+	}
+	d = min(d, ceiling)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Do dispatches the HTTP request to the network. The request's context cancels both the
+// wait for the rate limiter and the request itself.
+//
+// Requests that fail with a network error, a 429 or a 5xx are retried after a backoff. If
+// the retries run out the last response or error is returned, so callers see the failure
+// as they would have without retries. Requests with bodies are only retried if the body
+// can be replayed. A failed response the retry check turns down is returned straight
+// away, without slowing down, with its body still readable. Only a 2xx or 3xx speeds the
+// client back up; any other 4xx is returned as it is without touching the interval.
 func (c *RLHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	// Comment out the below 5 lines to turn off ratelimiting
-	ctx := context.Background()
-	err := c.Ratelimiter.Wait(ctx) // This is a blocking call. Honors the rate limit
+	c.mu.Lock()
+	retries, retryMax, check := c.limit.MaxRetries, milliseconds(c.limit.RetryMaxMilliseconds), c.check
+	c.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(req)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		var wait time.Duration
+		switch {
+		case err != nil:
+		case retryable(resp.StatusCode):
+			if check != nil && !check(resp, readBody(resp)) {
+				return resp, nil
+			}
+			wait = min(retryAfter(resp, time.Now()), retryMax)
+		default:
+			if resp.StatusCode < 400 {
+				c.speedUp()
+			}
+			return resp, nil
+		}
+		c.SlowDown()
+		if attempt >= retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		metrics.HTTPRetries.WithLabelValues(c.Store).Inc()
+		if !Sleep(req.Context(), wait) {
+			return nil, req.Context().Err()
+		}
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readBody reads the response's body, replacing it so it can be read again. A body that
+// fails partway through is cut short.
+func readBody(resp *http.Response) []byte {
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// rewind copies the request with a fresh body, so it can be sent again.
+func rewind(req *http.Request) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+	return next, nil
+}
+
+// do sends the request once, after waiting for the rate limiter.
+func (c *RLHTTPClient) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	err := c.rateLimiter().Wait(req.Context()) // This is a blocking call. Honors the rate limit
+	metrics.RateLimiterWait.WithLabelValues(c.Store).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return nil, err
 	}
+	start = time.Now()
 	resp, err := c.Client.Do(req)
+	metrics.HTTPRequestDuration.WithLabelValues(c.Store).Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.HTTPRequests.WithLabelValues(c.Store, "error").Inc()
 		return nil, err
 	}
+	metrics.HTTPRequests.WithLabelValues(c.Store, strconv.Itoa(resp.StatusCode)).Inc()
 	return resp, nil
 }
+
+func (c *RLHTTPClient) rateLimiter() *rate.Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limiter
+}
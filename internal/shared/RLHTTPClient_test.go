@@ -0,0 +1,347 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingServer answers with each of the statuses in turn, then 200s. Every request's body
+// is checked against the expected one.
+func failingServer(t *testing.T, body string, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := io.ReadAll(r.Body)
+		if want := body; want != string(got) {
+			t.Errorf("Expected body %q, got %q", want, got)
+		}
+		n := int(requests.Add(1)) - 1
+		if n < len(statuses) {
+			if statuses[n] == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			w.WriteHeader(statuses[n])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func testRateLimit() RateLimit {
+	return RateLimit{
+		IntervalMilliseconds:    10,
+		MaxIntervalMilliseconds: 100,
+		SlowdownFactor:          2,
+		RecoveryMilliseconds:    5,
+		MaxRetries:              3,
+		RetryBaseMilliseconds:   1,
+		RetryMaxMilliseconds:    10,
+	}
+}
+
+func get(t *testing.T, c *RLHTTPClient, url string) *http.Response {
+	req, err := http.NewRequestWithContext(t.Context(), "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRetry(t *testing.T) {
+	server, requests := failingServer(t, "", http.StatusServiceUnavailable, http.StatusBadGateway)
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+
+	resp := get(t, c, server.URL)
+	if want, got := http.StatusOK, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := int32(3), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	// Two failures doubled the interval twice, and the success took some off again.
+	if want, got := 35*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRetriesRunOut(t *testing.T) {
+	server, requests := failingServer(t, "", 500, 500, 500, 500, 500)
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+
+	resp := get(t, c, server.URL)
+	if want, got := http.StatusInternalServerError, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := int32(4), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	// Four failures would be 160ms, but it stops at the maximum.
+	if want, got := 100*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	server, requests := failingServer(t, "", http.StatusNotFound)
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+
+	resp := get(t, c, server.URL)
+	if want, got := http.StatusNotFound, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := int32(1), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 10*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestNoSpeedUpOnClientError(t *testing.T) {
+	server, _ := failingServer(t, "", http.StatusForbidden, http.StatusNotFound)
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+	c.SlowDown()
+
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound} {
+		resp := get(t, c, server.URL)
+		if want, got := status, resp.StatusCode; want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+		if want, got := 20*time.Millisecond, c.Interval(); want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+
+	// A success does speed it up again.
+	get(t, c, server.URL)
+	if want, got := 15*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, requests := failingServer(t, "", http.StatusTooManyRequests)
+	limit := testRateLimit()
+	limit.RetryMaxMilliseconds = 2000
+	c := NewRLHTTPClient(server.Client(), "test", limit)
+
+	start := time.Now()
+	resp := get(t, c, server.URL)
+	if want, got := http.StatusOK, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := int32(2), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	// The first backoff is at most a millisecond, so only the Retry-After could make it wait this long.
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected to wait at least a second, waited %v", elapsed)
+	}
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+
+	// An hour's Retry-After only waits as long as RetryMax.
+	start := time.Now()
+	resp := get(t, c, server.URL)
+	if want, got := http.StatusOK, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to wait at most RetryMax, waited %v", elapsed)
+	}
+}
+
+func TestRetryCheck(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("busy"))
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("trap"))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+	var checked []string
+	c.SetRetryCheck(func(resp *http.Response, body []byte) bool {
+		checked = append(checked, string(body))
+		return string(body) != "trap"
+	})
+
+	// The check sees the first failure and lets it be retried, then turns down the second.
+	resp := get(t, c, server.URL)
+	if want, got := http.StatusServiceUnavailable, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := []string{"busy", "trap"}, checked; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := int32(2), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	// Its body is still there for the caller.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "trap", string(body); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	// Only the retried failure slowed it down.
+	if want, got := 20*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	server, requests := failingServer(t, "request", http.StatusServiceUnavailable)
+	c := NewRLHTTPClient(server.Client(), "test", testRateLimit())
+
+	req, err := http.NewRequestWithContext(t.Context(), "POST", server.URL, bytes.NewBufferString("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if want, got := http.StatusOK, resp.StatusCode; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := int32(2), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRetryNetworkError(t *testing.T) {
+	server, _ := failingServer(t, "")
+	url := server.URL
+	server.Close()
+	limit := testRateLimit()
+	limit.MaxRetries = 1
+	c := NewRLHTTPClient(&http.Client{}, "test", limit)
+
+	req, err := http.NewRequestWithContext(t.Context(), "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if want, got := 40*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	server, requests := failingServer(t, "", http.StatusTooManyRequests)
+	limit := testRateLimit()
+	limit.RetryMaxMilliseconds = 2000
+	c := NewRLHTTPClient(server.Client(), "test", limit)
+
+	// The cancellation comes while waiting out the Retry-After.
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if want, got := int32(1), requests.Load(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestSlowDownRecovers(t *testing.T) {
+	c := NewRLHTTPClient(&http.Client{}, "test", testRateLimit())
+	c.SlowDown()
+	c.SlowDown()
+	if want, got := 40*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for i := 0; i < 10; i++ {
+		c.speedUp()
+	}
+	if want, got := 10*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Setting the rate limit forgets the slowdown.
+	c.SlowDown()
+	c.SetRateLimit(testRateLimit())
+	if want, got := 10*time.Millisecond, c.Interval(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := NewRLHTTPClient(&http.Client{}, "test", RateLimit{RetryBaseMilliseconds: 100, RetryMaxMilliseconds: 1000})
+	for retry, ceiling := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		ceiling *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := c.backoff(retry); d < ceiling/2 || d > ceiling {
+				t.Errorf("Retry %d: expected between %v and %v, got %v", retry, ceiling/2, ceiling, d)
+			}
+		}
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-5":                            0,
+		"soon":                          0,
+		"Mon, 01 Jan 2024 00:00:30 GMT": 30 * time.Second,
+		"Sun, 31 Dec 2023 23:00:00 GMT": 0,
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if value != "" {
+			resp.Header.Set("Retry-After", value)
+		}
+		if got := retryAfter(resp, now); want != got {
+			t.Errorf("%q: Expected %v, got %v", value, want, got)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for status, want := range map[int]bool{200: false, 404: false, 429: true, 500: true, 501: false, 503: true} {
+		if got := retryable(status); want != got {
+			t.Errorf("%d: Expected %v, got %v", status, want, got)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package shared
+
+import (
+	"context"
+	"time"
+)
+
+// Sleep pauses for the duration, or until the context is done. It returns false if the
+// context finished first, so loops can use it to know when to stop.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// jarWithout is a cookie jar that never sends one of its cookies.
+type jarWithout struct {
+	http.CookieJar
+	name string
+}
+
+// JarWithout wraps the cookie jar so it never sends the named cookie, even if the server
+// sets it. Requests that need the cookie add it themselves, and the jar can't send a second,
+// conflicting copy alongside it.
+func JarWithout(jar http.CookieJar, name string) http.CookieJar {
+	return jarWithout{jar, name}
+}
+
+func (j jarWithout) Cookies(u *url.URL) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, cookie := range j.CookieJar.Cookies(u) {
+		if cookie.Name != j.name {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
@@ -0,0 +1,47 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestJarWithout(t *testing.T) {
+	var got [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var stores []string
+		for _, cookie := range r.Cookies() {
+			stores = append(stores, cookie.Name+"="+cookie.Value)
+		}
+		got = append(got, stores)
+		http.SetCookie(w, &http.Cookie{Name: "store", Value: "server"})
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+	}))
+	defer server.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: JarWithout(jar, "store")}
+
+	for _, store := range []string{"", "1234"} {
+		req, err := http.NewRequestWithContext(t.Context(), "GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store != "" {
+			req.AddCookie(&http.Cookie{Name: "store", Value: store})
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The jar keeps the session, but only the request's own store is sent.
+	if want := [][]string{nil, {"store=1234", "session=1"}}; !slices.EqualFunc(want, got, slices.Equal) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
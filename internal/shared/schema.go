@@ -12,21 +12,118 @@ type ProductInfo struct {
 	ID                 string
 	Name               string
 	Description        string
+	Brand              string
 	Store              string
 	Department         string
 	Location           string
+	GTIN               string // The product's barcode as a GTIN-14, or blank if it isn't known.
 	PriceCents         int
 	PreviousPriceCents int
 	WeightGrams        int
+	Promotion          Promotion
+	UnitPrice          UnitPrice
 	Timestamp          time.Time
 }
 
+// WithDefaultLocation puts the retailer's default location, "", ahead of the others,
+// dropping repeats. The default location is always scraped, because searching, matching
+// and the inflation index only read its prices.
+func WithDefaultLocation(locations []string) []string {
+	result := []string{""}
+	seen := map[string]bool{"": true}
+	for _, location := range locations {
+		if !seen[location] {
+			seen[location] = true
+			result = append(result, location)
+		}
+	}
+	return result
+}
+
+// The amounts a UnitPrice can be given per.
+const UNIT_PER_100G = "100g"
+const UNIT_PER_100ML = "100ml"
+const UNIT_EACH = "each"
+
+// UnitPrice is a product's price normalised to a standard amount, so products sold in
+// different sizes, or by different retailers, can be compared.
+type UnitPrice struct {
+	Cents float64 // The price of Unit, to a hundredth of a cent.
+	Unit  string  // One of the UNIT_* constants, or blank if the unit price isn't known.
+}
+
+// Promotion types, from most to least significant. A product on more than one kind of
+// promotion is recorded as the most significant.
+const PROMOTION_NONE = ""
+const PROMOTION_HALF_PRICE = "half_price"
+const PROMOTION_SPECIAL = "special"
+const PROMOTION_MULTIBUY = "multibuy"
+const PROMOTION_MEMBER_PRICE = "member_price"
+
+// Promotion describes a temporary offer on a product. A product's PriceCents is always the
+// price anyone pays for one unit, so a multibuy or member price doesn't change it.
+type Promotion struct {
+	Type               string // One of the PROMOTION_* constants.
+	WasPriceCents      int    // The regular price while the product is on special, otherwise 0.
+	MultibuyQuantity   int    // The number of units that must be bought for MultibuyPriceCents.
+	MultibuyPriceCents int    // The total price of MultibuyQuantity units.
+	MemberPriceCents   int    // The price for members of the retailer's loyalty program.
+}
+
+// OnPromotion reports whether there's any promotion on the product.
+func (p Promotion) OnPromotion() bool {
+	return p.Type != PROMOTION_NONE
+}
+
+// ExportCursor marks how far a consumer has read through a store's products. Products
+// are exported in (Updated, ProductID, Location) order, so the triple uniquely identifies
+// a position. ProductID is the store's own ID, without the store prefix.
+type ExportCursor struct {
+	Updated   time.Time
+	ProductID string
+	Location  string
+}
+
+// PriceHistoryEntry is a product's price at a location as first seen at Recorded. It holds
+// until the product's next entry at that location.
+type PriceHistoryEntry struct {
+	Location      string
+	PriceCents    int
+	WasPriceCents int
+	OnSpecial     bool
+	PromotionType string
+	Recorded      time.Time
+}
+
+// ShrinkflationEvent is a product's pack getting smaller without its price falling to
+// match, as seen between two consecutive updates.
+type ShrinkflationEvent struct {
+	ID                string // The prefixed product ID.
+	Name              string
+	Store             string
+	Location          string
+	SizeUnit          string // "g", "ml" or "each".
+	BeforeSize        float64
+	AfterSize         float64
+	BeforePriceCents  int
+	AfterPriceCents   int
+	UnitPriceIncrease float64 // The rise in price per unit of size, e.g. 0.1 for 10%.
+	Detected          time.Time
+}
+
+// The timeseries sinks write shrinkflation events to their product table's name with this
+// suffix.
+const SHRINKFLATION_TABLE_SUFFIX = "_shrinkflation"
+
 const SYSTEM_VERSION_FIELD = "version"
 const SYSTEM_SERVICE_NAME = "agpd"
 const SYSTEM_RAM_UTILISATION_PERCENT_FIELD = "ram_utilisation_percentage"
 const SYSTEM_PRODUCTS_PER_SECOND_FIELD = "products_per_second"
 const SYSTEM_HDD_BYTES_FREE_FIELD = "hdd_bytes_free"
 const SYSTEM_TOTAL_PRODUCT_COUNT_FIELD = "total_product_count"
+const SYSTEM_FAKE_SALES_FIELD = "fake_sales"           // Suffixed with the lower case store name.
+const SYSTEM_INFLATION_INDEX_FIELD = "inflation_index" // Combined, or suffixed with the lower case store name.
+const SYSTEM_SCRAPE_TRAPPED_FIELD = "scrape_trapped"   // Suffixed with the lower case store name.
 
 type SystemStatusDatapoint struct {
 	RAMUtilisationPercent float64
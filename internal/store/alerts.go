@@ -0,0 +1,51 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SentAlert is the last alert a watchlist rule sent about a product at a location.
+type SentAlert struct {
+	Rule       string
+	ProductID  string // The prefixed ID.
+	Location   string
+	PriceCents int // Zero once the rule stopped matching the product.
+	Sent       time.Time
+}
+
+// GetSentAlerts returns the last alert each rule sent about each product.
+func (d *DB) GetSentAlerts() ([]SentAlert, error) {
+	rows, err := d.Query("SELECT rule, productID, location, priceCents, sent FROM alerts_sent ORDER BY rule, productID, location")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sent alerts: %w", err)
+	}
+	defer rows.Close()
+	var alerts []SentAlert
+	for rows.Next() {
+		var alert SentAlert
+		if err := rows.Scan(&alert.Rule, &alert.ProductID, &alert.Location, &alert.PriceCents, &alert.Sent); err != nil {
+			return alerts, fmt.Errorf("failed to scan sent alert: %w", err)
+		}
+		alert.ProductID = d.retailer.IDPrefix + alert.ProductID
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// SaveSentAlert records the last alert a rule sent about a product at a location, replacing
+// the one before. The ID may be given with or without the retailer's prefix.
+func (d *DB) SaveSentAlert(alert SentAlert) error {
+	_, err := d.Exec(`
+		INSERT INTO alerts_sent (rule, productID, location, priceCents, sent)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (rule, productID, location) DO UPDATE SET
+			priceCents = excluded.priceCents,
+			sent = excluded.sent`,
+		alert.Rule, strings.TrimPrefix(alert.ProductID, d.retailer.IDPrefix), alert.Location, alert.PriceCents, alert.Sent)
+	if err != nil {
+		return fmt.Errorf("failed to save sent alert: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSentAlerts(t *testing.T) {
+	db := getTestDB(t)
+	sent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, alert := range []SentAlert{
+		{Rule: "cheap milk", ProductID: "test_1", PriceCents: 280, Sent: sent},
+		{Rule: "cheap milk", ProductID: "1", Location: "1234", PriceCents: 290, Sent: sent},
+		// A later alert replaces the earlier one.
+		{Rule: "cheap milk", ProductID: "test_1", PriceCents: 0, Sent: sent.Add(time.Hour)},
+	} {
+		if err := db.SaveSentAlert(alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alerts, err := db.GetSentAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(alerts); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := (SentAlert{Rule: "cheap milk", ProductID: "test_1", PriceCents: 0, Sent: sent.Add(time.Hour)}), alerts[0]; want != got {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if want, got := (SentAlert{Rule: "cheap milk", ProductID: "test_1", Location: "1234", PriceCents: 290, Sent: sent}), alerts[1]; want != got {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
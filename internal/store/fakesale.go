@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// FakeSaleRecord is a fake sale as it's kept in the DB.
+type FakeSaleRecord struct {
+	analysis.FakeSale
+	ProductID string // The prefixed ID.
+	Store     string
+	Name      string
+	Detected  time.Time // When the sale was first flagged.
+	Updated   time.Time // When the sale was last flagged.
+}
+
+// DetectFakeSales checks every special in the DB for fake sales and records them. It returns
+// the sales flagged by this check, in ID order. Those first detected by it have a
+// Detected time of now.
+func (d *DB) DetectFakeSales(options analysis.FakeSaleOptions, now time.Time) ([]FakeSaleRecord, error) {
+	var ids []string
+	rows, err := d.Query("SELECT DISTINCT productID FROM products WHERE promotionType IN (?, ?) ORDER BY productID",
+		shared.PROMOTION_SPECIAL, shared.PROMOTION_HALF_PRICE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query specials: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan productID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query specials: %w", err)
+	}
+
+	var flagged []FakeSaleRecord
+	for _, id := range ids {
+		history, err := d.GetPriceHistory(id)
+		if err != nil {
+			return flagged, err
+		}
+		for _, sale := range analysis.CheckSales(history, options) {
+			_, err := d.Exec(`
+				INSERT INTO fake_sales (productID, location, saleStarted, priceCents, wasPriceCents, wasPriceShare, medianPriceCents, reasons, detected, updated)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (productID, location, saleStarted) DO UPDATE SET
+					priceCents = excluded.priceCents,
+					wasPriceCents = excluded.wasPriceCents,
+					wasPriceShare = excluded.wasPriceShare,
+					medianPriceCents = excluded.medianPriceCents,
+					reasons = excluded.reasons,
+					updated = excluded.updated`,
+				id, sale.Location, sale.SaleStarted, sale.PriceCents, sale.WasPriceCents, sale.WasPriceShare,
+				sale.MedianPriceCents, strings.Join(sale.Reasons, ","), now, now)
+			if err != nil {
+				return flagged, fmt.Errorf("failed to save fake sale: %w", err)
+			}
+		}
+	}
+	return d.queryFakeSales("WHERE fake_sales.updated = ? ORDER BY fake_sales.productID, fake_sales.location", now)
+}
+
+// GetFakeSales returns the fake sales recorded in the DB, most recently detected first.
+func (d *DB) GetFakeSales(limit, offset int) ([]FakeSaleRecord, error) {
+	return d.queryFakeSales("ORDER BY fake_sales.detected DESC, fake_sales.productID, fake_sales.location LIMIT ? OFFSET ?", limit, offset)
+}
+
+// queryFakeSales returns the fake sales selected by the clause.
+func (d *DB) queryFakeSales(clause string, args ...any) ([]FakeSaleRecord, error) {
+	rows, err := d.Query(`
+		SELECT
+			fake_sales.productID,
+			fake_sales.location,
+			COALESCE(products.name, ''),
+			saleStarted,
+			fake_sales.priceCents,
+			fake_sales.wasPriceCents,
+			wasPriceShare,
+			medianPriceCents,
+			reasons,
+			detected,
+			fake_sales.updated
+		FROM
+			fake_sales
+			LEFT JOIN products ON products.productID = fake_sales.productID AND products.location = fake_sales.location
+		`+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fake sales: %w", err)
+	}
+	defer rows.Close()
+	var sales []FakeSaleRecord
+	for rows.Next() {
+		var sale FakeSaleRecord
+		var reasons string
+		err := rows.Scan(&sale.ProductID, &sale.Location, &sale.Name, &sale.SaleStarted, &sale.PriceCents, &sale.WasPriceCents,
+			&sale.WasPriceShare, &sale.MedianPriceCents, &reasons, &sale.Detected, &sale.Updated)
+		if err != nil {
+			return sales, fmt.Errorf("failed to scan fake sale: %w", err)
+		}
+		sale.ProductID = d.retailer.IDPrefix + sale.ProductID
+		sale.Store = d.retailer.Name
+		sale.Reasons = strings.Split(reasons, ",")
+		sales = append(sales, sale)
+	}
+	return sales, rows.Err()
+}
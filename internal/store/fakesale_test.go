@@ -0,0 +1,80 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestDetectFakeSales(t *testing.T) {
+	db := getTestDB(t)
+	start := time.Now().Add(-10 * 7 * 24 * time.Hour)
+	special := shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: 500}
+	for _, product := range []Product{
+		// The was price was never charged.
+		{ID: "1", Name: "Apples", PriceCents: 400, Updated: start},
+		{ID: "1", Name: "Apples", PriceCents: 350, Promotion: special, Updated: start.Add(9 * 7 * 24 * time.Hour)},
+		// A genuine special.
+		{ID: "2", Name: "Pears", PriceCents: 500, Updated: start},
+		{ID: "2", Name: "Pears", PriceCents: 350, Promotion: special, Updated: start.Add(9 * 7 * 24 * time.Hour)},
+	} {
+		if err := db.SaveProducts([]Product{product}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	sales, err := db.DetectFakeSales(analysis.DefaultFakeSaleOptions, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(sales); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "test_1", sales[0].ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Apples", sales[0].Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := analysis.REASON_WAS_PRICE_RARELY_CHARGED, sales[0].Reasons[0]; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if !sales[0].Detected.Equal(now) {
+		t.Errorf("Expected %v, got %v", now, sales[0].Detected)
+	}
+
+	// Checking again finds the same sale, first detected earlier.
+	later := now.Add(time.Hour)
+	sales, err = db.DetectFakeSales(analysis.DefaultFakeSaleOptions, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(sales); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if !sales[0].Detected.Equal(now) {
+		t.Errorf("Expected %v, got %v", now, sales[0].Detected)
+	}
+
+	// Once the special ends it's no longer flagged, but is still recorded.
+	if err := db.SaveProducts([]Product{{ID: "1", Name: "Apples", PriceCents: 400, Updated: later}}); err != nil {
+		t.Fatal(err)
+	}
+	sales, err = db.DetectFakeSales(analysis.DefaultFakeSaleOptions, later.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(sales); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	sales, err = db.GetFakeSales(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(sales); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+)
+
+// MIN_FORECAST_HISTORY is the fewest price changes a product needs before a cycle is
+// looked for. A cycle needs at least two drops and two recoveries.
+const MIN_FORECAST_HISTORY = 4
+
+// ForecastRecord is a low price forecast as it's kept in the DB.
+type ForecastRecord struct {
+	analysis.LowPriceForecast
+	ProductID string // The prefixed ID.
+	Computed  time.Time
+}
+
+// UpdateForecasts looks for promotion cycles in every product's price history and records
+// a forecast of the next low price for each found. Forecasts for products no longer cycling
+// are removed. Returns the number of forecasts recorded.
+func (d *DB) UpdateForecasts(options analysis.PeriodicityOptions, now time.Time) (int, error) {
+	var ids []string
+	rows, err := d.Query("SELECT productID FROM price_history GROUP BY productID HAVING COUNT(*) >= ? ORDER BY productID",
+		MIN_FORECAST_HISTORY)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query price histories: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan productID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query price histories: %w", err)
+	}
+
+	count := 0
+	for _, id := range ids {
+		history, err := d.GetPriceHistory(id)
+		if err != nil {
+			return count, err
+		}
+		for _, forecast := range analysis.PredictLowPrices(history, now, options) {
+			_, err := d.Exec(`
+				INSERT INTO forecasts (productID, location, periodDays, confidence, regularPriceCents, lowPriceCents, nextLowStart, nextLowEnd, computed)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (productID, location) DO UPDATE SET
+					periodDays = excluded.periodDays,
+					confidence = excluded.confidence,
+					regularPriceCents = excluded.regularPriceCents,
+					lowPriceCents = excluded.lowPriceCents,
+					nextLowStart = excluded.nextLowStart,
+					nextLowEnd = excluded.nextLowEnd,
+					computed = excluded.computed`,
+				id, forecast.Location, int(forecast.Period/(24*time.Hour)), forecast.Confidence, forecast.RegularPriceCents,
+				forecast.LowPriceCents, forecast.NextLowStart, forecast.NextLowEnd, now)
+			if err != nil {
+				return count, fmt.Errorf("failed to save forecast: %w", err)
+			}
+			count++
+		}
+	}
+	if _, err := d.Exec("DELETE FROM forecasts WHERE computed != ?", now); err != nil {
+		return count, fmt.Errorf("failed to clear stale forecasts: %w", err)
+	}
+	return count, nil
+}
+
+// GetForecasts returns the product's low price forecast at each location it cycles at, in
+// location order. The ID may be given with or without the retailer's prefix.
+func (d *DB) GetForecasts(id string) ([]ForecastRecord, error) {
+	rows, err := d.Query(`
+		SELECT productID, location, periodDays, confidence, regularPriceCents, lowPriceCents, nextLowStart, nextLowEnd, computed
+		FROM forecasts
+		WHERE productID = ?
+		ORDER BY location`, strings.TrimPrefix(id, d.retailer.IDPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query forecasts: %w", err)
+	}
+	defer rows.Close()
+	var forecasts []ForecastRecord
+	for rows.Next() {
+		var forecast ForecastRecord
+		var periodDays int
+		err := rows.Scan(&forecast.ProductID, &forecast.Location, &periodDays, &forecast.Confidence, &forecast.RegularPriceCents,
+			&forecast.LowPriceCents, &forecast.NextLowStart, &forecast.NextLowEnd, &forecast.Computed)
+		if err != nil {
+			return forecasts, fmt.Errorf("failed to scan forecast: %w", err)
+		}
+		forecast.ProductID = d.retailer.IDPrefix + forecast.ProductID
+		forecast.Period = time.Duration(periodDays) * 24 * time.Hour
+		forecasts = append(forecasts, forecast)
+	}
+	return forecasts, rows.Err()
+}
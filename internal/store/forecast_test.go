@@ -0,0 +1,86 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+)
+
+func TestUpdateForecasts(t *testing.T) {
+	db := getTestDB(t)
+	fortnight := 14 * 24 * time.Hour
+	start := time.Now().Truncate(24 * time.Hour).Add(-8 * fortnight)
+	// Apples are cheap for four days a fortnight. Pears were cheap once.
+	for i := 0; i < 8; i++ {
+		cycleStart := start.Add(time.Duration(i) * fortnight)
+		for _, product := range []Product{
+			{ID: "1", Name: "Apples", PriceCents: 500, Updated: cycleStart},
+			{ID: "1", Name: "Apples", PriceCents: 350, Updated: cycleStart.Add(10 * 24 * time.Hour)},
+		} {
+			if err := db.SaveProducts([]Product{product}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, product := range []Product{
+		{ID: "2", Name: "Pears", PriceCents: 500, Updated: start},
+		{ID: "2", Name: "Pears", PriceCents: 350, Updated: start.Add(fortnight)},
+		{ID: "2", Name: "Pears", PriceCents: 500, Updated: start.Add(2 * fortnight)},
+		{ID: "2", Name: "Pears", PriceCents: 450, Updated: start.Add(3 * fortnight)},
+	} {
+		if err := db.SaveProducts([]Product{product}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	count, err := db.UpdateForecasts(analysis.DefaultPeriodicityOptions, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, count; want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	forecasts, err := db.GetForecasts("test_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(forecasts); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "test_1", forecasts[0].ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := fortnight, forecasts[0].Period; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 350, forecasts[0].LowPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if forecasts[0].NextLowEnd.Before(now) {
+		t.Errorf("Expected the next low price window to end after %v, got %v", now, forecasts[0].NextLowEnd)
+	}
+	forecasts, err = db.GetForecasts("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(forecasts); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// Once the apples stop cycling, their forecast goes.
+	if _, err := db.Exec("DELETE FROM price_history WHERE productID = '1'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateForecasts(analysis.DefaultPeriodicityOptions, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	forecasts, err = db.GetForecasts("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(forecasts); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !sqlite_fts5
+
+package store
+
+// fts5Tag is whether the tests were built with the sqlite_fts5 tag, and so must have FTS5.
+const fts5Tag = false
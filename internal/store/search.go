@@ -0,0 +1,194 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// searchIndexSelect selects a product's row in products_search. Callers append the WHERE clause.
+const searchIndexSelect = `
+	SELECT products.rowid, products.name, products.description, products.brand, COALESCE(departments.description, '')
+	FROM
+		products
+		LEFT JOIN departments ON products.departmentID = departments.departmentID`
+
+// searchRank weighs matches in the name, description, brand and department columns
+// respectively. Lower ranks are better matches.
+const searchRank = "bm25(products_search, 10.0, 1.0, 5.0, 2.0)"
+
+// SearchOptions narrows and pages a product search.
+type SearchOptions struct {
+	// Department matches a department's ID or, ignoring case, its description. Blank
+	// matches every department.
+	Department string
+	// Limit is the most results to return. Below one returns every match.
+	Limit  int
+	Offset int
+}
+
+// SearchResult is a product matching a search. Results are ordered by Rank, lowest first.
+// Ranks from different stores are only roughly comparable, as each store weighs words by
+// how common they are in its own catalogue.
+type SearchResult struct {
+	Product shared.ProductInfo
+	Rank    float64
+}
+
+// initSearch creates the products_search full-text index and fills in any products missing
+// from it. The index needs SQLite's FTS5 module, which go-sqlite3 only builds with the
+// sqlite_fts5 build tag. Without it searches fall back to matching names with LIKE, which
+// is unranked and reads every product. The index isn't a migration so the same DB works
+// in either build.
+func (d *DB) initSearch() error {
+	var enabled bool
+	if err := d.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled); err != nil {
+		return fmt.Errorf("failed to check for FTS5: %w", err)
+	}
+	if !enabled {
+		slog.Warn("SQLite was built without FTS5, product search will be slow and unranked. Build with -tags sqlite_fts5 to fix.", "store", d.retailer.Name)
+		return nil
+	}
+	_, err := d.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS products_search
+		USING fts5(name, description, brand, department, tokenize = 'unicode61 remove_diacritics 2')`)
+	if err != nil {
+		return fmt.Errorf("failed to create search index: %w", err)
+	}
+	d.fullText = true
+
+	// Products saved by a build without FTS5 weren't indexed.
+	var indexed, products int
+	err = d.QueryRow("SELECT (SELECT COUNT(*) FROM products_search), (SELECT COUNT(*) FROM products)").Scan(&indexed, &products)
+	if err != nil {
+		return fmt.Errorf("failed to count indexed products: %w", err)
+	}
+	if indexed == products {
+		return nil
+	}
+	slog.Info("Rebuilding search index", "store", d.retailer.Name, "indexed", indexed, "products", products)
+	tx, err := d.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM products_search"); err != nil {
+		return fmt.Errorf("failed to clear search index: %w", err)
+	}
+	if _, err := tx.Exec("INSERT INTO products_search (rowid, name, description, brand, department)" + searchIndexSelect); err != nil {
+		return fmt.Errorf("failed to fill search index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// indexProduct replaces the product's entry in the search index with its saved details.
+func (d *DB) indexProduct(tx *sql.Tx, productID string, location string) error {
+	if !d.fullText {
+		return nil
+	}
+	_, err := tx.Exec("DELETE FROM products_search WHERE rowid = (SELECT rowid FROM products WHERE productID = ? AND location = ?)", productID, location)
+	if err != nil {
+		return fmt.Errorf("failed to remove product from search index: %w", err)
+	}
+	_, err = tx.Exec("INSERT INTO products_search (rowid, name, description, brand, department)"+searchIndexSelect+`
+		WHERE productID = ? AND location = ?`, productID, location)
+	if err != nil {
+		return fmt.Errorf("failed to add product to search index: %w", err)
+	}
+	return nil
+}
+
+// searchWords splits a query into the words the search index holds.
+func searchWords(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// matchExpression builds an FTS5 query matching products with every word of the query
+// as a prefix of one of their words, e.g. "gala app" finds "Royal Gala Apples".
+func matchExpression(words []string) string {
+	terms := make([]string, len(words))
+	for i, word := range words {
+		// The words are only letters and numbers, so they can't escape the quotes.
+		terms[i] = `"` + word + `"*`
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchProducts returns the products at the retailer's default location matching every
+// word of the query, best matches first. Names, descriptions, brands and departments are
+// searched, with words matching as prefixes.
+func (d *DB) SearchProducts(query string, options SearchOptions) ([]SearchResult, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	limit := options.Limit
+	if limit < 1 {
+		limit = -1
+	}
+
+	var conditions []string
+	var args []any
+	var from, rank, order string
+	if d.fullText {
+		from = `
+		FROM
+			products_search
+			JOIN products ON products.rowid = products_search.rowid
+			LEFT JOIN departments ON products.departmentID = departments.departmentID`
+		rank = searchRank
+		order = "searchRank, productID"
+		conditions = append(conditions, "products_search MATCH ?")
+		args = append(args, matchExpression(words))
+	} else {
+		from = `
+		FROM
+			products
+			LEFT JOIN departments ON products.departmentID = departments.departmentID`
+		rank = "0.0"
+		order = "products.name, productID"
+		for _, word := range words {
+			conditions = append(conditions, "(products.name LIKE ? ESCAPE '\\' OR products.brand LIKE ? ESCAPE '\\')")
+			pattern := "%" + likeEscaper.Replace(word) + "%"
+			args = append(args, pattern, pattern)
+		}
+	}
+	conditions = append(conditions, "location = ''")
+	if options.Department != "" {
+		conditions = append(conditions, "(products.departmentID = ? OR departments.description = ? COLLATE NOCASE)")
+		args = append(args, options.Department, options.Department)
+	}
+	args = append(args, limit, options.Offset)
+
+	rows, err := d.Query(`
+		SELECT`+sharedProductColumns+`,
+			`+rank+` AS searchRank`+from+`
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+order+`
+		LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search products: %w", err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		result.Product, err = d.scanSharedProduct(rows, &result.Rank)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getSearchTestDB(t *testing.T) *DB {
+	db := getTestDB(t)
+	updated := time.Now()
+	for _, department := range []Department{
+		{ID: "fruit", Description: "Fruit & Veg", Updated: updated},
+		{ID: "bakery", Description: "Bakery", Updated: updated},
+	} {
+		if err := db.SaveDepartment(department); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.SaveProducts([]Product{
+		{ID: "1", Name: "Royal Gala Apples", Brand: "Woolworths", DepartmentID: "fruit", Updated: updated},
+		{ID: "1", Location: "1234", Name: "Royal Gala Apples", Brand: "Woolworths", DepartmentID: "fruit", Updated: updated},
+		{ID: "2", Name: "Pink Lady Apples", DepartmentID: "fruit", Updated: updated},
+		{ID: "3", Name: "Strawberries", Brand: "Driscoll's", DepartmentID: "fruit", Updated: updated},
+		{ID: "4", Name: "Apple Pie", Description: "Apple and cinnamon", DepartmentID: "bakery", Updated: updated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// requireFullText skips the test if the DB has no full-text index, unless the tests were
+// built with the sqlite_fts5 tag, in which case it fails.
+func requireFullText(t *testing.T, db *DB) {
+	t.Helper()
+	if db.fullText {
+		return
+	}
+	if fts5Tag {
+		t.Fatal("Built with -tags sqlite_fts5 but SQLite has no FTS5")
+	}
+	t.Skip("SQLite was built without FTS5, use -tags sqlite_fts5")
+}
+
+// searchIDs returns the IDs of the products found, in order.
+func searchIDs(t *testing.T, db *DB, query string, options SearchOptions) []string {
+	results, err := db.SearchProducts(query, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.Product.ID)
+	}
+	return ids
+}
+
+func TestSearchProducts(t *testing.T) {
+	db := getSearchTestDB(t)
+	for _, test := range []struct {
+		query   string
+		options SearchOptions
+		want    int
+	}{
+		{"apples", SearchOptions{}, 2},
+		{"gala app", SearchOptions{}, 1},
+		{"GALA", SearchOptions{}, 1},
+		{"driscoll", SearchOptions{}, 1},
+		{"apple", SearchOptions{}, 3},
+		{"apple", SearchOptions{Department: "bakery"}, 1},
+		{"apple", SearchOptions{Department: "fruit & veg"}, 2},
+		{"apple", SearchOptions{Limit: 2}, 2},
+		{"apple", SearchOptions{Limit: 2, Offset: 2}, 1},
+		{"apple", SearchOptions{Offset: 3}, 0},
+		{"pears", SearchOptions{}, 0},
+		{`"apple*" -`, SearchOptions{}, 3},
+		{"%_", SearchOptions{}, 0},
+	} {
+		if got := len(searchIDs(t, db, test.query, test.options)); test.want != got {
+			t.Errorf("%q %+v: expected %d, got %d", test.query, test.options, test.want, got)
+		}
+	}
+
+	// Renamed products are reindexed.
+	if err := db.SaveProducts([]Product{{ID: "2", Name: "Pink Lady Pears", DepartmentID: "fruit", Updated: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := fmt.Sprint([]string{"test_2"}), fmt.Sprint(searchIDs(t, db, "pears", SearchOptions{})); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 1, len(searchIDs(t, db, "apples", SearchOptions{})); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestSearchProductsLike(t *testing.T) {
+	db := getSearchTestDB(t)
+	// As if SQLite had been built without FTS5.
+	db.fullText = false
+	for _, test := range []struct {
+		query   string
+		options SearchOptions
+		want    []string
+	}{
+		// Sorted by name rather than ranked.
+		{"apples", SearchOptions{}, []string{"test_2", "test_1"}},
+		{"GALA app", SearchOptions{}, []string{"test_1"}},
+		{"driscoll", SearchOptions{}, []string{"test_3"}},
+		{"apple", SearchOptions{Department: "fruit & veg"}, []string{"test_2", "test_1"}},
+		{"apple", SearchOptions{Limit: 1, Offset: 1}, []string{"test_2"}},
+		// Only names and brands are searched.
+		{"cinnamon", SearchOptions{}, nil},
+		{"veg", SearchOptions{}, nil},
+		// Wildcards are matched literally.
+		{"%_", SearchOptions{}, nil},
+	} {
+		if want, got := fmt.Sprint(test.want), fmt.Sprint(searchIDs(t, db, test.query, test.options)); want != got {
+			t.Errorf("%q %+v: expected %s, got %s", test.query, test.options, want, got)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	db := getSearchTestDB(t)
+	requireFullText(t, db)
+	// A match in the name outranks one in the description.
+	if want, got := "test_4", searchIDs(t, db, "cinnamon apple", SearchOptions{})[0]; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	// Departments are searched too.
+	if want, got := 3, len(searchIDs(t, db, "veg", SearchOptions{})); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	results, err := db.SearchProducts("apple", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i-1].Rank > results[i].Rank {
+			t.Errorf("Expected results in rank order, got %v before %v", results[i-1].Rank, results[i].Rank)
+		}
+	}
+}
+
+func TestSearchIndexRebuild(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db3")
+	db, err := Open(dbPath, testRetailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.fullText {
+		db.Close()
+		requireFullText(t, db)
+	}
+	if err := db.SaveProducts([]Product{{ID: "1", Name: "Royal Gala Apples", Updated: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	// As if the product had been saved by a build without FTS5.
+	if _, err := db.Exec("DELETE FROM products_search"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(dbPath, testRetailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if want, got := 1, len(searchIDs(t, db, "gala", SearchOptions{})); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+// The search index has a brand column of its own, so selecting the product's brand
+// alongside it mustn't be ambiguous.
+func TestSearchProductBrand(t *testing.T) {
+	db := getSearchTestDB(t)
+	results, err := db.SearchProducts("driscoll", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(results); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "Driscoll's", results[0].Product.Brand; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// checkShrinkflation compares the product with how it was last saved at its location,
+// recording a shrinkflation event if its pack shrank without the price falling to match.
+func (d *DB) checkShrinkflation(tx *sql.Tx, product Product) error {
+	var previous Product
+	err := tx.QueryRow(`
+		SELECT priceCents, weightGrams, unitPriceCents, unitPriceUnit
+		FROM products
+		WHERE productID = ? AND location = ?`, product.ID, product.Location).Scan(
+		&previous.PriceCents, &previous.WeightGrams, &previous.UnitPrice.Cents, &previous.UnitPrice.Unit)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to load previous pack size: %w", err)
+	}
+
+	before, ok := analysis.SizeOf(previous.WeightGrams, previous.PriceCents, previous.UnitPrice)
+	if !ok {
+		return nil
+	}
+	after, ok := analysis.SizeOf(product.WeightGrams, product.PriceCents, product.UnitPrice)
+	if !ok {
+		return nil
+	}
+	increase, ok := analysis.CheckShrinkflation(before, after, previous.PriceCents, product.PriceCents)
+	if !ok {
+		return nil
+	}
+	slog.Info("Shrinkflation detected", "store", d.retailer.Name, "id", product.ID, "name", product.Name, "location", product.Location,
+		"before", before.Amount, "after", after.Amount, "unit", after.Unit, "unitPriceIncrease", increase)
+	_, err = tx.Exec(`
+		INSERT INTO shrinkflation (productID, location, detected, sizeUnit, beforeSize, afterSize, beforePriceCents, afterPriceCents, unitPriceIncrease)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (productID, location, detected) DO NOTHING`,
+		product.ID, product.Location, product.Updated, after.Unit, before.Amount, after.Amount, previous.PriceCents, product.PriceCents, increase)
+	if err != nil {
+		return fmt.Errorf("failed to save shrinkflation: %w", err)
+	}
+	return nil
+}
+
+// GetShrinkflation returns the shrinkflation events recorded in the DB, most recent first.
+func (d *DB) GetShrinkflation(limit, offset int) ([]shared.ShrinkflationEvent, error) {
+	return d.queryShrinkflation("ORDER BY detected DESC, shrinkflation.productID, shrinkflation.location LIMIT ? OFFSET ?", limit, offset)
+}
+
+// GetShrinkflationAfterCursor provides up to count shrinkflation events that sort after the
+// given cursor, ordered by (detected, productID, location). It also returns the cursor of the
+// last event provided, which is the given cursor if there are no more.
+func (d *DB) GetShrinkflationAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ShrinkflationEvent, shared.ExportCursor, error) {
+	events, err := d.queryShrinkflation(`
+		WHERE detected > ? OR (detected = ? AND (shrinkflation.productID > ? OR (shrinkflation.productID = ? AND shrinkflation.location > ?)))
+		ORDER BY detected, shrinkflation.productID, shrinkflation.location
+		LIMIT ?`, cursor.Updated, cursor.Updated, cursor.ProductID, cursor.ProductID, cursor.Location, count)
+	if err != nil || len(events) == 0 {
+		return events, cursor, err
+	}
+	last := events[len(events)-1]
+	return events, shared.ExportCursor{Updated: last.Detected, ProductID: strings.TrimPrefix(last.ID, d.retailer.IDPrefix), Location: last.Location}, nil
+}
+
+// queryShrinkflation returns the shrinkflation events selected by the clause.
+func (d *DB) queryShrinkflation(clause string, args ...any) ([]shared.ShrinkflationEvent, error) {
+	rows, err := d.Query(`
+		SELECT
+			shrinkflation.productID,
+			shrinkflation.location,
+			COALESCE(products.name, ''),
+			sizeUnit,
+			beforeSize,
+			afterSize,
+			beforePriceCents,
+			afterPriceCents,
+			unitPriceIncrease,
+			detected
+		FROM
+			shrinkflation
+			LEFT JOIN products ON products.productID = shrinkflation.productID AND products.location = shrinkflation.location
+		`+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shrinkflation: %w", err)
+	}
+	defer rows.Close()
+	var events []shared.ShrinkflationEvent
+	for rows.Next() {
+		var event shared.ShrinkflationEvent
+		err := rows.Scan(&event.ID, &event.Location, &event.Name, &event.SizeUnit, &event.BeforeSize, &event.AfterSize,
+			&event.BeforePriceCents, &event.AfterPriceCents, &event.UnitPriceIncrease, &event.Detected)
+		if err != nil {
+			return events, fmt.Errorf("failed to scan shrinkflation: %w", err)
+		}
+		event.ID = d.retailer.IDPrefix + event.ID
+		event.Store = d.retailer.Name
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestShrinkflation(t *testing.T) {
+	db := getTestDB(t)
+	start := time.Now().Add(-time.Hour)
+	for _, product := range []Product{
+		{ID: "1", Name: "Chips", PriceCents: 400, WeightGrams: 200, Updated: start},
+		// The pack shrinks at the same price.
+		{ID: "1", Name: "Chips", PriceCents: 400, WeightGrams: 180, Updated: start.Add(time.Minute)},
+		// Known only by its unit price, a bottle shrinks and gets dearer.
+		{ID: "2", Name: "Juice", PriceCents: 300, UnitPrice: shared.UnitPrice{Cents: 15, Unit: shared.UNIT_PER_100ML}, Updated: start},
+		{ID: "2", Name: "Juice", PriceCents: 330, UnitPrice: shared.UnitPrice{Cents: 18.33, Unit: shared.UNIT_PER_100ML}, Updated: start.Add(2 * time.Minute)},
+		// A price rise alone isn't shrinkflation.
+		{ID: "3", Name: "Bread", PriceCents: 400, WeightGrams: 700, Updated: start},
+		{ID: "3", Name: "Bread", PriceCents: 450, WeightGrams: 700, Updated: start.Add(3 * time.Minute)},
+	} {
+		if err := db.SaveProducts([]Product{product}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := db.GetShrinkflation(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(events); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	juice, chips := events[0], events[1]
+	if want, got := "test_2", juice.ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "ml", juice.SizeUnit; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 330, juice.AfterPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := "Chips", chips.Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 180.0, chips.AfterSize; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 200.0/180-1, chips.UnitPriceIncrease; math.Abs(want-got) > 1e-9 {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Exporting pages through the events oldest first.
+	exported, cursor, err := db.GetShrinkflationAfterCursor(shared.ExportCursor{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(exported); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "test_1", exported[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	exported, cursor, err = db.GetShrinkflationAfterCursor(cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(exported); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "test_2", exported[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	exported, _, err = db.GetShrinkflationAfterCursor(cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(exported); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
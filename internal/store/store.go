@@ -0,0 +1,819 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tjhowse/aus_grocery_price_database/internal/gtin"
+	"github.com/tjhowse/aus_grocery_price_database/internal/migrate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// Retailer describes a store to the storage layer. It's all a retailer needs to provide to
+// keep its products in a DB.
+type Retailer struct {
+	// Name is the store name on exported products, e.g. "Woolworths".
+	Name string
+	// IDPrefix is prepended to product IDs when they're exported.
+	IDPrefix string
+	// SchemaBaseline is the schema version the retailer's DBs were at when migrations
+	// were introduced. New retailers should use 1.
+	SchemaBaseline int
+}
+
+// Product is a product as it's kept in the DB. A product is stored once per location, where
+// the location is the retailer's store the price was read from. The empty location is the
+// retailer's default.
+type Product struct {
+	ID                 string
+	Location           string
+	Name               string
+	Description        string
+	Brand              string
+	Barcode            string
+	PriceCents         int
+	PreviousPriceCents int // Only set when loading. Saving moves the old price here.
+	Promotion          shared.Promotion
+	UnitPrice          shared.UnitPrice
+	WeightGrams        int
+	RawJSON            []byte
+	DepartmentID       string
+	DepartmentName     string // Only set when loading, from the department table.
+	Updated            time.Time
+}
+
+// Department is a department as it's kept in the DB.
+type Department struct {
+	ID           string
+	Description  string
+	ProductCount int
+	Updated      time.Time
+}
+
+// DB is a retailer's local SQLite product cache. The embedded *sql.DB is available for
+// retailer-specific queries.
+type DB struct {
+	*sql.DB
+	retailer Retailer
+	fullText bool // Whether products_search is available, see initSearch.
+}
+
+// schemaSteps are the changes to the schema, oldest first. Each becomes a migration
+// numbered from the retailer's baseline. To change the schema, append a step. Never
+// edit one that has shipped.
+var schemaSteps = []struct {
+	description string
+	statements  []string
+}{
+	{
+		description: "baseline",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS departments (departmentID TEXT UNIQUE, description TEXT, productCount INTEGER, updated DATETIME)",
+			`CREATE TABLE IF NOT EXISTS products
+			(	productID TEXT UNIQUE,
+				name TEXT,
+				description TEXT,
+				barcode TEXT,
+				priceCents INTEGER,
+				previousPriceCents INTEGER,
+				weightGrams INTEGER,
+				productJSON TEXT,
+				departmentID TEXT DEFAULT "",
+				updated DATETIME
+			)`,
+		},
+	},
+	{
+		description: "export cursors",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS export_cursors (name TEXT PRIMARY KEY, updated DATETIME, productID TEXT)",
+		},
+	},
+	{
+		description: "price history",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS price_history (productID TEXT, priceCents INTEGER, wasPriceCents INTEGER, onSpecial BOOLEAN, recorded DATETIME)",
+			"CREATE INDEX IF NOT EXISTS price_history_product ON price_history (productID, recorded)",
+		},
+	},
+	{
+		// SQLite can't change a table's constraints, so products is rebuilt to make
+		// (productID, location) unique instead of productID. Existing rows are at the
+		// retailer's default location.
+		description: "locations",
+		statements: []string{
+			`CREATE TABLE products_by_location
+			(	productID TEXT,
+				location TEXT NOT NULL DEFAULT '',
+				name TEXT,
+				description TEXT,
+				barcode TEXT,
+				priceCents INTEGER,
+				previousPriceCents INTEGER,
+				weightGrams INTEGER,
+				productJSON TEXT,
+				departmentID TEXT DEFAULT "",
+				updated DATETIME,
+				UNIQUE (productID, location)
+			)`,
+			`INSERT INTO products_by_location (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
+			SELECT productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated FROM products`,
+			"DROP TABLE products",
+			"ALTER TABLE products_by_location RENAME TO products",
+			"ALTER TABLE price_history ADD COLUMN location TEXT NOT NULL DEFAULT ''",
+			"DROP INDEX IF EXISTS price_history_product",
+			"CREATE INDEX price_history_product ON price_history (productID, location, recorded)",
+			"ALTER TABLE export_cursors ADD COLUMN location TEXT NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		description: "promotions",
+		statements: []string{
+			"ALTER TABLE products ADD COLUMN promotionType TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE products ADD COLUMN wasPriceCents INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE products ADD COLUMN multibuyQuantity INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE products ADD COLUMN multibuyPriceCents INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE products ADD COLUMN memberPriceCents INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE price_history ADD COLUMN promotionType TEXT NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		description: "unit prices",
+		statements: []string{
+			"ALTER TABLE products ADD COLUMN unitPriceCents REAL NOT NULL DEFAULT 0",
+			"ALTER TABLE products ADD COLUMN unitPriceUnit TEXT NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		// gtin is filled in as products are next saved.
+		description: "gtin index",
+		statements: []string{
+			"ALTER TABLE products ADD COLUMN gtin TEXT NOT NULL DEFAULT ''",
+			"CREATE INDEX products_gtin ON products (gtin)",
+			"UPDATE products SET barcode = '' WHERE barcode = '0'",
+		},
+	},
+	{
+		// brand is filled in as products are next saved. The full-text index over it
+		// isn't a migration, see initSearch.
+		description: "brands",
+		statements: []string{
+			"ALTER TABLE products ADD COLUMN brand TEXT NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		description: "fake sales",
+		statements: []string{
+			`CREATE TABLE fake_sales
+			(	productID TEXT,
+				location TEXT,
+				saleStarted DATETIME,
+				priceCents INTEGER,
+				wasPriceCents INTEGER,
+				wasPriceShare REAL,
+				medianPriceCents INTEGER,
+				reasons TEXT,
+				detected DATETIME,
+				updated DATETIME,
+				PRIMARY KEY (productID, location, saleStarted)
+			)`,
+			"CREATE INDEX fake_sales_detected ON fake_sales (detected)",
+		},
+	},
+	{
+		description: "low price forecasts",
+		statements: []string{
+			`CREATE TABLE forecasts
+			(	productID TEXT,
+				location TEXT,
+				periodDays INTEGER,
+				confidence REAL,
+				regularPriceCents INTEGER,
+				lowPriceCents INTEGER,
+				nextLowStart DATETIME,
+				nextLowEnd DATETIME,
+				computed DATETIME,
+				PRIMARY KEY (productID, location)
+			)`,
+		},
+	},
+	{
+		description: "shrinkflation",
+		statements: []string{
+			`CREATE TABLE shrinkflation
+			(	productID TEXT,
+				location TEXT,
+				detected DATETIME,
+				sizeUnit TEXT,
+				beforeSize REAL,
+				afterSize REAL,
+				beforePriceCents INTEGER,
+				afterPriceCents INTEGER,
+				unitPriceIncrease REAL,
+				PRIMARY KEY (productID, location, detected)
+			)`,
+			"CREATE INDEX shrinkflation_detected ON shrinkflation (detected)",
+		},
+	},
+	{
+		description: "alerts sent",
+		statements: []string{
+			`CREATE TABLE alerts_sent
+			(	rule TEXT,
+				productID TEXT,
+				location TEXT,
+				priceCents INTEGER,
+				sent DATETIME,
+				PRIMARY KEY (rule, productID, location)
+			)`,
+		},
+	},
+}
+
+// Migrations returns the retailer's schema migrations.
+func (r Retailer) Migrations() []migrate.Migration {
+	var migrations []migrate.Migration
+	for i, step := range schemaSteps {
+		migrations = append(migrations, migrate.Migration{
+			Version:     r.SchemaBaseline + i,
+			Description: step.description,
+			Statements:  step.statements,
+		})
+	}
+	return migrations
+}
+
+// SchemaVersion returns the schema version the retailer's DBs are migrated to.
+func (r Retailer) SchemaVersion() int {
+	return migrate.Latest(r.Migrations())
+}
+
+// backupDB moves the specified DB to the same directory with an ISO8601 timestamp and the schema
+// number prepended to the filename.
+func backupDB(dbPath string, oldSchema int) error {
+	backupName := fmt.Sprintf("%s.%d.%s", dbPath, oldSchema, time.Now().Format("2006-01-02T15:04:05"))
+	err := os.Rename(dbPath, backupName)
+	if err != nil {
+		return fmt.Errorf("failed to backup existing DB: %w", err)
+	}
+	slog.Info("Backed up old DB", "old", dbPath, "new", backupName)
+	return nil
+}
+
+func openDB(dbPath string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dbPath+"?cache=shared")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// Open opens the retailer's DB and migrates it to the current schema. If the DB is at a
+// version that can't be migrated it's backed up and replaced with a blank one.
+func Open(dbPath string, retailer Retailer) (*DB, error) {
+	migrations := retailer.Migrations()
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DB: %w", err)
+	}
+	_, err = migrate.Migrate(db, migrations, false)
+	if errors.Is(err, migrate.ErrNoMigrationPath) {
+		version, verr := migrate.Version(db)
+		if verr != nil {
+			return nil, fmt.Errorf("failed to read schema version: %w", verr)
+		}
+		slog.Warn("DB schema can't be migrated, starting afresh", "path", dbPath, "currentVersion", migrate.Latest(migrations), "detectedVersion", version, "error", err)
+		err = db.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to close existing DB before backing it up: %w", err)
+		}
+		err = backupDB(dbPath, version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to backup existing DB: %w", err)
+		}
+		db, err = openDB(dbPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open DB: %w", err)
+		}
+		_, err = migrate.Migrate(db, migrations, false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate DB: %w", err)
+	}
+	d := &DB{DB: db, retailer: retailer}
+	if err := d.initSearch(); err != nil {
+		return nil, fmt.Errorf("failed to initialise search index: %w", err)
+	}
+	return d, nil
+}
+
+// DryRunMigrations reports the migrations the DB at dbPath needs, proving they apply
+// cleanly without committing them. A DB that doesn't exist yet needs every migration.
+func DryRunMigrations(dbPath string, retailer Retailer) ([]migrate.Migration, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return retailer.Migrations(), nil
+	}
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DB: %w", err)
+	}
+	defer db.Close()
+	return migrate.Migrate(db, retailer.Migrations(), true)
+}
+
+// normaliseBarcode returns the barcode as a GTIN-14, or blank if it isn't a valid barcode.
+func normaliseBarcode(barcode string) string {
+	if barcode == "" {
+		return ""
+	}
+	normalised, err := gtin.Normalise(barcode)
+	if err != nil {
+		slog.Debug("Ignoring invalid barcode", "barcode", barcode, "error", err)
+		return ""
+	}
+	return normalised
+}
+
+// SaveProduct upserts the product and records its price history, and any shrinkflation
+// since it was last saved.
+func (d *DB) SaveProduct(tx *sql.Tx, product Product) error {
+	var err error
+	var result sql.Result
+
+	if err := d.checkShrinkflation(tx, product); err != nil {
+		return err
+	}
+	result, err = tx.Exec(`
+			INSERT INTO products (productID, location, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated,
+				promotionType, wasPriceCents, multibuyQuantity, multibuyPriceCents, memberPriceCents,
+				unitPriceCents, unitPriceUnit, gtin, brand)
+			VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(productID, location) DO UPDATE SET
+				name = excluded.name,
+				description = excluded.description,
+				barcode = excluded.barcode,
+				priceCents = excluded.priceCents,
+				previousPriceCents = priceCents,
+				weightGrams = excluded.weightGrams,
+				productJSON = excluded.productJSON,
+				departmentID = excluded.departmentID,
+				updated = excluded.updated,
+				promotionType = excluded.promotionType,
+				wasPriceCents = excluded.wasPriceCents,
+				multibuyQuantity = excluded.multibuyQuantity,
+				multibuyPriceCents = excluded.multibuyPriceCents,
+				memberPriceCents = excluded.memberPriceCents,
+				unitPriceCents = excluded.unitPriceCents,
+				unitPriceUnit = excluded.unitPriceUnit,
+				gtin = excluded.gtin,
+				brand = excluded.brand`,
+		product.ID, product.Location, product.Name, product.Description, product.Barcode,
+		product.PriceCents,
+		product.WeightGrams, product.RawJSON, product.DepartmentID, product.Updated,
+		product.Promotion.Type, product.Promotion.WasPriceCents, product.Promotion.MultibuyQuantity,
+		product.Promotion.MultibuyPriceCents, product.Promotion.MemberPriceCents,
+		product.UnitPrice.Cents, product.UnitPrice.Unit, normaliseBarcode(product.Barcode), product.Brand)
+
+	if err != nil {
+		return fmt.Errorf("failed to update product info: %w", err)
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if rowsAffected == 0 {
+		slog.Warn("Product info not updated.")
+	}
+	if err := d.indexProduct(tx, product.ID, product.Location); err != nil {
+		return err
+	}
+
+	return d.savePriceHistory(tx, product.ID, shared.PriceHistoryEntry{
+		Location:      product.Location,
+		PriceCents:    product.PriceCents,
+		WasPriceCents: product.Promotion.WasPriceCents,
+		OnSpecial:     product.Promotion.OnPromotion(),
+		PromotionType: product.Promotion.Type,
+		Recorded:      product.Updated,
+	})
+}
+
+// SaveProducts saves the products in a single transaction.
+func (d *DB) SaveProducts(products []Product) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, product := range products {
+		if err := d.SaveProduct(tx, product); err != nil {
+			return fmt.Errorf("failed to save product info: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LoadProduct loads a cached product at a location from the database, returning
+// shared.ErrProductMissing if it isn't there.
+func (d *DB) LoadProduct(productID string, location string) (Product, error) {
+	var product Product
+	var deptDescription sql.NullString
+	var barcode sql.NullString
+	row := d.QueryRow(`
+	SELECT
+		productID,
+		location,
+		name,
+		products.description,
+		barcode,
+		priceCents,
+		previousPriceCents,
+		weightGrams,
+		productJSON,
+		products.departmentID,
+		departments.description,
+		products.updated,
+		promotionType,
+		wasPriceCents,
+		multibuyQuantity,
+		multibuyPriceCents,
+		memberPriceCents,
+		unitPriceCents,
+		unitPriceUnit,
+		brand
+	FROM
+		products
+		LEFT JOIN departments ON products.departmentID = departments.departmentID
+	WHERE productID = ? AND location = ? LIMIT 1`, productID, location)
+	err := row.Scan(
+		&product.ID,
+		&product.Location,
+		&product.Name,
+		&product.Description,
+		&barcode,
+		&product.PriceCents,
+		&product.PreviousPriceCents,
+		&product.WeightGrams,
+		&product.RawJSON,
+		&product.DepartmentID,
+		&deptDescription, // This value comes from a join, so it might be NULL.
+		&product.Updated,
+		&product.Promotion.Type,
+		&product.Promotion.WasPriceCents,
+		&product.Promotion.MultibuyQuantity,
+		&product.Promotion.MultibuyPriceCents,
+		&product.Promotion.MemberPriceCents,
+		&product.UnitPrice.Cents,
+		&product.UnitPrice.Unit,
+		&product.Brand)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return product, shared.ErrProductMissing
+		}
+		return product, fmt.Errorf("failed to query existing product info: %w", err)
+	}
+	product.Barcode = barcode.String
+	if deptDescription.Valid {
+		product.DepartmentName = deptDescription.String
+	}
+	return product, nil
+}
+
+// SaveDepartment upserts the department.
+func (d *DB) SaveDepartment(department Department) error {
+	var err error
+	var result sql.Result
+
+	result, err = d.Exec(`
+		INSERT INTO departments (departmentID, description, productCount, updated)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(departmentID) DO UPDATE SET
+			departmentID = excluded.departmentID,
+			description = excluded.description,
+			productCount = excluded.productCount,
+			updated = excluded.updated`,
+		department.ID, department.Description, department.ProductCount, department.Updated)
+
+	if err != nil {
+		return fmt.Errorf("failed to update department ID info: %w", err)
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if rowsAffected == 0 {
+		slog.Warn("Department not upserted")
+	}
+
+	return nil
+}
+
+// Size returns the size of the DB in bytes.
+func (d *DB) Size() (int64, error) {
+	var size int64
+	err := d.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query DB size: %w", err)
+	}
+	return size, nil
+}
+
+// LastDepartmentUpdate returns when a department was last scraped, or the zero time if none
+// has been.
+func (d *DB) LastDepartmentUpdate() (time.Time, error) {
+	var updated time.Time
+	err := d.QueryRow("SELECT updated FROM departments ORDER BY updated DESC LIMIT 1").Scan(&updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query last department update: %w", err)
+	}
+	return updated, nil
+}
+
+// LoadDepartments loads every department in the database.
+func (d *DB) LoadDepartments() ([]Department, error) {
+	var departments []Department
+	rows, err := d.Query("SELECT departmentID, description, productCount, updated FROM departments")
+	if err != nil {
+		return departments, fmt.Errorf("failed to query departmentIDs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var department Department
+		err = rows.Scan(&department.ID, &department.Description, &department.ProductCount, &department.Updated)
+		if err != nil {
+			return departments, fmt.Errorf("failed to scan departmentID: %w", err)
+		}
+		departments = append(departments, department)
+	}
+	return departments, nil
+}
+
+// GetSharedProductsUpdatedAfter provides a list of product IDs that have been updated since the given time
+func (d *DB) GetSharedProductsUpdatedAfter(t time.Time, count int) ([]shared.ProductInfo, error) {
+	products, _, err := d.GetSharedProductsAfterCursor(shared.ExportCursor{Updated: t}, count)
+	return products, err
+}
+
+// sharedProductColumns are the columns scanSharedProduct reads.
+const sharedProductColumns = `
+			productID,
+			location,
+			gtin,
+			products.name,
+			products.description,
+			departments.description,
+			priceCents,
+			previousPriceCents,
+			weightGrams,
+			products.updated,
+			promotionType,
+			wasPriceCents,
+			multibuyQuantity,
+			multibuyPriceCents,
+			memberPriceCents,
+			unitPriceCents,
+			unitPriceUnit,
+			products.brand`
+
+// sharedProductQuery selects the columns scanSharedProducts reads. Callers append the
+// WHERE clause.
+const sharedProductQuery = `
+		SELECT` + sharedProductColumns + `
+		FROM
+			products
+			LEFT JOIN departments ON products.departmentID = departments.departmentID`
+
+// scanSharedProducts reads the rows of a sharedProductQuery, prefixing the IDs for export.
+func (d *DB) scanSharedProducts(rows *sql.Rows) ([]shared.ProductInfo, error) {
+	var products []shared.ProductInfo
+	for rows.Next() {
+		product, err := d.scanSharedProduct(rows)
+		if err != nil {
+			return products, err
+		}
+		products = append(products, product)
+	}
+	return products, rows.Err()
+}
+
+// scanSharedProduct reads the current row of a sharedProductQuery. Any columns selected
+// after the shared ones are scanned into extra.
+func (d *DB) scanSharedProduct(rows *sql.Rows, extra ...any) (shared.ProductInfo, error) {
+	var product shared.ProductInfo
+	var deptDescription sql.NullString
+	dest := []any{
+		&product.ID,
+		&product.Location,
+		&product.GTIN,
+		&product.Name,
+		&product.Description,
+		&deptDescription,
+		&product.PriceCents,
+		&product.PreviousPriceCents,
+		&product.WeightGrams,
+		&product.Timestamp,
+		&product.Promotion.Type,
+		&product.Promotion.WasPriceCents,
+		&product.Promotion.MultibuyQuantity,
+		&product.Promotion.MultibuyPriceCents,
+		&product.Promotion.MemberPriceCents,
+		&product.UnitPrice.Cents,
+		&product.UnitPrice.Unit,
+		&product.Brand,
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return product, fmt.Errorf("failed to scan productID: %w", err)
+	}
+	if deptDescription.Valid {
+		product.Department = deptDescription.String
+	}
+	product.ID = d.retailer.IDPrefix + product.ID
+	product.Store = d.retailer.Name
+	return product, nil
+}
+
+// GetSharedProductsAfterCursor provides up to count products that sort after the given cursor,
+// ordered by (updated, productID, location). It also returns the cursor of the last product provided, which
+// is the given cursor if there are no more products.
+func (d *DB) GetSharedProductsAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ProductInfo, shared.ExportCursor, error) {
+	rows, err := d.Query(sharedProductQuery+`
+		WHERE
+			(products.updated > ? OR (products.updated = ? AND (productID > ? OR (productID = ? AND location > ?))))
+			AND name != ''
+		ORDER BY products.updated, productID, location
+		LIMIT ?`, cursor.Updated, cursor.Updated, cursor.ProductID, cursor.ProductID, cursor.Location, count)
+	if err != nil {
+		return nil, cursor, fmt.Errorf("failed to query productIDs: %w", err)
+	}
+	defer rows.Close()
+	products, err := d.scanSharedProducts(rows)
+	if err != nil {
+		return products, cursor, err
+	}
+	if len(products) > 0 {
+		last := products[len(products)-1]
+		cursor = shared.ExportCursor{Updated: last.Timestamp, ProductID: strings.TrimPrefix(last.ID, d.retailer.IDPrefix), Location: last.Location}
+	}
+	return products, cursor, nil
+}
+
+// GetProduct returns the product at every location it's stocked, ordered by location. The ID
+// may be given with or without the retailer's prefix. Returns shared.ErrProductMissing if
+// the product isn't in the database.
+func (d *DB) GetProduct(id string) ([]shared.ProductInfo, error) {
+	rows, err := d.Query(sharedProductQuery+`
+		WHERE productID = ?
+		ORDER BY location`, strings.TrimPrefix(id, d.retailer.IDPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query product: %w", err)
+	}
+	defer rows.Close()
+	products, err := d.scanSharedProducts(rows)
+	if err != nil {
+		return products, err
+	}
+	if len(products) == 0 {
+		return nil, shared.ErrProductMissing
+	}
+	return products, nil
+}
+
+// FindByGTIN returns the products at every location with the given GTIN-14, ordered by ID
+// and location.
+func (d *DB) FindByGTIN(code string) ([]shared.ProductInfo, error) {
+	if code == "" {
+		return nil, nil
+	}
+	rows, err := d.Query(sharedProductQuery+`
+		WHERE gtin = ?
+		ORDER BY productID, location`, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query products by gtin: %w", err)
+	}
+	defer rows.Close()
+	return d.scanSharedProducts(rows)
+}
+
+// Status summarises the contents of the DB.
+type Status struct {
+	ProductCount    int
+	DepartmentCount int
+	LastUpdated     time.Time // When a product was last updated, or zero if there are none.
+}
+
+// GetStatus summarises the contents of the DB.
+func (d *DB) GetStatus() (Status, error) {
+	var status Status
+	err := d.QueryRow("SELECT COUNT(*) FROM products").Scan(&status.ProductCount)
+	if err != nil {
+		return status, fmt.Errorf("failed to query product count: %w", err)
+	}
+	// MAX(updated) would lose the column's type, so the time wouldn't be parsed.
+	err = d.QueryRow("SELECT updated FROM products ORDER BY updated DESC LIMIT 1").Scan(&status.LastUpdated)
+	if err != nil && err != sql.ErrNoRows {
+		return status, fmt.Errorf("failed to query last updated time: %w", err)
+	}
+	err = d.QueryRow("SELECT COUNT(*) FROM departments").Scan(&status.DepartmentCount)
+	if err != nil {
+		return status, fmt.Errorf("failed to query department count: %w", err)
+	}
+	return status, nil
+}
+
+// Retailer returns the retailer whose products are in the DB.
+func (d *DB) Retailer() Retailer {
+	return d.retailer
+}
+
+// GetTotalProductCount returns the total number of products in the database.
+func (d *DB) GetTotalProductCount() (int, error) {
+	var count int
+	err := d.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query product count: %w", err)
+	}
+	return count, nil
+}
+
+// LoadExportCursor loads the named export cursor from the database. A cursor that has never
+// been saved is returned as the zero cursor, which sorts before every product.
+func (d *DB) LoadExportCursor(name string) (shared.ExportCursor, error) {
+	var cursor shared.ExportCursor
+	err := d.QueryRow("SELECT updated, productID, location FROM export_cursors WHERE name = ?", name).Scan(&cursor.Updated, &cursor.ProductID, &cursor.Location)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return shared.ExportCursor{}, nil
+		}
+		return shared.ExportCursor{}, fmt.Errorf("failed to query export cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// SaveExportCursor saves the named export cursor to the database.
+func (d *DB) SaveExportCursor(name string, cursor shared.ExportCursor) error {
+	_, err := d.Exec(`
+		INSERT INTO export_cursors (name, updated, productID, location)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			updated = excluded.updated,
+			productID = excluded.productID,
+			location = excluded.location`,
+		name, cursor.Updated, cursor.ProductID, cursor.Location)
+	if err != nil {
+		return fmt.Errorf("failed to save export cursor: %w", err)
+	}
+	return nil
+}
+
+// savePriceHistory appends an entry to the product's price history, unless the price, was-price,
+// special state and promotion type are the same as the product's latest entry at the same location.
+func (d *DB) savePriceHistory(tx *sql.Tx, productID string, entry shared.PriceHistoryEntry) error {
+	_, err := tx.Exec(`
+		INSERT INTO price_history (productID, location, priceCents, wasPriceCents, onSpecial, promotionType, recorded)
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM (
+				SELECT priceCents, wasPriceCents, onSpecial, promotionType FROM price_history
+				WHERE productID = ? AND location = ? ORDER BY recorded DESC LIMIT 1
+			) AS latest
+			WHERE latest.priceCents = ? AND latest.wasPriceCents = ? AND latest.onSpecial = ? AND latest.promotionType = ?
+		)`,
+		productID, entry.Location, entry.PriceCents, entry.WasPriceCents, entry.OnSpecial, entry.PromotionType, entry.Recorded,
+		productID, entry.Location, entry.PriceCents, entry.WasPriceCents, entry.OnSpecial, entry.PromotionType)
+	if err != nil {
+		return fmt.Errorf("failed to save price history: %w", err)
+	}
+	return nil
+}
+
+// GetPriceHistory returns every recorded price change for the product at every location,
+// oldest first. The ID may be given with or without the retailer's prefix.
+func (d *DB) GetPriceHistory(id string) ([]shared.PriceHistoryEntry, error) {
+	var history []shared.PriceHistoryEntry
+	rows, err := d.Query(`
+		SELECT location, priceCents, wasPriceCents, onSpecial, promotionType, recorded
+		FROM price_history
+		WHERE productID = ?
+		ORDER BY recorded, location`, strings.TrimPrefix(id, d.retailer.IDPrefix))
+	if err != nil {
+		return history, fmt.Errorf("failed to query price history: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry shared.PriceHistoryEntry
+		if err := rows.Scan(&entry.Location, &entry.PriceCents, &entry.WasPriceCents, &entry.OnSpecial, &entry.PromotionType, &entry.Recorded); err != nil {
+			return history, fmt.Errorf("failed to scan price history: %w", err)
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
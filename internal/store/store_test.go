@@ -0,0 +1,278 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+var testRetailer = Retailer{Name: "Test", IDPrefix: "test_", SchemaBaseline: 1}
+
+func getTestDB(t *testing.T) *DB {
+	db, err := Open(":memory:", testRetailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrations(t *testing.T) {
+	migrations := Retailer{SchemaBaseline: 7}.Migrations()
+	if want, got := len(schemaSteps), len(migrations); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := 7, migrations[0].Version; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 7+len(schemaSteps)-1, (Retailer{SchemaBaseline: 7}).SchemaVersion(); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestSaveAndLoadProduct(t *testing.T) {
+	db := getTestDB(t)
+	if err := db.SaveDepartment(Department{ID: "fruit", Description: "Fruit", ProductCount: 1, Updated: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	updated := time.Now().Add(-time.Minute)
+	unitPrice := shared.UnitPrice{Cents: 35.5, Unit: shared.UNIT_PER_100G}
+	product := Product{ID: "1", Name: "Apple", Brand: "Pink Lady", Barcode: "9300000000000", PriceCents: 100, UnitPrice: unitPrice, DepartmentID: "fruit", Updated: updated}
+	if err := db.SaveProducts([]Product{product}); err != nil {
+		t.Fatal(err)
+	}
+	product.PriceCents = 120
+	if err := db.SaveProducts([]Product{product}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := db.LoadProduct("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 120, loaded.PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 100, loaded.PreviousPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := "Fruit", loaded.DepartmentName; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "9300000000000", loaded.Barcode; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Pink Lady", loaded.Brand; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := unitPrice, loaded.UnitPrice; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if _, err := db.LoadProduct("2", ""); err != shared.ErrProductMissing {
+		t.Errorf("Expected %v, got %v", shared.ErrProductMissing, err)
+	}
+
+	products, err := db.GetSharedProductsUpdatedAfter(time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "test_1", products[0].ID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "Test", products[0].Store; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := unitPrice, products[0].UnitPrice; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	history, err := db.GetPriceHistory("test_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(history); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestLocations(t *testing.T) {
+	db := getTestDB(t)
+	updated := time.Now().Add(-time.Minute)
+	err := db.SaveProducts([]Product{
+		{ID: "1", Location: "", Name: "Apple", PriceCents: 100, Updated: updated},
+		{ID: "1", Location: "0584", Name: "Apple", PriceCents: 110, Updated: updated},
+		{ID: "1", Location: "0361", Name: "Apple", PriceCents: 105, Updated: updated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for location, want := range map[string]int{"": 100, "0584": 110, "0361": 105} {
+		product, err := db.LoadProduct("1", location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := product.PriceCents; want != got {
+			t.Errorf("%q: expected %d, got %d", location, want, got)
+		}
+	}
+
+	// Products that share an updated time and ID are ordered by location, so a cursor can
+	// stop between them.
+	products, cursor, err := db.GetSharedProductsAfterCursor(shared.ExportCursor{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "0361", cursor.Location; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if err := db.SaveExportCursor("test", cursor); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err = db.LoadExportCursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	products, _, err = db.GetSharedProductsAfterCursor(cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "0584", products[0].Location; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// A price change at one location doesn't add history at the others.
+	if err := db.SaveProducts([]Product{{ID: "1", Location: "0584", Name: "Apple", PriceCents: 120, Updated: updated.Add(time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.GetPriceHistory("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, len(history); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	db := getTestDB(t)
+	updated := time.Now().Add(-time.Minute)
+	promotion := shared.Promotion{Type: shared.PROMOTION_MULTIBUY, MultibuyQuantity: 2, MultibuyPriceCents: 500, MemberPriceCents: 240}
+	if err := db.SaveProducts([]Product{{ID: "1", Name: "Spinach", PriceCents: 300, Promotion: promotion, Updated: updated}}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := db.LoadProduct("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := promotion, loaded.Promotion; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	products, err := db.GetSharedProductsUpdatedAfter(time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := promotion, products[0].Promotion; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// The promotion ending is a price history entry even though the price didn't change.
+	if err := db.SaveProducts([]Product{{ID: "1", Name: "Spinach", PriceCents: 300, Updated: updated.Add(time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.GetPriceHistory("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(history); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := shared.PROMOTION_MULTIBUY, history[0].PromotionType; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := []bool{true, false}, []bool{history[0].OnSpecial, history[1].OnSpecial}; want[0] != got[0] || want[1] != got[1] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestFindByGTIN(t *testing.T) {
+	db := getTestDB(t)
+	updated := time.Now()
+	err := db.SaveProducts([]Product{
+		{ID: "1", Name: "Apple", Barcode: "9300633603540", PriceCents: 100, Updated: updated},
+		{ID: "1", Location: "0584", Name: "Apple", Barcode: "9300633603540", PriceCents: 110, Updated: updated},
+		{ID: "2", Name: "Pear", Barcode: "0", PriceCents: 200, Updated: updated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	products, err := db.FindByGTIN("09300633603540")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(products); want != got {
+		t.Fatalf("Expected %d, got %d", want, got)
+	}
+	if want, got := "09300633603540", products[0].GTIN; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	// Invalid barcodes aren't indexed.
+	pear, err := db.GetProduct("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "", pear[0].GTIN; want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestLastDepartmentUpdate(t *testing.T) {
+	db := getTestDB(t)
+	updated, err := db.LastDepartmentUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.IsZero() {
+		t.Errorf("Expected the zero time, got %v", updated)
+	}
+
+	latest := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for _, department := range []Department{
+		{ID: "fruit", Description: "Fruit", Updated: latest.Add(-time.Hour)},
+		{ID: "bakery", Description: "Bakery", Updated: latest},
+	} {
+		if err := db.SaveDepartment(department); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated, err = db.LastDepartmentUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := latest, updated; !want.Equal(got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestSize(t *testing.T) {
+	db := getTestDB(t)
+	size, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size <= 0 {
+		t.Errorf("Expected a positive size, got %d", size)
+	}
+}
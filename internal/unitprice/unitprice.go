@@ -0,0 +1,139 @@
+package unitprice
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+// Dimension is what a quantity measures.
+type Dimension string
+
+const MASS Dimension = "mass"
+const VOLUME Dimension = "volume"
+const COUNT Dimension = "count"
+
+// Quantity is an amount in its dimension's base unit: grams, millilitres or items.
+type Quantity struct {
+	Amount    float64
+	Dimension Dimension
+}
+
+// unit is a unit of measure as the retailers write it.
+type unit struct {
+	dimension Dimension
+	scale     float64 // The number of base units in one of this unit.
+}
+
+var units = map[string]unit{
+	"mg":     {MASS, 0.001},
+	"g":      {MASS, 1},
+	"gm":     {MASS, 1},
+	"kg":     {MASS, 1000},
+	"ml":     {VOLUME, 1},
+	"l":      {VOLUME, 1000},
+	"lt":     {VOLUME, 1000},
+	"ltr":    {VOLUME, 1000},
+	"litre":  {VOLUME, 1000},
+	"ea":     {COUNT, 1},
+	"each":   {COUNT, 1},
+	"pk":     {COUNT, 1},
+	"pack":   {COUNT, 1},
+	"sheets": {COUNT, 1},
+}
+
+// This matches quantities like "500g", "1.25 L", "6 x 375ml", "12 pack", "1EA", "per kg" and "each".
+var quantityRegex = regexp.MustCompile(`^(?:per\s*)?(?:(\d+)\s*x\s*)?(\d+(?:\.\d+)?)?\s*([a-z]+)$`)
+
+// Parse reads a quantity as written on a product or its unit price.
+func Parse(s string) (Quantity, error) {
+	matches := quantityRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if matches == nil {
+		return Quantity{}, fmt.Errorf("cannot parse quantity `%s`", s)
+	}
+	u, ok := units[matches[3]]
+	if !ok {
+		return Quantity{}, fmt.Errorf("unknown unit `%s` in quantity `%s`", matches[3], s)
+	}
+	count := 1.0
+	if matches[1] != "" {
+		count, _ = strconv.ParseFloat(matches[1], 64)
+	}
+	amount := 1.0
+	if matches[2] != "" {
+		amount, _ = strconv.ParseFloat(matches[2], 64)
+	}
+	if amount == 0 || count == 0 {
+		return Quantity{}, fmt.Errorf("zero quantity `%s`", s)
+	}
+	return Quantity{Amount: count * amount * u.scale, Dimension: u.dimension}, nil
+}
+
+// This matches unit prices like "$4.50 per 1kg" and "$0.72 / 1EA".
+var rateRegex = regexp.MustCompile(`^\$\s*(\d+(?:\.\d+)?)\s*(?:per|/)\s*(.+)$`)
+
+// ParseRate reads a unit price as the retailers display it, returning the price in cents
+// and the quantity it's for.
+func ParseRate(s string) (float64, Quantity, error) {
+	matches := rateRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if matches == nil {
+		return 0, Quantity{}, fmt.Errorf("cannot parse unit price `%s`", s)
+	}
+	dollars, err := decimal.NewFromString(matches[1])
+	if err != nil {
+		return 0, Quantity{}, fmt.Errorf("cannot parse price in unit price `%s`: %w", s, err)
+	}
+	quantity, err := Parse(matches[2])
+	if err != nil {
+		return 0, Quantity{}, err
+	}
+	cents, _ := dollars.Mul(decimal.NewFromInt(100)).Float64()
+	return cents, quantity, nil
+}
+
+// FromParts builds a quantity from an amount and a unit written separately.
+func FromParts(amount float64, unitName string) (Quantity, error) {
+	u, ok := units[strings.ToLower(strings.TrimSpace(unitName))]
+	if !ok {
+		return Quantity{}, fmt.Errorf("unknown unit `%s`", unitName)
+	}
+	if amount <= 0 {
+		return Quantity{}, fmt.Errorf("non-positive quantity %v", amount)
+	}
+	return Quantity{Amount: amount * u.scale, Dimension: u.dimension}, nil
+}
+
+// Grams returns the quantity's weight in grams, or an error if it isn't a mass.
+func (q Quantity) Grams() (int, error) {
+	if q.Dimension != MASS {
+		return 0, fmt.Errorf("cannot convert %s to grams", q.Dimension)
+	}
+	return int(q.Amount), nil
+}
+
+// Of converts a price for a quantity into the comparable price of 100g, 100ml or one item,
+// rounded to a hundredth of a cent.
+func Of(priceCents float64, quantity Quantity) (shared.UnitPrice, error) {
+	if quantity.Amount <= 0 {
+		return shared.UnitPrice{}, fmt.Errorf("non-positive quantity %v", quantity.Amount)
+	}
+	var per float64
+	var unitPrice shared.UnitPrice
+	switch quantity.Dimension {
+	case MASS:
+		per, unitPrice.Unit = 100, shared.UNIT_PER_100G
+	case VOLUME:
+		per, unitPrice.Unit = 100, shared.UNIT_PER_100ML
+	case COUNT:
+		per, unitPrice.Unit = 1, shared.UNIT_EACH
+	default:
+		return shared.UnitPrice{}, fmt.Errorf("unknown dimension `%s`", quantity.Dimension)
+	}
+	unitPrice.Cents = math.Round(priceCents*per/quantity.Amount*100) / 100
+	return unitPrice, nil
+}
@@ -0,0 +1,86 @@
+package unitprice
+
+import (
+	"testing"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want Quantity
+		err  bool
+	}{
+		{"500g", Quantity{500, MASS}, false},
+		{"1KG", Quantity{1000, MASS}, false},
+		{"1.25 L", Quantity{1250, VOLUME}, false},
+		{"100ML", Quantity{100, VOLUME}, false},
+		{"6 x 375ml", Quantity{2250, VOLUME}, false},
+		{"6 x 100g", Quantity{600, MASS}, false},
+		{"12 pack", Quantity{12, COUNT}, false},
+		{"1EA", Quantity{1, COUNT}, false},
+		{"each", Quantity{1, COUNT}, false},
+		{"per kg", Quantity{1000, MASS}, false},
+		{"", Quantity{}, true},
+		{"2 bunches", Quantity{}, true},
+		{"0g", Quantity{}, true},
+	} {
+		got, err := Parse(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.in, err)
+		}
+		if want := test.want; want != got {
+			t.Errorf("%q: expected %v, got %v", test.in, want, got)
+		}
+	}
+}
+
+func TestOf(t *testing.T) {
+	for _, test := range []struct {
+		cents    float64
+		quantity Quantity
+		want     shared.UnitPrice
+	}{
+		{350, Quantity{1000, MASS}, shared.UnitPrice{Cents: 35, Unit: shared.UNIT_PER_100G}},
+		{299, Quantity{2000, VOLUME}, shared.UnitPrice{Cents: 14.95, Unit: shared.UNIT_PER_100ML}},
+		{100, Quantity{3, COUNT}, shared.UnitPrice{Cents: 33.33, Unit: shared.UNIT_EACH}},
+	} {
+		got, err := Of(test.cents, test.quantity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := test.want; want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+	if _, err := Of(100, Quantity{}); err == nil {
+		t.Errorf("Expected an error for an empty quantity")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		cents    float64
+		quantity Quantity
+	}{
+		{"$4.50 per 1kg", 450, Quantity{1000, MASS}},
+		{"$0.72 / 1EA", 72, Quantity{1, COUNT}},
+		{"$1.10 per 100mL", 110, Quantity{100, VOLUME}},
+	} {
+		cents, quantity, err := ParseRate(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := test.cents, cents; want != got {
+			t.Errorf("%q: expected %v, got %v", test.in, want, got)
+		}
+		if want, got := test.quantity, quantity; want != got {
+			t.Errorf("%q: expected %v, got %v", test.in, want, got)
+		}
+	}
+	if _, _, err := ParseRate(""); err == nil {
+		t.Errorf("Expected an error for an empty unit price")
+	}
+}
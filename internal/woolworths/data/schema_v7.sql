@@ -0,0 +1,20 @@
+CREATE TABLE schema (version INTEGER PRIMARY KEY);
+INSERT INTO schema (version) VALUES (7);
+CREATE TABLE departments (departmentID TEXT UNIQUE, description TEXT, productCount INTEGER, updated DATETIME);
+CREATE TABLE products
+(	productID TEXT UNIQUE,
+	name TEXT,
+	description TEXT,
+	barcode TEXT,
+	priceCents INTEGER,
+	previousPriceCents INTEGER,
+	weightGrams INTEGER,
+	productJSON TEXT,
+	departmentID TEXT DEFAULT "",
+	updated DATETIME
+);
+INSERT INTO departments (departmentID, description, productCount, updated) VALUES ('1-E5BEE36E', 'Fruit & Veg', 2, '2024-09-01 10:00:00+00:00');
+INSERT INTO products (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
+VALUES ('133211', 'Cavendish Bananas Each', 'Cavendish Bananas Each', '261151000000', 80, 80, 180, '{}', '1-E5BEE36E', '2024-09-01 10:00:00+00:00');
+INSERT INTO products (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
+VALUES ('134034', 'Woolworths Brown Onions 1kg', 'Woolworths Brown Onions 1kg', '9300633154548', 350, 400, 1000, '{}', '1-E5BEE36E', '2024-09-01 10:00:01+00:00');
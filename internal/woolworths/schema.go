@@ -35,8 +35,9 @@ type productID string
 type departmentID string
 
 type departmentPage struct {
-	ID   departmentID
-	page int
+	ID       departmentID
+	page     int
+	location string
 }
 
 type categoryData []byte
@@ -48,6 +49,7 @@ const PRODUCTS_PER_PAGE = 36
 
 type woolworthsProductInfo struct {
 	ID                    productID
+	location              string
 	departmentID          departmentID
 	departmentDescription string
 	Info                  productListPageProduct
@@ -274,6 +276,19 @@ type buyAction struct {
 	Target                    interface{} `json:"target"`
 }
 
+// multibuyData is a "buy Quantity for Price" offer shown in a product's centre tag.
+type multibuyData struct {
+	Quantity int             `json:"Quantity"`
+	Price    decimal.Decimal `json:"Price"`
+	CupTag   string          `json:"CupTag"`
+}
+
+// memberPriceData is an Everyday Rewards member-only price shown in a product's centre tag.
+type memberPriceData struct {
+	MemberPrice decimal.Decimal `json:"MemberPrice"`
+	WasPrice    decimal.Decimal `json:"WasPrice"`
+}
+
 type productListPageProduct struct {
 	TileID                    int             `json:"TileID"`
 	Stockcode                 int             `json:"Stockcode"`
@@ -324,16 +339,16 @@ type productListPageProduct struct {
 	ProductRestrictionMessage interface{}     `json:"ProductRestrictionMessage"`
 	ProductWarningMessage     interface{}     `json:"ProductWarningMessage"`
 	CentreTag                 struct {
-		TagContent                      interface{} `json:"TagContent"`
-		TagLink                         interface{} `json:"TagLink"`
-		FallbackText                    interface{} `json:"FallbackText"`
-		TagType                         string      `json:"TagType"`
-		MultibuyData                    interface{} `json:"MultibuyData"`
-		MemberPriceData                 interface{} `json:"MemberPriceData"`
-		TagContentText                  interface{} `json:"TagContentText"`
-		DualImageTagContent             interface{} `json:"DualImageTagContent"`
-		PromotionType                   string      `json:"PromotionType"`
-		IsRegisteredRewardCardPromotion bool        `json:"IsRegisteredRewardCardPromotion"`
+		TagContent                      interface{}      `json:"TagContent"`
+		TagLink                         interface{}      `json:"TagLink"`
+		FallbackText                    interface{}      `json:"FallbackText"`
+		TagType                         string           `json:"TagType"`
+		MultibuyData                    *multibuyData    `json:"MultibuyData"`
+		MemberPriceData                 *memberPriceData `json:"MemberPriceData"`
+		TagContentText                  interface{}      `json:"TagContentText"`
+		DualImageTagContent             interface{}      `json:"DualImageTagContent"`
+		PromotionType                   string           `json:"PromotionType"`
+		IsRegisteredRewardCardPromotion bool             `json:"IsRegisteredRewardCardPromotion"`
 	} `json:"CentreTag"`
 	IsCentreTag bool `json:"IsCentreTag"`
 	ImageTag    struct {
@@ -363,7 +378,7 @@ type productListPageProduct struct {
 	RichDescription              interface{} `json:"RichDescription"`
 	HideWasSavedPrice            bool        `json:"HideWasSavedPrice"`
 	SapCategories                interface{} `json:"SapCategories"`
-	Brand                        interface{} `json:"Brand"`
+	Brand                        string      `json:"Brand"`
 	IsRestrictedByDeliveryMethod bool        `json:"IsRestrictedByDeliveryMethod"`
 	FooterTag                    struct {
 		TagContent                      interface{} `json:"TagContent"`
@@ -1,86 +1,85 @@
 package woolworths
 
 import (
-	"database/sql"
 	"fmt"
 	"net/http"
 	"net/http/cookiejar"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
-	"golang.org/x/time/rate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
 )
 
 const WOOLWORTHS_PRODUCT_URL_FORMAT = "%s/api/v3/ui/schemaorg/product/%s"
 const PRODUCT_INFO_WORKER_COUNT = 2
 const DEFAULT_LISTING_PAGE_CHECK_INTERVAL = 1 * time.Minute
 
+// DEFAULT_REQUEST_INTERVAL is the time between requests to Woolworths while it isn't struggling.
+const DEFAULT_REQUEST_INTERVAL = 100 * time.Millisecond
+
+// WOOLWORTHS_STORE_COOKIE selects the fulfilment store Woolworths prices products at.
+const WOOLWORTHS_STORE_COOKIE = "w-fulfilment-store-id"
+
 // Woolworths satisfies the ProductInfoGetter interface to provide a stream of product information from Woolworths.
 type Woolworths struct {
 	baseURL                   string
 	client                    *shared.RLHTTPClient
 	cookieJar                 *cookiejar.Jar // TODO This might not be threadsafe.
-	db                        *sql.DB
+	db                        *store.DB
 	productMaxAge             time.Duration
 	listingPageUpdateInterval time.Duration
 	filterDepartments         bool // These are used to limit the departments and products for gradual testing.
 	filteredDepartmentIDsSet  map[departmentID]bool
+	locations                 []string // Fulfilment store IDs to read prices from. "" is Woolworths' default.
+}
+
+// SetLocations sets the fulfilment store IDs to read prices from as well as Woolworths'
+// default store. Every department is scraped once per location.
+func (w *Woolworths) SetLocations(locations []string) {
+	w.locations = shared.WithDefaultLocation(locations)
+}
+
+// SetRateLimit sets how fast Woolworths is scraped, and how the scraper backs off when Woolworths
+// struggles.
+func (w *Woolworths) SetRateLimit(limit shared.RateLimit) {
+	w.client.SetRateLimit(limit)
 }
 
 // GetSharedProductsUpdatedAfter provides a list of product IDs that have been updated since the given time
 func (w *Woolworths) GetSharedProductsUpdatedAfter(t time.Time, count int) ([]shared.ProductInfo, error) {
-	var productIDs []shared.ProductInfo
-	var deptDescription sql.NullString
-	rows, err := w.db.Query(`
-		SELECT
-			productID,
-			products.name,
-			products.description,
-			departments.description,
-			priceCents,
-			previousPriceCents,
-			weightGrams,
-			products.updated
-		FROM
-			products
-			LEFT JOIN departments ON products.departmentID = departments.departmentID
-		WHERE products.updated > ? AND name != '' LIMIT ?`, t, count)
-	if err != nil {
-		return productIDs, fmt.Errorf("failed to query productIDs: %w", err)
-	}
-	for rows.Next() {
-		var product shared.ProductInfo
-		err = rows.Scan(
-			&product.ID,
-			&product.Name,
-			&product.Description,
-			&deptDescription,
-			&product.PriceCents,
-			&product.PreviousPriceCents,
-			&product.WeightGrams,
-			&product.Timestamp)
-		if err != nil {
-			return productIDs, fmt.Errorf("failed to scan productID: %w", err)
-		}
-		if deptDescription.Valid {
-			product.Department = deptDescription.String
-		}
-		product.ID = WOOLWORTHS_ID_PREFIX + product.ID
-		product.Store = "Woolworths"
-		productIDs = append(productIDs, product)
-	}
-	return productIDs, nil
+	return w.db.GetSharedProductsUpdatedAfter(t, count)
+}
+
+// GetSharedProductsAfterCursor provides up to count products that sort after the given cursor.
+func (w *Woolworths) GetSharedProductsAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ProductInfo, shared.ExportCursor, error) {
+	return w.db.GetSharedProductsAfterCursor(cursor, count)
+}
+
+// GetShrinkflationAfterCursor provides up to count shrinkflation events that sort after the
+// given cursor.
+func (w *Woolworths) GetShrinkflationAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ShrinkflationEvent, shared.ExportCursor, error) {
+	return w.db.GetShrinkflationAfterCursor(cursor, count)
 }
 
 // GetTotalProductCount returns the total number of products in the database
 func (w *Woolworths) GetTotalProductCount() (int, error) {
-	var count int
-	err := w.db.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
-	if err != nil {
-		return 0, fmt.Errorf("failed to query product count: %w", err)
-	}
-	return count, nil
+	return w.db.GetTotalProductCount()
+}
+
+// LoadExportCursor loads the named export cursor from the database.
+func (w *Woolworths) LoadExportCursor(name string) (shared.ExportCursor, error) {
+	return w.db.LoadExportCursor(name)
+}
+
+// SaveExportCursor saves the named export cursor to the database.
+func (w *Woolworths) SaveExportCursor(name string, cursor shared.ExportCursor) error {
+	return w.db.SaveExportCursor(name, cursor)
+}
+
+// GetPriceHistory returns every recorded price change for the product, oldest first. The
+// ID may be given with or without the Woolworths prefix.
+func (w *Woolworths) GetPriceHistory(id string) ([]shared.PriceHistoryEntry, error) {
+	return w.db.GetPriceHistory(id)
 }
 
 // Init sets up the Woolworths struct with the given parameters
@@ -95,14 +94,13 @@ func (w *Woolworths) Init(baseURL string, dbPath string, productMaxAge time.Dura
 		return fmt.Errorf("error creating cookie jar: %v", err)
 	}
 	w.baseURL = baseURL
-	w.client = &shared.RLHTTPClient{
-		Client: &http.Client{
-			Jar:     w.cookieJar,
-			Timeout: 30 * time.Second,
-		},
-		Ratelimiter: rate.NewLimiter(rate.Every(100*time.Millisecond), 1),
-	}
+	// Each request sets its own location, so the jar mustn't add the store Woolworths last set.
+	w.client = shared.NewRLHTTPClient(&http.Client{
+		Jar:     shared.JarWithout(w.cookieJar, WOOLWORTHS_STORE_COOKIE),
+		Timeout: 30 * time.Second,
+	}, retailer.Name, shared.DefaultRateLimit(DEFAULT_REQUEST_INTERVAL))
 	w.productMaxAge = productMaxAge
+	w.SetLocations(nil)
 	err = w.initDB(dbPath)
 	if err != nil {
 		return err
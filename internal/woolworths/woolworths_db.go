@@ -4,155 +4,105 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
-	"os"
-	"time"
 
 	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/migrate"
 	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
+	"github.com/tjhowse/aus_grocery_price_database/internal/unitprice"
 )
 
-const DB_SCHEMA_VERSION = 7
+// retailer plugs Woolworths into the shared store. Woolworths DBs were at schema version 7
+// when migrations were introduced.
+var retailer = store.Retailer{Name: "Woolworths", IDPrefix: WOOLWORTHS_ID_PREFIX, SchemaBaseline: 7}
 
-// Initialises the DB with the schema. Note you must bump the DB_SCHEMA_VERSION
-// constant if you change the schema.
-func (w *Woolworths) initBlankDB() error {
+var DB_SCHEMA_VERSION = retailer.SchemaVersion()
 
-	// Drop all tables
-	for _, table := range []string{"schema", "departments", "products"} {
-		// Mildly confused by why this doesn't work? TODO investigate
-		// _, err := w.db.Exec("DROP TABLE IF EXISTS ?", table)
-		_, err := w.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
-		if err != nil {
-			return err
-		}
-	}
-
-	_, err := w.db.Exec("CREATE TABLE IF NOT EXISTS schema (version INTEGER PRIMARY KEY)")
-	if err != nil {
-		return err
-	}
-	_, err = w.db.Exec("INSERT INTO schema (version) VALUES (?)", DB_SCHEMA_VERSION)
-	if err != nil {
-		return err
-	}
-	_, err = w.db.Exec("CREATE TABLE IF NOT EXISTS departments (departmentID TEXT UNIQUE, description TEXT, productCount INTEGER, updated DATETIME)")
-	if err != nil {
-		return err
-	}
-	_, err =
-		w.db.Exec(`	CREATE TABLE IF NOT EXISTS products
-						(	productID TEXT UNIQUE,
-							name TEXT,
-							description TEXT,
-							barcode TEXT,
-							priceCents INTEGER,
-							previousPriceCents INTEGER,
-							weightGrams INTEGER,
-							productJSON TEXT,
-							departmentID TEXT DEFAULT "",
-							updated DATETIME
-						)`)
-	if err != nil {
-		return err
-	}
-	return nil
+// initDB opens the DB and migrates it to the current schema.
+func (w *Woolworths) initDB(dbPath string) error {
+	var err error
+	w.db, err = store.Open(dbPath, retailer)
+	return err
 }
 
-// backupDB moves the specified DB to the same directory with an ISO8601 timestamp and the schema
-// number prepended to the filename.
-func (w *Woolworths) backupDB(dbPath string, oldSchema int) error {
-	backupName := fmt.Sprintf("%s.%d.%s", dbPath, oldSchema, time.Now().Format("2006-01-02T15:04:05"))
-	err := os.Rename(dbPath, backupName)
-	if err != nil {
-		return fmt.Errorf("failed to backup existing DB: %w", err)
-	}
-	slog.Info("Backed up old DB", "old", dbPath, "new", backupName)
-	return nil
+// DryRunMigrations reports the migrations the DB at dbPath needs without applying them.
+func DryRunMigrations(dbPath string) ([]migrate.Migration, error) {
+	return store.DryRunMigrations(dbPath, retailer)
 }
 
-func openDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?cache=shared")
-	if err != nil {
-		return nil, err
-	}
-	db.SetMaxOpenConns(1)
-	return db, nil
+// DB returns the local product DB, for read-only queries.
+func (w *Woolworths) DB() *store.DB {
+	return w.db
 }
 
-func (w *Woolworths) initDB(dbPath string) error {
-	var err error
-	w.db, err = openDB(dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to open DB: %w", err)
+// toStoreProduct converts a product to the shared store's representation.
+func (p woolworthsProductInfo) toStoreProduct() store.Product {
+	return store.Product{
+		ID:           string(p.ID),
+		Location:     p.location,
+		Name:         p.Info.DisplayName,
+		Description:  p.Info.Description,
+		Brand:        p.Info.Brand,
+		Barcode:      p.Info.Barcode,
+		PriceCents:   int(p.Info.Price.Mul(decimal.NewFromInt(100)).IntPart()),
+		Promotion:    p.promotion(),
+		UnitPrice:    p.unitPrice(),
+		WeightGrams:  p.Info.UnitWeightInGrams,
+		RawJSON:      p.RawJSON,
+		DepartmentID: string(p.departmentID),
+		Updated:      p.Updated,
 	}
-	var version int
-	err = w.db.QueryRow("SELECT version FROM schema").Scan(&version)
-
-	if err != nil || version != DB_SCHEMA_VERSION {
-		slog.Warn("DB schema mismatch", "path", dbPath, "currentVersion", DB_SCHEMA_VERSION, "detectedVersion", version)
-
-		if version != 0 {
-			// If we detected an old schema, backup the DB and create a new one.
-			err = w.db.Close()
-			if err != nil {
-				return fmt.Errorf("failed to close existing DB before backing it up: %w", err)
-			}
-			err = w.backupDB(dbPath, version)
-			if err != nil {
-				return fmt.Errorf("failed to backup existing DB: %w", err)
-			}
+}
 
-			// Open a new DB
-			w.db, err = openDB(dbPath)
-			if err != nil {
-				return fmt.Errorf("failed to open DB: %w", err)
-			}
+// promotion collects the product's offers into the shared promotion model.
+func (p woolworthsProductInfo) promotion() shared.Promotion {
+	var promotion shared.Promotion
+	if multibuy := p.Info.CentreTag.MultibuyData; multibuy != nil && multibuy.Quantity > 0 {
+		promotion.Type = shared.PROMOTION_MULTIBUY
+		promotion.MultibuyQuantity = multibuy.Quantity
+		promotion.MultibuyPriceCents = int(multibuy.Price.Mul(decimal.NewFromInt(100)).IntPart())
+	}
+	if member := p.Info.CentreTag.MemberPriceData; member != nil && member.MemberPrice.IsPositive() {
+		if promotion.Type == shared.PROMOTION_NONE {
+			promotion.Type = shared.PROMOTION_MEMBER_PRICE
 		}
-
-		// Create the schema
-		err := w.initBlankDB()
-		if err != nil {
-			return fmt.Errorf("failed to create blank DB: %w", err)
-		} else {
-			slog.Info("New blank DB created")
+		promotion.MemberPriceCents = int(member.MemberPrice.Mul(decimal.NewFromInt(100)).IntPart())
+	}
+	if p.Info.IsOnSpecial || p.Info.IsHalfPrice {
+		promotion.Type = shared.PROMOTION_SPECIAL
+		if p.Info.IsHalfPrice {
+			promotion.Type = shared.PROMOTION_HALF_PRICE
 		}
+		promotion.WasPriceCents = int(decimal.NewFromFloat(p.Info.WasPrice).Mul(decimal.NewFromInt(100)).IntPart())
 	}
-	return nil
+	return promotion
 }
 
-// Saves product info to the database
-func (w *Woolworths) saveProductInfo(tx *sql.Tx, productInfo woolworthsProductInfo) error {
-	var err error
-	var result sql.Result
-
-	result, err = tx.Exec(`
-			INSERT INTO products (productID, name, description, barcode, priceCents, previousPriceCents, weightGrams, productJSON, departmentID, updated)
-			VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?)
-			ON CONFLICT(productID) DO UPDATE SET
-				productID = excluded.productID,
-				name = excluded.name,
-				description = excluded.description,
-				barcode = excluded.barcode,
-				priceCents = excluded.priceCents,
-				previousPriceCents = priceCents,
-				weightGrams = excluded.weightGrams,
-				productJSON = excluded.productJSON,
-				departmentID = excluded.departmentID,
-				updated = excluded.updated`,
-		productInfo.ID, productInfo.Info.DisplayName, productInfo.Info.Description, productInfo.Info.Barcode,
-		productInfo.Info.Price.Mul(decimal.NewFromInt(100)).IntPart(),
-		productInfo.Info.UnitWeightInGrams, productInfo.RawJSON, productInfo.departmentID, productInfo.Updated)
-
+// unitPrice normalises the product's cup price, falling back to working it out from the
+// package size.
+func (p woolworthsProductInfo) unitPrice() shared.UnitPrice {
+	priceCents, _ := p.Info.Price.Mul(decimal.NewFromInt(100)).Float64()
+	sizeText := p.Info.PackageSize
+	if p.Info.HasCupPrice {
+		priceCents = p.Info.CupPrice * 100
+		sizeText = p.Info.CupMeasure
+	}
+	quantity, err := unitprice.Parse(sizeText)
 	if err != nil {
-		return fmt.Errorf("failed to update product info: %w", err)
+		slog.Debug("Couldn't work out unit price", "productID", p.ID, "error", err)
+		return shared.UnitPrice{}
 	}
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	} else if rowsAffected == 0 {
-		slog.Warn("Product info not updated.")
+	unitPrice, err := unitprice.Of(priceCents, quantity)
+	if err != nil {
+		slog.Debug("Couldn't work out unit price", "productID", p.ID, "error", err)
+		return shared.UnitPrice{}
 	}
+	return unitPrice
+}
 
-	return nil
+// Saves product info to the database
+func (w *Woolworths) saveProductInfo(tx *sql.Tx, productInfo woolworthsProductInfo) error {
+	return w.db.SaveProduct(tx, productInfo.toStoreProduct())
 }
 
 // Saves product info to the database
@@ -174,89 +124,49 @@ func (w *Woolworths) saveProductInfoNoTx(productInfo woolworthsProductInfo) erro
 
 // Saves product info to the database
 func (w *Woolworths) saveDepartment(departmentInfo departmentInfo) error {
-	var err error
-	var result sql.Result
-
-	result, err = w.db.Exec(`
-		INSERT INTO departments (departmentID, description, productCount, updated)
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT(departmentID) DO UPDATE SET
-			departmentID = excluded.departmentID,
-			description = excluded.description,
-			productCount = excluded.productCount,
-			updated = excluded.updated`,
-		departmentInfo.NodeID, departmentInfo.Description, departmentInfo.ProductCount, departmentInfo.Updated)
-
-	if err != nil {
-		return fmt.Errorf("failed to update department ID info: %w", err)
-	}
-	if rowsAffected, err := result.RowsAffected(); err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	} else if rowsAffected == 0 {
-		slog.Warn("Department not upserted")
-	}
-
-	return nil
+	return w.db.SaveDepartment(store.Department{
+		ID:           string(departmentInfo.NodeID),
+		Description:  departmentInfo.Description,
+		ProductCount: departmentInfo.ProductCount,
+		Updated:      departmentInfo.Updated,
+	})
 }
 
-// loadProductInfo loads cached extended product info from the database
+// loadProductInfo loads cached extended product info at the default location from the
+// database. Prices are loaded in cents.
 func (w *Woolworths) loadProductInfo(productID productID) (woolworthsProductInfo, error) {
 	var wProdInfo woolworthsProductInfo
-	var deptDescription sql.NullString
-	row := w.db.QueryRow(`
-	SELECT
-		productID,
-		name,
-		products.description,
-		barcode,
-		priceCents,
-		previousPriceCents,
-		weightGrams,
-		productJSON,
-		products.departmentID,
-		departments.description,
-		products.updated
-	FROM
-		products
-		LEFT JOIN departments ON products.departmentID = departments.departmentID
-	WHERE productID = ? LIMIT 1`, productID)
-	err := row.Scan(
-		&wProdInfo.ID,
-		&wProdInfo.Info.DisplayName,
-		&wProdInfo.Info.Description,
-		&wProdInfo.Info.Barcode,
-		&wProdInfo.Info.Price,
-		&wProdInfo.PreviousPrice,
-		&wProdInfo.Info.UnitWeightInGrams,
-		&wProdInfo.RawJSON,
-		&wProdInfo.departmentID,
-		&deptDescription, // This value comes from a join, so it might be NULL.
-		&wProdInfo.Updated)
+	product, err := w.db.LoadProduct(string(productID), "")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return wProdInfo, shared.ErrProductMissing
-		}
-		return wProdInfo, fmt.Errorf("failed to query existing product info: %w", err)
-	}
-	if deptDescription.Valid {
-		wProdInfo.departmentDescription = deptDescription.String
-	}
+		return wProdInfo, err
+	}
+	wProdInfo.ID = productID
+	wProdInfo.Info.DisplayName = product.Name
+	wProdInfo.Info.Description = product.Description
+	wProdInfo.Info.Barcode = product.Barcode
+	wProdInfo.Info.Price = decimal.NewFromInt(int64(product.PriceCents))
+	wProdInfo.PreviousPrice = decimal.NewFromInt(int64(product.PreviousPriceCents))
+	wProdInfo.Info.UnitWeightInGrams = product.WeightGrams
+	wProdInfo.RawJSON = product.RawJSON
+	wProdInfo.departmentID = departmentID(product.DepartmentID)
+	wProdInfo.departmentDescription = product.DepartmentName
+	wProdInfo.Updated = product.Updated
 	return wProdInfo, nil
 }
 
 func (w *Woolworths) loadDepartmentInfoList() ([]departmentInfo, error) {
 	var departmentInfos []departmentInfo
-	rows, err := w.db.Query("SELECT departmentID, description, productCount, updated FROM departments")
+	departments, err := w.db.LoadDepartments()
 	if err != nil {
-		return departmentInfos, fmt.Errorf("failed to query departmentIDs: %w", err)
-	}
-	for rows.Next() {
-		var deptInfo departmentInfo
-		err = rows.Scan(&deptInfo.NodeID, &deptInfo.Description, &deptInfo.ProductCount, &deptInfo.Updated)
-		if err != nil {
-			return departmentInfos, fmt.Errorf("failed to scan departmentID: %w", err)
-		}
-		departmentInfos = append(departmentInfos, deptInfo)
+		return departmentInfos, err
+	}
+	for _, department := range departments {
+		departmentInfos = append(departmentInfos, departmentInfo{
+			NodeID:       departmentID(department.ID),
+			Description:  department.Description,
+			ProductCount: department.ProductCount,
+			Updated:      department.Updated,
+		})
 	}
 	return departmentInfos, nil
 }
@@ -1,9 +1,11 @@
 package woolworths
 
 import (
+	"database/sql"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"testing"
 	"time"
@@ -77,7 +79,7 @@ func TestDBFail(t *testing.T) {
 	if err == nil {
 		t.Fatal("Expected an error")
 	}
-	if want, got := "failed to create blank DB: unable to open database file: no such file or directory", err.Error(); want != got {
+	if want, got := "failed to migrate DB: failed to check for schema table: unable to open database file: no such file or directory", err.Error(); want != got {
 		t.Errorf("Expected %s, got %s", want, got)
 	}
 }
@@ -232,8 +234,8 @@ func TestBackupDB(t *testing.T) {
 		if want, got := 0, len(matches); want != got {
 			t.Fatalf("Unexpectedly found a backup of the DB that shouldn't've been created.")
 		}
-		// Tweak the schema version to DB_SCHEMA_VERSION-1 to force a backup.
-		w.db.Exec("UPDATE schema SET version = ?", DB_SCHEMA_VERSION-1)
+		// Set the schema version to one we have no migrations for to force a backup.
+		w.db.Exec("UPDATE schema SET version = ?", DB_SCHEMA_VERSION+1)
 	}()
 
 	func() {
@@ -242,8 +244,8 @@ func TestBackupDB(t *testing.T) {
 		if err != nil {
 			slog.Error("Failed to initialise Woolworths", "error", err)
 		}
-		// Ensure we created a backup of the old database at tempDirName/delme.db3.{DB_SCHEMA_VERSION-1}.{timestamp}
-		matches, err := filepath.Glob(tempDirName + "/delme.db3." + strconv.Itoa(DB_SCHEMA_VERSION-1) + ".*")
+		// Ensure we created a backup of the old database at tempDirName/delme.db3.{DB_SCHEMA_VERSION+1}.{timestamp}
+		matches, err := filepath.Glob(tempDirName + "/delme.db3." + strconv.Itoa(DB_SCHEMA_VERSION+1) + ".*")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -253,3 +255,240 @@ func TestBackupDB(t *testing.T) {
 	}()
 
 }
+
+// loadFixtureDB builds a DB at dbPath from a SQL dump of an old schema version.
+func loadFixtureDB(t *testing.T, dbPath, fixturePath string) {
+	fixture, err := os.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(fixture)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateFromFixture(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "woolworths.db3")
+	loadFixtureDB(t, dbPath, "data/schema_v7.sql")
+
+	pending, err := DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := DB_SCHEMA_VERSION-7, len(pending); want != got {
+		t.Fatalf("Expected %d pending migrations, got %d", want, got)
+	}
+
+	w := Woolworths{}
+	if err := w.Init(woolworthsServer.URL, dbPath, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer w.db.Close()
+
+	matches, err := filepath.Glob(dbPath + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(matches); want != got {
+		t.Errorf("Expected no backup, found %v", matches)
+	}
+	var version int
+	if err := w.db.QueryRow("SELECT version FROM schema").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := DB_SCHEMA_VERSION, version; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// The cached products and departments survive the upgrade.
+	count, err := w.GetTotalProductCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, count; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	departments, err := w.loadDepartmentInfoList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(departments); want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	products, err := w.GetSharedProductsUpdatedAfter(time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 350, products[1].PriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+
+	// The new tables are usable.
+	cursor := shared.ExportCursor{Updated: time.Now().UTC().Truncate(time.Second), ProductID: "133211"}
+	if err := w.SaveExportCursor("influxdb", cursor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.GetPriceHistory(WOOLWORTHS_ID_PREFIX + "133211"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err = DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(pending); want != got {
+		t.Errorf("Expected %d pending migrations, got %d", want, got)
+	}
+}
+
+func TestGetSharedProductsAfterCursor(t *testing.T) {
+	w := getInitialisedWoolworths()
+	updated := time.Now().Add(-1 * time.Minute)
+	// Two products share an updated time, so the cursor must break the tie on productID.
+	for _, info := range []woolworthsProductInfo{
+		{ID: "123457", Info: productListPageProduct{DisplayName: "3", Price: decimal.NewFromFloat(3.3)}, Updated: updated},
+		{ID: "123456", Info: productListPageProduct{DisplayName: "2", Price: decimal.NewFromFloat(2.4)}, Updated: updated},
+		{ID: "123455", Info: productListPageProduct{DisplayName: "1", Price: decimal.NewFromFloat(1.5)}, Updated: updated.Add(-1 * time.Minute)},
+	} {
+		if err := w.saveProductInfoNoTx(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var cursor shared.ExportCursor
+	var ids []string
+	for {
+		products, next, err := w.GetSharedProductsAfterCursor(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(products) == 0 {
+			if next != cursor {
+				t.Errorf("Expected the cursor to stay at %v, got %v", cursor, next)
+			}
+			break
+		}
+		for _, product := range products {
+			ids = append(ids, product.ID)
+		}
+		cursor = next
+	}
+	if want, got := []string{WOOLWORTHS_ID_PREFIX + "123455", WOOLWORTHS_ID_PREFIX + "123456", WOOLWORTHS_ID_PREFIX + "123457"}, ids; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if err := w.SaveExportCursor("test", cursor); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := w.LoadExportCursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "123457", loaded.ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	products, _, err := w.GetSharedProductsAfterCursor(loaded, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(products); want != got {
+		t.Errorf("Expected %d products after the loaded cursor, got %d", want, got)
+	}
+
+	// A cursor that was never saved starts from the beginning.
+	if loaded, err := w.LoadExportCursor("missing"); err != nil {
+		t.Fatal(err)
+	} else if want, got := (shared.ExportCursor{}), loaded; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestPriceHistory(t *testing.T) {
+	w := getInitialisedWoolworths()
+	start := time.Now().Add(-1 * time.Hour)
+	for i, info := range []productListPageProduct{
+		{DisplayName: "1", Price: decimal.NewFromFloat(1.5)},
+		// Nothing changed, so no new entry.
+		{DisplayName: "1", Price: decimal.NewFromFloat(1.5)},
+		{DisplayName: "1", Price: decimal.NewFromFloat(1.2), WasPrice: 1.5, IsOnSpecial: true},
+		// Special ends with the price unchanged.
+		{DisplayName: "1", Price: decimal.NewFromFloat(1.2)},
+	} {
+		err := w.saveProductInfoNoTx(woolworthsProductInfo{ID: "123455", Info: info, Updated: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := w.GetPriceHistory(WOOLWORTHS_ID_PREFIX + "123455")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(history); want != got {
+		t.Fatalf("Expected %d entries, got %d", want, got)
+	}
+	if want, got := []int{150, 120, 120}, []int{history[0].PriceCents, history[1].PriceCents, history[2].PriceCents}; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 150, history[1].WasPriceCents; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := []bool{false, true, false}, []bool{history[0].OnSpecial, history[1].OnSpecial, history[2].OnSpecial}; !slices.Equal(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if !history[1].Recorded.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("Expected %v, got %v", start.Add(2*time.Minute), history[1].Recorded)
+	}
+
+	history, err = w.GetPriceHistory("999999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(history); want != got {
+		t.Errorf("Expected %d entries, got %d", want, got)
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	for _, test := range []struct {
+		info productListPageProduct
+		want shared.Promotion
+	}{
+		{productListPageProduct{Price: decimal.NewFromFloat(4.5), WasPrice: 4.5}, shared.Promotion{}},
+		{productListPageProduct{Price: decimal.NewFromFloat(3.9), WasPrice: 4.5, IsOnSpecial: true}, shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: 450}},
+		{productListPageProduct{Price: decimal.NewFromFloat(2), WasPrice: 4, IsOnSpecial: true, IsHalfPrice: true}, shared.Promotion{Type: shared.PROMOTION_HALF_PRICE, WasPriceCents: 400}},
+	} {
+		if want, got := test.want, (woolworthsProductInfo{Info: test.info}).promotion(); want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+
+	info := productListPageProduct{Price: decimal.NewFromFloat(3)}
+	info.CentreTag.MultibuyData = &multibuyData{Quantity: 2, Price: decimal.NewFromFloat(5)}
+	info.CentreTag.MemberPriceData = &memberPriceData{MemberPrice: decimal.NewFromFloat(2.4)}
+	want := shared.Promotion{Type: shared.PROMOTION_MULTIBUY, MultibuyQuantity: 2, MultibuyPriceCents: 500, MemberPriceCents: 240}
+	if got := (woolworthsProductInfo{Info: info}).promotion(); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestUnitPrice(t *testing.T) {
+	for _, test := range []struct {
+		info productListPageProduct
+		want shared.UnitPrice
+	}{
+		{productListPageProduct{Price: decimal.NewFromFloat(3.5), HasCupPrice: true, CupPrice: 7, CupMeasure: "1KG", PackageSize: "500g"}, shared.UnitPrice{Cents: 70, Unit: shared.UNIT_PER_100G}},
+		{productListPageProduct{Price: decimal.NewFromFloat(0.72), HasCupPrice: true, CupPrice: 0.72, CupMeasure: "1EA", PackageSize: "Each"}, shared.UnitPrice{Cents: 72, Unit: shared.UNIT_EACH}},
+		{productListPageProduct{Price: decimal.NewFromFloat(2.2), CupMeasure: "", PackageSize: "2L"}, shared.UnitPrice{Cents: 11, Unit: shared.UNIT_PER_100ML}},
+		{productListPageProduct{Price: decimal.NewFromFloat(2.8), PackageSize: "Bunch"}, shared.UnitPrice{}},
+	} {
+		if want, got := test.want, (woolworthsProductInfo{Info: test.info}).unitPrice(); want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+}
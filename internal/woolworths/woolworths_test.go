@@ -1,11 +1,14 @@
 package woolworths
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/tjhowse/aus_grocery_price_database/internal/leaktest"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
 )
 
 func ValidateProduct(t *testing.T, w *Woolworths, id productID, expectedName string) error {
@@ -31,15 +34,20 @@ func ValidateProduct(t *testing.T, w *Woolworths, id productID, expectedName str
 func TestScheduler(t *testing.T) {
 	w := Woolworths{}
 	w.Init(woolworthsServer.URL, ":memory:", 100*time.Second)
-	w.client.Ratelimiter = rate.NewLimiter(rate.Every(1*time.Millisecond), 1)
+	w.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
 	w.listingPageUpdateInterval = 1 * time.Second
 	w.filteredDepartmentIDsSet = map[departmentID]bool{
 		"1-E5BEE36E": true, // Fruit & Veg
 		"1_DEB537E":  true, // Bakery
 	}
 	w.filterDepartments = true
-	cancel := make(chan struct{})
-	go w.Run(cancel)
+	checkLeaks := leaktest.Check(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(stopped)
+	}()
 
 	done := make(chan struct{})
 	go func() {
@@ -61,5 +69,67 @@ func TestScheduler(t *testing.T) {
 
 	}
 
-	close(cancel)
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for scheduler to stop")
+	case <-stopped:
+	}
+	checkLeaks()
+}
+
+func TestSchedulerWithLocations(t *testing.T) {
+	w := Woolworths{}
+	w.Init(woolworthsServer.URL, ":memory:", 100*time.Second)
+	w.SetRateLimit(shared.RateLimit{IntervalMilliseconds: 1})
+	w.SetLocations([]string{"1234"})
+	w.listingPageUpdateInterval = 1 * time.Second
+	w.filteredDepartmentIDsSet = map[departmentID]bool{
+		"1-E5BEE36E": true, // Fruit & Veg
+	}
+	w.filterDepartments = true
+	checkLeaks := leaktest.Check(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(stopped)
+	}()
+
+	// Wait until both locations have been scraped.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var locations int
+		err := w.db.QueryRow("SELECT COUNT(DISTINCT location) FROM products WHERE productID = '165262'").Scan(&locations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locations == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for both locations to be scraped")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Searches only read the default location, so it's scraped alongside the configured one.
+	results, err := w.db.SearchProducts("raspberries punnet", store.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(results); want != got {
+		t.Fatalf("Expected %d results, got %d", want, got)
+	}
+	if want, got := "Raspberries 125g Punnet", results[0].Product.Name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for scheduler to stop")
+	case <-stopped:
+	}
+	checkLeaks()
 }
@@ -2,6 +2,7 @@ package woolworths
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"regexp"
 	"strconv"
 	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
 )
 
 func extractStockCodes(body categoryData) ([]string, error) {
@@ -46,14 +49,14 @@ func extractDepartmentInfos(body fruitVegPage) ([]departmentInfo, error) {
 	return departmentList.Categories, nil
 }
 
-func (w *Woolworths) getDepartmentInfos() ([]departmentInfo, error) {
+func (w *Woolworths) getDepartmentInfos(ctx context.Context) ([]departmentInfo, error) {
 	var req *http.Request
 	var resp *http.Response
 	var err error
 	departmentInfos := []departmentInfo{}
 
 	url := fmt.Sprintf("%s/shop/browse/fruit-veg", w.baseURL)
-	if req, err = http.NewRequest("GET", url, nil); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, "GET", url, nil); err != nil {
 		return departmentInfos, err
 	}
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:129.0) Gecko/20100101 Firefox/129.0")
@@ -73,12 +76,13 @@ func (w *Woolworths) getDepartmentInfos() ([]departmentInfo, error) {
 	}
 	departmentInfos, err = extractDepartmentInfos(body)
 	if err != nil {
+		metrics.ParseFailures.WithLabelValues(retailer.Name).Inc()
 		return departmentInfos, err
 	}
 	departmentInfos = w.filterOutDepartments(departmentInfos)
 	// Now we have to populate the product count, since the fruit-veg page doesn't have it.
 	for i, departmentInfo := range departmentInfos {
-		_, count, err := w.getProductIDsAndCountFromListPage(departmentInfo.NodeID, 1)
+		_, count, err := w.getProductIDsAndCountFromListPage(ctx, departmentInfo.NodeID, 1)
 		if err != nil {
 			slog.Warn("Failed to get product count for department", "department", departmentInfo.NodeID, "error", err)
 			continue
@@ -187,8 +191,9 @@ func extractProductInfoFromProductListPage(body []byte) ([]woolworthsProductInfo
 	return productInfos, nil
 }
 
-// getProductListPage returns the bytes of the product list page for the given department and page number.
-func (w *Woolworths) getProductListPage(department departmentID, page int) ([]byte, error) {
+// getProductListPage returns the bytes of the product list page for the given department and page number,
+// priced at the given fulfilment store. A blank location uses Woolworths' default store.
+func (w *Woolworths) getProductListPage(ctx context.Context, department departmentID, page int, location string) ([]byte, error) {
 
 	var url string
 
@@ -199,7 +204,7 @@ func (w *Woolworths) getProductListPage(department departmentID, page int) ([]by
 	slog.Debug("Requesting product info page", "department", department, "page", page)
 
 	url = fmt.Sprintf("%s/apis/ui/browse/category", w.baseURL)
-	if req, err := http.NewRequest("POST", url, bytes.NewBufferString(requestBody)); err != nil {
+	if req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBufferString(requestBody)); err != nil {
 		return nil, err
 	} else {
 		// This is the minimal set of headers the request expects to see.
@@ -209,6 +214,9 @@ func (w *Woolworths) getProductListPage(department departmentID, page int) ([]by
 		req.Header.Set("Accept", "application/json, text/plain, */*")
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Request-Id", "|b14af797522740e5a25290ac283f739d.037da5c5e87f4706")
+		if location != "" {
+			req.AddCookie(&http.Cookie{Name: WOOLWORTHS_STORE_COOKIE, Value: location})
+		}
 		resp, err := w.client.Do(req)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get category data: %w", err)
@@ -222,6 +230,7 @@ func (w *Woolworths) getProductListPage(department departmentID, page int) ([]by
 		if err != nil {
 			return nil, err
 		}
+		metrics.PagesFetched.WithLabelValues(retailer.Name).Inc()
 		return body, nil
 	}
 }
@@ -229,11 +238,11 @@ func (w *Woolworths) getProductListPage(department departmentID, page int) ([]by
 // This queries the Woolworths API to get the product list for a department. It reads
 // the specified page of that department's product list, returning the list of product
 // IDs and the total number of products in the department.
-func (w *Woolworths) getProductIDsAndCountFromListPage(department departmentID, page int) ([]productID, int, error) {
+func (w *Woolworths) getProductIDsAndCountFromListPage(ctx context.Context, department departmentID, page int) ([]productID, int, error) {
 	var totalCount int
 
 	prodIDs := []productID{}
-	body, err := w.getProductListPage(department, page)
+	body, err := w.getProductListPage(ctx, department, page, "")
 	if err != nil {
 		return prodIDs, 0, err
 	}
@@ -255,17 +264,24 @@ func (w *Woolworths) getProductIDsAndCountFromListPage(department departmentID,
 }
 
 // getProductInfoFromListPage returns the product information from the department list page
-func (w *Woolworths) getProductInfoFromListPage(dp departmentPage) ([]woolworthsProductInfo, error) {
+func (w *Woolworths) getProductInfoFromListPage(ctx context.Context, dp departmentPage) ([]woolworthsProductInfo, error) {
 	productInfos := []woolworthsProductInfo{}
 	var body []byte
 	var err error
 
-	body, err = w.getProductListPage(dp.ID, dp.page)
+	body, err = w.getProductListPage(ctx, dp.ID, dp.page, dp.location)
 	if err != nil {
 		return productInfos, err
 	}
 
-	return extractProductInfoFromProductListPage(body)
+	productInfos, err = extractProductInfoFromProductListPage(body)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(retailer.Name).Inc()
+	}
+	for i := range productInfos {
+		productInfos[i].location = dp.location
+	}
+	return productInfos, err
 }
 
 // isDepartmentFilteredOut returns true if the department is in the filteredDepartmentIDsSet
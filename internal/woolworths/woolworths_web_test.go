@@ -91,7 +91,7 @@ func WoolworthsHTTPServer() *httptest.Server {
 func TestGetProductListPage(t *testing.T) {
 	w := getInitialisedWoolworths()
 
-	prodIDs, count, err := w.getProductIDsAndCountFromListPage("1-E5BEE36E", 1)
+	prodIDs, count, err := w.getProductIDsAndCountFromListPage(t.Context(), "1-E5BEE36E", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -137,7 +137,7 @@ func TestExtractDepartmentInfos(t *testing.T) {
 func TestGetDepartmentInfos(t *testing.T) {
 	w := getInitialisedWoolworths()
 
-	departmentInfos, err := w.getDepartmentInfos()
+	departmentInfos, err := w.getDepartmentInfos(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -176,7 +176,7 @@ func TestGetProductInfoFromListPage(t *testing.T) {
 		ID:   "1-E5BEE36E",
 		page: 1,
 	}
-	productInfo, err := w.getProductInfoFromListPage(dp)
+	productInfo, err := w.getProductInfoFromListPage(t.Context(), dp)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -230,3 +230,27 @@ func TestIsDepartmentFilteredOut(t *testing.T) {
 		t.Errorf("Expected %t, got %t", want, got)
 	}
 }
+
+func TestGetProductInfoFromListPageAtLocation(t *testing.T) {
+	w := getInitialisedWoolworths()
+	var gotStore string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(WOOLWORTHS_STORE_COOKIE); err == nil {
+			gotStore = cookie.Value
+		}
+		http.Redirect(rw, r, woolworthsServer.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	w.baseURL = server.URL
+
+	productInfo, err := w.getProductInfoFromListPage(t.Context(), departmentPage{ID: "1-E5BEE36E", page: 1, location: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "1234", gotStore; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "1234", productInfo[0].location; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
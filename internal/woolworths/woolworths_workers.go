@@ -1,11 +1,15 @@
 package woolworths
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/shopspring/decimal"
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
 )
 
 func departmentInSlice(a departmentInfo, list []departmentInfo) *departmentInfo {
@@ -18,10 +22,11 @@ func departmentInSlice(a departmentInfo, list []departmentInfo) *departmentInfo
 }
 
 // This worker emits a stream of new department IDs that don't currently exist in the database.
-func (w *Woolworths) newDepartmentInfoWorker(output chan<- departmentInfo) {
+// It returns once the context is done.
+func (w *Woolworths) newDepartmentInfoWorker(ctx context.Context, output chan<- departmentInfo) {
 	for {
 		// Read the department list from the web...
-		departmentsFromWeb, err := w.getDepartmentInfos()
+		departmentsFromWeb, err := w.getDepartmentInfos(ctx)
 		if err != nil {
 			slog.Error(fmt.Sprintf("Error getting department IDs from web: %v", err))
 		}
@@ -36,25 +41,45 @@ func (w *Woolworths) newDepartmentInfoWorker(output chan<- departmentInfo) {
 		for _, webDepartmentID := range departmentsFromWeb {
 			if dept := departmentInSlice(webDepartmentID, departmentInfosFromDB); dept == nil {
 				slog.Info("New department ID", "ID", webDepartmentID.NodeID, "Description", webDepartmentID.Description)
-				output <- webDepartmentID
+			} else if dept.ProductCount != webDepartmentID.ProductCount {
+				slog.Info("Department flagged for update", "oldProductCount", dept.ProductCount, "newProductCount", webDepartmentID.ProductCount)
 			} else {
-				if dept.ProductCount != webDepartmentID.ProductCount {
-					slog.Info("Department flagged for update", "oldProductCount", dept.ProductCount, "newProductCount", webDepartmentID.ProductCount)
-					output <- webDepartmentID
-				}
+				continue
+			}
+			select {
+			case output <- webDepartmentID:
+			case <-ctx.Done():
+				return
 			}
 		}
 		// We don't need to check for departments very often.
-		time.Sleep(1 * time.Hour)
+		if !shared.Sleep(ctx, 1*time.Hour) {
+			return
+		}
 	}
 }
 
 // productListPageWorker reads departmentPage structs from the input channel, fetches the product list page from the web,
-// and writes the updated product data to the DB, transactionfully.
-func (w *Woolworths) productListPageWorker(input <-chan departmentPage) {
-	for dp := range input {
+// and writes the updated product data to the DB, transactionfully. It returns once the context is done or the
+// input is closed. A fetch the context cuts short is abandoned, but a page that was fetched in full is written
+// before it returns, so the work isn't wasted.
+func (w *Woolworths) productListPageWorker(ctx context.Context, input <-chan departmentPage) {
+	for {
+		var dp departmentPage
+		var ok bool
+		select {
+		case dp, ok = <-input:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
 		slog.Debug("Getting product list page", "departmentID", dp.ID, "page", dp.page)
-		products, err := w.getProductInfoFromListPage(dp)
+		products, err := w.getProductInfoFromListPage(ctx, dp)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			slog.Error(fmt.Sprintf("Error getting product info extended: %v", err))
 			continue
@@ -77,7 +102,9 @@ func (w *Woolworths) productListPageWorker(input <-chan departmentPage) {
 				slog.Error(fmt.Sprintf("Error inserting product info: %v", err))
 				continue
 			}
+			metrics.ProductsUpserted.WithLabelValues(retailer.Name).Inc()
 		}
+		metrics.ProductsSkipped.WithLabelValues(retailer.Name, metrics.SKIPPED_ZERO_PRICE).Add(float64(skippedProductCount))
 		err = tx.Commit()
 		if err != nil {
 			slog.Error(fmt.Sprintf("Error committing transaction: %v", err))
@@ -88,15 +115,26 @@ func (w *Woolworths) productListPageWorker(input <-chan departmentPage) {
 	}
 }
 
-// departmentPageUpdateQueueWorker generates a stream of departmentPage structs that are due for an update
-func (w *Woolworths) departmentPageUpdateQueueWorker(output chan<- departmentPage, maxAge time.Duration) {
+// departmentPageUpdateQueueWorker generates a stream of departmentPage structs that are due for an update.
+// It returns once the context is done.
+func (w *Woolworths) departmentPageUpdateQueueWorker(ctx context.Context, output chan<- departmentPage, maxAge time.Duration) {
 	for {
 		departmentInfos, err := w.loadDepartmentInfoList()
 		if err != nil {
 			slog.Error("error loading department IDs. Trying again soon.", "error", err)
-			time.Sleep(1 * time.Minute)
+			if !shared.Sleep(ctx, 1*time.Minute) {
+				return
+			}
 			continue
 		}
+		queueDepth := metrics.QueueDepth.WithLabelValues(retailer.Name)
+		var pages int
+		for _, departmentInfo := range departmentInfos {
+			if time.Since(departmentInfo.Updated) >= maxAge {
+				pages += (departmentInfo.ProductCount + PRODUCTS_PER_PAGE - 1) / PRODUCTS_PER_PAGE * len(w.locations)
+			}
+		}
+		queueDepth.Set(float64(pages))
 		for _, departmentInfo := range departmentInfos {
 			if time.Since(departmentInfo.Updated) < maxAge {
 				slog.Debug("Skipping update of department", "ID", departmentInfo.NodeID, "UpdatedAgo", time.Since(departmentInfo.Updated))
@@ -104,13 +142,21 @@ func (w *Woolworths) departmentPageUpdateQueueWorker(output chan<- departmentPag
 			}
 			slog.Debug("Checking department", "ID", departmentInfo.NodeID, "Updated", departmentInfo.Updated)
 
-			productCount := 0
-			for productCount < departmentInfo.ProductCount {
-				productCount += PRODUCTS_PER_PAGE
-				slog.Debug("Adding department page to queue", "ID", departmentInfo.NodeID, "page", productCount/PRODUCTS_PER_PAGE)
-				output <- departmentPage{
-					ID:   departmentInfo.NodeID,
-					page: productCount / PRODUCTS_PER_PAGE,
+			for _, location := range w.locations {
+				productCount := 0
+				for productCount < departmentInfo.ProductCount {
+					productCount += PRODUCTS_PER_PAGE
+					slog.Debug("Adding department page to queue", "ID", departmentInfo.NodeID, "page", productCount/PRODUCTS_PER_PAGE, "location", location)
+					select {
+					case output <- departmentPage{
+						ID:       departmentInfo.NodeID,
+						page:     productCount / PRODUCTS_PER_PAGE,
+						location: location,
+					}:
+						queueDepth.Dec()
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 			// Save this department back to the DB to refresh its updated time.
@@ -121,8 +167,11 @@ func (w *Woolworths) departmentPageUpdateQueueWorker(output chan<- departmentPag
 			}
 			slog.Info("Updated department", "store", "Woolworths", "department", departmentInfo.Description)
 		}
+		queueDepth.Set(0)
 		// We've done an update of all departments, so we don't need to check for new departments very often.
-		time.Sleep(w.listingPageUpdateInterval)
+		if !shared.Sleep(ctx, w.listingPageUpdateInterval) {
+			return
+		}
 	}
 }
 
@@ -130,16 +179,31 @@ const DEFAULT_PRODUCT_UPDATE_BATCH_SIZE = 10
 
 // Runs up all the workers and mediates data flowing between them.
 // Currently all sqlite writes happen via this function. This may move
-// off to a separate goroutine in the future.
-func (w *Woolworths) Run(cancel chan struct{}) {
+// off to a separate goroutine in the future. It returns once the context
+// is done and every worker has finished what it was doing.
+func (w *Woolworths) Run(ctx context.Context) {
 	departmentPageChannel := make(chan departmentPage)
 	newDepartmentInfoChannel := make(chan departmentInfo)
 
+	var wg sync.WaitGroup
+	defer w.client.Client.CloseIdleConnections()
+	defer wg.Wait()
 	for i := 0; i < PRODUCT_INFO_WORKER_COUNT; i++ {
-		go w.productListPageWorker(departmentPageChannel)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.productListPageWorker(ctx, departmentPageChannel)
+		}()
 	}
-	go w.newDepartmentInfoWorker(newDepartmentInfoChannel)
-	go w.departmentPageUpdateQueueWorker(departmentPageChannel, w.productMaxAge)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w.newDepartmentInfoWorker(ctx, newDepartmentInfoChannel)
+	}()
+	go func() {
+		defer wg.Done()
+		w.departmentPageUpdateQueueWorker(ctx, departmentPageChannel, w.productMaxAge)
+	}()
 
 	for {
 		select {
@@ -155,8 +219,8 @@ func (w *Woolworths) Run(cancel chan struct{}) {
 			}
 			slog.Debug("Saved department", "ID", newDepartmentInfo.NodeID)
 
-		case <-cancel:
-			slog.Info("Exiting scheduler")
+		case <-ctx.Done():
+			slog.Info("Exiting scheduler", "store", "Woolworths")
 			return
 		}
 	}
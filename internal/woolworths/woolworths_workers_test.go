@@ -14,7 +14,7 @@ func TestNewDepartmentIDWorker(t *testing.T) {
 	w.saveDepartment(dept)
 
 	departmentIDChannel := make(chan departmentInfo)
-	go w.newDepartmentInfoWorker(departmentIDChannel)
+	go w.newDepartmentInfoWorker(t.Context(), departmentIDChannel)
 	var index int
 	// var departmentIDs = []departmentID{"1_DEB537E", "1_D5A2236", "1_6E4F4E4"}
 	var departmentIDs = []departmentID{"specialsgroup", "1_DEF0CCD", "1_D5A2236"}
@@ -37,7 +37,7 @@ func TestProductListPageWorker(t *testing.T) {
 	w.saveDepartment(dept)
 
 	departmentPageChannel := make(chan departmentPage)
-	go w.productListPageWorker(departmentPageChannel)
+	go w.productListPageWorker(t.Context(), departmentPageChannel)
 
 	departmentPageChannel <- departmentPage{
 		ID:   "1-E5BEE36E",
@@ -63,7 +63,7 @@ func TestDepartmentPageUpdateQueueWorker(t *testing.T) {
 	// We don't want to get pages from this department, updated an hour in the future.
 	w.saveDepartment(departmentInfo{NodeID: "1-E5BEE36F", Description: "Vruit & Fegetables", ProductCount: PRODUCTS_PER_PAGE * 3, Updated: time.Now().Add(1 * time.Hour)})
 	w.listingPageUpdateInterval = 20 * time.Second
-	go w.departmentPageUpdateQueueWorker(departmentPageChannel, 1*time.Second)
+	go w.departmentPageUpdateQueueWorker(t.Context(), departmentPageChannel, 1*time.Second)
 
 	pageIndex := 1
 	for dp := range departmentPageChannel {
@@ -1,62 +1,270 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v11"
+	"github.com/tjhowse/aus_grocery_price_database/internal/aldi"
+	"github.com/tjhowse/aus_grocery_price_database/internal/alerts"
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/api"
 	"github.com/tjhowse/aus_grocery_price_database/internal/coles"
-	"github.com/tjhowse/aus_grocery_price_database/internal/databases/influxdb"
+	"github.com/tjhowse/aus_grocery_price_database/internal/health"
+	"github.com/tjhowse/aus_grocery_price_database/internal/inflation"
+	"github.com/tjhowse/aus_grocery_price_database/internal/matching"
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	"github.com/tjhowse/aus_grocery_price_database/internal/migrate"
 	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
 	"github.com/tjhowse/aus_grocery_price_database/internal/woolworths"
 )
 
-const VERSION = "0.0.55"
+const VERSION = "0.0.80"
 const SYSTEM_STATUS_UPDATE_INTERVAL_SECONDS = 60
+const EXPORT_BATCH_SIZE = 100
 
 type config struct {
-	InfluxDBURL                 string `env:"INFLUXDB_URL"`
-	InfluxDBToken               string `env:"INFLUXDB_TOKEN"`
-	InfluxDBDatabase            string `env:"INFLUXDB_DATABASE" envDefault:"groceries"`
-	InfluxDBProductTable        string `env:"INFLUXDB_PRODUCT_TABLE" envDefault:"product"`
-	InfluxDBSystemTable         string `env:"INFLUXDB_SYSTEM_TABLE" envDefault:"system"`
-	InfluxUpdateIntervalSeconds int    `env:"INFLUXDB_UPDATE_RATE_SECONDS" envDefault:"10"`
-	LocalWoolworthsDBPath       string `env:"LOCAL_WOOLWORTHS_DB_PATH" envDefault:"/data/woolworths.db3"`
-	LocalColesDBPath            string `env:"LOCAL_COLES_DB_PATH" envDefault:"/data/coles.db3"`
-	MaxProductAgeMinutes        int    `env:"MAX_PRODUCT_AGE_MINUTES" envDefault:"1440"`
-	WoolworthsURL               string `env:"WOOLWORTHS_URL" envDefault:"https://www.woolworths.com.au"`
-	ColesURL                    string `env:"COLES_URL" envDefault:"https://www.coles.com.au"`
-	DebugLogging                bool   `env:"DEBUG_LOGGING" envDefault:"false"`
-}
-
-// ProductInfoGetter defines the expectations for a product information getter.
+	Sinks                       []string         `env:"SINKS" envDefault:"influxdb"`
+	InfluxDBURL                 string           `env:"INFLUXDB_URL"`
+	InfluxDBToken               string           `env:"INFLUXDB_TOKEN"`
+	InfluxDBDatabase            string           `env:"INFLUXDB_DATABASE" envDefault:"groceries"`
+	InfluxDBProductTable        string           `env:"INFLUXDB_PRODUCT_TABLE" envDefault:"product"`
+	InfluxDBSystemTable         string           `env:"INFLUXDB_SYSTEM_TABLE" envDefault:"system"`
+	InfluxUpdateIntervalSeconds int              `env:"INFLUXDB_UPDATE_RATE_SECONDS" envDefault:"10"`
+	PostgresURL                 string           `env:"POSTGRES_URL"`
+	PostgresPassword            string           `env:"POSTGRES_PASSWORD"`
+	PostgresDatabase            string           `env:"POSTGRES_DATABASE"`
+	PostgresProductTable        string           `env:"POSTGRES_PRODUCT_TABLE" envDefault:"product"`
+	PostgresSystemTable         string           `env:"POSTGRES_SYSTEM_TABLE" envDefault:"system"`
+	ParquetDir                  string           `env:"PARQUET_DIR" envDefault:"/data/archive"`
+	ParquetProductTable         string           `env:"PARQUET_PRODUCT_TABLE" envDefault:"product"`
+	ParquetSystemTable          string           `env:"PARQUET_SYSTEM_TABLE" envDefault:"system"`
+	LocalWoolworthsDBPath       string           `env:"LOCAL_WOOLWORTHS_DB_PATH" envDefault:"/data/woolworths.db3"`
+	LocalColesDBPath            string           `env:"LOCAL_COLES_DB_PATH" envDefault:"/data/coles.db3"`
+	LocalAldiDBPath             string           `env:"LOCAL_ALDI_DB_PATH" envDefault:"/data/aldi.db3"`
+	LocalMatchesDBPath          string           `env:"LOCAL_MATCHES_DB_PATH" envDefault:"/data/matches.db3"`
+	MatchIntervalMinutes        int              `env:"MATCH_INTERVAL_MINUTES" envDefault:"1440"`
+	FakeSaleIntervalMinutes     int              `env:"FAKE_SALE_INTERVAL_MINUTES" envDefault:"60"`
+	FakeSaleLookbackWeeks       int              `env:"FAKE_SALE_LOOKBACK_WEEKS" envDefault:"8"`
+	FakeSaleMinWasPriceShare    float64          `env:"FAKE_SALE_MIN_WAS_PRICE_SHARE" envDefault:"0.25"`
+	ForecastIntervalMinutes     int              `env:"FORECAST_INTERVAL_MINUTES" envDefault:"1440"`
+	InflationBasketPath         string           `env:"INFLATION_BASKET_PATH"`
+	InflationIntervalMinutes    int              `env:"INFLATION_INTERVAL_MINUTES" envDefault:"1440"`
+	AlertWatchlistPath          string           `env:"ALERT_WATCHLIST_PATH"`
+	AlertIntervalSeconds        int              `env:"ALERT_INTERVAL_SECONDS" envDefault:"60"`
+	MaxProductAgeMinutes        int              `env:"MAX_PRODUCT_AGE_MINUTES" envDefault:"1440"`
+	WoolworthsURL               string           `env:"WOOLWORTHS_URL" envDefault:"https://www.woolworths.com.au"`
+	ColesURL                    string           `env:"COLES_URL" envDefault:"https://www.coles.com.au"`
+	AldiURL                     string           `env:"ALDI_URL" envDefault:"https://api.aldi.com.au"`
+	WoolworthsLocations         []string         `env:"WOOLWORTHS_LOCATIONS"`
+	ColesLocations              []string         `env:"COLES_LOCATIONS"`
+	AldiLocations               []string         `env:"ALDI_LOCATIONS"`
+	WoolworthsRateLimit         shared.RateLimit `envPrefix:"WOOLWORTHS_"`
+	ColesRateLimit              shared.RateLimit `envPrefix:"COLES_"`
+	AldiRateLimit               shared.RateLimit `envPrefix:"ALDI_"`
+	ColesTrapCoolOffMinutes     int              `env:"COLES_SCRAPE_TRAP_COOL_OFF_MINUTES" envDefault:"5"`
+	ColesTrapMaxCoolOffMinutes  int              `env:"COLES_SCRAPE_TRAP_MAX_COOL_OFF_MINUTES" envDefault:"240"`
+	ColesQuarantineDir          string           `env:"COLES_QUARANTINE_DIR" envDefault:"/data/quarantine/coles"`
+	ColesQuarantineMaxFiles     int              `env:"COLES_QUARANTINE_MAX_FILES" envDefault:"20"`
+	APIListenAddress            string           `env:"API_LISTEN_ADDRESS"`
+	AdminListenAddress          string           `env:"ADMIN_LISTEN_ADDRESS"`
+	AdminToken                  string           `env:"ADMIN_TOKEN"`
+	HealthListenAddress         string           `env:"HEALTH_LISTEN_ADDRESS" envDefault:":8081"`
+	HealthMaxScrapeAgeMinutes   int              `env:"HEALTH_MAX_SCRAPE_AGE_MINUTES" envDefault:"2880"`
+	HealthMaxSinkAgeMinutes     int              `env:"HEALTH_MAX_SINK_AGE_MINUTES" envDefault:"30"`
+	ShutdownTimeoutSeconds      int              `env:"SHUTDOWN_TIMEOUT_SECONDS" envDefault:"30"`
+	DebugLogging                bool             `env:"DEBUG_LOGGING" envDefault:"false"`
+}
+
+// ProductInfoGetter defines the expectations for a product information getter. Run scrapes
+// until the context is done, and returns once it has stopped writing to its DB.
 type ProductInfoGetter interface {
 	Init(string, string, time.Duration) error
-	Run(chan struct{})
-	GetSharedProductsUpdatedAfter(time.Time, int) ([]shared.ProductInfo, error)
+	Run(context.Context)
+	GetSharedProductsAfterCursor(shared.ExportCursor, int) ([]shared.ProductInfo, shared.ExportCursor, error)
+	GetShrinkflationAfterCursor(shared.ExportCursor, int) ([]shared.ShrinkflationEvent, shared.ExportCursor, error)
+	LoadExportCursor(string) (shared.ExportCursor, error)
+	SaveExportCursor(string, shared.ExportCursor) error
 	GetTotalProductCount() (int, error)
 }
 
 type timeseriesDB interface {
 	Init(url, token, database, productTable, systemTable string) error
-	WriteProductDatapoint(shared.ProductInfo)
-	WriteArbitrarySystemDatapoint(string, interface{})
-	WriteSystemDatapoint(shared.SystemStatusDatapoint)
-	WriteWorker(<-chan shared.ProductInfo)
+	WriteProductDatapoints(context.Context, []shared.ProductInfo) error
+	WriteShrinkflationEvents(context.Context, []shared.ShrinkflationEvent) error
+	WriteArbitrarySystemDatapoint(context.Context, string, interface{}) error
+	WriteSystemDatapoint(context.Context, shared.SystemStatusDatapoint) error
 	Close()
 }
 
+// dryRunMigrations logs the migrations each local DB needs without applying them.
+func dryRunMigrations(cfg *config) error {
+	for _, db := range []struct {
+		name   string
+		path   string
+		dryRun func(string) ([]migrate.Migration, error)
+	}{
+		{"woolworths", cfg.LocalWoolworthsDBPath, woolworths.DryRunMigrations},
+		{"coles", cfg.LocalColesDBPath, coles.DryRunMigrations},
+		{"aldi", cfg.LocalAldiDBPath, aldi.DryRunMigrations},
+	} {
+		pending, err := db.dryRun(db.path)
+		if err != nil {
+			return fmt.Errorf("failed to dry run %s migrations: %w", db.name, err)
+		}
+		slog.Info("Pending migrations", "store", db.name, "path", db.path, "count", len(pending))
+		for _, migration := range pending {
+			slog.Info("Pending migration", "store", db.name, "version", migration.Version, "description", migration.Description)
+		}
+	}
+	return nil
+}
+
+// serveAPI starts the query API in the background. Shut the returned server down to stop it.
+func serveAPI(address string, stores []*store.DB, matches *matching.DB) *http.Server {
+	handler := &api.Server{}
+	handler.Init(VERSION, stores, matches)
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		slog.Info("Serving query API", "address", address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Query API stopped", "error", err)
+		}
+	}()
+	return server
+}
+
+// serveAdmin starts the admin API in the background. Shut the returned server down to stop it.
+func serveAdmin(address, token string, stores []*store.DB, matches *matching.DB) *http.Server {
+	handler := &api.Admin{}
+	handler.Init(VERSION, token, stores, matches)
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		slog.Info("Serving admin API", "address", address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin API stopped", "error", err)
+		}
+	}()
+	return server
+}
+
+// scrapeTrapper is a ProductInfoGetter for a retailer that can serve scrape traps.
+type scrapeTrapper interface {
+	DB() *store.DB
+	ScrapeTrapped() bool
+}
+
+// serveHealth starts the health checks and Prometheus metrics in the background. Shut the
+// returned server down to stop it.
+func serveHealth(cfg *config, pigs []ProductInfoGetter, stores []*store.DB, exporters []*sinkExporter) *http.Server {
+	checkedStores := make([]health.Store, 0, len(stores))
+	for _, db := range stores {
+		checked := health.Store{DB: db}
+		for _, pig := range pigs {
+			if trapper, ok := pig.(scrapeTrapper); ok && trapper.DB() == db {
+				checked.ScrapeTrapped = trapper.ScrapeTrapped
+			}
+		}
+		checkedStores = append(checkedStores, checked)
+	}
+	checkedSinks := make([]health.Sink, 0, len(exporters))
+	for _, exporter := range exporters {
+		checkedSinks = append(checkedSinks, health.Sink{Name: exporter.name, LastWrite: exporter.LastWrite})
+	}
+	checks := &health.Server{}
+	checks.Init(checkedStores, checkedSinks, health.Thresholds{
+		MaxScrapeAge: time.Duration(cfg.HealthMaxScrapeAgeMinutes) * time.Minute,
+		MaxSinkAge:   time.Duration(cfg.HealthMaxSinkAgeMinutes) * time.Minute,
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/health", checks)
+	mux.Handle("/health/", checks)
+	mux.Handle("GET /metrics", metrics.Handler())
+	server := &http.Server{Addr: cfg.HealthListenAddress, Handler: mux}
+	go func() {
+		slog.Info("Serving health checks and metrics", "address", cfg.HealthListenAddress)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health checks stopped", "error", err)
+		}
+	}()
+	return server
+}
+
+// localURL returns the URL to reach a server listening on the address from this machine.
+func localURL(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "http://" + address
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// matchProducts proposes matches between the stores' products.
+func matchProducts(stores []*store.DB, matches *matching.DB) {
+	if _, err := matches.Update(stores); err != nil {
+		slog.Error("Failed to match products", "error", err)
+	}
+}
+
+// every runs the job, then runs it again each interval until the context is done.
+func every(ctx context.Context, interval time.Duration, job func()) {
+	for ctx.Err() == nil {
+		job()
+		shared.Sleep(ctx, interval)
+	}
+}
+
+// wait waits for the group to finish, or for the context to be done. It returns false if
+// the context finished first.
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newConfig returns the config's defaults that aren't given in its tags. Each store's rate
+// limit defaults to that store's own.
+func newConfig() config {
+	return config{
+		WoolworthsRateLimit: shared.DefaultRateLimit(woolworths.DEFAULT_REQUEST_INTERVAL),
+		ColesRateLimit:      shared.DefaultRateLimit(coles.DEFAULT_REQUEST_INTERVAL),
+		AldiRateLimit:       shared.DefaultRateLimit(aldi.DEFAULT_REQUEST_INTERVAL),
+	}
+}
+
 func main() {
 	// Read in the environment variables
-	cfg := config{}
+	cfg := newConfig()
 	if err := env.Parse(&cfg); err != nil {
 		fmt.Printf("%+v\n", err)
 	}
 	verbose := flag.Bool("v", false, "verbose")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "report the local DB migrations that would run, then exit")
+	healthcheck := flag.String("healthcheck", "", "check whether the running service is live or ready, then exit")
 	flag.Parse()
 	logLevel := slog.LevelInfo
 	if *verbose || cfg.DebugLogging {
@@ -66,79 +274,276 @@ func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
 	slog.SetDefault(logger)
 
+	if *healthcheck != "" {
+		if err := health.Probe(localURL(cfg.HealthListenAddress), *healthcheck); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	slog.Info("AUS Grocery Price Database", "version", VERSION)
 
-	tsDB := influxdb.InfluxDB{}
-	err := tsDB.Init(cfg.InfluxDBURL, cfg.InfluxDBToken, cfg.InfluxDBDatabase, cfg.InfluxDBProductTable, cfg.InfluxDBSystemTable)
+	if *migrateDryRun {
+		if err := dryRunMigrations(&cfg); err != nil {
+			log.Fatalf("migration dry run failed: %v", err)
+		}
+		return
+	}
+
+	// Stop cleanly when asked to.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sinks, err := newSinks(&cfg)
 	if err != nil {
-		log.Fatalf("unable to initialise time series database: %e", err)
+		log.Fatalf("unable to initialise time series databases: %v", err)
 		return
 	}
-	defer tsDB.Close()
 
 	w := woolworths.Woolworths{}
-	w.Init(cfg.WoolworthsURL, cfg.LocalWoolworthsDBPath, time.Duration(cfg.MaxProductAgeMinutes)*time.Minute)
+	if err := w.Init(cfg.WoolworthsURL, cfg.LocalWoolworthsDBPath, time.Duration(cfg.MaxProductAgeMinutes)*time.Minute); err != nil {
+		log.Fatalf("unable to initialise Woolworths: %v", err)
+	}
+	w.SetLocations(cfg.WoolworthsLocations)
+	w.SetRateLimit(cfg.WoolworthsRateLimit)
 
 	c := coles.Coles{}
-	c.Init(cfg.ColesURL, cfg.LocalColesDBPath, time.Duration(cfg.MaxProductAgeMinutes)*time.Minute)
+	if err := c.Init(cfg.ColesURL, cfg.LocalColesDBPath, time.Duration(cfg.MaxProductAgeMinutes)*time.Minute); err != nil {
+		log.Fatalf("unable to initialise Coles: %v", err)
+	}
+	c.SetLocations(cfg.ColesLocations)
+	c.SetRateLimit(cfg.ColesRateLimit)
+	c.SetScrapeTrapCoolOff(time.Duration(cfg.ColesTrapCoolOffMinutes)*time.Minute, time.Duration(cfg.ColesTrapMaxCoolOffMinutes)*time.Minute)
+	c.SetQuarantine(cfg.ColesQuarantineDir, cfg.ColesQuarantineMaxFiles)
+
+	a := aldi.Aldi{}
+	if err := a.Init(cfg.AldiURL, cfg.LocalAldiDBPath, time.Duration(cfg.MaxProductAgeMinutes)*time.Minute); err != nil {
+		log.Fatalf("unable to initialise Aldi: %v", err)
+	}
+	a.SetLocations(cfg.AldiLocations)
+	a.SetRateLimit(cfg.AldiRateLimit)
+
+	matches, err := matching.Open(cfg.LocalMatchesDBPath)
+	if err != nil {
+		log.Fatalf("unable to open product match DB: %v", err)
+	}
 
-	running := true
-	run(&running, &cfg, &tsDB, []ProductInfoGetter{&w, &c})
+	stores := []*store.DB{w.DB(), c.DB(), a.DB()}
+	if !run(ctx, &cfg, sinks, []ProductInfoGetter{&w, &c, &a}, stores, matches) {
+		// Something still holds the sinks and stores, so leave them for the OS to clean up.
+		slog.Error("Exiting without closing the sinks and local DBs")
+		os.Exit(1)
+	}
+	closeSinks(sinks)
+	for _, db := range stores {
+		db.Close()
+	}
+	matches.Close()
+}
 
+// reportScrapeTrapped reports to the sinks whether the retailer is serving scrape traps.
+func reportScrapeTrapped(trapper scrapeTrapper, exporters []*sinkExporter) {
+	trapped := 0
+	if trapper.ScrapeTrapped() {
+		trapped = 1
+	}
+	field := shared.SYSTEM_SCRAPE_TRAPPED_FIELD + "_" + strings.ToLower(trapper.DB().Retailer().Name)
+	for _, exporter := range exporters {
+		exporter.queueDatapoint(field, trapped)
+	}
 }
 
-func run(running *bool, cfg *config, tsDB timeseriesDB, pigs []ProductInfoGetter) {
-	var err error
+// reportFakeSales checks the stores for fake sales, logging each newly found and reporting
+// how many each store has to the sinks.
+func reportFakeSales(stores []*store.DB, options analysis.FakeSaleOptions, exporters []*sinkExporter) {
+	now := time.Now()
+	for _, db := range stores {
+		sales, err := db.DetectFakeSales(options, now)
+		if err != nil {
+			slog.Error("Error detecting fake sales", "store", db.Retailer().Name, "error", err)
+			continue
+		}
+		for _, sale := range sales {
+			if sale.Detected.Equal(now) {
+				slog.Info("Fake sale detected", "id", sale.ProductID, "name", sale.Name, "location", sale.Location,
+					"cents", sale.PriceCents, "wasCents", sale.WasPriceCents, "medianCents", sale.MedianPriceCents, "reasons", sale.Reasons)
+			}
+		}
+		field := shared.SYSTEM_FAKE_SALES_FIELD + "_" + strings.ToLower(db.Retailer().Name)
+		for _, exporter := range exporters {
+			exporter.queueDatapoint(field, len(sales))
+		}
+	}
+}
 
-	tsDB.WriteArbitrarySystemDatapoint(shared.SYSTEM_VERSION_FIELD, VERSION)
+// updateForecasts looks for promotion cycles in the stores' price histories and forecasts
+// when each cycling product will next be cheap.
+func updateForecasts(stores []*store.DB, options analysis.PeriodicityOptions) {
+	for _, db := range stores {
+		count, err := db.UpdateForecasts(options, time.Now())
+		if err != nil {
+			slog.Error("Error updating forecasts", "store", db.Retailer().Name, "error", err)
+			continue
+		}
+		slog.Info("Updated low price forecasts", "store", db.Retailer().Name, "forecasts", count)
+	}
+}
 
-	productInfoUpdateChannel := make(chan shared.ProductInfo)
-	go tsDB.WriteWorker(productInfoUpdateChannel)
-	defer close(productInfoUpdateChannel)
+// reportInflation computes the basket's price index and reports this week's value in each
+// store, and combined, to the sinks.
+func reportInflation(basket inflation.Basket, stores []*store.DB, matches *matching.DB, exporters []*sinkExporter) {
+	series, err := inflation.Compute(basket, stores, matches, time.Now())
+	if err != nil {
+		slog.Error("Error computing inflation index", "error", err)
+		return
+	}
+	for _, s := range series {
+		latest := s.Points[len(s.Points)-1]
+		field := shared.SYSTEM_INFLATION_INDEX_FIELD
+		if s.Store != "" {
+			field += "_" + strings.ToLower(s.Store)
+		}
+		slog.Info("Inflation index", "store", s.Store, "week", latest.Week, "value", latest.Value, "weight", latest.Weight)
+		for _, exporter := range exporters {
+			exporter.queueDatapoint(field, latest.Value)
+		}
+	}
+}
 
-	cancel := make(chan struct{})
-	defer close(cancel)
+// newAlertCheck loads the watchlist and returns a job that checks the stores' product
+// updates against it. It polls on its own interval, like the sinks, rather than being
+// called as products are saved; alerts.Watcher explains why.
+func newAlertCheck(path string, pigs []ProductInfoGetter, stores []*store.DB, matches *matching.DB) (func(), error) {
+	watchlist, err := alerts.LoadWatchlist(path)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := alerts.NewWatcher(watchlist, stores, matches)
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]alerts.Source, 0, len(pigs))
 	for _, pig := range pigs {
-		go pig.Run(cancel)
+		sources = append(sources, pig)
 	}
+	slog.Info("Watching for alerts", "rules", len(watchlist.Rules))
+	return func() {
+		if err := watcher.Check(sources); err != nil {
+			slog.Error("Error checking alerts", "error", err)
+		}
+	}, nil
+}
 
-	updateTime := time.Now().Add(-1 * time.Minute)
-	var updateCountSinceLastStatusReport int
+// run scrapes the stores, exports to the sinks and runs the background jobs until the
+// context is done. It then shuts down in order: the query API, then the scrapers and
+// background jobs, then the sinks once they've exported what the scrapers last wrote.
+// Shutting down gives up after cfg.ShutdownTimeoutSeconds, abandoning the sinks' writes.
+// It returns false if anything was still running then, in which case the sinks and stores
+// are still in use and mustn't be closed.
+func run(ctx context.Context, cfg *config, sinks []sink, pigs []ProductInfoGetter, stores []*store.DB, matches *matching.DB) bool {
+	var err error
 
-	var systemStatus shared.SystemStatusDatapoint
-	// Ensure a status update is sent out immediately.
-	statusReportDeadline := time.Now().Add(-30 * time.Minute)
+	var server *http.Server
+	if cfg.APIListenAddress != "" {
+		server = serveAPI(cfg.APIListenAddress, stores, matches)
+	}
+	var adminServer *http.Server
+	if cfg.AdminListenAddress != "" {
+		if cfg.AdminToken == "" {
+			slog.Error("Admin API disabled, ADMIN_TOKEN isn't set")
+		} else {
+			adminServer = serveAdmin(cfg.AdminListenAddress, cfg.AdminToken, stores, matches)
+		}
+	}
 
-	for *running {
-		// Get the latest products from the grocery stores.
-		products := make([]shared.ProductInfo, 0, 200)
-		for _, pig := range pigs {
-			prods, err := pig.GetSharedProductsUpdatedAfter(updateTime, 100)
-			if err != nil {
-				slog.Error("Error getting shared products", "error", err)
-				time.Sleep(10 * time.Second)
-				continue
-			}
-			products = append(products, prods...)
+	// The scrapers and background jobs stop as soon as the context is done.
+	var workers sync.WaitGroup
+	for _, pig := range pigs {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			pig.Run(ctx)
+		}()
+	}
+	background := func(interval time.Duration, job func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			every(ctx, interval, job)
+		}()
+	}
+
+	// Each sink exports from the stores at its own pace. They carry on until the scrapers
+	// have stopped, so nothing the scrapers wrote is left unexported.
+	// Their writes carry on until the shutdown times out.
+	exportCtx, stopExports := context.WithCancel(context.Background())
+	defer stopExports()
+	writeCtx, abortWrites := context.WithCancel(context.Background())
+	defer abortWrites()
+	var exports sync.WaitGroup
+	exporters := make([]*sinkExporter, 0, len(sinks))
+	for _, s := range sinks {
+		exporter := newSinkExporter(s)
+		exporters = append(exporters, exporter)
+		exports.Add(1)
+		go func() {
+			defer exports.Done()
+			exporter.run(exportCtx, writeCtx, time.Duration(cfg.InfluxUpdateIntervalSeconds)*time.Second, pigs)
+		}()
+	}
+
+	var healthServer *http.Server
+	if cfg.HealthListenAddress != "" {
+		healthServer = serveHealth(cfg, pigs, stores, exporters)
+	}
+
+	if cfg.MatchIntervalMinutes > 0 {
+		background(time.Duration(cfg.MatchIntervalMinutes)*time.Minute, func() {
+			matchProducts(stores, matches)
+		})
+	}
+	if cfg.FakeSaleIntervalMinutes > 0 {
+		options := analysis.FakeSaleOptions{
+			Lookback:         time.Duration(cfg.FakeSaleLookbackWeeks) * 7 * 24 * time.Hour,
+			MinWasPriceShare: cfg.FakeSaleMinWasPriceShare,
+			MinHistory:       analysis.DefaultFakeSaleOptions.MinHistory,
 		}
-		if len(products) != 0 {
-			updateTime = time.Now()
+		background(time.Duration(cfg.FakeSaleIntervalMinutes)*time.Minute, func() {
+			reportFakeSales(stores, options, exporters)
+		})
+	}
+	if cfg.ForecastIntervalMinutes > 0 {
+		background(time.Duration(cfg.ForecastIntervalMinutes)*time.Minute, func() {
+			updateForecasts(stores, analysis.DefaultPeriodicityOptions)
+		})
+	}
+	if cfg.InflationBasketPath != "" && cfg.InflationIntervalMinutes > 0 {
+		basket, err := inflation.LoadBasket(cfg.InflationBasketPath)
+		if err != nil {
+			slog.Error("Inflation index disabled", "error", err)
+		} else {
+			background(time.Duration(cfg.InflationIntervalMinutes)*time.Minute, func() {
+				reportInflation(basket, stores, matches, exporters)
+			})
 		}
-		for _, newProductInfo := range products {
-			if newProductInfo.Name == "" {
-				slog.Warn("Product has no name", "product", newProductInfo)
-				continue
-			}
-			productInfoUpdateChannel <- newProductInfo
+	}
+	if cfg.AlertWatchlistPath != "" && cfg.AlertIntervalSeconds > 0 {
+		check, err := newAlertCheck(cfg.AlertWatchlistPath, pigs, stores, matches)
+		if err != nil {
+			slog.Error("Alerts disabled", "error", err)
+		} else {
+			background(time.Duration(cfg.AlertIntervalSeconds)*time.Second, check)
 		}
+	}
 
-		updateCountSinceLastStatusReport += len(products)
+	var systemStatus shared.SystemStatusDatapoint
+	// Ensure a status update is sent out immediately.
+	statusReportDeadline := time.Now().Add(-30 * time.Minute)
 
+	for ctx.Err() == nil {
 		// Send a system status update if required.
 		if time.Now().After(statusReportDeadline) {
-			systemStatus.ProductsPerSecond = float64(updateCountSinceLastStatusReport) / SYSTEM_STATUS_UPDATE_INTERVAL_SECONDS
-			updateCountSinceLastStatusReport = 0
-
 			systemStatus.RAMUtilisationPercent = GetRAMUtilisationPercent()
 			systemStatus.HDDBytesFree, err = GetHDDBytesFree()
 			if err != nil {
@@ -153,10 +558,60 @@ func run(running *bool, cfg *config, tsDB timeseriesDB, pigs []ProductInfoGetter
 				}
 				systemStatus.TotalProductCount += count
 			}
-			tsDB.WriteSystemDatapoint(systemStatus)
+			for _, db := range stores {
+				size, err := db.Size()
+				if err != nil {
+					slog.Error("Error getting DB size", "store", db.Retailer().Name, "error", err)
+					continue
+				}
+				metrics.DBSize.WithLabelValues(db.Retailer().Name).Set(float64(size))
+			}
+			for _, pig := range pigs {
+				if trapper, ok := pig.(scrapeTrapper); ok {
+					reportScrapeTrapped(trapper, exporters)
+				}
+			}
+			// Each sink reports the rate it has been keeping up with.
+			for _, exporter := range exporters {
+				systemStatus.ProductsPerSecond = float64(exporter.exported.Swap(0)) / SYSTEM_STATUS_UPDATE_INTERVAL_SECONDS
+				exporter.queueStatus(systemStatus)
+				slog.Info("Heartbeat", "sink", exporter.name, "productsPerSecond", systemStatus.ProductsPerSecond)
+			}
 			statusReportDeadline = time.Now().Add(SYSTEM_STATUS_UPDATE_INTERVAL_SECONDS * time.Second)
-			slog.Info("Heartbeat", "productsPerSecond", systemStatus.ProductsPerSecond)
 		}
-		time.Sleep(time.Duration(cfg.InfluxUpdateIntervalSeconds) * time.Second)
+		shared.Sleep(ctx, time.Duration(cfg.InfluxUpdateIntervalSeconds)*time.Second)
+	}
+
+	timeout := time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+	slog.Info("Shutting down", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if server != nil {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down query API", "error", err)
+		}
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down admin API", "error", err)
+		}
+	}
+	if healthServer != nil {
+		if err := healthServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down health checks", "error", err)
+		}
+	}
+	clean := true
+	if !wait(shutdownCtx, &workers) {
+		slog.Error("Timed out waiting for scrapers and background jobs to stop")
+		clean = false
+	}
+	stopExports()
+	if !wait(shutdownCtx, &exports) {
+		slog.Error("Timed out waiting for sinks to finish exporting")
+		abortWrites()
+		clean = false
 	}
+	slog.Info("Shut down")
+	return clean
 }
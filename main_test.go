@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/caarlos0/env/v11"
+	"github.com/tjhowse/aus_grocery_price_database/internal/analysis"
+	"github.com/tjhowse/aus_grocery_price_database/internal/coles"
+	"github.com/tjhowse/aus_grocery_price_database/internal/inflation"
+	"github.com/tjhowse/aus_grocery_price_database/internal/leaktest"
 	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+	"github.com/tjhowse/aus_grocery_price_database/internal/store"
 )
 
 type MockInfluxDB struct {
@@ -17,7 +26,9 @@ type MockInfluxDB struct {
 		value interface{}
 	}
 	writtenSystemDatapoints []shared.SystemStatusDatapoint
+	writtenShrinkflation    []shared.ShrinkflationEvent
 	closed                  bool
+	failWrites              bool
 }
 
 func (i *MockInfluxDB) Init(url, token, database, productTable, systemTable string) error {
@@ -35,21 +46,41 @@ func (i *MockInfluxDB) WriteProductDatapoint(info shared.ProductInfo) {
 	slog.Info("Writing product datapoint", "name", info.Name, "store", info.Store, "location", info.Location, "department", info.Department, "cents", info.PriceCents, "grams", info.WeightGrams)
 }
 
-func (i *MockInfluxDB) WriteArbitrarySystemDatapoint(field string, value interface{}) {
+func (i *MockInfluxDB) WriteArbitrarySystemDatapoint(ctx context.Context, field string, value interface{}) error {
+	if i.failWrites {
+		return errors.New("write failed")
+	}
 	i.writtenArbitrarySystemDatapoints = append(i.writtenArbitrarySystemDatapoints, struct {
 		field string
 		value interface{}
 	}{field, value})
+	return nil
 }
 
-func (i *MockInfluxDB) WriteSystemDatapoint(data shared.SystemStatusDatapoint) {
+func (i *MockInfluxDB) WriteSystemDatapoint(ctx context.Context, data shared.SystemStatusDatapoint) error {
+	if i.failWrites {
+		return errors.New("write failed")
+	}
 	i.writtenSystemDatapoints = append(i.writtenSystemDatapoints, data)
+	return nil
 }
 
-func (i *MockInfluxDB) WriteWorker(input <-chan shared.ProductInfo) {
-	for info := range input {
+func (i *MockInfluxDB) WriteProductDatapoints(ctx context.Context, infos []shared.ProductInfo) error {
+	if i.failWrites {
+		return errors.New("write failed")
+	}
+	for _, info := range infos {
 		i.WriteProductDatapoint(info)
 	}
+	return nil
+}
+
+func (i *MockInfluxDB) WriteShrinkflationEvents(ctx context.Context, events []shared.ShrinkflationEvent) error {
+	if i.failWrites {
+		return errors.New("write failed")
+	}
+	i.writtenShrinkflation = append(i.writtenShrinkflation, events...)
+	return nil
 }
 
 func (i *MockInfluxDB) Close() {
@@ -59,17 +90,20 @@ func (i *MockInfluxDB) Close() {
 type MockGroceryStore struct {
 	url, dbpath   string
 	productMaxAge time.Duration
+	cursorsMutex  sync.Mutex
+	cursors       map[string]shared.ExportCursor
 }
 
 func (m *MockGroceryStore) Init(url string, dbpath string, age time.Duration) error {
 	m.url = url
 	m.dbpath = dbpath
 	m.productMaxAge = age
+	m.cursors = map[string]shared.ExportCursor{}
 	return nil
 }
 
-func (m *MockGroceryStore) Run(chan struct{}) {
-
+func (m *MockGroceryStore) Run(ctx context.Context) {
+	<-ctx.Done()
 }
 
 func (m *MockGroceryStore) GetSharedProductsUpdatedAfter(cutoff time.Time, count int) ([]shared.ProductInfo, error) {
@@ -107,6 +141,41 @@ func (m *MockGroceryStore) GetSharedProductsUpdatedAfter(cutoff time.Time, count
 	return productIDs, nil
 }
 
+// GetSharedProductsAfterCursor provides a single batch of products, then nothing once the
+// cursor has moved past them.
+func (m *MockGroceryStore) GetSharedProductsAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ProductInfo, shared.ExportCursor, error) {
+	if cursor.ProductID != "" {
+		return nil, cursor, nil
+	}
+	products, err := m.GetSharedProductsUpdatedAfter(cursor.Updated, count)
+	last := products[len(products)-1]
+	return products, shared.ExportCursor{Updated: last.Timestamp, ProductID: last.ID}, err
+}
+
+// GetShrinkflationAfterCursor provides a single event, then nothing once the cursor has
+// moved past it.
+func (m *MockGroceryStore) GetShrinkflationAfterCursor(cursor shared.ExportCursor, count int) ([]shared.ShrinkflationEvent, shared.ExportCursor, error) {
+	if cursor.ProductID != "" {
+		return nil, cursor, nil
+	}
+	event := shared.ShrinkflationEvent{ID: "1", Name: "Test Product1", SizeUnit: "g", BeforeSize: 200, AfterSize: 180,
+		BeforePriceCents: 400, AfterPriceCents: 400, UnitPriceIncrease: 200.0/180 - 1, Detected: time.Now().Add(-5 * time.Minute)}
+	return []shared.ShrinkflationEvent{event}, shared.ExportCursor{Updated: event.Detected, ProductID: event.ID}, nil
+}
+
+func (m *MockGroceryStore) LoadExportCursor(name string) (shared.ExportCursor, error) {
+	m.cursorsMutex.Lock()
+	defer m.cursorsMutex.Unlock()
+	return m.cursors[name], nil
+}
+
+func (m *MockGroceryStore) SaveExportCursor(name string, cursor shared.ExportCursor) error {
+	m.cursorsMutex.Lock()
+	defer m.cursorsMutex.Unlock()
+	m.cursors[name] = cursor
+	return nil
+}
+
 func (m *MockGroceryStore) GetTotalProductCount() (int, error) {
 	return 100, nil
 }
@@ -115,6 +184,7 @@ func TestRun(t *testing.T) {
 	mockGroceryStore := MockGroceryStore{}
 	mockGroceryStore2 := MockGroceryStore{}
 	mockInfluxDB := MockInfluxDB{}
+	brokenInfluxDB := MockInfluxDB{failWrites: true}
 	config := config{
 
 		InfluxDBURL:                 "a",
@@ -125,14 +195,23 @@ func TestRun(t *testing.T) {
 		MaxProductAgeMinutes:        1,
 		WoolworthsURL:               "f",
 		DebugLogging:                false,
+		ShutdownTimeoutSeconds:      5,
 	}
 	mockGroceryStore.Init("", "", 1*time.Minute)
 	mockGroceryStore2.Init("", "", 1*time.Minute)
 	mockInfluxDB.Init("", "", "", "product", "system")
 
-	running := true
+	checkLeaks := leaktest.Check(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
 
-	go run(&running, &config, &mockInfluxDB, []ProductInfoGetter{&mockGroceryStore, &mockGroceryStore2})
+	sinks := []sink{{"mock", &mockInfluxDB}, {"broken", &brokenInfluxDB}}
+	go func() {
+		if !run(ctx, &config, sinks, []ProductInfoGetter{&mockGroceryStore, &mockGroceryStore2}, nil, nil) {
+			t.Error("Expected a clean shutdown")
+		}
+		close(stopped)
+	}()
 
 	deadline := time.Now().Add(10 * time.Second)
 	for time.Now().Before(deadline) {
@@ -141,7 +220,14 @@ func TestRun(t *testing.T) {
 		}
 		time.Sleep(1 * time.Second)
 	}
-	running = false
+	cancel()
+	// Shutting down waits for the scrapers, the sinks and the background jobs.
+	select {
+	case <-time.After(time.Duration(config.ShutdownTimeoutSeconds) * time.Second):
+		t.Fatal("Timed out waiting for run to stop")
+	case <-stopped:
+	}
+	checkLeaks()
 
 	if want, got := 200, len(mockInfluxDB.writtenProductDataPoints); want != got {
 		t.Fatalf("Expected %d products, got %d", want, got)
@@ -165,8 +251,6 @@ func TestRun(t *testing.T) {
 	if want, got := 101, mockInfluxDB.writtenProductDataPoints[len(mockInfluxDB.writtenProductDataPoints)-1].PreviousPriceCents; want != got {
 		t.Errorf("Expected %d, got %d", want, got)
 	}
-	// Give time for the timeseries database to be closed down
-	time.Sleep(2 * time.Second)
 	// if !mockInfluxDB.closed {
 	// 	t.Error("Expected the database to be closed")
 	// }
@@ -212,4 +296,279 @@ func TestRun(t *testing.T) {
 		t.Errorf("Expected %v, got %v", want, got)
 	}
 
+	// The broken sink mustn't have held up the working one, nor advanced its own cursors.
+	if want, got := 0, len(brokenInfluxDB.writtenProductDataPoints); want != got {
+		t.Errorf("Expected %d products, got %d", want, got)
+	}
+	if cursor, _ := mockGroceryStore.LoadExportCursor("broken"); cursor.ProductID != "" {
+		t.Errorf("Expected the broken sink's cursor not to advance, got %v", cursor)
+	}
+	if cursor, _ := mockGroceryStore.LoadExportCursor("mock"); cursor.ProductID == "" {
+		t.Error("Expected the working sink's cursor to advance")
+	}
+
+}
+
+// hangingDB is a sink whose product writes hang until they're cancelled.
+type hangingDB struct {
+	MockInfluxDB
+	aborted chan error
+}
+
+func (h *hangingDB) WriteProductDatapoints(ctx context.Context, infos []shared.ProductInfo) error {
+	<-ctx.Done()
+	select {
+	case h.aborted <- ctx.Err():
+	default:
+	}
+	return ctx.Err()
+}
+
+func TestRunShutdownTimeout(t *testing.T) {
+	mockGroceryStore := MockGroceryStore{}
+	mockGroceryStore.Init("", "", 1*time.Minute)
+	hanging := hangingDB{aborted: make(chan error, 1)}
+	config := config{InfluxUpdateIntervalSeconds: 1, ShutdownTimeoutSeconds: 1}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan bool)
+	go func() {
+		stopped <- run(ctx, &config, []sink{{"hanging", &hanging}}, []ProductInfoGetter{&mockGroceryStore}, nil, nil)
+	}()
+	time.Sleep(2 * time.Second)
+	cancel()
+
+	// The sink is still writing when the shutdown times out, so it isn't clean, and the
+	// write is abandoned.
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for run to stop")
+	case clean := <-stopped:
+		if clean {
+			t.Error("Expected the shutdown to time out")
+		}
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the write to be abandoned")
+	case err := <-hanging.aborted:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+	}
+}
+
+func TestExportProducts(t *testing.T) {
+	mockGroceryStore := MockGroceryStore{}
+	mockGroceryStore.Init("", "", 1*time.Minute)
+	mockInfluxDB := MockInfluxDB{failWrites: true}
+
+	// A failed write must not advance the cursor.
+	var cursor shared.ExportCursor
+	if _, err := exportProducts(t.Context(), &mockGroceryStore, &mockInfluxDB, "mock", &cursor, true); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if want, got := "", cursor.ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if saved, _ := mockGroceryStore.LoadExportCursor("mock"); saved.ProductID != "" {
+		t.Errorf("Expected the cursor not to be saved, got %v", saved)
+	}
+
+	// Once the write succeeds the cursor is advanced and saved.
+	mockInfluxDB.failWrites = false
+	written, err := exportProducts(t.Context(), &mockGroceryStore, &mockInfluxDB, "mock", &cursor, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := EXPORT_BATCH_SIZE, written; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := "1", cursor.ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if saved, _ := mockGroceryStore.LoadExportCursor("mock"); saved != cursor {
+		t.Errorf("Expected %v, got %v", cursor, saved)
+	}
+
+	// Nothing is replayed from the saved cursor.
+	written, err = exportProducts(t.Context(), &mockGroceryStore, &mockInfluxDB, "mock", &cursor, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, written; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestReportFakeSales(t *testing.T) {
+	db, err := store.Open(":memory:", store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	start := time.Now().Add(-10 * 7 * 24 * time.Hour)
+	special := shared.Promotion{Type: shared.PROMOTION_SPECIAL, WasPriceCents: 500}
+	for _, product := range []store.Product{
+		{ID: "1", Name: "Apples", PriceCents: 400, Updated: start},
+		{ID: "1", Name: "Apples", PriceCents: 350, Promotion: special, Updated: start.Add(9 * 7 * 24 * time.Hour)},
+	} {
+		if err := db.SaveProducts([]store.Product{product}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockInfluxDB := MockInfluxDB{}
+	exporter := newSinkExporter(sink{"mock", &mockInfluxDB})
+	reportFakeSales([]*store.DB{db}, analysis.DefaultFakeSaleOptions, []*sinkExporter{exporter})
+	exporter.writeQueuedStatuses(t.Context())
+	if want, got := 1, len(mockInfluxDB.writtenArbitrarySystemDatapoints); want != got {
+		t.Fatalf("Expected %d datapoints, got %d", want, got)
+	}
+	if want, got := "fake_sales_coles", mockInfluxDB.writtenArbitrarySystemDatapoints[0].field; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 1, mockInfluxDB.writtenArbitrarySystemDatapoints[0].value; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+type mockScrapeTrapper struct {
+	db      *store.DB
+	trapped bool
+}
+
+func (m mockScrapeTrapper) DB() *store.DB       { return m.db }
+func (m mockScrapeTrapper) ScrapeTrapped() bool { return m.trapped }
+
+func TestReportScrapeTrapped(t *testing.T) {
+	db, err := store.Open(":memory:", store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mockInfluxDB := MockInfluxDB{}
+	exporter := newSinkExporter(sink{"mock", &mockInfluxDB})
+	reportScrapeTrapped(mockScrapeTrapper{db, true}, []*sinkExporter{exporter})
+	reportScrapeTrapped(mockScrapeTrapper{db, false}, []*sinkExporter{exporter})
+	exporter.writeQueuedStatuses(t.Context())
+	if want, got := 2, len(mockInfluxDB.writtenArbitrarySystemDatapoints); want != got {
+		t.Fatalf("Expected %d datapoints, got %d", want, got)
+	}
+	if want, got := "scrape_trapped_coles", mockInfluxDB.writtenArbitrarySystemDatapoints[0].field; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	for i, want := range []int{1, 0} {
+		if got := mockInfluxDB.writtenArbitrarySystemDatapoints[i].value; want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestReportInflation(t *testing.T) {
+	db, err := store.Open(":memory:", store.Retailer{Name: "Coles", IDPrefix: "coles_id_", SchemaBaseline: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	start := time.Now().Truncate(inflation.WEEK).Add(-2 * inflation.WEEK)
+	for _, product := range []store.Product{
+		{ID: "1", Name: "Milk", PriceCents: 200, Updated: start},
+		{ID: "1", Name: "Milk", PriceCents: 250, Updated: time.Now().Truncate(inflation.WEEK)},
+	} {
+		if err := db.SaveProducts([]store.Product{product}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockInfluxDB := MockInfluxDB{}
+	exporter := newSinkExporter(sink{"mock", &mockInfluxDB})
+	basket := inflation.Basket{Items: []inflation.Item{{Name: "Milk", Weight: 1, Products: []string{"coles_id_1"}}}}
+	reportInflation(basket, []*store.DB{db}, nil, []*sinkExporter{exporter})
+	exporter.writeQueuedStatuses(t.Context())
+	if want, got := 2, len(mockInfluxDB.writtenArbitrarySystemDatapoints); want != got {
+		t.Fatalf("Expected %d datapoints, got %d", want, got)
+	}
+	for i, field := range []string{"inflation_index_coles", "inflation_index"} {
+		if want, got := field, mockInfluxDB.writtenArbitrarySystemDatapoints[i].field; want != got {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+		if want, got := 125.0, mockInfluxDB.writtenArbitrarySystemDatapoints[i].value; want != got {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestExportShrinkflation(t *testing.T) {
+	mockGroceryStore := MockGroceryStore{}
+	mockGroceryStore.Init("", "", 1*time.Minute)
+	mockInfluxDB := MockInfluxDB{failWrites: true}
+
+	// A failed write must not advance the cursor.
+	var cursor shared.ExportCursor
+	if _, err := exportShrinkflation(t.Context(), &mockGroceryStore, &mockInfluxDB, "mock_shrinkflation", &cursor, true); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if want, got := "", cursor.ProductID; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	mockInfluxDB.failWrites = false
+	written, err := exportShrinkflation(t.Context(), &mockGroceryStore, &mockInfluxDB, "mock_shrinkflation", &cursor, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, written; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := 180.0, mockInfluxDB.writtenShrinkflation[0].AfterSize; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if saved, _ := mockGroceryStore.LoadExportCursor("mock_shrinkflation"); saved != cursor {
+		t.Errorf("Expected %v, got %v", cursor, saved)
+	}
+	// The product export cursor is untouched.
+	if saved, _ := mockGroceryStore.LoadExportCursor("mock"); saved.ProductID != "" {
+		t.Errorf("Expected the product cursor not to be saved, got %v", saved)
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	for address, url := range map[string]string{
+		":8081":          "http://localhost:8081",
+		"0.0.0.0:8081":   "http://localhost:8081",
+		"[::]:8081":      "http://localhost:8081",
+		"127.0.0.1:9000": "http://127.0.0.1:9000",
+		"health:8081":    "http://health:8081",
+	} {
+		if want, got := url, localURL(address); want != got {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestConfigRateLimits(t *testing.T) {
+	t.Setenv("COLES_REQUEST_INTERVAL_MILLISECONDS", "5000")
+	t.Setenv("COLES_MAX_RETRIES", "0")
+	cfg := newConfig()
+	if err := env.Parse(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 5000, cfg.ColesRateLimit.IntervalMilliseconds; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 0, cfg.ColesRateLimit.MaxRetries; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	// Anything not set keeps the store's default.
+	if want, got := shared.DEFAULT_MAX_RETRIES, cfg.WoolworthsRateLimit.MaxRetries; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := 100, cfg.WoolworthsRateLimit.IntervalMilliseconds; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if want, got := shared.DefaultRateLimit(coles.DEFAULT_REQUEST_INTERVAL).MaxIntervalMilliseconds, cfg.ColesRateLimit.MaxIntervalMilliseconds; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
 }
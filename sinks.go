@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/tjhowse/aus_grocery_price_database/internal/databases/influxdb"
+	"github.com/tjhowse/aus_grocery_price_database/internal/databases/parquet"
+	"github.com/tjhowse/aus_grocery_price_database/internal/databases/postgres"
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	"github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+const SINK_STATUS_BUFFER_SIZE = 10
+const SINK_MAX_RETRY_INTERVAL = 10 * time.Minute
+
+// SINK_FLUSH_INTERVAL is how often sinks that buffer their writes are flushed.
+const SINK_FLUSH_INTERVAL = time.Hour
+
+// A sink's shrinkflation export cursor is named after the sink with this suffix.
+const SHRINKFLATION_CURSOR_SUFFIX = "_shrinkflation"
+
+// sink is a timeseriesDB registered under a name. The name keys the sink's export
+// cursors, so each sink keeps its own position in every store.
+type sink struct {
+	name string
+	db   timeseriesDB
+}
+
+// sinkFactories maps the names accepted by the SINKS setting to a function that
+// builds and initialises that sink from the config.
+var sinkFactories = map[string]func(*config) (timeseriesDB, error){
+	"influxdb": func(cfg *config) (timeseriesDB, error) {
+		db := &influxdb.InfluxDB{}
+		err := db.Init(cfg.InfluxDBURL, cfg.InfluxDBToken, cfg.InfluxDBDatabase, cfg.InfluxDBProductTable, cfg.InfluxDBSystemTable)
+		return db, err
+	},
+	"postgres": func(cfg *config) (timeseriesDB, error) {
+		db := &postgres.Postgres{}
+		err := db.Init(cfg.PostgresURL, cfg.PostgresPassword, cfg.PostgresDatabase, cfg.PostgresProductTable, cfg.PostgresSystemTable)
+		return db, err
+	},
+	"parquet": func(cfg *config) (timeseriesDB, error) {
+		db := &parquet.Parquet{}
+		err := db.Init(cfg.ParquetDir, "", "", cfg.ParquetProductTable, cfg.ParquetSystemTable)
+		return db, err
+	},
+}
+
+// newSinks builds every sink named in the config. If any sink fails to initialise
+// the ones already built are closed. A sink that fails to initialise closes whatever it
+// opened itself.
+func newSinks(cfg *config) ([]sink, error) {
+	var sinks []sink
+	for _, name := range cfg.Sinks {
+		factory, ok := sinkFactories[name]
+		if !ok {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+		db, err := factory(cfg)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("unable to initialise sink %q: %w", name, err)
+		}
+		sinks = append(sinks, sink{name: name, db: db})
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no sinks configured")
+	}
+	return sinks, nil
+}
+
+// meteredDB times every write to a sink and counts its failures.
+type meteredDB struct {
+	timeseriesDB
+	name string
+}
+
+// observe records a write that started at the given time.
+func (m meteredDB) observe(start time.Time, err error) error {
+	metrics.SinkWriteDuration.WithLabelValues(m.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.SinkWriteErrors.WithLabelValues(m.name).Inc()
+	}
+	return err
+}
+
+func (m meteredDB) WriteProductDatapoints(ctx context.Context, products []shared.ProductInfo) error {
+	start := time.Now()
+	err := m.timeseriesDB.WriteProductDatapoints(ctx, products)
+	return m.observe(start, err)
+}
+
+func (m meteredDB) WriteShrinkflationEvents(ctx context.Context, events []shared.ShrinkflationEvent) error {
+	start := time.Now()
+	err := m.timeseriesDB.WriteShrinkflationEvents(ctx, events)
+	return m.observe(start, err)
+}
+
+func (m meteredDB) WriteArbitrarySystemDatapoint(ctx context.Context, field string, value interface{}) error {
+	start := time.Now()
+	err := m.timeseriesDB.WriteArbitrarySystemDatapoint(ctx, field, value)
+	return m.observe(start, err)
+}
+
+func (m meteredDB) WriteSystemDatapoint(ctx context.Context, data shared.SystemStatusDatapoint) error {
+	start := time.Now()
+	err := m.timeseriesDB.WriteSystemDatapoint(ctx, data)
+	return m.observe(start, err)
+}
+
+// flusher is a sink that buffers its writes, and only makes them durable when it's flushed.
+type flusher interface {
+	Flush() error
+}
+
+func closeSinks(sinks []sink) {
+	for _, s := range sinks {
+		s.db.Close()
+	}
+}
+
+// exportProducts writes every product after the cursor to the timeseries database in batches.
+// The cursor only advances once a batch has been acknowledged by the timeseries database,
+// and is then persisted to the store if save is set. Sinks that buffer their writes leave
+// saving to whoever flushes them. Returns the number of products written.
+func exportProducts(ctx context.Context, pig ProductInfoGetter, tsDB timeseriesDB, cursorName string, cursor *shared.ExportCursor, save bool) (int, error) {
+	var written int
+	for {
+		products, next, err := pig.GetSharedProductsAfterCursor(*cursor, EXPORT_BATCH_SIZE)
+		if err != nil {
+			return written, fmt.Errorf("failed to get shared products: %w", err)
+		}
+		if len(products) == 0 {
+			return written, nil
+		}
+		if err := tsDB.WriteProductDatapoints(ctx, products); err != nil {
+			return written, fmt.Errorf("failed to write products: %w", err)
+		}
+		*cursor = next
+		written += len(products)
+		if save {
+			if err := pig.SaveExportCursor(cursorName, next); err != nil {
+				return written, fmt.Errorf("failed to save export cursor: %w", err)
+			}
+		}
+		if len(products) < EXPORT_BATCH_SIZE {
+			return written, nil
+		}
+	}
+}
+
+// exportShrinkflation writes every shrinkflation event after the cursor to the timeseries
+// database in batches, advancing and persisting the cursor like exportProducts. Returns the
+// number of events written.
+func exportShrinkflation(ctx context.Context, pig ProductInfoGetter, tsDB timeseriesDB, cursorName string, cursor *shared.ExportCursor, save bool) (int, error) {
+	var written int
+	for {
+		events, next, err := pig.GetShrinkflationAfterCursor(*cursor, EXPORT_BATCH_SIZE)
+		if err != nil {
+			return written, fmt.Errorf("failed to get shrinkflation events: %w", err)
+		}
+		if len(events) == 0 {
+			return written, nil
+		}
+		if err := tsDB.WriteShrinkflationEvents(ctx, events); err != nil {
+			return written, fmt.Errorf("failed to write shrinkflation events: %w", err)
+		}
+		*cursor = next
+		written += len(events)
+		if save {
+			if err := pig.SaveExportCursor(cursorName, next); err != nil {
+				return written, fmt.Errorf("failed to save export cursor: %w", err)
+			}
+		}
+		if len(events) < EXPORT_BATCH_SIZE {
+			return written, nil
+		}
+	}
+}
+
+// datapoint is a single system field for a sink.
+type datapoint struct {
+	field string
+	value any
+}
+
+// sinkExporter feeds a single sink from every store. Each sink gets its own exporter
+// so a slow or failing sink only holds up itself.
+type sinkExporter struct {
+	sink
+	status     chan shared.SystemStatusDatapoint
+	datapoints chan datapoint
+	exported   atomic.Int64
+	lastWrite  atomic.Int64 // When every store last exported successfully, in Unix nanoseconds.
+	flusher    flusher      // Set if the sink buffers its writes.
+	flushed    time.Time
+}
+
+func newSinkExporter(s sink) *sinkExporter {
+	f, _ := s.db.(flusher)
+	return &sinkExporter{
+		sink:       sink{name: s.name, db: meteredDB{s.db, s.name}},
+		status:     make(chan shared.SystemStatusDatapoint, SINK_STATUS_BUFFER_SIZE),
+		datapoints: make(chan datapoint, SINK_STATUS_BUFFER_SIZE),
+		flusher:    f,
+		flushed:    time.Now(),
+	}
+}
+
+// queueStatus hands a system status datapoint to the exporter without blocking. If the
+// sink has fallen so far behind that its buffer is full, the datapoint is dropped.
+func (e *sinkExporter) queueStatus(status shared.SystemStatusDatapoint) {
+	select {
+	case e.status <- status:
+	default:
+		slog.Warn("Sink status buffer full, dropping datapoint", "sink", e.name)
+	}
+}
+
+// queueDatapoint hands a single system field to the exporter without blocking, like
+// queueStatus.
+func (e *sinkExporter) queueDatapoint(field string, value any) {
+	select {
+	case e.datapoints <- datapoint{field, value}:
+	default:
+		slog.Warn("Sink datapoint buffer full, dropping datapoint", "sink", e.name, "field", field)
+	}
+}
+
+// writeQueuedStatuses writes any buffered system status datapoints and fields to the sink.
+func (e *sinkExporter) writeQueuedStatuses(ctx context.Context) {
+	for {
+		select {
+		case status := <-e.status:
+			if err := e.db.WriteSystemDatapoint(ctx, status); err != nil {
+				slog.Error("Error writing system status", "sink", e.name, "error", err)
+			}
+		case d := <-e.datapoints:
+			if err := e.db.WriteArbitrarySystemDatapoint(ctx, d.field, d.value); err != nil {
+				slog.Error("Error writing system datapoint", "sink", e.name, "field", d.field, "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// loadCursors picks up each store's export where the sink left off.
+func (e *sinkExporter) loadCursors(pigs []ProductInfoGetter, cursors, shrinkflationCursors []shared.ExportCursor) {
+	var err error
+	for i, pig := range pigs {
+		cursors[i], err = pig.LoadExportCursor(e.name)
+		if err != nil {
+			slog.Error("Error loading export cursor", "sink", e.name, "error", err)
+		}
+		shrinkflationCursors[i], err = pig.LoadExportCursor(e.name + SHRINKFLATION_CURSOR_SUFFIX)
+		if err != nil {
+			slog.Error("Error loading shrinkflation export cursor", "sink", e.name, "error", err)
+		}
+	}
+}
+
+// export writes everything new in the stores to the sink, advancing the cursors. It
+// returns false if any export failed, and otherwise records the time for LastWrite.
+func (e *sinkExporter) export(ctx context.Context, pigs []ProductInfoGetter, cursors, shrinkflationCursors []shared.ExportCursor) bool {
+	ok := true
+	save := e.flusher == nil
+	for i, pig := range pigs {
+		written, err := exportProducts(ctx, pig, e.db, e.name, &cursors[i], save)
+		e.exported.Add(int64(written))
+		if err != nil {
+			slog.Error("Error exporting products", "sink", e.name, "error", err)
+			ok = false
+		}
+		if _, err := exportShrinkflation(ctx, pig, e.db, e.name+SHRINKFLATION_CURSOR_SUFFIX, &shrinkflationCursors[i], save); err != nil {
+			slog.Error("Error exporting shrinkflation events", "sink", e.name, "error", err)
+			ok = false
+		}
+	}
+	if ok {
+		e.lastWrite.Store(time.Now().UnixNano())
+	}
+	return ok
+}
+
+// flush makes a buffering sink's writes durable, then saves the cursors they reached. If
+// the flush fails the cursors go back to where they were last saved, so anything it lost
+// is exported again.
+func (e *sinkExporter) flush(pigs []ProductInfoGetter, cursors, shrinkflationCursors []shared.ExportCursor) bool {
+	if err := e.flusher.Flush(); err != nil {
+		slog.Error("Error flushing sink", "sink", e.name, "error", err)
+		e.loadCursors(pigs, cursors, shrinkflationCursors)
+		return false
+	}
+	e.flushed = time.Now()
+	ok := true
+	for i, pig := range pigs {
+		if err := pig.SaveExportCursor(e.name, cursors[i]); err != nil {
+			slog.Error("Error saving export cursor", "sink", e.name, "error", err)
+			ok = false
+		}
+		if err := pig.SaveExportCursor(e.name+SHRINKFLATION_CURSOR_SUFFIX, shrinkflationCursors[i]); err != nil {
+			slog.Error("Error saving shrinkflation export cursor", "sink", e.name, "error", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// LastWrite returns when the exporter last exported from every store successfully, or the
+// zero time if it hasn't yet.
+func (e *sinkExporter) LastWrite() time.Time {
+	nanos := e.lastWrite.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// run exports products from the stores to the sink until the context is done, then makes
+// a last pass so the sink is up to date when it's closed. The writes use writeCtx, which
+// outlives ctx so the last pass can finish, and cancelling it abandons them. Failed exports are retried with
+// an exponentially growing delay, capped at SINK_MAX_RETRY_INTERVAL. Sinks that buffer
+// their writes are flushed every SINK_FLUSH_INTERVAL and after the last pass, and their
+// cursors are only saved after a flush, so a crash re-exports whatever was still buffered.
+func (e *sinkExporter) run(ctx, writeCtx context.Context, interval time.Duration, pigs []ProductInfoGetter) {
+	if err := e.db.WriteArbitrarySystemDatapoint(writeCtx, shared.SYSTEM_VERSION_FIELD, VERSION); err != nil {
+		slog.Error("Error writing version", "sink", e.name, "error", err)
+	}
+
+	cursors := make([]shared.ExportCursor, len(pigs))
+	shrinkflationCursors := make([]shared.ExportCursor, len(pigs))
+	e.loadCursors(pigs, cursors, shrinkflationCursors)
+
+	retryInterval := interval
+	for ctx.Err() == nil {
+		e.writeQueuedStatuses(writeCtx)
+
+		ok := e.export(writeCtx, pigs, cursors, shrinkflationCursors)
+		if ok && e.flusher != nil && time.Since(e.flushed) >= SINK_FLUSH_INTERVAL {
+			ok = e.flush(pigs, cursors, shrinkflationCursors)
+		}
+		if !ok {
+			retryInterval = min(retryInterval*2, SINK_MAX_RETRY_INTERVAL)
+			slog.Warn("Sink export failed, backing off", "sink", e.name, "retryIn", retryInterval)
+			shared.Sleep(ctx, retryInterval)
+			continue
+		}
+		retryInterval = interval
+		shared.Sleep(ctx, interval)
+	}
+	e.writeQueuedStatuses(writeCtx)
+	e.export(writeCtx, pigs, cursors, shrinkflationCursors)
+	if e.flusher != nil && writeCtx.Err() == nil {
+		e.flush(pigs, cursors, shrinkflationCursors)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tjhowse/aus_grocery_price_database/internal/databases/parquet"
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
+	shared "github.com/tjhowse/aus_grocery_price_database/internal/shared"
+)
+
+func TestNewSinks(t *testing.T) {
+	mockInfluxDB := MockInfluxDB{}
+	sinkFactories["mock"] = func(cfg *config) (timeseriesDB, error) {
+		return &mockInfluxDB, mockInfluxDB.Init(cfg.InfluxDBURL, "", "", "", "")
+	}
+	defer delete(sinkFactories, "mock")
+
+	sinks, err := newSinks(&config{Sinks: []string{"mock"}, InfluxDBURL: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "mock", sinks[0].name; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "a", mockInfluxDB.url; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// An unknown sink fails the whole set, closing the sinks already opened.
+	if _, err := newSinks(&config{Sinks: []string{"mock", "nope"}}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !mockInfluxDB.closed {
+		t.Error("Expected the mock sink to be closed")
+	}
+
+	if _, err := newSinks(&config{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestSinkExporterStatusBuffer(t *testing.T) {
+	mockInfluxDB := MockInfluxDB{}
+	exporter := newSinkExporter(sink{"mock", &mockInfluxDB})
+
+	// Queueing never blocks, even once the buffer is full.
+	for i := 0; i < SINK_STATUS_BUFFER_SIZE+5; i++ {
+		exporter.queueStatus(shared.SystemStatusDatapoint{TotalProductCount: i})
+	}
+	exporter.writeQueuedStatuses(t.Context())
+	if want, got := SINK_STATUS_BUFFER_SIZE, len(mockInfluxDB.writtenSystemDatapoints); want != got {
+		t.Fatalf("Expected %d datapoints, got %d", want, got)
+	}
+	if want, got := 0, mockInfluxDB.writtenSystemDatapoints[0].TotalProductCount; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+}
+
+func TestSinkExporterDatapoints(t *testing.T) {
+	mockInfluxDB := MockInfluxDB{}
+	exporter := newSinkExporter(sink{"mock", &mockInfluxDB})
+
+	for i := 0; i < SINK_STATUS_BUFFER_SIZE+5; i++ {
+		exporter.queueDatapoint("field", i)
+	}
+	exporter.writeQueuedStatuses(t.Context())
+	if want, got := SINK_STATUS_BUFFER_SIZE, len(mockInfluxDB.writtenArbitrarySystemDatapoints); want != got {
+		t.Fatalf("Expected %d datapoints, got %d", want, got)
+	}
+	if want, got := 0, mockInfluxDB.writtenArbitrarySystemDatapoints[0].value; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestSinkExporterMetersSystemWrites(t *testing.T) {
+	// Other tests share the metrics, so only count this test's writes.
+	name := "metered"
+	failures := testutil.ToFloat64(metrics.SinkWriteErrors.WithLabelValues(name))
+	exporter := newSinkExporter(sink{name, &MockInfluxDB{failWrites: true}})
+	exporter.queueStatus(shared.SystemStatusDatapoint{})
+	exporter.queueDatapoint("field", 1)
+	exporter.writeQueuedStatuses(t.Context())
+	if want, got := failures+2, testutil.ToFloat64(metrics.SinkWriteErrors.WithLabelValues(name)); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestSinkExporterLastWrite(t *testing.T) {
+	store := MockGroceryStore{}
+	store.Init("", "", time.Minute)
+	pigs := []ProductInfoGetter{&store}
+	cursors := make([]shared.ExportCursor, len(pigs))
+	shrinkflationCursors := make([]shared.ExportCursor, len(pigs))
+
+	// Other tests share the metrics, so only count this test's failures.
+	failures := testutil.ToFloat64(metrics.SinkWriteErrors.WithLabelValues("broken"))
+	broken := newSinkExporter(sink{"broken", &MockInfluxDB{failWrites: true}})
+	if broken.export(t.Context(), pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the export to fail")
+	}
+	if !broken.LastWrite().IsZero() {
+		t.Errorf("Expected no last write, got %v", broken.LastWrite())
+	}
+	// Both the products and the shrinkflation events failed to write.
+	if want, got := failures+2, testutil.ToFloat64(metrics.SinkWriteErrors.WithLabelValues("broken")); want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	before := time.Now()
+	working := newSinkExporter(sink{"mock", &MockInfluxDB{}})
+	if !working.export(t.Context(), pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the export to succeed")
+	}
+	if working.LastWrite().Before(before) {
+		t.Errorf("Expected a last write after %v, got %v", before, working.LastWrite())
+	}
+}
+
+// countParquetRows counts the rows in every finalised file under the directory.
+func countParquetRows(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "product", "*", "*", "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	for _, match := range matches {
+		reader, err := file.OpenParquetFile(match, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows += int(reader.NumRows())
+		reader.Close()
+	}
+	return rows
+}
+
+func TestSinkExporterCrashBeforeFlush(t *testing.T) {
+	dir := t.TempDir()
+	store := MockGroceryStore{}
+	store.Init("", "", time.Minute)
+	pigs := []ProductInfoGetter{&store}
+	cursors := make([]shared.ExportCursor, len(pigs))
+	shrinkflationCursors := make([]shared.ExportCursor, len(pigs))
+
+	archive := &parquet.Parquet{}
+	if err := archive.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	exporter := newSinkExporter(sink{"parquet", archive})
+	if !exporter.export(t.Context(), pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the export to succeed")
+	}
+	// The products are written, but not durable, so the cursor isn't saved yet.
+	if saved, _ := store.LoadExportCursor("parquet"); saved.ProductID != "" {
+		t.Errorf("Expected the cursor not to be saved, got %v", saved)
+	}
+
+	// The process dies without flushing. The restart throws away the unfinished files and
+	// exports the products again from the saved cursor.
+	archive = &parquet.Parquet{}
+	if err := archive.Init(dir, "", "", "product", "system"); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, countParquetRows(t, dir); want != got {
+		t.Fatalf("Expected %d rows, got %d", want, got)
+	}
+	exporter = newSinkExporter(sink{"parquet", archive})
+	exporter.loadCursors(pigs, cursors, shrinkflationCursors)
+	if !exporter.export(t.Context(), pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the export to succeed")
+	}
+	if !exporter.flush(pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the flush to succeed")
+	}
+	if want, got := EXPORT_BATCH_SIZE, countParquetRows(t, dir); want != got {
+		t.Errorf("Expected %d rows, got %d", want, got)
+	}
+	if saved, _ := store.LoadExportCursor("parquet"); saved != cursors[0] {
+		t.Errorf("Expected %v, got %v", cursors[0], saved)
+	}
+	archive.Close()
+}
+
+// MockFlushingDB buffers its writes until it's flushed.
+type MockFlushingDB struct {
+	MockInfluxDB
+	failFlush bool
+}
+
+func (m *MockFlushingDB) Flush() error {
+	if m.failFlush {
+		return errors.New("flush failed")
+	}
+	return nil
+}
+
+func TestSinkExporterFailedFlush(t *testing.T) {
+	store := MockGroceryStore{}
+	store.Init("", "", time.Minute)
+	pigs := []ProductInfoGetter{&store}
+	cursors := make([]shared.ExportCursor, len(pigs))
+	shrinkflationCursors := make([]shared.ExportCursor, len(pigs))
+
+	exporter := newSinkExporter(sink{"mock", &MockFlushingDB{failFlush: true}})
+	if !exporter.export(t.Context(), pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the export to succeed")
+	}
+	if cursors[0].ProductID == "" {
+		t.Fatal("Expected the cursor to advance")
+	}
+	// The flush may have lost the products, so they're exported again.
+	if exporter.flush(pigs, cursors, shrinkflationCursors) {
+		t.Fatal("Expected the flush to fail")
+	}
+	if want, got := "", cursors[0].ProductID; want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if saved, _ := store.LoadExportCursor("mock"); saved.ProductID != "" {
+		t.Errorf("Expected the cursor not to be saved, got %v", saved)
+	}
+}
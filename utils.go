@@ -1,16 +1,49 @@
 package main
 
 import (
-	"runtime"
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
 
+	"github.com/tjhowse/aus_grocery_price_database/internal/metrics"
 	"golang.org/x/sys/unix"
 )
 
-// Returns the RAM utilisation of this process as a percentage.
+// GetRAMUtilisationPercent returns this process's resident memory, as the Prometheus process
+// collector reports it, as a percentage of the machine's RAM. It returns zero where either
+// isn't available.
 func GetRAMUtilisationPercent() float64 {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	return float64(m.Alloc) / float64(m.Sys) * 100
+	resident, ok := metrics.Value("process_resident_memory_bytes")
+	if !ok {
+		return 0
+	}
+	total, err := totalRAMBytes("/proc/meminfo")
+	if err != nil || total == 0 {
+		return 0
+	}
+	return resident / total * 100
+}
+
+// totalRAMBytes reads the machine's RAM from a meminfo file.
+func totalRAMBytes(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseFloat(fields[1], 64)
+			return kb * 1024, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, os.ErrNotExist
 }
 
 func GetHDDBytesFree() (int, error) {
@@ -1,17 +1,50 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
 
 func TestGetRAMUtilisationPercent(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("The process collector only reads resident memory on Linux")
+	}
 	ram_start := GetRAMUtilisationPercent()
-	if ram_start < 0 {
-		t.Errorf("RAM utilisation is less than 0")
+	if ram_start <= 0 || ram_start > 100 {
+		t.Errorf("Expected RAM utilisation between 0 and 100, got %v", ram_start)
+	}
+	// Allocate a bunch of stuff that will use RAM, touching every page so it's resident.
+	data := make([]byte, 256*1024*1024)
+	for i := 0; i < len(data); i += os.Getpagesize() {
+		data[i] = 1
 	}
-	// Allocate a bunch of stuff that will use RAM
-	_ = make([]byte, 1024*1024*1024)
 
 	ram_end := GetRAMUtilisationPercent()
-	if ram_end < ram_start {
+	if ram_end <= ram_start {
 		t.Errorf("RAM utilisation has not increased")
 	}
+	runtime.KeepAlive(data)
+}
+
+func TestTotalRAMBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meminfo")
+	if err := os.WriteFile(path, []byte("MemTotal:        2048 kB\nMemFree:         1024 kB\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	total, err := totalRAMBytes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2048.0*1024, total; want != got {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if err := os.WriteFile(path, []byte("MemFree:         1024 kB\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := totalRAMBytes(path); err == nil {
+		t.Error("Expected an error")
+	}
 }